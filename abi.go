@@ -0,0 +1,273 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// Kernels declare their ABI in header comments:
+//
+//	// NIP13-KERNEL-ABI: 1
+//	// NIP13-KERNEL-CAPS: max_serialized_length=2048 max_nonce_digits=22
+//
+// The ABI version fixes the kernel argument layout. Capabilities describe
+// optional features and limits the host has to respect.
+//
+// ABI 1: (input, length, nonce offset, difficulty, base nonce low, base nonce
+// high, results, digits). The batch's starting nonce is passed as arguments.
+//
+// ABI 2: (input, length, nonce offset, difficulty, results, digits). The
+// batch's starting nonce is passed as the NDRange global offset.
+//
+// Kernels with the midstate capability take two more arguments after their
+// ABI's: a buffer with the SHA-256 state after the event's first blocks, and
+// the number of bytes hashed into it. Their input holds only the rest.
+//
+// The target capability names the function the kernel searches for (see
+// powTarget); kernels without it search for NIP-13 event ID leading zeros.
+var (
+	kernelABIPattern  = regexp.MustCompile(`NIP13-KERNEL-ABI:\s*(\d+)`)
+	kernelCapsPattern = regexp.MustCompile(`NIP13-KERNEL-CAPS:([^\n]*)`)
+)
+
+// maxSupportedKernelABI is the newest kernel ABI this host knows how to drive
+const maxSupportedKernelABI = 2
+
+// kernelABI describes the argument layout and capabilities of a kernel
+type kernelABI struct {
+	Version             int
+	Midstate            bool // kernel accepts a precomputed SHA-256 midstate
+	BestDifficulty      bool // kernel reports the best difficulty seen
+	MaxSerializedLength int  // 0 means unlimited
+	MaxNonceDigits      int  // 0 means unlimited
+	Target              string
+}
+
+// String formats the ABI for verbose logging
+func (abi kernelABI) String() string {
+	caps := []string{}
+	if abi.Midstate {
+		caps = append(caps, "midstate")
+	}
+	if abi.BestDifficulty {
+		caps = append(caps, "best_difficulty")
+	}
+	if abi.MaxSerializedLength > 0 {
+		caps = append(caps, fmt.Sprintf("max_serialized_length=%d", abi.MaxSerializedLength))
+	}
+	if abi.MaxNonceDigits > 0 {
+		caps = append(caps, fmt.Sprintf("max_nonce_digits=%d", abi.MaxNonceDigits))
+	}
+	if abi.Target != defaultPowTarget {
+		caps = append(caps, "target="+abi.Target)
+	}
+	return fmt.Sprintf("ABI v%d [%s]", abi.Version, strings.Join(caps, " "))
+}
+
+// parseKernelABI reads the ABI declaration from a kernel's source.
+// Kernels without a declaration are treated as ABI v1 with no capabilities.
+func parseKernelABI(source string) (kernelABI, error) {
+	abi := kernelABI{Version: 1, Target: defaultPowTarget}
+
+	if m := kernelABIPattern.FindStringSubmatch(source); m != nil {
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			return abi, fmt.Errorf("invalid kernel ABI version %q", m[1])
+		}
+		abi.Version = version
+	}
+	if abi.Version < 1 || abi.Version > maxSupportedKernelABI {
+		return abi, fmt.Errorf("unsupported kernel ABI version %d (supported: 1-%d)", abi.Version, maxSupportedKernelABI)
+	}
+
+	if m := kernelCapsPattern.FindStringSubmatch(source); m != nil {
+		for _, field := range strings.Fields(m[1]) {
+			name, value, hasValue := strings.Cut(field, "=")
+			switch name {
+			case "midstate":
+				abi.Midstate = true
+			case "best_difficulty":
+				abi.BestDifficulty = true
+			case "target":
+				if !hasValue || value == "" {
+					return abi, fmt.Errorf("invalid kernel capability %q", field)
+				}
+				abi.Target = value
+			case "max_serialized_length", "max_nonce_digits":
+				n, err := strconv.Atoi(value)
+				if !hasValue || err != nil || n < 0 {
+					return abi, fmt.Errorf("invalid kernel capability %q", field)
+				}
+				if name == "max_serialized_length" {
+					abi.MaxSerializedLength = n
+				} else {
+					abi.MaxNonceDigits = n
+				}
+			default:
+				// Unknown capabilities are ignored so newer kernels still load
+				vlog("Ignoring unknown kernel capability %q", field)
+			}
+		}
+	}
+
+	return abi, nil
+}
+
+// checkEventFits returns an error if the kernel cannot hash an event of the
+// given serialized length and nonce width
+func (abi kernelABI) checkEventFits(serializedLength, numDigits int) error {
+	if abi.MaxSerializedLength > 0 && serializedLength > abi.MaxSerializedLength {
+		return fmt.Errorf("serialized event is %d bytes, kernel supports at most %d", serializedLength, abi.MaxSerializedLength)
+	}
+	if abi.MaxNonceDigits > 0 && numDigits > abi.MaxNonceDigits {
+		return fmt.Errorf("nonce needs %d digits, kernel supports at most %d", numDigits, abi.MaxNonceDigits)
+	}
+	return nil
+}
+
+// kernelArgs holds the values passed to a mining kernel
+type kernelArgs struct {
+	input            *cl.MemObject
+	serializedLength int
+	nonceOffset      int
+	difficulty       int
+	baseNonce        uint64
+	results          *cl.MemObject
+	numDigits        int
+	midstate         *cl.MemObject // only for kernels with the midstate capability
+	prefixLength     int
+}
+
+// setKernelArgs sets the mining kernel arguments using the layout of the kernel's ABI
+func setKernelArgs(kernel *cl.Kernel, abi kernelABI, args kernelArgs) error {
+	var values []interface{}
+	switch abi.Version {
+	case 1:
+		// Base nonce is passed as two 32-bit values to avoid 64-bit arg issues
+		values = []interface{}{
+			args.input,
+			int32(args.serializedLength),
+			int32(args.nonceOffset),
+			int32(args.difficulty),
+			int32(uint32(args.baseNonce & 0xFFFFFFFF)),
+			int32(uint32(args.baseNonce >> 32)),
+			args.results,
+			int32(args.numDigits),
+		}
+	case 2:
+		values = []interface{}{
+			args.input,
+			int32(args.serializedLength),
+			int32(args.nonceOffset),
+			int32(args.difficulty),
+			args.results,
+			int32(args.numDigits),
+		}
+	default:
+		return fmt.Errorf("unsupported kernel ABI version %d", abi.Version)
+	}
+	if abi.Midstate {
+		values = append(values, args.midstate, int32(args.prefixLength))
+	}
+	return setArgList(kernel, values)
+}
+
+// setArgList sets kernel arguments in order
+func setArgList(kernel *cl.Kernel, values []interface{}) error {
+	for i, v := range values {
+		if err := kernel.SetArg(i, v); err != nil {
+			return fmt.Errorf("failed to set kernel arg %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// setKernelNonce updates only the base nonce arguments, for use between
+// batches once setKernelArgs has been called
+func setKernelNonce(kernel *cl.Kernel, abi kernelABI, baseNonce uint64) error {
+	switch abi.Version {
+	case 1:
+		if err := kernel.SetArgInt32(4, int32(uint32(baseNonce&0xFFFFFFFF))); err != nil {
+			return fmt.Errorf("failed to set kernel arg 4: %v", err)
+		}
+		if err := kernel.SetArgInt32(5, int32(uint32(baseNonce>>32))); err != nil {
+			return fmt.Errorf("failed to set kernel arg 5: %v", err)
+		}
+		return nil
+	case 2:
+		// Passed as the global offset at enqueue time
+		return nil
+	default:
+		return fmt.Errorf("unsupported kernel ABI version %d", abi.Version)
+	}
+}
+
+// setKernelDifficulty updates only the difficulty argument, for use once
+// setKernelArgs has been called
+func setKernelDifficulty(kernel *cl.Kernel, abi kernelABI, difficulty int) error {
+	switch abi.Version {
+	case 1, 2:
+		if err := kernel.SetArgInt32(3, int32(difficulty)); err != nil {
+			return fmt.Errorf("failed to set kernel arg 3: %v", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported kernel ABI version %d", abi.Version)
+	}
+}
+
+// checkDevice returns an error if the device cannot run kernels of this ABI
+func (abi kernelABI) checkDevice(device *cl.Device) error {
+	if abi.Version >= 2 {
+		// Global offsets need OpenCL 1.1, and nonces beyond 2^32 need a 64-bit size_t
+		if major, minor := deviceCLCVersion(device); major == 1 && minor == 0 {
+			return fmt.Errorf("kernel ABI %d needs OpenCL 1.1 or newer (device reports %s)", abi.Version, device.Version())
+		}
+		if device.AddressBits() < 64 {
+			return fmt.Errorf("kernel ABI %d needs a 64-bit device (device has %d address bits)", abi.Version, device.AddressBits())
+		}
+	}
+	return nil
+}
+
+// launchArgs holds the work sizes passed to EnqueueNDRangeKernel. They are
+// reused between launches so the mining loop doesn't allocate.
+type launchArgs struct {
+	globalOffset [1]int
+	globalSize   [1]int
+	localSize    [1]int
+	wavefront    int // see localWorkSizeLimits
+	maxLocalSize int
+}
+
+// enqueueMiningKernel launches count work items testing nonces starting at
+// baseNonce. For ABI 1 the base nonce must already be set with setKernelNonce.
+func enqueueMiningKernel(queue *cl.CommandQueue, kernel *cl.Kernel, abi kernelABI, launch *launchArgs,
+	baseNonce uint64, count int) error {
+	var globalOffset, localSize []int
+	if abi.Version >= 2 {
+		launch.globalOffset[0] = int(baseNonce)
+		globalOffset = launch.globalOffset[:]
+	}
+	launch.globalSize[0] = count
+	if size := localWorkSize(launch.wavefront, launch.maxLocalSize, count); size > 0 {
+		launch.localSize[0] = size
+		localSize = launch.localSize[:]
+	}
+	event, err := queue.EnqueueNDRangeKernel(kernel, globalOffset, launch.globalSize[:], localSize, nil)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue kernel: %v", err)
+	}
+	// Nothing waits on the event; releasing it now keeps it from piling up
+	// until the garbage collector runs its finalizer
+	event.Release()
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// nonceAlphabet is the characters nonces are written in, in digit order: the
+// first character is digit 0. Nonces of each width run from "10…0" to the
+// last character repeated, so none starts with digit 0.
+type nonceAlphabet string
+
+// decimalAlphabet is the alphabet of the kernels and the default
+const decimalAlphabet nonceAlphabet = "0123456789"
+
+// nonceAlphabets are the alphabets -nonce-alphabet knows by name
+var nonceAlphabets = map[string]nonceAlphabet{
+	"decimal":         decimalAlphabet,
+	"hex":             "0123456789abcdef",
+	"base36":          "0123456789abcdefghijklmnopqrstuvwxyz",
+	"base36-novowels": "0123456789bcdfghjklmnpqrstvwxyz", // no accidental words
+}
+
+// parseNonceAlphabet parses -nonce-alphabet: a name from nonceAlphabets, or
+// the characters themselves. The characters have to be unique and, like
+// -nonce-prefix, letters, digits, '-', '_' or '.', which JSON writes as they
+// are, so a nonce takes as many bytes in the serialized event as it has
+// characters.
+func parseNonceAlphabet(value string) (nonceAlphabet, error) {
+	if alphabet, ok := nonceAlphabets[value]; ok {
+		return alphabet, nil
+	}
+	if len(value) < 2 {
+		return "", fmt.Errorf("unknown alphabet %q (use decimal, hex, base36, base36-novowels, or at least 2 characters)", value)
+	}
+	for i, c := range value {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_' || c == '.') {
+			return "", fmt.Errorf("alphabet %q may only contain letters, digits, '-', '_' and '.'", value)
+		}
+		if strings.IndexRune(value[:i], c) != -1 {
+			return "", fmt.Errorf("alphabet %q repeats %q", value, c)
+		}
+	}
+	return nonceAlphabet(value), nil
+}
+
+// base returns the number of characters
+func (a nonceAlphabet) base() uint64 {
+	return uint64(len(a))
+}
+
+// maxWidth returns the widest nonce whose values fit in a uint64
+func (a nonceAlphabet) maxWidth() int {
+	width, limit := 0, uint64(1)
+	for {
+		hi, lo := bits.Mul64(limit, a.base())
+		if hi != 0 {
+			return width
+		}
+		width, limit = width+1, lo
+	}
+}
+
+// first returns the value of the first nonce of a width: digit 1 followed by
+// zeros
+func (a nonceAlphabet) first(width int) uint64 {
+	value := uint64(1)
+	for i := 1; i < width; i++ {
+		value *= a.base()
+	}
+	return value
+}
+
+// last returns the value of the last nonce of a width, which must be at most
+// maxWidth
+func (a nonceAlphabet) last(width int) uint64 {
+	return a.first(width)*a.base() - 1
+}
+
+// appendNonce appends a nonce written in the alphabet to dst
+func (a nonceAlphabet) appendNonce(dst []byte, nonce uint64) []byte {
+	if a == decimalAlphabet {
+		return strconv.AppendUint(dst, nonce, 10)
+	}
+	var digits [64]byte
+	i := len(digits)
+	for {
+		i--
+		digits[i] = a[nonce%a.base()]
+		nonce /= a.base()
+		if nonce == 0 {
+			break
+		}
+	}
+	return append(dst, digits[i:]...)
+}
+
+// String returns the alphabet's name, or its characters
+func (a nonceAlphabet) String() string {
+	for name, alphabet := range nonceAlphabets {
+		if alphabet == a {
+			return name
+		}
+	}
+	return string(a)
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseNonceAlphabet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    nonceAlphabet
+		wantErr bool
+	}{
+		{"decimal", decimalAlphabet, false},
+		{"hex", "0123456789abcdef", false},
+		{"base36-novowels", "0123456789bcdfghjklmnpqrstvwxyz", false},
+		{"01", "01", false},
+		{"ab-_.", "ab-_.", false},
+		{"0", "", true},
+		{"", "", true},
+		{"aba", "", true},
+		{"ab\"", "", true},
+		{"a b", "", true},
+		{"aé", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseNonceAlphabet(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNonceAlphabet(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseNonceAlphabet(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNonceAlphabetRange(t *testing.T) {
+	tests := []struct {
+		alphabet nonceAlphabet
+		width    int
+		first    string
+		last     string
+	}{
+		{decimalAlphabet, 1, "1", "9"},
+		{decimalAlphabet, 4, "1000", "9999"},
+		{"0123456789abcdef", 3, "100", "fff"},
+		{"01", 5, "10000", "11111"},
+		{"xyz", 2, "yx", "zz"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.alphabet), func(t *testing.T) {
+			if got := string(tt.alphabet.appendNonce(nil, tt.alphabet.first(tt.width))); got != tt.first {
+				t.Errorf("first(%d) = %q, want %q", tt.width, got, tt.first)
+			}
+			if got := string(tt.alphabet.appendNonce(nil, tt.alphabet.last(tt.width))); got != tt.last {
+				t.Errorf("last(%d) = %q, want %q", tt.width, got, tt.last)
+			}
+		})
+	}
+}
+
+func TestNonceAlphabetAppendNonce(t *testing.T) {
+	tests := []struct {
+		alphabet nonceAlphabet
+		nonce    uint64
+		want     string
+	}{
+		{decimalAlphabet, 0, "0"},
+		{decimalAlphabet, 1234567890, "1234567890"},
+		{"0123456789abcdef", 255, "ff"},
+		{"0123456789abcdef", math.MaxUint64, "ffffffffffffffff"},
+		{"01", 5, "101"},
+		{"xyz", 5, "yz"},
+	}
+	for _, tt := range tests {
+		if got := string(tt.alphabet.appendNonce([]byte("n="), tt.nonce)); got != "n="+tt.want {
+			t.Errorf("%s.appendNonce(%d) = %q, want %q", tt.alphabet, tt.nonce, got, "n="+tt.want)
+		}
+	}
+}
+
+func TestNonceAlphabetMaxWidth(t *testing.T) {
+	tests := []struct {
+		alphabet nonceAlphabet
+		want     int
+	}{
+		{decimalAlphabet, 19},
+		{"0123456789abcdef", 15},
+		{"01", 63},
+		{nonceAlphabets["base36"], 12},
+	}
+	for _, tt := range tests {
+		if got := tt.alphabet.maxWidth(); got != tt.want {
+			t.Errorf("%s.maxWidth() = %d, want %d", tt.alphabet, got, tt.want)
+		}
+		// The last nonce of the widest width must not overflow
+		if last := tt.alphabet.last(tt.want); last < tt.alphabet.first(tt.want) {
+			t.Errorf("%s.last(%d) overflowed", tt.alphabet, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import "time"
+
+// Auto-sized batches aim to take between these durations: long enough to keep
+// the device busy, short enough that cancellation, the progress bar and the
+// API stay responsive and the GPU is not hogged for seconds at a time.
+const (
+	batchTargetMin = 100 * time.Millisecond
+	batchTargetMax = 250 * time.Millisecond
+)
+
+// maxAdaptiveBatch bounds how far an auto-sized batch may grow (a 64 MB
+// results buffer)
+const maxAdaptiveBatch = 1 << 24
+
+// batchGranule keeps adapted batch sizes a multiple of common work-group sizes
+const batchGranule = 256
+
+// batchController adapts the number of nonces per kernel launch to the
+// observed batch latency
+type batchController struct {
+	size     int // nonces in the next full batch
+	min, max int
+}
+
+// newBatchController starts at initial and keeps the size within [min, max]
+func newBatchController(initial, min, max int) *batchController {
+	if min > max {
+		min = max
+	}
+	c := &batchController{min: min, max: max}
+	c.size = c.clamp(initial)
+	return c
+}
+
+// clamp bounds a size to the controller's range
+func (c *batchController) clamp(size int) int {
+	if size < c.min {
+		return c.min
+	}
+	if size > c.max {
+		return c.max
+	}
+	return size
+}
+
+// observe records that a batch of count nonces took elapsed and returns the
+// size for the next batch. Partial batches (the end of a digit range) say
+// little about the device and are ignored. The size moves toward the middle
+// of the target range, at most doubling or quartering per step so a single
+// slow or fast batch doesn't swing it too far.
+func (c *batchController) observe(count int, elapsed time.Duration) int {
+	if count < c.size || elapsed <= 0 || (elapsed >= batchTargetMin && elapsed <= batchTargetMax) {
+		return c.size
+	}
+
+	scale := float64(batchTargetMin+batchTargetMax) / 2 / float64(elapsed)
+	if scale > 2 {
+		scale = 2
+	} else if scale < 0.25 {
+		scale = 0.25
+	}
+	size := int(float64(c.size) * scale)
+	if size > batchGranule {
+		size -= size % batchGranule
+	}
+	size = c.clamp(size)
+	if size != c.size {
+		vlog("Batch of %d nonces took %s, next batches use %d", c.size, elapsed.Round(time.Millisecond), size)
+	}
+	c.size = size
+	return size
+}
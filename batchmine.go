@@ -0,0 +1,151 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// batchMaxLine bounds one event in -batch input
+const batchMaxLine = 4 << 20
+
+// batchJob is one -batch event, ready for the device
+type batchJob struct {
+	line     int
+	event    nostr.Event // without its nonce tag
+	template nostr.Tag
+	position int
+	first    preparedInput // the event at the narrowest nonce width
+	err      error
+}
+
+// runBatchMining mines every event in in, one JSON event per line, to the
+// difficulty and writes each mined event as a line to out, in input order.
+// All events share one device session, so the kernel is compiled and buffers
+// allocated once. While the device mines one event the next is parsed,
+// serialized and hashed up to its nonce on the host, and consecutive events
+// that serialize to the same bytes before the nonce (same pubkey, created_at,
+// kind and leading tags) reuse one midstate. Events that fail are reported on
+// stderr and skipped; it returns how many were mined and how many failed.
+// When no event arrives for idle (if not 0), the session is released so the
+// GPU can drop to its low power states, and set up again for the next event.
+func runBatchMining(in io.Reader, out io.Writer, difficulty int, opts libOptions, memBudget int64, idle time.Duration) (int, int, error) {
+	session, batchSize, err := openLibSession(opts, libInputBytes, memBudget)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if session != nil {
+			session.Release()
+		}
+	}()
+	vlog("Batch mining with kernel %s, batch size %d", session.kernelType, batchSize)
+	minDigits, _ := libDigits(difficulty, batchSize)
+	abi := session.abi // a session set up again builds the same kernel
+
+	// One job ahead is enough to hide the host work behind the device's
+	jobs := make(chan batchJob, 1)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		preparer := &inputPreparer{abi: abi}
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 0, 64*1024), batchMaxLine)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			jobs <- prepareBatchJob(preparer, line, scanner.Bytes(), difficulty, opts.NoncePrefix, minDigits)
+		}
+		readErr <- scanner.Err()
+	}()
+
+	mined, failed := 0, 0
+	for {
+		job, ok, timedOut := nextBatchJob(jobs, session != nil, idle)
+		if timedOut {
+			vlog("No event for %s; releasing the device until the next one", idle)
+			session.Release()
+			session = nil
+			job, ok = <-jobs
+		}
+		if !ok {
+			break
+		}
+		if job.err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Line %d: %v\n", job.line, job.err)
+			failed++
+			continue
+		}
+		start := time.Now()
+		if session == nil {
+			if session, batchSize, err = openLibSession(opts, libInputBytes, memBudget); err != nil {
+				return mined, failed, fmt.Errorf("failed to set up the device again: %v", err)
+			}
+			vlog("Set up the device again in %s", time.Since(start).Round(time.Millisecond))
+		}
+		event, err := mineOnSession(session, batchSize, job.event, job.template, job.position, difficulty, opts.NoncePrefix, time.Time{}, nil, &job.first)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Line %d: %v\n", job.line, err)
+			failed++
+			continue
+		}
+		eventJSON, err := json.Marshal(event)
+		if err != nil {
+			return mined, failed, fmt.Errorf("failed to encode event: %v", err)
+		}
+		if _, err := out.Write(append(eventJSON, '\n')); err != nil {
+			return mined, failed, fmt.Errorf("failed to write event: %v", err)
+		}
+		mined++
+		vlog("Line %d: mined %s in %s", job.line, event.ID, time.Since(start).Round(time.Millisecond))
+	}
+	if err := <-readErr; err != nil {
+		return mined, failed, fmt.Errorf("failed to read events: %v", err)
+	}
+	return mined, failed, nil
+}
+
+// nextBatchJob waits for the next job; ok is false at the end of the input.
+// With a session to release and an idle timeout, it gives up after idle.
+func nextBatchJob(jobs <-chan batchJob, releasable bool, idle time.Duration) (job batchJob, ok, timedOut bool) {
+	if !releasable || idle <= 0 {
+		job, ok = <-jobs
+		return job, ok, false
+	}
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	select {
+	case job, ok = <-jobs:
+		return job, ok, false
+	case <-timer.C:
+		return job, false, true
+	}
+}
+
+// prepareBatchJob parses one line of -batch input and prepares it for the
+// device at the narrowest nonce width
+func prepareBatchJob(preparer *inputPreparer, line int, data []byte, difficulty int, noncePrefix string, digits int) batchJob {
+	job := batchJob{line: line}
+	event, _, err := parseInputEvent(data)
+	if err != nil {
+		job.err = fmt.Errorf("failed to parse JSON event: %v", err)
+		return job
+	}
+	if job.event, job.template, job.position, job.err = prepareLibEvent(event, difficulty, noncePrefix); job.err != nil {
+		return job
+	}
+	job.first, job.err = prepareWidth(preparer, job.event, job.template, job.position, noncePrefix, digits)
+	return job
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// benchmarkKind is one kind of event the benchmark mines, with its share of
+// the mix and the log-normal distribution of its content length in bytes
+type benchmarkKind struct {
+	kind          int
+	weight        int
+	medianContent float64
+	sigma         float64
+	maxContent    int
+}
+
+// benchmarkKinds approximates the traffic on public relays: mostly short
+// notes and reactions, some reposts, which embed the reposted note, and the
+// occasional long-form article. Reposts and reactions get their content from
+// the note and reaction generators, not from the length distribution.
+var benchmarkKinds = []benchmarkKind{
+	{kind: nostr.KindTextNote, weight: 70, medianContent: 120, sigma: 1.0, maxContent: 8000},
+	{kind: nostr.KindReaction, weight: 20},
+	{kind: nostr.KindRepost, weight: 7},
+	{kind: nostr.KindArticle, weight: 3, medianContent: 5000, sigma: 0.8, maxContent: 60000},
+}
+
+// benchmarkWords is the vocabulary notes and articles are written with
+var benchmarkWords = strings.Fields(`
+	the a to and of is in it that for you on with this i was are be have not but
+	just so what like at my all we if they do can about your up out more one how
+	when from get now people time day good think know really today new see still
+	going work back want much make something gm gn nostr bitcoin zap zaps relay
+	relays client npub lightning sats node key keys freedom protocol decentralized
+	censorship network coffee morning weekend music photo post thread reply thanks
+	agree interesting wrong right great love fun build building shipped update
+	release open source code bug feature test looks works again better years week
+`)
+
+// benchmarkExtras are sprinkled into text: emoji, hashtags, links and mentions,
+// which are multi-byte or longer than words and change how JSON escapes the text
+var benchmarkExtras = []string{
+	"🤙", "⚡", "🧡", "😂", "🔥", "👀", "🫂", "#bitcoin", "#nostr", "#grownostr", "#plebchain",
+	"https://example.com/2024/notes.html", "https://image.example.org/f3a9c1.jpg",
+	"nostr:npub1sg6plzptd64u62a878hep2kev88swjh3tw00gjsfl8f237lmu63q0uf63m",
+	"\"quoted\"", "(yes)", "...", "?", "!",
+}
+
+var benchmarkTopics = []string{"bitcoin", "nostr", "zaps", "music", "photography", "dev", "plebchain", "foodstr"}
+
+var benchmarkRelays = []string{"wss://relay.damus.io", "wss://nos.lol", "wss://relay.nostr.band", "wss://relay.primal.net", ""}
+
+var benchmarkReactions = []string{"+", "+", "+", "🤙", "❤️", "🔥", "😂", "-"}
+
+// benchmarkEvents generates the events -benchmark and -test-kernels mine
+type benchmarkEvents struct {
+	rng         *mrand.Rand
+	fixedLength int // content length for every event, or 0 for per-kind lengths
+}
+
+// newBenchmarkEvents returns a generator for a -bench-event-size setting:
+// "typical" for the per-kind content lengths in benchmarkKinds, or a byte
+// size such as 2K for that content length in every event
+func newBenchmarkEvents(sizeSpec string, seed int64) (*benchmarkEvents, error) {
+	g := &benchmarkEvents{rng: mrand.New(mrand.NewSource(seed))}
+	if sizeSpec == "typical" {
+		return g, nil
+	}
+	size, err := parseByteSize(sizeSpec)
+	if err != nil || size <= 0 {
+		return nil, fmt.Errorf("invalid event size %q (use typical or a size such as 2K)", sizeSpec)
+	}
+	g.fixedLength = int(size)
+	return g, nil
+}
+
+// next returns a new event of a kind drawn from the mix
+func (g *benchmarkEvents) next() nostr.Event {
+	total := 0
+	for _, k := range benchmarkKinds {
+		total += k.weight
+	}
+	pick := g.rng.Intn(total)
+	for _, k := range benchmarkKinds {
+		if pick < k.weight {
+			return g.event(k)
+		}
+		pick -= k.weight
+	}
+	return g.event(benchmarkKinds[0])
+}
+
+// event builds an event of one kind with the tags such events usually carry
+func (g *benchmarkEvents) event(k benchmarkKind) nostr.Event {
+	event := nostr.Event{
+		PubKey:    g.hex(32),
+		CreatedAt: nostr.Timestamp(time.Now().Unix() - g.rng.Int63n(86400)),
+		Kind:      k.kind,
+	}
+
+	switch k.kind {
+	case nostr.KindReaction:
+		event.Content = benchmarkReactions[g.rng.Intn(len(benchmarkReactions))]
+		event.Tags = nostr.Tags{{"e", g.hex(32), g.relay()}, {"p", g.hex(32)}, {"k", "1"}}
+	case nostr.KindRepost:
+		reposted := g.event(benchmarkKinds[0])
+		reposted.ID = g.hex(32)
+		reposted.Sig = g.hex(64)
+		content, _ := json.Marshal(reposted)
+		event.Content = string(content)
+		event.Tags = nostr.Tags{{"e", reposted.ID, g.relay()}, {"p", reposted.PubKey}}
+	case nostr.KindArticle:
+		event.Content = g.article(g.contentLength(k))
+		event.Tags = nostr.Tags{
+			{"d", strings.ReplaceAll(g.words(3), " ", "-")},
+			{"title", g.words(6)},
+			{"summary", g.words(20)},
+			{"published_at", fmt.Sprint(int64(event.CreatedAt) - g.rng.Int63n(86400*30))},
+		}
+		for i := 2 + g.rng.Intn(4); i > 0; i-- {
+			event.Tags = append(event.Tags, nostr.Tag{"t", benchmarkTopics[g.rng.Intn(len(benchmarkTopics))]})
+		}
+	default:
+		event.Content = g.text(g.contentLength(k))
+		// About half of all notes are replies
+		if g.rng.Intn(2) == 0 {
+			event.Tags = append(event.Tags, nostr.Tag{"e", g.hex(32), g.relay(), "root"}, nostr.Tag{"e", g.hex(32), g.relay(), "reply"})
+			for i := 1 + g.rng.Intn(3); i > 0; i-- {
+				event.Tags = append(event.Tags, nostr.Tag{"p", g.hex(32)})
+			}
+		}
+		if g.rng.Intn(4) == 0 {
+			for i := 1 + g.rng.Intn(3); i > 0; i-- {
+				event.Tags = append(event.Tags, nostr.Tag{"t", benchmarkTopics[g.rng.Intn(len(benchmarkTopics))]})
+			}
+		}
+		if g.rng.Intn(10) == 0 {
+			event.Tags = append(event.Tags, nostr.Tag{"client", "benchmark"})
+		}
+	}
+
+	if g.fixedLength > 0 && k.kind != nostr.KindRepost {
+		event.Content = g.text(g.fixedLength)
+	}
+	return event
+}
+
+// contentLength draws a content length for a kind
+func (g *benchmarkEvents) contentLength(k benchmarkKind) int {
+	length := int(k.medianContent * math.Exp(k.sigma*g.rng.NormFloat64()))
+	if length < 1 {
+		return 1
+	}
+	if length > k.maxContent {
+		return k.maxContent
+	}
+	return length
+}
+
+// text returns length bytes of words and extras, cut at a word boundary and
+// padded with spaces so multi-byte text is never split
+func (g *benchmarkEvents) text(length int) string {
+	var b strings.Builder
+	for b.Len() < length {
+		word := benchmarkWords[g.rng.Intn(len(benchmarkWords))]
+		if g.rng.Intn(12) == 0 {
+			word = benchmarkExtras[g.rng.Intn(len(benchmarkExtras))]
+		}
+		if b.Len() > 0 {
+			word = " " + word
+			if g.rng.Intn(15) == 0 {
+				word = ".\n" + word[1:]
+			}
+		}
+		if b.Len()+len(word) > length {
+			break
+		}
+		b.WriteString(word)
+	}
+	return b.String() + strings.Repeat(" ", length-b.Len())
+}
+
+// article returns about length bytes of markdown: a heading and paragraphs
+func (g *benchmarkEvents) article(length int) string {
+	var b strings.Builder
+	b.WriteString("# " + g.words(5) + "\n\n")
+	for b.Len() < length {
+		b.WriteString(g.text(200+g.rng.Intn(600)) + "\n\n")
+	}
+	return b.String()
+}
+
+// words returns n words separated by spaces
+func (g *benchmarkEvents) words(n int) string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = benchmarkWords[g.rng.Intn(len(benchmarkWords))]
+	}
+	return strings.Join(words, " ")
+}
+
+// hex returns n random bytes in hex, for IDs, pubkeys and signatures
+func (g *benchmarkEvents) hex(n int) string {
+	b := make([]byte, n)
+	g.rng.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// relay returns a relay hint, sometimes empty
+func (g *benchmarkEvents) relay() string {
+	return benchmarkRelays[g.rng.Intn(len(benchmarkRelays))]
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	mrand "math/rand"
+	"os"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// calibrationDifficulty is low enough that a few hundred events mine in a
+// second or two and every attempt can be re-checked on the CPU, and high
+// enough that the attempts needed for each spread over a wide range
+const calibrationDifficulty = 10
+
+// Calibration checks are two-sided at a 0.1% false alarm rate, so a correct
+// kernel almost never fails and a real deviation has to be large to pass
+const (
+	calibrationBins    = 10
+	calibrationChiSq   = 27.88 // chi-square critical value, 9 degrees of freedom
+	calibrationMaxZ    = 3.29  // normal critical value for the mean
+	calibrationGiveUp  = 64    // attempts per event, in multiples of the expected, before giving up
+	calibrationBatch   = 1 << 13
+	calibrationDigits  = 10
+	calibrationBaseNum = 1000000000
+)
+
+// calibrationEvent builds a random event: random pubkey, timestamp and content
+// length, so the nonce falls at many different offsets and block positions
+func calibrationEvent(rng *mrand.Rand, placeholder string) nostr.Event {
+	pubkey := make([]byte, 32)
+	rng.Read(pubkey)
+	content := make([]byte, rng.Intn(300))
+	for i := range content {
+		content[i] = byte('a' + rng.Intn(26))
+	}
+	return nostr.Event{
+		PubKey:    hex.EncodeToString(pubkey),
+		CreatedAt: nostr.Timestamp(1700000000 + rng.Int63n(100000000)),
+		Kind:      1,
+		Tags:      nostr.Tags{nostr.Tag{"nonce", placeholder, fmt.Sprint(calibrationDifficulty)}},
+		Content:   string(content),
+	}
+}
+
+// calibrationSample mines one event from the first nonce and returns the
+// attempts the kernel took to report a hit. Every nonce up to the hit is
+// checked on the CPU; missed counts earlier nonces the kernel should have
+// reported, and falseHit is set when the reported nonce does not qualify.
+func calibrationSample(session *clSession, event nostr.Event, placeholder string) (attempts int64, missed int, falseHit bool, err error) {
+	serialized := event.Serialize()
+	nonceOffset := findNonceOffset(serialized, placeholder)
+	if nonceOffset == -1 {
+		return 0, 0, false, fmt.Errorf("could not find nonce placeholder in serialized event")
+	}
+	if err := session.setInput(serialized, nonceOffset, calibrationDigits, calibrationDifficulty); err != nil {
+		return 0, 0, false, err
+	}
+
+	message := append([]byte(nil), serialized...)
+	cpuHit := func(nonce uint64) bool {
+		copy(message[nonceOffset:], fmt.Sprintf("%0*d", calibrationDigits, nonce))
+		return session.target.score(message) >= calibrationDifficulty
+	}
+
+	limit := int64(calibrationGiveUp) << calibrationDifficulty
+	for base := uint64(calibrationBaseNum); attempts < limit; base += calibrationBatch {
+		results, err := session.runBatch(base, calibrationBatch)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		for i, index := range results {
+			nonce := base + uint64(i)
+			if index < 0 {
+				if cpuHit(nonce) {
+					missed++
+				}
+				continue
+			}
+			return attempts + int64(i) + 1, missed, !cpuHit(nonce), nil
+		}
+		attempts += int64(len(results))
+	}
+	return 0, missed, false, fmt.Errorf("no hit in %d attempts", limit)
+}
+
+// geometricCDF is the probability that a hit with probability p per attempt
+// takes at most k attempts
+func geometricCDF(p float64, k int64) float64 {
+	return 1 - math.Pow(1-p, float64(k))
+}
+
+// runCalibration mines events at calibrationDifficulty on a device and checks
+// that the attempts each took follow the geometric distribution a correct
+// SHA-256 gives: each nonce hits independently with probability
+// 2^-difficulty. Kernels that skip nonces, test some twice, or compare the
+// hash wrongly shift the distribution even when every hit they report is
+// valid. Returns whether the kernel passed.
+func runCalibration(deviceIndex int, kernelType string, events int, seed int64) bool {
+	defer reportCLObjects()
+
+	selectedDevice, err := findDevice(deviceIndex)
+	if err != nil {
+		log.Fatalf("Failed to select device: %v", err)
+	}
+
+	// The kernel is not gated: a kernel failing its self-test is exactly
+	// what calibration should report rather than swap for the default
+	session, err := newCLSession(selectedDevice, kernelType)
+	if err != nil {
+		log.Fatalf("Failed to set up kernel: %v", err)
+	}
+	defer session.Release()
+	if err := session.allocResults(calibrationBatch); err != nil {
+		log.Fatalf("Failed to allocate results: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Calibrating kernel %s on %s: %d events at difficulty %d (seed %d)\n",
+		session.kernelType, selectedDevice.Name(), events, calibrationDifficulty, seed)
+
+	placeholder := fmt.Sprintf("%0*d", calibrationDigits, calibrationBaseNum)
+	rng := mrand.New(mrand.NewSource(seed))
+	samples := make([]int64, 0, events)
+	missed, falseHits, errors := 0, 0, 0
+	for i := 0; i < events; i++ {
+		attempts, m, falseHit, err := calibrationSample(session, calibrationEvent(rng, placeholder), placeholder)
+		missed += m
+		if err != nil {
+			vlog("Event %d: %v", i+1, err)
+			errors++
+			continue
+		}
+		if falseHit {
+			falseHits++
+		}
+		samples = append(samples, attempts)
+	}
+	if len(samples) < calibrationBins*5 {
+		fmt.Fprintf(os.Stderr, "Only %d of %d events produced a hit, too few to compare distributions\n", len(samples), events)
+		return false
+	}
+
+	// Bins of (nearly) equal probability under the geometric distribution
+	p := math.Ldexp(1, -calibrationDifficulty)
+	upper := make([]int64, calibrationBins)
+	for j := 1; j < calibrationBins; j++ {
+		upper[j-1] = int64(math.Ceil(math.Log(1-float64(j)/calibrationBins) / math.Log(1-p)))
+	}
+	upper[calibrationBins-1] = math.MaxInt64
+	observed := make([]int, calibrationBins)
+	var sum float64
+	for _, attempts := range samples {
+		sum += float64(attempts)
+		for j, limit := range upper {
+			if attempts <= limit {
+				observed[j]++
+				break
+			}
+		}
+	}
+
+	n := float64(len(samples))
+	fmt.Fprintf(os.Stderr, "\n%-20s %9s %9s\n", "Attempts", "Observed", "Expected")
+	chiSq := 0.0
+	var lower int64 = 1
+	prevCDF := 0.0
+	for j, limit := range upper {
+		cdf := 1.0
+		label := fmt.Sprintf("%d+", lower)
+		if limit != math.MaxInt64 {
+			cdf = geometricCDF(p, limit)
+			label = fmt.Sprintf("%d-%d", lower, limit)
+		}
+		expected := n * (cdf - prevCDF)
+		chiSq += (float64(observed[j]) - expected) * (float64(observed[j]) - expected) / expected
+		fmt.Fprintf(os.Stderr, "%-20s %9d %9.1f\n", label, observed[j], expected)
+		lower = limit + 1
+		prevCDF = cdf
+	}
+
+	mean := sum / n
+	z := (mean - 1/p) / (math.Sqrt(1-p) / p / math.Sqrt(n))
+	fmt.Fprintf(os.Stderr, "\nMean attempts: %.1f (expected %.0f, z = %.2f)\n", mean, 1/p, z)
+	fmt.Fprintf(os.Stderr, "Chi-square: %.2f over %d bins (fails above %.2f)\n", chiSq, calibrationBins, calibrationChiSq)
+	fmt.Fprintf(os.Stderr, "Hits missed: %d, false hits: %d, errors: %d\n", missed, falseHits, errors)
+
+	var problems []string
+	if missed > 0 {
+		problems = append(problems, fmt.Sprintf("%d qualifying nonces were not reported", missed))
+	}
+	if falseHits > 0 {
+		problems = append(problems, fmt.Sprintf("%d reported nonces failed CPU validation", falseHits))
+	}
+	if errors > 0 {
+		problems = append(problems, fmt.Sprintf("%d events failed to mine", errors))
+	}
+	if math.Abs(z) > calibrationMaxZ {
+		problems = append(problems, fmt.Sprintf("mean attempts is off by %.1f standard errors", z))
+	}
+	if chiSq > calibrationChiSq {
+		problems = append(problems, "attempts do not follow the geometric distribution")
+	}
+	if len(problems) == 0 {
+		fmt.Fprintf(os.Stderr, "PASS: attempts to success match theory\n")
+		return true
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "FAIL: %s\n", problem)
+	}
+	fmt.Fprintf(os.Stderr, "Rerun with -calibrate-seed %d to reproduce\n", seed)
+	return false
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+// The C ABI of the shared library built with `make lib`. Strings cross the
+// boundary as NUL-terminated UTF-8; strings returned to C are allocated with
+// malloc and must be released with gnp_free.
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"unsafe"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// libResult is what gnp_mine returns: the mined event, or why there is none
+type libResult struct {
+	Event *nostr.Event `json:"event,omitempty"`
+	Error string       `json:"error,omitempty"`
+}
+
+// gnp_mine mines event_json, a Nostr event, to difficulty leading zero bits
+// and returns {"event": <mined event>} or {"error": "<message>"}. opts_json
+// holds libOptions and may be NULL or empty for the defaults. The call blocks
+// until a nonce is found, timeout_ms passes or mining fails; calls on
+// different threads may run at once.
+//
+//export gnp_mine
+func gnp_mine(eventJSON *C.char, difficulty C.int, optsJSON *C.char) *C.char {
+	result := libResult{}
+	if mined, err := mineFromC(eventJSON, int(difficulty), optsJSON); err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Event = &mined
+	}
+	out, err := json.Marshal(result)
+	if err != nil {
+		out = []byte(`{"error":"failed to encode result"}`)
+	}
+	return C.CString(string(out))
+}
+
+// gnp_free releases a string returned by gnp_mine
+//
+//export gnp_free
+func gnp_free(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+// gnp_version returns the miner's version; release it with gnp_free
+//
+//export gnp_version
+func gnp_version() *C.char {
+	return C.CString(minerVersion())
+}
+
+// mineFromC decodes gnp_mine's arguments and mines
+func mineFromC(eventJSON *C.char, difficulty int, optsJSON *C.char) (nostr.Event, error) {
+	if eventJSON == nil {
+		return nostr.Event{}, fmt.Errorf("event_json is NULL")
+	}
+	event, _, err := parseInputEvent([]byte(C.GoString(eventJSON)))
+	if err != nil {
+		return event, fmt.Errorf("failed to parse JSON event: %v", err)
+	}
+	opts := libOptions{Device: -1}
+	if optsJSON != nil {
+		if data := C.GoString(optsJSON); data != "" {
+			if err := json.Unmarshal([]byte(data), &opts); err != nil {
+				return event, fmt.Errorf("failed to parse options: %v", err)
+			}
+		}
+	}
+	return mineEvent(event, difficulty, opts)
+}
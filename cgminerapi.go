@@ -0,0 +1,274 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minerStats holds the counters reported by the cgminer-compatible API.
+// The mining loop updates them; API connections only read them, apart from
+// control commands, which leave requests for the mining loop.
+type minerStats struct {
+	hashes     atomic.Int64 // nonces tested
+	found      atomic.Int64 // valid nonces found
+	hwErrors   atomic.Int64 // GPU candidates rejected by CPU validation
+	difficulty atomic.Int64 // current target
+
+	start       time.Time
+	suspended   atomic.Int64 // nanoseconds the machine slept that time.Since(start) counts
+	deviceIndex int
+	deviceName  string
+	kernel      string
+
+	// Control commands, accepted only with -api-control
+	control             bool
+	requestedDifficulty atomic.Int64 // 0 if no change is pending
+
+	// Samples for the 5 second hash rate, one per second
+	mu       sync.Mutex
+	samples  []int64
+	sampling sync.Once
+
+	// Smoothed 10s, 1m and 15m rates, fed by the mining loop
+	meter rateMeter
+}
+
+// apiField is one name=value pair of a cgminer API response. Responses keep
+// field order because some monitoring tools parse the plain-text form by position.
+type apiField struct {
+	name  string
+	value interface{}
+}
+
+// apiSection is an ordered list of fields
+type apiSection []apiField
+
+// MarshalJSON writes the fields as a JSON object in order
+func (s apiSection) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range s {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(f.name)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// text formats the fields as cgminer's plain-text "Name=Value,..." list
+func (s apiSection) text() string {
+	parts := make([]string, len(s))
+	for i, f := range s {
+		parts[i] = fmt.Sprintf("%s=%v", f.name, f.value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// startCgminerAPI serves a subset of the cgminer API (summary, devs, version)
+// on addr, so GPU farm monitoring tools that poll cgminer can track the miner.
+// If stats.control is set it also accepts setdifficulty. It returns once the
+// listener is open.
+func startCgminerAPI(addr string, stats *minerStats) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+
+	stats.sampling.Do(func() { go stats.sampleHashRate() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				vlog("Warning: API listener stopped: %v", err)
+				return
+			}
+			go handleCgminerAPI(conn, stats)
+		}
+	}()
+	return nil
+}
+
+// sampleHashRate records the hash counter once per second for "MHS 5s"
+func (s *minerStats) sampleHashRate() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		s.samples = append(s.samples, s.hashes.Load())
+		if len(s.samples) > 6 {
+			s.samples = s.samples[len(s.samples)-6:]
+		}
+		s.mu.Unlock()
+	}
+}
+
+// elapsed returns how long the miner has been mining, leaving out time the
+// machine slept
+func (s *minerStats) elapsed() time.Duration {
+	return time.Since(s.start) - time.Duration(s.suspended.Load())
+}
+
+// rates returns the average and 5 second hash rates in MH/s
+func (s *minerStats) rates() (average, recent float64) {
+	hashes := s.hashes.Load()
+	if elapsed := s.elapsed().Seconds(); elapsed > 0 {
+		average = float64(hashes) / elapsed / 1e6
+	}
+	recent = average
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.samples); n >= 2 {
+		recent = float64(s.samples[n-1]-s.samples[0]) / float64(n-1) / 1e6
+	}
+	return average, recent
+}
+
+// handleCgminerAPI answers a single request. Like cgminer, it accepts either a
+// JSON request ({"command":"summary"}) or a plain command name, replies in the
+// same form, and terminates the reply with a NUL byte.
+func handleCgminerAPI(conn net.Conn, stats *minerStats) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	request := strings.TrimSpace(strings.TrimRight(string(buf[:n]), "\x00"))
+
+	isJSON := strings.HasPrefix(request, "{")
+	command, parameter := request, ""
+	if isJSON {
+		var req struct {
+			Command   string `json:"command"`
+			Parameter string `json:"parameter"`
+		}
+		if err := json.Unmarshal([]byte(request), &req); err != nil {
+			command = ""
+		} else {
+			command, parameter = req.Command, req.Parameter
+		}
+	} else if i := strings.IndexByte(command, '|'); i >= 0 {
+		command, parameter = command[:i], command[i+1:]
+	}
+
+	section, items, status := cgminerAPIReply(strings.ToLower(command), parameter, stats)
+
+	var reply []byte
+	if isJSON {
+		response := map[string]interface{}{"STATUS": []apiSection{status}, "id": 1}
+		if section != "" {
+			response[section] = items
+		}
+		reply, _ = json.Marshal(response)
+	} else {
+		var b strings.Builder
+		b.WriteString(status.text())
+		b.WriteByte('|')
+		for _, item := range items {
+			if section == "SUMMARY" || section == "VERSION" {
+				b.WriteString(section + ",")
+			}
+			b.WriteString(item.text())
+			b.WriteByte('|')
+		}
+		reply = []byte(b.String())
+	}
+	conn.Write(append(reply, 0))
+}
+
+// cgminerAPIReply builds the response section and STATUS block for a command
+func cgminerAPIReply(command, parameter string, stats *minerStats) (string, []apiSection, apiSection) {
+	now := time.Now().Unix()
+	status := func(state string, code int, msg string) apiSection {
+		return apiSection{
+			{"STATUS", state},
+			{"When", now},
+			{"Code", code},
+			{"Msg", msg},
+			{"Description", "gpu-nostr-pow"},
+		}
+	}
+
+	average, recent := stats.rates()
+	smoothed := stats.meter.rates()
+	elapsed := int64(stats.elapsed().Seconds())
+	totalMH := float64(stats.hashes.Load()) / 1e6
+	found := stats.found.Load()
+	hwErrors := stats.hwErrors.Load()
+
+	switch command {
+	case "summary":
+		return "SUMMARY", []apiSection{{
+			{"Elapsed", elapsed},
+			{"MHS av", average},
+			{"MHS 5s", recent},
+			{"MHS 1m", smoothed[1] / 1e6},
+			{"MHS 15m", smoothed[2] / 1e6},
+			{"Found Blocks", found},
+			{"Accepted", found},
+			{"Rejected", 0},
+			{"Hardware Errors", hwErrors},
+			{"Total MH", totalMH},
+			{"Difficulty Accepted", float64(found) * float64(stats.difficulty.Load())},
+			{"Best Share", 0},
+		}}, status("S", 11, "Summary")
+	case "devs":
+		return "DEVS", []apiSection{{
+			{"GPU", stats.deviceIndex},
+			{"Enabled", "Y"},
+			{"Status", "Alive"},
+			{"Name", stats.deviceName},
+			{"Kernel", stats.kernel},
+			{"MHS av", average},
+			{"MHS 5s", recent},
+			{"MHS 1m", smoothed[1] / 1e6},
+			{"MHS 15m", smoothed[2] / 1e6},
+			{"Accepted", found},
+			{"Rejected", 0},
+			{"Hardware Errors", hwErrors},
+			{"Total MH", totalMH},
+			{"Device Elapsed", elapsed},
+		}}, status("S", 9, "1 GPU(s)")
+	case "version":
+		return "VERSION", []apiSection{{
+			{"CGMiner", "gpu-nostr-pow"},
+			{"API", "3.7"},
+		}}, status("S", 22, "CGMiner versions")
+	case "setdifficulty":
+		// Takes effect at the next batch; the event is re-serialized with the new target
+		if !stats.control {
+			return "", nil, status("E", 45, "Access denied to 'setdifficulty' command")
+		}
+		difficulty, err := strconv.Atoi(strings.TrimSpace(parameter))
+		if err != nil || difficulty < 1 || difficulty > 256 {
+			return "", nil, status("E", 84, fmt.Sprintf("Invalid difficulty '%s' (1-256)", parameter))
+		}
+		stats.requestedDifficulty.Store(int64(difficulty))
+		return "", nil, status("S", 300, fmt.Sprintf("Difficulty %d requested", difficulty))
+	default:
+		return "", nil, status("E", 14, "Invalid command")
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// deviceCLCVersion returns the OpenCL C version the device compiles kernels
+// for, falling back to the platform version the device reports. Unparseable
+// versions are treated as 1.0.
+func deviceCLCVersion(device *cl.Device) (major, minor int) {
+	if _, err := fmt.Sscanf(device.OpenCLCVersion(), "OpenCL C %d.%d", &major, &minor); err == nil {
+		return major, minor
+	}
+	if _, err := fmt.Sscanf(device.Version(), "OpenCL %d.%d", &major, &minor); err == nil {
+		return major, minor
+	}
+	return 1, 0
+}
+
+// isLegacyCLDevice reports whether a device only compiles OpenCL C 1.0 or 1.1
+func isLegacyCLDevice(device *cl.Device) bool {
+	major, minor := deviceCLCVersion(device)
+	return major < 1 || (major == 1 && minor <= 1)
+}
+
+// kernelBuildOptions returns the compiler options for building kernels on a
+// device. Legacy devices get NIP13_CL11 defined, which makes the kernels skip
+// constructs that OpenCL 1.1 compilers reject (unroll pragmas, inline PTX).
+func kernelBuildOptions(device *cl.Device) string {
+	if isLegacyCLDevice(device) {
+		return "-D NIP13_CL11"
+	}
+	return ""
+}
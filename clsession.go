@@ -0,0 +1,670 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// clSession holds everything needed to run a mining kernel on one device:
+// context, queue, built program and kernel, and the input and results
+// buffers. Mining, benchmarks and kernel tests all set up through it, so
+// kernel ABI changes only touch this file and abi.go.
+type clSession struct {
+	device     *cl.Device
+	kernelType string // resolved kernel, never "auto"
+	kernelName string
+	abi        kernelABI
+	target     powTarget // what the kernel searches for, to check its hits
+	limits     deviceLimits
+	occupancy  occupancyReport
+
+	context *cl.Context
+	queue   *cl.CommandQueue
+	program *cl.Program
+	kernel  *cl.Kernel
+	launch  launchArgs
+	// launchCap bounds the nonces per launch below what the device accepts,
+	// to keep launches short under a GPU watchdog; 0 is no bound
+	launchCap int
+	// launches counts kernel launches, for -benchmark's allocation check
+	launches uint64
+
+	input       *cl.MemObject
+	midstate    *cl.MemObject // only for kernels with the midstate capability
+	results     *cl.MemObject
+	batchSize   int
+	resultBytes []byte
+	difficulty  int // the kernel's current difficulty, for readbackSize
+
+	// extraLanes are the queues beyond the first (-queues); queue, kernel
+	// and results above are lane 0
+	extraLanes []queueLane
+}
+
+// queueLane is one command queue with its own kernel object and results
+// buffer. Kernel arguments belong to the kernel object, so each queue needs
+// its own to launch on different nonces at the same time; the input and
+// midstate buffers are shared.
+type queueLane struct {
+	queue   *cl.CommandQueue
+	kernel  *cl.Kernel
+	results *cl.MemObject
+}
+
+// maxQueues bounds -queues; benchmarkMaxQueues is the most -benchmark tries.
+// A handful of queues is enough to keep any current GPU's compute units fed.
+const (
+	maxQueues          = 16
+	benchmarkMaxQueues = 4
+)
+
+// clObjects counts live OpenCL objects by kind. Every object is created and
+// released through clSession, so anything still counted when a mode finishes
+// has leaked.
+var clObjects = struct {
+	sync.Mutex
+	live map[string]int
+}{live: make(map[string]int)}
+
+// trackCL records the creation (delta 1) or release (delta -1) of an object
+func trackCL(kind string, delta int) {
+	clObjects.Lock()
+	defer clObjects.Unlock()
+	clObjects.live[kind] += delta
+	if clObjects.live[kind] == 0 {
+		delete(clObjects.live, kind)
+	}
+}
+
+// reportCLObjects logs OpenCL objects that are still alive, in verbose mode
+func reportCLObjects() {
+	clObjects.Lock()
+	defer clObjects.Unlock()
+	if len(clObjects.live) == 0 {
+		vlog("All OpenCL objects released")
+		return
+	}
+	var parts []string
+	for kind, n := range clObjects.live {
+		parts = append(parts, fmt.Sprintf("%d %s", n, kind))
+	}
+	sort.Strings(parts)
+	vlog("Warning: OpenCL objects not released: %s", strings.Join(parts, ", "))
+}
+
+// newCLSession builds a kernel for a device. "auto" selects the kernel for the
+// device; no self-test is run (see gateKernel).
+func newCLSession(device *cl.Device, kernelType string) (*clSession, error) {
+	return newTunedCLSession(device, kernelType, "")
+}
+
+// newTunedCLSession is newCLSession with extra compiler options after the
+// device's, as -tune tries them
+func newTunedCLSession(device *cl.Device, kernelType, extraOptions string) (*clSession, error) {
+	if kernelType == "auto" {
+		kernelType = selectKernelForDevice(device)
+	}
+	s := &clSession{device: device, kernelType: kernelType, limits: queryDeviceLimits(device)}
+	ok := false
+	defer func() {
+		if !ok {
+			s.Release()
+		}
+	}()
+
+	// Get kernel source
+	kernelSource, kernelName, err := getKernelSource(kernelType, device)
+	if err != nil {
+		return nil, err
+	}
+	s.kernelName = kernelName
+	s.abi, err = parseKernelABI(kernelSource)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.abi.checkDevice(device); err != nil {
+		return nil, err
+	}
+	s.target, err = lookupPowTarget(s.abi.Target)
+	if err != nil {
+		return nil, fmt.Errorf("kernel %s: %v", kernelType, err)
+	}
+
+	// Create context
+	s.context, err = cl.CreateContext([]*cl.Device{device})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create context: %v", err)
+	}
+	trackCL("context", 1)
+
+	// Create command queue
+	s.queue, err = s.context.CreateCommandQueue(device, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create command queue: %v", err)
+	}
+	trackCL("queue", 1)
+
+	// Create and build program
+	s.program, err = s.context.CreateProgramWithSource([]string{kernelSource})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create program: %v", err)
+	}
+	trackCL("program", 1)
+	options := strings.TrimSpace(kernelBuildOptions(device) + " " + extraOptions)
+	if options != "" {
+		vlog("Building %s kernel for OpenCL 1.1 (%s)", kernelType, options)
+	}
+	if err := s.program.BuildProgram(nil, options); err != nil {
+		return nil, fmt.Errorf("failed to build program: %v", err)
+	}
+
+	// Create kernel
+	s.kernel, err = s.program.CreateKernel(kernelName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kernel: %v", err)
+	}
+	trackCL("kernel", 1)
+	s.launch.wavefront, s.launch.maxLocalSize = localWorkSizeLimits(kernelType, s.kernel, device)
+	s.occupancy = measureOccupancy(s.kernel, device, kernelSource)
+
+	ok = true
+	return s, nil
+}
+
+// Release frees the session's OpenCL objects. It is safe to call more than once.
+func (s *clSession) Release() {
+	s.releaseInput()
+	s.releaseResults()
+	for _, lane := range s.extraLanes {
+		if lane.kernel != nil {
+			lane.kernel.Release()
+			trackCL("kernel", -1)
+		}
+		lane.queue.Release()
+		trackCL("queue", -1)
+	}
+	s.extraLanes = nil
+	if s.kernel != nil {
+		s.kernel.Release()
+		s.kernel = nil
+		trackCL("kernel", -1)
+	}
+	if s.program != nil {
+		s.program.Release()
+		s.program = nil
+		trackCL("program", -1)
+	}
+	if s.queue != nil {
+		s.queue.Release()
+		s.queue = nil
+		trackCL("queue", -1)
+	}
+	if s.context != nil {
+		s.context.Release()
+		s.context = nil
+		trackCL("context", -1)
+	}
+}
+
+// releaseInput frees the input and midstate buffers
+func (s *clSession) releaseInput() {
+	if s.input != nil {
+		s.input.Release()
+		s.input = nil
+		trackCL("buffer", -1)
+	}
+	if s.midstate != nil {
+		s.midstate.Release()
+		s.midstate = nil
+		trackCL("buffer", -1)
+	}
+}
+
+// releaseResults frees the results buffers
+func (s *clSession) releaseResults() {
+	if s.results != nil {
+		s.results.Release()
+		s.results = nil
+		trackCL("buffer", -1)
+	}
+	for i := range s.extraLanes {
+		if s.extraLanes[i].results != nil {
+			s.extraLanes[i].results.Release()
+			s.extraLanes[i].results = nil
+			trackCL("buffer", -1)
+		}
+	}
+}
+
+// setQueues gives the session n command queues in all, each with its own
+// kernel object. It must be called before allocResults and setInput.
+func (s *clSession) setQueues(n int) error {
+	for len(s.extraLanes) < n-1 {
+		queue, err := s.context.CreateCommandQueue(s.device, 0)
+		if err != nil {
+			return fmt.Errorf("failed to create command queue: %v", err)
+		}
+		trackCL("queue", 1)
+		s.extraLanes = append(s.extraLanes, queueLane{queue: queue})
+		kernel, err := s.program.CreateKernel(s.kernelName)
+		if err != nil {
+			return fmt.Errorf("failed to create kernel: %v", err)
+		}
+		trackCL("kernel", 1)
+		s.extraLanes[len(s.extraLanes)-1].kernel = kernel
+	}
+	return nil
+}
+
+// queues returns the number of command queues the session runs batches on
+func (s *clSession) queues() int {
+	return 1 + len(s.extraLanes)
+}
+
+// lane returns command queue i with its kernel and results buffer
+func (s *clSession) lane(i int) queueLane {
+	if i == 0 {
+		return queueLane{queue: s.queue, kernel: s.kernel, results: s.results}
+	}
+	return s.extraLanes[i-1]
+}
+
+// laneSize is the number of nonces each queue runs of a batch
+func (s *clSession) laneSize(count int) int {
+	return (count + s.queues() - 1) / s.queues()
+}
+
+// allocResults creates the results buffers: one int32 per work item, the
+// item's index on a hit and -1 otherwise. With several queues each gets a
+// buffer for its share of the batch.
+func (s *clSession) allocResults(batchSize int) error {
+	s.releaseResults()
+	size := batchSize
+	if len(s.extraLanes) > 0 {
+		size = s.laneSize(batchSize)
+	}
+	results, err := s.context.CreateEmptyBuffer(cl.MemWriteOnly, size*resultSize)
+	if err != nil {
+		return fmt.Errorf("failed to create results buffer: %v", err)
+	}
+	trackCL("buffer", 1)
+	s.results = results
+	for i := range s.extraLanes {
+		results, err := s.context.CreateEmptyBuffer(cl.MemWriteOnly, size*resultSize)
+		if err != nil {
+			return fmt.Errorf("failed to create results buffer: %v", err)
+		}
+		trackCL("buffer", 1)
+		s.extraLanes[i].results = results
+	}
+	s.batchSize = batchSize
+	s.resultBytes = make([]byte, batchSize*resultSize)
+	return nil
+}
+
+// setLocalSize launches work-groups of size items, when a launch divides
+// evenly into them, instead of the size localWorkSizeLimits picks for the
+// kernel. 0 goes back to that size.
+func (s *clSession) setLocalSize(size int) error {
+	if size == 0 {
+		s.launch.wavefront, s.launch.maxLocalSize = localWorkSizeLimits(s.kernelType, s.kernel, s.device)
+		return nil
+	}
+	if size < 0 || size > 256 {
+		return fmt.Errorf("local size must be between 0 and 256, got %d", size)
+	}
+	if limit, err := s.kernel.WorkGroupSize(s.device); err == nil && size > limit {
+		return fmt.Errorf("local size %d exceeds the kernel's limit of %d", size, limit)
+	}
+	s.launch.wavefront, s.launch.maxLocalSize = size, size
+	return nil
+}
+
+// preparedInput is an event serialized for one nonce width, with the host
+// side of setInput done: for kernels with the midstate capability, the
+// blocks before the nonce hashed into the midstate
+type preparedInput struct {
+	serialized   []byte
+	nonceOffset  int
+	numDigits    int
+	prefixLength int    // bytes covered by midstate
+	midstate     []byte // nil unless the kernel takes a midstate
+}
+
+// inputPreparer does setInput's host-side work for a kernel ABI, so it can run
+// on another goroutine while the device mines. Consecutive events whose
+// blocks before the nonce are the same share their midstate.
+type inputPreparer struct {
+	abi          kernelABI
+	lastPrefix   []byte
+	lastMidstate []byte
+}
+
+// prepare checks that a serialized event fits the kernel and computes its
+// midstate if the kernel takes one
+func (p *inputPreparer) prepare(serialized []byte, nonceOffset, numDigits int) (preparedInput, error) {
+	in := preparedInput{serialized: serialized, nonceOffset: nonceOffset, numDigits: numDigits}
+	if err := p.abi.checkEventFits(len(serialized), numDigits); err != nil {
+		return in, err
+	}
+	if !p.abi.Midstate {
+		return in, nil
+	}
+	in.prefixLength = midstatePrefixLength(nonceOffset)
+	prefix := serialized[:in.prefixLength]
+	if p.lastMidstate != nil && bytes.Equal(prefix, p.lastPrefix) {
+		in.midstate = p.lastMidstate
+	} else {
+		midstate, err := sha256Midstate(prefix)
+		if err != nil {
+			return in, err
+		}
+		in.midstate = midstate
+		p.lastPrefix, p.lastMidstate = append(p.lastPrefix[:0], prefix...), midstate
+	}
+	totalBlocks := sha256Blocks(len(serialized))
+	vlog("Midstate covers %d of %d SHA-256 blocks; each nonce hashes %d",
+		in.prefixLength/sha256BlockSize, totalBlocks, totalBlocks-in.prefixLength/sha256BlockSize)
+	return in, nil
+}
+
+// setInput uploads a serialized event with its nonce placeholder and sets the
+// kernel arguments for it. allocResults must be called first. For kernels with
+// the midstate capability, the blocks before the nonce are hashed here and
+// only the rest of the event is uploaded.
+func (s *clSession) setInput(serialized []byte, nonceOffset, numDigits, difficulty int) error {
+	p := inputPreparer{abi: s.abi}
+	in, err := p.prepare(serialized, nonceOffset, numDigits)
+	if err != nil {
+		return err
+	}
+	return s.setPreparedInput(in, difficulty)
+}
+
+// setPreparedInput is setInput for an event whose host-side work is done
+func (s *clSession) setPreparedInput(in preparedInput, difficulty int) error {
+	s.releaseInput()
+	serialized, nonceOffset, numDigits, prefixLength := in.serialized, in.nonceOffset, in.numDigits, in.prefixLength
+	if in.midstate != nil {
+		midstate := in.midstate
+		buffer, err := s.context.CreateEmptyBuffer(cl.MemReadOnly, len(midstate))
+		if err != nil {
+			return fmt.Errorf("failed to create midstate buffer: %v", err)
+		}
+		trackCL("buffer", 1)
+		s.midstate = buffer
+		event, err := s.queue.EnqueueWriteBuffer(buffer, true, 0, len(midstate), unsafe.Pointer(&midstate[0]), nil)
+		if err != nil {
+			return fmt.Errorf("failed to write midstate buffer: %v", err)
+		}
+		event.Release()
+	}
+	rest := serialized[prefixLength:]
+
+	input, err := s.context.CreateEmptyBuffer(cl.MemReadOnly, len(rest))
+	if err != nil {
+		return fmt.Errorf("failed to create input buffer: %v", err)
+	}
+	trackCL("buffer", 1)
+	s.input = input
+
+	event, err := s.queue.EnqueueWriteBuffer(input, true, 0, len(rest), unsafe.Pointer(&rest[0]), nil)
+	if err != nil {
+		return fmt.Errorf("failed to write input buffer: %v", err)
+	}
+	event.Release()
+
+	s.difficulty = difficulty
+	args := kernelArgs{
+		input:            input,
+		serializedLength: len(rest),
+		nonceOffset:      nonceOffset - prefixLength,
+		difficulty:       difficulty,
+		numDigits:        numDigits,
+		midstate:         s.midstate,
+		prefixLength:     prefixLength,
+	}
+	for i := 0; i < s.queues(); i++ {
+		lane := s.lane(i)
+		args.results = lane.results
+		if err := setKernelArgs(lane.kernel, s.abi, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setDifficulty changes the difficulty the kernels report hits at
+func (s *clSession) setDifficulty(difficulty int) error {
+	s.difficulty = difficulty
+	for i := 0; i < s.queues(); i++ {
+		if err := setKernelDifficulty(s.lane(i).kernel, s.abi, difficulty); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamLaunchSize bounds the launches of batches larger than it. Their
+// results are checked launch by launch while the next one runs, and the batch
+// stops at the first launch with a hit instead of finishing, so a hit in a
+// huge batch ends the run without waiting for the rest of it.
+const streamLaunchSize = 1 << 22
+
+// minReadbackSize is the smallest launch readbackSize picks. Below it the
+// launch and read overhead would cost more than the earlier stop saves.
+const minReadbackSize = 1 << 18
+
+// readbackSize is the launch size at which results are read back and checked
+// while the rest of a batch runs. A batch expecting less than one hit is read
+// back in launches of streamLaunchSize. One expecting several, at low
+// difficulty, is read back about once per expected hit (2^difficulty nonces),
+// so the first hit ends it without running the nonces after it.
+func (s *clSession) readbackSize() int {
+	if s.difficulty >= 22 {
+		return streamLaunchSize
+	}
+	return max(1<<max(s.difficulty, 0), minReadbackSize)
+}
+
+// setLaunchCap runs batches in launches of at most size nonces; 0 removes
+// the cap
+func (s *clSession) setLaunchCap(size int) {
+	s.launchCap = size
+}
+
+// launchLimit returns the most nonces one launch may test
+func (s *clSession) launchLimit() int {
+	limit := s.limits.maxGlobalSize(0)
+	if s.launchCap > 0 {
+		limit = min(limit, s.launchCap)
+	}
+	return limit
+}
+
+// runBatch tests count nonces starting at baseNonce (count at most the batch
+// size) and returns each work item's result. The slice is only valid until
+// the next call.
+//
+// Batches larger than the device accepts in one launch, or than
+// readbackSize, are run as several launches, each writing the start of the
+// results buffer. Their hits are shifted so indices stay relative to
+// baseNonce. Batches larger than readbackSize stop after the first launch
+// with a hit; the returned slice then covers only the nonces tested. Sessions
+// with several queues run batches with runLanes instead.
+func (s *clSession) runBatch(baseNonce uint64, count int) ([]int32, error) {
+	if count > s.batchSize {
+		return nil, fmt.Errorf("batch of %d nonces exceeds the results buffer (%d)", count, s.batchSize)
+	}
+	if len(s.extraLanes) > 0 {
+		return s.runLanes(baseNonce, count)
+	}
+	results := (*[maxResultEntries]int32)(unsafe.Pointer(&s.resultBytes[0]))[:count:count]
+	launchSize := s.launchLimit()
+	readback := s.readbackSize()
+	stream := count > readback
+	if stream && launchSize > readback {
+		launchSize = readback
+	}
+
+	if count <= launchSize {
+		event, err := s.launchChunk(s.lane(0), baseNonce, 0, count, true)
+		if err != nil {
+			return nil, err
+		}
+		event.Release()
+		return results, nil
+	}
+
+	// Each launch and the non-blocking read of its results are queued one
+	// launch ahead. The queue runs commands in order, so the host checks one
+	// launch's results while the device runs the next.
+	read, err := s.launchChunk(s.lane(0), baseNonce, 0, launchSize, false)
+	if err != nil {
+		return nil, err
+	}
+	for done := 0; done < count; {
+		n := min(count-done, launchSize)
+		var next *cl.Event
+		if done+n < count {
+			next, err = s.launchChunk(s.lane(0), baseNonce, done+n, min(count-done-n, launchSize), false)
+			if err != nil {
+				s.queue.Finish()
+				read.Release()
+				return nil, err
+			}
+		}
+
+		start := phaseStart()
+		err := cl.WaitForEvents([]*cl.Event{read})
+		read.Release()
+		phaseEnd(phaseRead, start)
+		if err != nil {
+			s.queue.Finish()
+			if next != nil {
+				next.Release()
+			}
+			return nil, fmt.Errorf("failed to read results buffer: %v", err)
+		}
+
+		start = phaseStart()
+		hit := false
+		for i, index := range results[done : done+n] {
+			if index >= 0 {
+				results[done+i] = index + int32(done)
+				hit = true
+			}
+		}
+		phaseEnd(phaseScan, start)
+		done += n
+
+		if hit && stream && next != nil {
+			// The queued launch writes into the results; let it finish first
+			s.queue.Finish()
+			next.Release()
+			return results[:done:done], nil
+		}
+		read = next
+	}
+	return results, nil
+}
+
+// runLanes runs a batch split into one contiguous slice per queue, so the
+// device works on launches from several queues at once. Each queue runs its
+// slice in launches of at most the device limit; the host waits for all of
+// them, then shifts hit indices to stay relative to baseNonce. A hit anywhere
+// ends the batch for all queues together, since the caller checks the whole
+// batch before queueing more.
+func (s *clSession) runLanes(baseNonce uint64, count int) ([]int32, error) {
+	results := (*[maxResultEntries]int32)(unsafe.Pointer(&s.resultBytes[0]))[:count:count]
+	per := s.laneSize(count)
+	launchSize := min(s.launchLimit(), per)
+
+	// chunks visits each launch of the batch: its lane, start and size
+	chunks := func(visit func(lane, done, n int) error) error {
+		for i := 0; i < s.queues(); i++ {
+			end := min((i+1)*per, count)
+			for done := i * per; done < end; done += launchSize {
+				if err := visit(i, done, min(launchSize, end-done)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	var reads []*cl.Event
+	err := chunks(func(lane, done, n int) error {
+		read, err := s.launchChunk(s.lane(lane), baseNonce, done, n, false)
+		if err != nil {
+			return err
+		}
+		reads = append(reads, read)
+		return nil
+	})
+	if err == nil && len(reads) > 0 {
+		start := phaseStart()
+		if werr := cl.WaitForEvents(reads); werr != nil {
+			err = fmt.Errorf("failed to read results buffer: %v", werr)
+		}
+		phaseEnd(phaseRead, start)
+	}
+	for _, read := range reads {
+		read.Release()
+	}
+	if err != nil {
+		for i := 0; i < s.queues(); i++ {
+			s.lane(i).queue.Finish()
+		}
+		return nil, err
+	}
+
+	start := phaseStart()
+	chunks(func(_, done, n int) error {
+		for i, index := range results[done : done+n] {
+			if index >= 0 {
+				results[done+i] = index + int32(done)
+			}
+		}
+		return nil
+	})
+	phaseEnd(phaseScan, start)
+	return results, nil
+}
+
+// launchChunk launches n work items on a lane testing nonces from
+// baseNonce+done and queues the read of their results into the results slice
+// at done. It returns the read's event, which the caller releases.
+func (s *clSession) launchChunk(lane queueLane, baseNonce uint64, done, n int, blocking bool) (*cl.Event, error) {
+	base := baseNonce + uint64(done)
+	start := phaseStart()
+	if err := setKernelNonce(lane.kernel, s.abi, base); err != nil {
+		return nil, err
+	}
+	phaseEnd(phaseSetArgs, start)
+	start = phaseStart()
+	if err := enqueueMiningKernel(lane.queue, lane.kernel, s.abi, &s.launch, base, n); err != nil {
+		return nil, err
+	}
+	phaseEnd(phaseEnqueue, start)
+	s.launches++
+	start = phaseStart()
+	event, err := lane.queue.EnqueueReadBuffer(lane.results, blocking, 0, n*resultSize, unsafe.Pointer(&s.resultBytes[done*resultSize]), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read results buffer: %v", err)
+	}
+	if blocking {
+		phaseEnd(phaseRead, start)
+	}
+	return event, nil
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// conformanceZeroCase is a hash prefix and the leading zero bits NIP-13
+// counts for it; the rest of the hash is 0xff
+type conformanceZeroCase struct {
+	prefix []byte
+	bits   int
+}
+
+// conformanceZeroCases cross nibble, byte and 32-bit word boundaries, where
+// counting by hex digit, by byte and by word can disagree
+var conformanceZeroCases = []conformanceZeroCase{
+	{[]byte{0x80}, 0},
+	{[]byte{0x7f}, 1},
+	{[]byte{0x10}, 3},
+	{[]byte{0x0f}, 4},
+	{[]byte{0x08}, 4},
+	{[]byte{0x01}, 7},
+	{[]byte{0x00, 0x80}, 8},
+	{[]byte{0x00, 0x7f}, 9},
+	{[]byte{0x00, 0x0f}, 12},
+	{[]byte{0x00, 0x00, 0x01}, 23},
+	{[]byte{0x00, 0x00, 0x00, 0x80}, 24},
+	{[]byte{0x00, 0x00, 0x00, 0x01}, 31},
+	{[]byte{0x00, 0x00, 0x00, 0x00, 0x80}, 32},
+	{[]byte{0x00, 0x00, 0x00, 0x00, 0x40}, 33},
+	{make([]byte, 31), 248},
+	{make([]byte, 32), 256},
+}
+
+// nip13ExampleID is the event ID NIP-13 gives as an example of difficulty 36
+const nip13ExampleID = "000000000e9d97a1ab09fc381030b346cdd7a142ad57e6df0b46dc9bef6c7e2d"
+
+// conformanceDifficulties are the difficulties mined events are checked at:
+// within the first byte, at its end and just past it, and two bytes
+var conformanceDifficulties = []int{1, 7, 8, 9, 16}
+
+// conformanceReport prints the outcome of each -conformance check
+type conformanceReport struct {
+	w                       io.Writer
+	passed, failed, skipped int
+}
+
+func (r *conformanceReport) section(name string) {
+	fmt.Fprintf(r.w, "\n%s\n", name)
+}
+
+func (r *conformanceReport) check(name string, err error) {
+	if err != nil {
+		fmt.Fprintf(r.w, "  FAIL  %s: %v\n", name, err)
+		r.failed++
+		return
+	}
+	fmt.Fprintf(r.w, "  PASS  %s\n", name)
+	r.passed++
+}
+
+func (r *conformanceReport) skip(name, reason string) {
+	fmt.Fprintf(r.w, "  SKIP  %s: %s\n", name, reason)
+	r.skipped++
+}
+
+// runConformance checks the miner's NIP-13 handling against curated edge
+// cases: leading zero bits counted across nibble, byte and word boundaries,
+// nonce tag formats, difficulty commitments, and the IDs of mined events with
+// awkward content. Mined events come from the CPU miner and, if one is
+// available, the device (deviceIndex and kernelType as for mining). Counts
+// and commitments are compared with go-nostr's nip13 package as well as the
+// miner's own code, so a go-nostr release or NIP text that disagrees shows
+// up here. It writes a report to w and returns whether every check passed.
+func runConformance(w io.Writer, deviceIndex int, kernelType string) bool {
+	r := &conformanceReport{w: w}
+	fmt.Fprintf(w, "NIP-13 conformance report\n")
+
+	r.section("Leading zero bits")
+	for _, c := range conformanceZeroCases {
+		var hash [32]byte
+		for i := range hash {
+			hash[i] = 0xff
+		}
+		copy(hash[:], c.prefix)
+		id := hex.EncodeToString(hash[:])
+		r.check(fmt.Sprintf("%.16s… has %d bits", id, c.bits), checkZeroCount(id, hash, c.bits))
+	}
+	exampleHash, _ := hex.DecodeString(nip13ExampleID)
+	r.check("NIP-13 example ID has 36 bits", checkZeroCount(nip13ExampleID, [32]byte(exampleHash), 36))
+
+	r.section("Nonce tag formats")
+	for _, c := range []struct {
+		tag nostr.Tag
+		ok  bool
+	}{
+		{nostr.Tag{"nonce", "776797", "20"}, true},
+		{nostr.Tag{"nonce", "776797"}, true}, // target filled in before mining
+		{nostr.Tag{"nonce"}, false},
+		{nostr.Tag{"nonce", "776797", "twenty"}, false},
+		{nostr.Tag{"nonce", "776797", "-1"}, false},
+	} {
+		err := checkNonceTag(c.tag)
+		if c.ok != (err == nil) {
+			err = fmt.Errorf("accepted: %v, want %v (%v)", err == nil, c.ok, err)
+		} else {
+			err = nil
+		}
+		verb := "rejected"
+		if c.ok {
+			verb = "accepted"
+		}
+		r.check(fmt.Sprintf("%s %s", tagJSON(c.tag), verb), err)
+	}
+	r.check("update mode keeps extra nonce tag elements", func() error {
+		template, err := nonceTagTemplate("update", nostr.Tags{{"nonce", "5", "16", "extra"}}, 20)
+		if err != nil {
+			return err
+		}
+		if len(template) != 4 || template[2] != "16" || template[3] != "extra" {
+			return fmt.Errorf("got %s", tagJSON(template))
+		}
+		return nil
+	}())
+	r.check("duplicate nonce tags leave one", func() error {
+		tags, _, err := sanitizeNonceTags(nostr.Tags{{"nonce", "1", "8"}, {"t", "x"}, {"nonce", "2", "8"}}, "lenient")
+		if err != nil {
+			return err
+		}
+		if n := len(tags) - len(withoutNonceTags(tags)); n != 1 {
+			return fmt.Errorf("%d nonce tags left", n)
+		}
+		return nil
+	}())
+
+	event := nostr.Event{
+		PubKey:    strings.Repeat("ab", 32),
+		CreatedAt: nostr.Timestamp(1700000000),
+		Kind:      1,
+		Tags:      nostr.Tags{{"t", "nip13"}},
+		Content:   "nip-13 conformance",
+	}
+
+	r.section("Difficulty commitments (CPU)")
+	for _, difficulty := range conformanceDifficulties {
+		template := nostr.Tag{"nonce", "", strconv.Itoa(difficulty)}
+		mined, _, err := mineOnCPU(event, template, "", decimalAlphabet, nonceTagLast, difficulty, 0, time.Time{}, nil)
+		if err == nil {
+			err = checkMinedEvent(mined, difficulty)
+		}
+		r.check(fmt.Sprintf("mined at difficulty %d", difficulty), err)
+	}
+	r.check("commitment above the work counts as 0", func() error {
+		template := nostr.Tag{"nonce", "", "8"}
+		mined, _, err := mineOnCPU(event, template, "", decimalAlphabet, nonceTagLast, 8, 0, time.Time{}, nil)
+		if err != nil {
+			return err
+		}
+		i := nonceTagIndex(mined.Tags)
+		mined.Tags[i] = nostr.Tag{"nonce", mined.Tags[i][1], "200"}
+		mined.ID = mined.GetID()
+		if committed := nip13.CommittedDifficulty(&mined); committed != 0 {
+			return fmt.Errorf("go-nostr counts %d", committed)
+		}
+		return nil
+	}())
+
+	r.section("Serialization of mined events (CPU)")
+	for i, vector := range escapingVectors() {
+		name := fmt.Sprintf("escaping vector %d (%.24q)", i, vector.Content)
+		if !utf8.ValidString(vector.Content) {
+			// JSON can't carry invalid UTF-8, so no relay sees such an event
+			r.skip(name, "content is not valid UTF-8")
+			continue
+		}
+		template := nostr.Tag{"nonce", "", "8"}
+		mined, _, err := mineOnCPU(vector, template, "", decimalAlphabet, nonceTagLast, 8, 0, time.Time{}, nil)
+		if err == nil {
+			err = checkMinedEvent(mined, 8)
+		}
+		r.check(name, err)
+	}
+
+	r.section("Difficulty commitments (device)")
+	if _, err := findDevice(deviceIndex); err != nil {
+		r.skip("device mining", err.Error())
+	} else {
+		opts := libOptions{Device: deviceIndex, Kernel: kernelType}
+		for _, difficulty := range conformanceDifficulties {
+			mined, err := mineEvent(event, difficulty, opts)
+			if err == nil {
+				err = checkMinedEvent(mined, difficulty)
+			}
+			r.check(fmt.Sprintf("mined at difficulty %d", difficulty), err)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d passed, %d failed, %d skipped\n", r.passed, r.failed, r.skipped)
+	return r.failed == 0
+}
+
+// checkZeroCount compares the leading zero bits of a hash, counted by the
+// miner, by go-nostr and by hex digit as the NIP-13 reference code does, with
+// the expected count
+func checkZeroCount(id string, hash [32]byte, want int) error {
+	counts := map[string]int{
+		"miner":    leadingZeroBits(hash),
+		"go-nostr": nip13.Difficulty(id),
+		"NIP-13":   nibbleZeroBits(id),
+	}
+	var wrong []string
+	for _, name := range []string{"miner", "go-nostr", "NIP-13"} {
+		if counts[name] != want {
+			wrong = append(wrong, fmt.Sprintf("%s counts %d", name, counts[name]))
+		}
+	}
+	if len(wrong) > 0 {
+		return fmt.Errorf("%s", strings.Join(wrong, ", "))
+	}
+	return nil
+}
+
+// nibbleZeroBits counts leading zero bits hex digit by hex digit, as the
+// reference implementation in NIP-13 does
+func nibbleZeroBits(id string) int {
+	count := 0
+	for _, c := range id {
+		nibble, err := strconv.ParseUint(string(c), 16, 8)
+		if err != nil {
+			return count
+		}
+		if nibble != 0 {
+			return count + bits.LeadingZeros8(uint8(nibble)) - 4
+		}
+		count += 4
+	}
+	return count
+}
+
+// checkMinedEvent checks a mined event the way relays and clients see it: a
+// single ["nonce", "<decimal>", "<difficulty>"] tag, an ID that an
+// independent serialization of its JSON agrees with, and the difficulty
+// reached and committed to by go-nostr's count
+func checkMinedEvent(event nostr.Event, difficulty int) error {
+	var nonceTags []nostr.Tag
+	for _, tag := range event.Tags {
+		if isNonceTag(tag) {
+			nonceTags = append(nonceTags, tag)
+		}
+	}
+	if len(nonceTags) != 1 {
+		return fmt.Errorf("%d nonce tags", len(nonceTags))
+	}
+	tag := nonceTags[0]
+	if len(tag) != 3 {
+		return fmt.Errorf("nonce tag %s does not have 3 elements", tagJSON(tag))
+	}
+	if nonce, err := strconv.ParseUint(tag[1], 10, 64); err != nil || strconv.FormatUint(nonce, 10) != tag[1] {
+		return fmt.Errorf("nonce value %q is not a decimal number without leading zeros", tag[1])
+	}
+	if tag[2] != strconv.Itoa(difficulty) {
+		return fmt.Errorf("nonce tag commits to %q, not %d", tag[2], difficulty)
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+	if err := doubleCheckOutput(eventJSON, difficulty); err != nil {
+		return err
+	}
+	if err := nip13.Check(event.ID, difficulty); err != nil {
+		return fmt.Errorf("go-nostr: %v", err)
+	}
+	if committed := nip13.CommittedDifficulty(&event); committed != difficulty {
+		return fmt.Errorf("go-nostr counts a committed difficulty of %d", committed)
+	}
+	return nil
+}
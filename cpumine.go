@@ -0,0 +1,270 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// cpuMinDigits is the shortest nonce the CPU path tries, matching the GPU path
+const cpuMinDigits = 5
+
+// cpuMaxDigits is the widest decimal nonce the CPU path tries; wider ones
+// overflow uint64
+const cpuMaxDigits = 19
+
+// cpuChunk is how many nonces a CPU worker claims at a time
+const cpuChunk = 4096
+
+// mineOnCPU searches for a nonce on the CPU with threads workers (0 for one
+// per CPU). At low difficulties the answer is only a few thousand hashes away,
+// less work than setting up OpenCL and launching a single GPU batch. The event
+// is serialized once per nonce width and the digits are written in place, as
+// the kernels do. The blocks before the nonce are hashed once (the midstate),
+// and crypto/sha256 uses the SHA extensions on amd64 (SHA-NI) and arm64, so
+// each nonce costs only its last blocks. It returns the event with its nonce
+// tag and ID set, and the number of nonces tested. Nonces are written in
+// alphabet, which, unlike the kernels, need not be decimal. A zero deadline
+// means no limit; closing stop, if not nil, ends the search within a chunk.
+func mineOnCPU(event nostr.Event, nonceTemplate nostr.Tag, noncePrefix string, alphabet nonceAlphabet, noncePosition, difficulty, threads int, deadline time.Time, stop <-chan struct{}) (nostr.Event, int64, error) {
+	maxDigits := int(math.Ceil(float64(difficulty)*math.Log(2)/math.Log(float64(alphabet.base())))) + 2
+	if maxDigits < 10 {
+		maxDigits = 10
+	}
+	if maxDigits > alphabet.maxWidth() {
+		maxDigits = alphabet.maxWidth()
+	}
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+
+	start := time.Now()
+	var attempts atomic.Int64
+	defer func() {
+		elapsed := time.Since(start)
+		vlog("CPU: %d hashes in %s on %d threads (%.2f MH/s)", attempts.Load(), elapsed.Round(time.Millisecond),
+			threads, float64(attempts.Load())/elapsed.Seconds()/1e6)
+	}()
+
+	for digits := cpuMinDigits; digits <= maxDigits; digits++ {
+		first, last := alphabet.first(digits), alphabet.last(digits)
+		placeholder := noncePrefix + string(alphabet.appendNonce(nil, first))
+
+		event.Tags = withNonceTag(event.Tags, nonceTagWithValue(nonceTemplate, placeholder), noncePosition)
+		message := event.Serialize()
+		offset := findNonceOffset(message, placeholder)
+		if offset == -1 {
+			return event, attempts.Load(), fmt.Errorf("could not find nonce placeholder in serialized event")
+		}
+		offset += len(noncePrefix)
+
+		nonce, found, err := searchOnCPU(message, offset, alphabet, first, last, difficulty, threads, deadline, stop, &attempts)
+		if err != nil {
+			return event, attempts.Load(), err
+		}
+		if !found {
+			continue
+		}
+
+		// Rebuild the event properly and check it, rather than trusting the offset
+		nonceStr := noncePrefix + string(alphabet.appendNonce(nil, nonce))
+		mined := event
+		mined.Tags = setNonceValue(event.Tags, nonceStr)
+		mined.ID = mined.GetID()
+		if nip13.Difficulty(mined.ID) < difficulty {
+			return event, attempts.Load(), fmt.Errorf("nonce %s does not reach difficulty %d after re-serialization", nonceStr, difficulty)
+		}
+		return mined, attempts.Load(), nil
+	}
+	return event, attempts.Load(), fmt.Errorf("no valid nonce found up to %d digits", maxDigits)
+}
+
+// searchOnCPU tests the nonces first to last, all the same width, written in
+// alphabet at offset in a serialized event, and returns the lowest hit any worker found.
+// Workers claim cpuChunk nonces at a time and all stop at the first hit, or
+// before claiming a chunk once the deadline (if not zero) passes or stop is
+// closed, which is returned as an error.
+func searchOnCPU(message []byte, offset int, alphabet nonceAlphabet, first, last uint64, difficulty, threads int, deadline time.Time, stop <-chan struct{}, attempts *atomic.Int64) (uint64, bool, error) {
+	// Hash the whole blocks before the nonce once; each nonce restores that state
+	prefixLength := midstatePrefixLength(offset)
+	h := sha256.New()
+	h.Write(message[:prefixLength])
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read SHA-256 state: %v", err)
+	}
+
+	var next atomic.Uint64
+	next.Store(first)
+	var done atomic.Bool
+	var halt atomic.Value // error ending the search early
+	var mu sync.Mutex
+	best, found := uint64(0), false
+
+	var wg sync.WaitGroup
+	for w := 0; w < threads; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := append([]byte(nil), message...)
+			rest := msg[prefixLength:]
+			h := sha256.New()
+			restore := h.(encoding.BinaryUnmarshaler)
+			var sum [sha256.Size]byte
+			digitBuf := make([]byte, 0, 64)
+
+			for !done.Load() {
+				if err := cpuHalted(deadline, stop); err != nil {
+					halt.CompareAndSwap(nil, err)
+					done.Store(true)
+					return
+				}
+				start := next.Add(cpuChunk) - cpuChunk
+				if start > last {
+					return
+				}
+				end := min(start+cpuChunk-1, last)
+				for nonce := start; nonce <= end; nonce++ {
+					copy(msg[offset:], alphabet.appendNonce(digitBuf[:0], nonce))
+					restore.UnmarshalBinary(state)
+					h.Write(rest)
+					h.Sum(sum[:0])
+					if leadingZeroBits(sum) < difficulty {
+						continue
+					}
+					mu.Lock()
+					if !found || nonce < best {
+						best, found = nonce, true
+					}
+					mu.Unlock()
+					done.Store(true)
+					end = nonce
+					break
+				}
+				attempts.Add(int64(end - start + 1))
+			}
+		}()
+	}
+	wg.Wait()
+	if !found {
+		if err, ok := halt.Load().(error); ok {
+			return 0, false, err
+		}
+	}
+	return best, found, nil
+}
+
+// cpuHalted returns why a CPU search has to stop early, if it does
+func cpuHalted(deadline time.Time, stop <-chan struct{}) error {
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return fmt.Errorf("no nonce found before the deadline")
+	}
+	select {
+	case <-stop:
+		return fmt.Errorf("stopped")
+	default:
+		return nil
+	}
+}
+
+// defaultCPUBelow is the -cpu-below threshold used in auto mode when no GPU
+// rate has been recorded to compare the CPU against
+const defaultCPUBelow = 12
+
+// assumedDeviceSetup is the device setup time assumed for rates recorded
+// before setup times were
+const assumedDeviceSetup = 1.0
+
+// cpuProbeChunks is how many chunks per thread the CPU probe hashes, a few
+// tens of milliseconds of work
+const cpuProbeChunks = 8
+
+// parseCPUBelow parses -cpu-below: "auto", or the highest difficulty mined on
+// the CPU (-1 for never)
+func parseCPUBelow(value string) (auto bool, below int, err error) {
+	if value == "auto" {
+		return true, 0, nil
+	}
+	below, err = strconv.Atoi(value)
+	if err != nil || below < -1 {
+		return false, 0, fmt.Errorf("invalid value %q (use auto, a difficulty, or -1)", value)
+	}
+	return false, below, nil
+}
+
+// probeCPURate measures the CPU miner's rate by hashing a typical event with
+// a target no hash reaches
+func probeCPURate(threads int) float64 {
+	message := []byte(`[0,"` + strings.Repeat("ab", 32) + `",1700000000,1,[["nonce","1000000000","16"]],"` + strings.Repeat("x", 200) + `"]`)
+	offset := findNonceOffset(message, "1000000000")
+	count := uint64(threads * cpuChunk * cpuProbeChunks)
+	var attempts atomic.Int64
+	start := time.Now()
+	if _, _, err := searchOnCPU(message, offset, decimalAlphabet, 1000000000, 1000000000+count-1, sha256.Size*8+1, threads, time.Time{}, nil, &attempts); err != nil {
+		return 0
+	}
+	return float64(attempts.Load()) / time.Since(start).Seconds()
+}
+
+// cpuRate returns the CPU miner's rate with threads workers, from the tuning
+// cache or, if it has none for that many threads, a probe that is then cached
+func cpuRate(cache *tuningCache, threads int) float64 {
+	if cache.CPU != nil && cache.CPU.Threads == threads && cache.CPU.HashRate > 0 {
+		return cache.CPU.HashRate
+	}
+	rate := probeCPURate(threads)
+	vlog("CPU probe: %.2f MH/s on %d threads", rate/1e6, threads)
+	if rate > 0 {
+		cache.recordCPURate(rate, threads)
+		if err := cache.save(); err != nil {
+			vlog("Warning: Failed to save tuning cache: %v", err)
+		}
+	}
+	return rate
+}
+
+// preferCPU decides for -cpu-below auto whether the CPU is expected to find a
+// nonce sooner than the fastest device in the tuning cache, counting the
+// device's setup time (OpenCL initialization, kernel build and self-test)
+// recorded with its rate. Without a recorded device rate it falls back to
+// mining difficulties up to defaultCPUBelow on the CPU.
+func preferCPU(difficulty, threads int) bool {
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	cache := loadTuningCache()
+	gpu := cache.fastestKernel()
+	if gpu == nil {
+		vlog("No device hash rate recorded yet; mining difficulty up to %d on the CPU", defaultCPUBelow)
+		return difficulty <= defaultCPUBelow
+	}
+	cpu := cpuRate(cache, threads)
+	if cpu <= 0 {
+		return false
+	}
+
+	setup := gpu.Startup
+	if setup <= 0 {
+		setup = assumedDeviceSetup
+	}
+	expected := math.Ldexp(1, difficulty)
+	cpuTime := expected / cpu
+	gpuTime := setup + expected/gpu.HashRate
+	vlog("Expected time to a nonce: CPU %.3gs (%.2f MH/s), device %.3gs (%.2f MH/s after %.2fs setup)",
+		cpuTime, cpu/1e6, gpuTime, gpu.HashRate/1e6, setup)
+	return cpuTime <= gpuTime
+}
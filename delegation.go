@@ -0,0 +1,145 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// parseDelegationTag parses a -delegation value of the form
+// "<delegator pubkey>:<conditions>:<token>" into a NIP-26 delegation tag
+func parseDelegationTag(input string) (nostr.Tag, error) {
+	parts := strings.Split(input, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("expected <delegator pubkey>:<conditions>:<token>")
+	}
+	delegator, conditions, token := parts[0], parts[1], parts[2]
+
+	if b, err := hex.DecodeString(delegator); err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("delegator pubkey must be 64 hex characters")
+	}
+	if b, err := hex.DecodeString(token); err != nil || len(b) != 64 {
+		return nil, fmt.Errorf("delegation token must be 128 hex characters")
+	}
+	if conditions == "" {
+		return nil, fmt.Errorf("empty delegation conditions")
+	}
+	return nostr.Tag{"delegation", delegator, conditions, token}, nil
+}
+
+// addDelegationTag puts the delegation tag on the event, replacing any existing
+// one in place, and checks that the token is valid for the event's pubkey
+// (the delegatee) and that the event's kind and created_at meet its conditions.
+// The tag is part of the serialized event, so it is covered by the nonce
+// search and by every validation copy.
+func addDelegationTag(event *nostr.Event, tag nostr.Tag) error {
+	replaced := false
+	tags := make(nostr.Tags, 0, len(event.Tags)+1)
+	for _, t := range event.Tags {
+		if len(t) > 0 && t[0] == "delegation" {
+			if !replaced {
+				tags = append(tags, tag)
+				replaced = true
+			}
+			continue
+		}
+		tags = append(tags, t)
+	}
+	if !replaced {
+		tags = append(tags, tag)
+	}
+	event.Tags = tags
+	return checkDelegation(event)
+}
+
+// checkDelegation verifies the event's delegation tag, if any, against its
+// pubkey, kind and created_at
+func checkDelegation(event *nostr.Event) error {
+	tag := event.Tags.Find("delegation")
+	if tag == nil {
+		return nil
+	}
+	if len(tag) != 4 {
+		return fmt.Errorf("delegation tag must have 4 elements, has %d", len(tag))
+	}
+	delegator, conditions, token := tag[1], tag[2], tag[3]
+
+	if err := checkDelegationConditions(event, conditions); err != nil {
+		return err
+	}
+
+	// NIP-26: the token is the delegator's signature of the sha256 of
+	// "nostr:delegation:<delegatee pubkey>:<conditions>"
+	pk, err := hex.DecodeString(delegator)
+	if err != nil {
+		return fmt.Errorf("delegator pubkey %q is invalid hex: %v", delegator, err)
+	}
+	pubkey, err := schnorr.ParsePubKey(pk)
+	if err != nil {
+		return fmt.Errorf("failed to parse delegator pubkey: %v", err)
+	}
+	s, err := hex.DecodeString(token)
+	if err != nil {
+		return fmt.Errorf("delegation token is invalid hex: %v", err)
+	}
+	sig, err := schnorr.ParseSignature(s)
+	if err != nil {
+		return fmt.Errorf("failed to parse delegation token: %v", err)
+	}
+	hash := sha256.Sum256([]byte("nostr:delegation:" + event.PubKey + ":" + conditions))
+	if !sig.Verify(hash[:], pubkey) {
+		return fmt.Errorf("delegation token is not valid for pubkey %s", event.PubKey)
+	}
+	return nil
+}
+
+// checkDelegationConditions checks the event against a NIP-26 conditions
+// query string: "kind=" conditions, of which the event's kind must match one
+// if there are any, and "created_at<" and "created_at>" bounds, which are
+// strict
+func checkDelegationConditions(event *nostr.Event, conditions string) error {
+	var kinds []int
+	for _, condition := range strings.Split(conditions, "&") {
+		var key, op, value string
+		switch {
+		case strings.HasPrefix(condition, "kind="):
+			key, op, value = "kind", "=", condition[len("kind="):]
+		case strings.HasPrefix(condition, "created_at<"):
+			key, op, value = "created_at", "<", condition[len("created_at<"):]
+		case strings.HasPrefix(condition, "created_at>"):
+			key, op, value = "created_at", ">", condition[len("created_at>"):]
+		default:
+			return fmt.Errorf("unsupported delegation condition %q", condition)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid delegation condition %q: %v", condition, err)
+		}
+		switch {
+		case key == "kind":
+			kinds = append(kinds, int(n))
+		case op == "<" && int64(event.CreatedAt) >= n:
+			return fmt.Errorf("created_at %d does not meet delegation condition %s", event.CreatedAt, condition)
+		case op == ">" && int64(event.CreatedAt) <= n:
+			return fmt.Errorf("created_at %d does not meet delegation condition %s", event.CreatedAt, condition)
+		}
+	}
+	if len(kinds) == 0 {
+		return nil
+	}
+	for _, kind := range kinds {
+		if event.Kind == kind {
+			return nil
+		}
+	}
+	return fmt.Errorf("kind %d does not meet delegation conditions %s", event.Kind, conditions)
+}
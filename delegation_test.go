@@ -0,0 +1,99 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCheckDelegationConditions(t *testing.T) {
+	event := &nostr.Event{Kind: 1, CreatedAt: 1700000000}
+	tests := []struct {
+		conditions string
+		wantErr    bool
+	}{
+		{"kind=1", false},
+		{"kind=0&kind=1", false},
+		{"kind=7", true},
+		{"kind=0&kind=7", true},
+		{"created_at<1700000001", false},
+		{"created_at<1700000000", true},
+		{"created_at>1699999999", false},
+		{"created_at>1700000000", true},
+		{"kind=1&created_at>1600000000&created_at<1800000000", false},
+		{"kind=1&created_at>1700000000&created_at<1800000000", true},
+		{"kind=2&created_at>1600000000&created_at<1800000000", true},
+		{"kind!=1", true},
+		{"created_at=1700000000", true},
+		{"kind=x", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.conditions, func(t *testing.T) {
+			err := checkDelegationConditions(event, tt.conditions)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkDelegationConditions(%q) error = %v, wantErr %v", tt.conditions, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckDelegationToken(t *testing.T) {
+	delegator, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{1}, 32))
+	delegatee, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{2}, 32))
+	delegatorHex := hex.EncodeToString(schnorr.SerializePubKey(delegator.PubKey()))
+	delegateeHex := hex.EncodeToString(schnorr.SerializePubKey(delegatee.PubKey()))
+	conditions := "kind=1&created_at<1800000000"
+	sign := func(pubkey, conditions string) string {
+		hash := sha256.Sum256([]byte("nostr:delegation:" + pubkey + ":" + conditions))
+		sig, err := schnorr.Sign(delegator, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hex.EncodeToString(sig.Serialize())
+	}
+	token := sign(delegateeHex, conditions)
+
+	tests := []struct {
+		name    string
+		pubkey  string
+		kind    int
+		tag     nostr.Tag
+		wantErr bool
+	}{
+		{"valid", delegateeHex, 1, nostr.Tag{"delegation", delegatorHex, conditions, token}, false},
+		{"other delegatee", delegatorHex, 1, nostr.Tag{"delegation", delegatorHex, conditions, token}, true},
+		{"conditions not met", delegateeHex, 7, nostr.Tag{"delegation", delegatorHex, conditions, token}, true},
+		{"conditions changed", delegateeHex, 1, nostr.Tag{"delegation", delegatorHex, "kind=1", token}, true},
+		{"token for other conditions", delegateeHex, 1, nostr.Tag{"delegation", delegatorHex, "kind=1", token}, true},
+		{"short tag", delegateeHex, 1, nostr.Tag{"delegation", delegatorHex, conditions}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &nostr.Event{PubKey: tt.pubkey, Kind: tt.kind, CreatedAt: 1700000000}
+			err := addDelegationTag(event, tt.tag)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("addDelegationTag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The tag replaces an existing delegation tag in place
+	event := &nostr.Event{PubKey: delegateeHex, Kind: 1, CreatedAt: 1700000000,
+		Tags: nostr.Tags{{"delegation", "old"}, {"t", "x"}, {"delegation", "older"}}}
+	if err := addDelegationTag(event, nostr.Tag{"delegation", delegatorHex, conditions, token}); err != nil {
+		t.Fatal(err)
+	}
+	if len(event.Tags) != 2 || event.Tags[0][1] != delegatorHex || event.Tags[1][0] != "t" {
+		t.Errorf("tags after addDelegationTag = %v", event.Tags)
+	}
+}
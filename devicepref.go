@@ -0,0 +1,99 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// deviceCriteria are the criteria -device-prefer accepts. Each returns a score
+// where higher is preferred.
+var deviceCriteria = map[string]func(device *cl.Device) int64{
+	"discrete":    func(d *cl.Device) int64 { return boolScore(deviceClass(d) == "discrete GPU") },
+	"integrated":  func(d *cl.Device) int64 { return boolScore(deviceClass(d) == "integrated GPU") },
+	"gpu":         func(d *cl.Device) int64 { return boolScore(d.Type()&cl.DeviceTypeGPU != 0) },
+	"cpu":         func(d *cl.Device) int64 { return boolScore(d.Type()&cl.DeviceTypeCPU != 0) },
+	"accelerator": func(d *cl.Device) int64 { return boolScore(d.Type()&cl.DeviceTypeAccelerator != 0) },
+	"units":       func(d *cl.Device) int64 { return int64(d.MaxComputeUnits()) },
+	"memory":      func(d *cl.Device) int64 { return d.GlobalMemSize() },
+	"clock":       func(d *cl.Device) int64 { return int64(d.MaxClockFrequency()) },
+}
+
+func boolScore(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// deviceClass tells discrete from integrated GPUs by whether they share
+// memory with the host, which integrated GPUs report and discrete ones don't
+func deviceClass(device *cl.Device) string {
+	if device.Type()&cl.DeviceTypeGPU != 0 {
+		if device.HostUnifiedMemory() {
+			return "integrated GPU"
+		}
+		return "discrete GPU"
+	}
+	return deviceTypeName(device)
+}
+
+// devicePreference is -device-prefer: the criteria a device is picked by when
+// -device is not given, most important first. Devices equal on every
+// criterion are picked in -list-devices order.
+type devicePreference []string
+
+// defaultDevicePreference picks a discrete GPU over an integrated one over a
+// CPU, then the one with the most compute units, then the most memory. The
+// old rule, the first GPU in enumeration order, picked the integrated GPU on
+// laptops whose Intel platform is listed before the discrete GPU's.
+var defaultDevicePreference = devicePreference{"discrete", "integrated", "cpu", "units", "memory"}
+
+// autoSelect is the preference findDevice and mining pick devices by
+var autoSelect = append(devicePreference(nil), defaultDevicePreference...)
+
+func (p *devicePreference) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *devicePreference) Set(value string) error {
+	var criteria devicePreference
+	for _, criterion := range strings.Split(value, ",") {
+		criterion = strings.TrimSpace(criterion)
+		if _, ok := deviceCriteria[criterion]; !ok {
+			return fmt.Errorf("unknown device preference %q (use discrete, integrated, gpu, cpu, accelerator, units, memory or clock)", criterion)
+		}
+		criteria = append(criteria, criterion)
+	}
+	*p = criteria
+	return nil
+}
+
+// pick returns the index of the preferred device
+func (p devicePreference) pick(devices []*cl.Device) int {
+	best := 0
+	for i := 1; i < len(devices); i++ {
+		for _, criterion := range p {
+			score := deviceCriteria[criterion]
+			a, b := score(devices[i]), score(devices[best])
+			if a != b {
+				if a > b {
+					best = i
+				}
+				break
+			}
+		}
+	}
+	return best
+}
+
+// describeDevice summarizes what -device-prefer looks at in a device
+func describeDevice(device *cl.Device) string {
+	return fmt.Sprintf("%s, %d compute units, %d MB, %d MHz", deviceClass(device),
+		device.MaxComputeUnits(), device.GlobalMemSize()/(1024*1024), device.MaxClockFrequency())
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// deviceOptions holds per-device overrides of command-line settings.
+// Empty or zero values mean "not overridden".
+type deviceOptions struct {
+	Kernel         string
+	BatchSizePower int // -1 if not set
+	MemBudget      int64
+}
+
+// parseDeviceOptions parses a -device-opts value such as
+// "0:kernel=default,batch=1e6;1:kernel=nvidia,batch=1e7,mem=2G"
+// into overrides keyed by device index.
+func parseDeviceOptions(input string) (map[int]deviceOptions, error) {
+	opts := make(map[int]deviceOptions)
+	if strings.TrimSpace(input) == "" {
+		return opts, nil
+	}
+
+	for _, entry := range strings.Split(input, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		indexStr, settings, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid device options %q (expected <index>:<key>=<value>,...)", entry)
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(indexStr))
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid device index %q", indexStr)
+		}
+		if _, dup := opts[index]; dup {
+			return nil, fmt.Errorf("device %d has options listed twice", index)
+		}
+
+		o := deviceOptions{BatchSizePower: -1}
+		for _, setting := range strings.Split(settings, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("invalid setting %q for device %d (expected key=value)", setting, index)
+			}
+			switch key {
+			case "kernel":
+				o.Kernel = value
+			case "batch":
+				power, err := parseBatchSizePower(value)
+				if err != nil {
+					return nil, fmt.Errorf("device %d: %v", index, err)
+				}
+				o.BatchSizePower = power
+			case "mem":
+				budget, err := parseByteSize(value)
+				if err != nil {
+					return nil, fmt.Errorf("device %d: %v", index, err)
+				}
+				o.MemBudget = budget
+			default:
+				return nil, fmt.Errorf("unknown setting %q for device %d (use kernel, batch, or mem)", key, index)
+			}
+		}
+		opts[index] = o
+	}
+	return opts, nil
+}
+
+// parseBatchSizePower parses a batch size written as a power of 10, either in
+// full ("1000000") or in exponent form ("1e6"), and returns the exponent
+func parseBatchSizePower(value string) (int, error) {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid batch size %q", value)
+	}
+	power := int(math.Round(math.Log10(n)))
+	if math.Pow(10, float64(power)) != n {
+		return 0, fmt.Errorf("batch size %q must be a power of 10", value)
+	}
+	if power > 10 {
+		return 0, fmt.Errorf("batch size %q exceeds the maximum of 1e10", value)
+	}
+	return power, nil
+}
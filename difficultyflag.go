@@ -0,0 +1,81 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// difficultyFlag is -difficulty: a number of bits, or "time:30s" for the
+// highest difficulty expected to take at most that long at the device's
+// cached rate. Times are turned into bits by resolve once the device is known.
+type difficultyFlag struct {
+	bits       int
+	targetTime time.Duration // 0 when bits were given
+}
+
+func (f *difficultyFlag) String() string {
+	if f.targetTime > 0 {
+		return "time:" + f.targetTime.String()
+	}
+	return strconv.Itoa(f.bits)
+}
+
+func (f *difficultyFlag) Set(value string) error {
+	if spec, ok := strings.CutPrefix(value, "time:"); ok {
+		d, err := time.ParseDuration(spec)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid target time %q (use e.g. time:30s or time:5m)", spec)
+		}
+		f.targetTime = d
+		return nil
+	}
+	bits, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid difficulty %q (use a number of bits or time:<duration>)", value)
+	}
+	f.bits, f.targetTime = bits, 0
+	return nil
+}
+
+// difficultyForTime returns the highest difficulty whose expected attempts,
+// 2^difficulty, take at most t at rate nonces per second
+func difficultyForTime(rate float64, t time.Duration) int {
+	bits := int(math.Floor(math.Log2(rate * t.Seconds())))
+	return max(bits, 1)
+}
+
+// resolve turns a target time into bits using the rate recorded in the tuning
+// cache for the kernel on the device, or else the fastest rate recorded on
+// any device
+func (f *difficultyFlag) resolve(device *cl.Device, kernelType string) error {
+	if f.targetTime == 0 {
+		return nil
+	}
+	cache := loadTuningCache()
+	rate := cache.kernel(device, kernelType).HashRate
+	source := fmt.Sprintf("kernel %s on %s", kernelType, strings.TrimSpace(device.Name()))
+	if rate == 0 {
+		if fastest := cache.fastestKernel(); fastest != nil {
+			rate = fastest.HashRate
+			source = "the fastest device in the tuning cache"
+		}
+	}
+	if rate == 0 {
+		return fmt.Errorf("no hash rate recorded for %s; run -benchmark or mine once first", source)
+	}
+	f.bits = difficultyForTime(rate, f.targetTime)
+	expected := time.Duration(math.Ldexp(1, f.bits) / rate * float64(time.Second))
+	fmt.Fprintf(os.Stderr, "Difficulty %d for time:%s: expected %s at %.2fM nonces/s (%s)\n",
+		f.bits, f.targetTime, expected.Round(time.Millisecond), rate/1e6, source)
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// digitAnalysisDuration is how long -analyze-digits mines each nonce width
+const digitAnalysisDuration = time.Second
+
+// digitAnalysisMargin is how much faster than starting at the minimum width a
+// later start must be to be recommended
+const digitAnalysisMargin = 0.05
+
+// maxAnalysisDigits is the widest nonce -analyze-digits measures: the widest
+// whose nonces fit in an int64
+const maxAnalysisDigits = 18
+
+// digitAnalysis is what -analyze-digits needs to mine an event at each nonce
+// width the way the mining loop would
+type digitAnalysis struct {
+	event         nostr.Event // without the nonce tag
+	nonceTemplate nostr.Tag
+	prefix        string
+	position      int
+	minDigits     int
+	maxDigits     int
+	difficulty    int
+	batchSize     int
+}
+
+// widthRate is the measured rate at one nonce width
+type widthRate struct {
+	digits int
+	blocks int     // SHA-256 blocks hashed per nonce
+	rate   float64 // nonces per second, 0 if the width failed
+	err    error
+}
+
+// nonces returns how many nonces the width holds: the mining loop mines
+// 10^(digits-1) to 10^digits-1 at each width
+func (w widthRate) nonces() float64 {
+	return 9 * math.Pow(10, float64(w.digits-1))
+}
+
+// measure mines the event at one width for digitAnalysisDuration, in batches
+// of the mining loop's size, and returns the rate. Narrow widths hold fewer
+// nonces than a batch, so their launches are short and the rate shows it.
+func (a digitAnalysis) measure(session *clSession, digits int) widthRate {
+	w := widthRate{digits: digits}
+	base := int64(math.Pow(10, float64(digits-1)))
+	last := int64(math.Pow(10, float64(digits))) - 1
+	placeholder := a.prefix + fmt.Sprintf("%0*d", digits, base)
+
+	event := a.event
+	event.Tags = withNonceTag(a.event.Tags, nonceTagWithValue(a.nonceTemplate, placeholder), a.position)
+	serialized := event.Serialize()
+	w.blocks = sha256Blocks(len(serialized))
+	nonceOffset := findNonceOffset(serialized, placeholder)
+	if nonceOffset == -1 {
+		w.err = fmt.Errorf("could not find nonce placeholder in serialized event")
+		return w
+	}
+	if err := session.setInput(serialized, nonceOffset+len(a.prefix), digits, a.difficulty); err != nil {
+		w.err = err
+		return w
+	}
+
+	start := time.Now()
+	tested := int64(0)
+	for nonce := base; time.Since(start) < digitAnalysisDuration; {
+		n := int(min(int64(a.batchSize), last-nonce+1))
+		results, err := session.runBatch(uint64(nonce), n)
+		if err != nil {
+			w.err = err
+			return w
+		}
+		tested += int64(len(results))
+		if nonce += int64(n); nonce > last {
+			nonce = base
+		}
+	}
+	w.rate = float64(tested) / time.Since(start).Seconds()
+	return w
+}
+
+// expectedSearchTime returns the expected seconds to a hit when mining starts
+// at widths[0] and moves to the next width each time one is exhausted. Each
+// nonce hits with probability p = 2^-difficulty, so a width of n nonces is
+// left without a hit with probability (1-p)^n, and the nonces tested in it,
+// given it is reached, average (1-(1-p)^n)/p. Returns +Inf if a width that
+// may be reached could not be measured.
+func expectedSearchTime(widths []widthRate, difficulty int) float64 {
+	p := math.Ldexp(1, -difficulty)
+	logMiss := math.Log1p(-p)
+	reach, total := 1.0, 0.0
+	for _, w := range widths {
+		if reach < 1e-12 {
+			break
+		}
+		if w.rate <= 0 {
+			return math.Inf(1)
+		}
+		x := w.nonces() * logMiss
+		total += reach * -math.Expm1(x) / p / w.rate
+		reach *= math.Exp(x)
+	}
+	return total
+}
+
+// run measures every width and reports, for each starting width, the
+// expected time to a hit, and which start to use
+func (a digitAnalysis) run(w io.Writer, session *clSession) {
+	maxDigits := min(a.maxDigits, maxAnalysisDigits)
+	fmt.Fprintf(w, "Measuring nonce widths %d-%d at difficulty %d (%s each)...\n\n", a.minDigits, maxDigits, a.difficulty, digitAnalysisDuration)
+
+	var widths []widthRate
+	for digits := a.minDigits; digits <= maxDigits; digits++ {
+		widths = append(widths, a.measure(session, digits))
+	}
+
+	fmt.Fprintf(w, "%-7s %8s %6s %14s %16s\n", "Digits", "Nonces", "Blocks", "Rate", "Expected time")
+	fmt.Fprintf(w, "%-7s %8s %6s %14s %16s\n", "------", "------", "------", "----", "-------------")
+	best, bestTime := a.minDigits, math.Inf(1)
+	for i, width := range widths {
+		if width.err != nil {
+			fmt.Fprintf(w, "%-7d %8.0e %6d %14s %16s\n", width.digits, width.nonces(), width.blocks, "failed", "-")
+			vlog("%d-digit nonces failed: %v", width.digits, width.err)
+			continue
+		}
+		expected := expectedSearchTime(widths[i:], a.difficulty)
+		shown := "-"
+		if !math.IsInf(expected, 1) {
+			shown = formatSeconds(expected)
+		}
+		fmt.Fprintf(w, "%-7d %8.0e %6d %12.2fM/s %16s\n", width.digits, width.nonces(), width.blocks, width.rate/1e6, shown)
+		if expected < bestTime {
+			best, bestTime = width.digits, expected
+		}
+	}
+	fmt.Fprintf(w, "\n(Expected time: average time to a hit when mining starts at that width.)\n")
+
+	// The rates are measured, so a start that is barely faster is noise
+	minTime := expectedSearchTime(widths, a.difficulty)
+	if bestTime > minTime*(1-digitAnalysisMargin) {
+		best, bestTime = a.minDigits, minTime
+	}
+
+	switch {
+	case math.IsInf(bestTime, 1):
+		fmt.Fprintf(w, "No width could be measured\n")
+	case best == a.minDigits:
+		fmt.Fprintf(w, "Starting at the minimum width (%d digits) is as fast as any; keep the default\n", best)
+	case math.IsInf(minTime, 1):
+		fmt.Fprintf(w, "Recommended: -start-digits %d (expected %s; narrower widths failed)\n", best, formatSeconds(bestTime))
+	default:
+		fmt.Fprintf(w, "Recommended: -start-digits %d (expected %s, vs %s from %d digits)\n",
+			best, formatSeconds(bestTime), formatSeconds(minTime), a.minDigits)
+	}
+}
+
+// formatSeconds formats a duration in seconds for the -analyze-digits table
+func formatSeconds(seconds float64) string {
+	if seconds < 1 {
+		return fmt.Sprintf("%.0fms", seconds*1000)
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second / 10).String()
+}
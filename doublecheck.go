@@ -0,0 +1,134 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// checkedEvent holds the fields of an output event that its ID covers. It is
+// decoded with encoding/json rather than go-nostr so that -double-check reads
+// the output the way another client would.
+type checkedEvent struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+}
+
+// serializeNIP01 writes the array an event ID is the hash of, following the
+// rules of NIP-01 without going through go-nostr's serializer. NIP-01 lists
+// the escapes for newline, double quote, backslash, carriage return, tab,
+// backspace and form feed; other control characters are written as \u00xx,
+// as JSON requires, and everything else is copied verbatim.
+func serializeNIP01(e checkedEvent) []byte {
+	var b bytes.Buffer
+	b.WriteString(`[0,`)
+	writeNIP01String(&b, e.PubKey)
+	b.WriteByte(',')
+	b.WriteString(strconv.FormatInt(e.CreatedAt, 10))
+	b.WriteByte(',')
+	b.WriteString(strconv.Itoa(e.Kind))
+	b.WriteString(`,[`)
+	for i, tag := range e.Tags {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('[')
+		for j, element := range tag {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			writeNIP01String(&b, element)
+		}
+		b.WriteByte(']')
+	}
+	b.WriteString(`],`)
+	writeNIP01String(&b, e.Content)
+	b.WriteByte(']')
+	return b.Bytes()
+}
+
+// writeNIP01String writes s as a JSON string escaped the NIP-01 way
+func writeNIP01String(b *bytes.Buffer, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\n':
+			b.WriteString(`\n`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if c < 0x20 {
+				fmt.Fprintf(b, `\u%04x`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+// doubleCheckOutput re-derives the ID of an event about to be written from
+// its JSON, with serializeNIP01 and a separate leading-zero count, and checks
+// it matches the event's id field and reaches difficulty (0 skips the
+// difficulty check, for targets other than NIP-13). The miner's own output
+// only ever goes through go-nostr's serializer, so a change in how a go-nostr
+// release serializes events would otherwise go unnoticed until relays or
+// clients computed a different ID.
+func doubleCheckOutput(eventJSON []byte, difficulty int) error {
+	var e checkedEvent
+	if err := json.Unmarshal(eventJSON, &e); err != nil {
+		return fmt.Errorf("failed to decode output event: %v", err)
+	}
+	serialized := serializeNIP01(e)
+	hash := sha256.Sum256(serialized)
+	if id := hex.EncodeToString(hash[:]); id != e.ID {
+		event := nostr.Event{PubKey: e.PubKey, CreatedAt: nostr.Timestamp(e.CreatedAt), Kind: e.Kind, Content: e.Content}
+		for _, tag := range e.Tags {
+			event.Tags = append(event.Tags, nostr.Tag(tag))
+		}
+		if theirs := event.Serialize(); !bytes.Equal(theirs, serialized) {
+			offset := 0
+			for offset < len(theirs) && offset < len(serialized) && theirs[offset] == serialized[offset] {
+				offset++
+			}
+			return fmt.Errorf("event ID %s does not match %s from an independent NIP-01 serialization; go-nostr's serialization differs from it at byte %d", e.ID, id, offset)
+		}
+		return fmt.Errorf("event ID %s does not match %s from an independent NIP-01 serialization", e.ID, id)
+	}
+
+	zeros := 0
+	for _, b := range hash {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	if zeros < difficulty {
+		return fmt.Errorf("event ID %s has %d leading zero bits, below the difficulty of %d", e.ID, zeros, difficulty)
+	}
+	return nil
+}
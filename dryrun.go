@@ -0,0 +1,95 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	cl "github.com/jgillich/go-opencl/cl"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// miningPlan describes what a mining run would do, for -dry-run
+type miningPlan struct {
+	event       nostr.Event // with the nonce tag holding placeholder
+	placeholder string
+
+	deviceIndex int
+	device      *cl.Device
+	kernel      string
+	kernelName  string
+	abi         kernelABI
+
+	batchSize  int
+	maxBatch   int // largest adapted batch, the results buffer size
+	minDigits  int
+	maxDigits  int
+	difficulty int
+	memBudget  int64
+	inputSize  int     // input buffer size at maxDigits
+	hashRate   float64 // nonces/s from the tuning cache, 0 if unknown
+}
+
+// printMiningPlan writes the -dry-run report
+func printMiningPlan(w io.Writer, plan miningPlan) {
+	serialized := string(plan.event.Serialize())
+	nonceOffset := findNonceOffset([]byte(serialized), plan.placeholder)
+
+	fmt.Fprintf(w, "Dry run: nothing will be mined\n\n")
+	fmt.Fprintf(w, "Event:       kind %d, %d tags, created_at %d\n", plan.event.Kind, len(plan.event.Tags), plan.event.CreatedAt)
+	fmt.Fprintf(w, "Serialized:  %s\n", highlightPlaceholder(w, serialized, nonceOffset, len(plan.placeholder)))
+	fmt.Fprintf(w, "             %d bytes, nonce value %q at byte offset %d\n", len(serialized), plan.placeholder, nonceOffset)
+	fmt.Fprintf(w, "Device:      [%d] %s (%s)\n", plan.deviceIndex, plan.device.Name(), plan.device.Vendor())
+	fmt.Fprintf(w, "Kernel:      %s (function %s, %s)\n", plan.kernel, plan.kernelName, plan.abi)
+	if err := plan.abi.checkEventFits(plan.inputSize, plan.maxDigits); err != nil {
+		fmt.Fprintf(w, "Warning:     %v\n", err)
+	}
+	if plan.maxBatch > plan.batchSize {
+		fmt.Fprintf(w, "Batch size:  %d nonces, adapted up to %d to keep batches at %s-%s\n",
+			plan.batchSize, plan.maxBatch, batchTargetMin, batchTargetMax)
+	} else {
+		fmt.Fprintf(w, "Batch size:  %d nonces\n", plan.batchSize)
+	}
+	fmt.Fprintf(w, "Nonce:       %d-%d digits (each extra digit adds one byte to the event)\n", plan.minDigits, plan.maxDigits)
+	fmt.Fprintf(w, "Memory:      %s results buffer + %d byte input buffer (budget %s, max allocation %s)\n",
+		formatByteSize(int64(max(plan.batchSize, plan.maxBatch))*resultSize), plan.inputSize,
+		formatByteSize(memBudgetOrDevice(plan.device, plan.memBudget)), formatByteSize(plan.device.MaxMemAllocSize()))
+
+	expected := math.Pow(2, float64(plan.difficulty))
+	fmt.Fprintf(w, "Difficulty:  %d bits, %.0f hashes expected\n", plan.difficulty, expected)
+	if plan.hashRate > 0 {
+		eta := time.Duration(expected / plan.hashRate * float64(time.Second))
+		fmt.Fprintf(w, "Estimate:    %s at %.0f nonces/s (rate from the last run with this device and kernel)\n",
+			eta.Round(time.Second), plan.hashRate)
+	} else {
+		fmt.Fprintf(w, "Estimate:    unknown (no recorded rate for this device and kernel; it is saved after the first run)\n")
+	}
+}
+
+// highlightPlaceholder marks the nonce placeholder in the serialized event:
+// reverse video on a terminal, brackets otherwise
+func highlightPlaceholder(w io.Writer, serialized string, offset, length int) string {
+	if offset < 0 {
+		return serialized
+	}
+	start, end := ">>>", "<<<"
+	if f, ok := w.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			start, end = "\x1b[7m", "\x1b[0m"
+		}
+	}
+	var b strings.Builder
+	b.WriteString(serialized[:offset])
+	b.WriteString(start)
+	b.WriteString(serialized[offset : offset+length])
+	b.WriteString(end)
+	b.WriteString(serialized[offset+length:])
+	return b.String()
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// parseInputEvent parses the event to mine. Kind 0 metadata whose content is
+// a JSON object rather than the string NIP-01 requires, which some clients
+// and scripts produce, is encoded into a string with a warning; other
+// malformed fields get an error naming the field instead of the decoder's.
+func parseInputEvent(data []byte) (nostr.Event, []string, error) {
+	var event nostr.Event
+	err := json.Unmarshal(data, &event)
+	if err == nil {
+		return event, nil, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return event, nil, err
+	}
+	var warnings []string
+	if content, ok := fields["content"]; ok && !isJSONString(content) {
+		var kind int
+		json.Unmarshal(fields["kind"], &kind)
+		trimmed := bytes.TrimSpace(content)
+		if kind != 0 || len(trimmed) == 0 || trimmed[0] != '{' {
+			return event, nil, fmt.Errorf("content must be a string, got %s", trimmed)
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, trimmed); err != nil {
+			return event, nil, fmt.Errorf("content: %v", err)
+		}
+		encoded, _ := json.Marshal(compact.String())
+		fields["content"] = encoded
+		warnings = append(warnings, "Kind 0 content was a JSON object; mining it encoded as a string, as NIP-01 requires")
+	}
+	if tags, ok := fields["tags"]; ok {
+		var parsed []json.RawMessage
+		if json.Unmarshal(tags, &parsed) != nil && !bytes.Equal(bytes.TrimSpace(tags), []byte("null")) {
+			return event, nil, fmt.Errorf("tags must be an array of tags")
+		}
+		for i, tag := range parsed {
+			var elements []json.RawMessage
+			if json.Unmarshal(tag, &elements) != nil {
+				return event, nil, fmt.Errorf("tag %d must be an array of strings, got %s", i, tag)
+			}
+			for j, element := range elements {
+				if !isJSONString(element) {
+					return event, nil, fmt.Errorf("tag %d element %d must be a string, got %s", i, j, element)
+				}
+			}
+		}
+	}
+
+	fixed, _ := json.Marshal(fields)
+	if err := json.Unmarshal(fixed, &event); err != nil {
+		return event, nil, err
+	}
+	return event, warnings, nil
+}
+
+// isJSONString reports whether a raw JSON value is a string
+func isJSONString(raw json.RawMessage) bool {
+	var s string
+	return json.Unmarshal(raw, &s) == nil
+}
+
+// eventShapeWarnings returns warnings about input that mines fine but whose
+// proof of work is likely lost or pointless afterwards
+func eventShapeWarnings(event nostr.Event) []string {
+	var warnings []string
+	if event.PubKey == "" {
+		warnings = append(warnings, "Event has no pubkey; signing it sets one and changes the ID, so the proof of work would be lost. Set the pubkey before mining")
+	} else if b, err := hex.DecodeString(event.PubKey); err != nil || len(b) != 32 || hex.EncodeToString(b) != event.PubKey {
+		warnings = append(warnings, fmt.Sprintf("Pubkey %q is not 64 lowercase hex characters; relays will reject the event", event.PubKey))
+	}
+	if event.CreatedAt == 0 {
+		warnings = append(warnings, "Event has no created_at; a signer that fills it in changes the ID, so the proof of work would be lost. Set created_at before mining")
+	}
+	if event.Kind == 0 {
+		var metadata map[string]interface{}
+		if json.Unmarshal([]byte(event.Content), &metadata) != nil {
+			warnings = append(warnings, "Kind 0 content is not a JSON object; clients will not be able to read this metadata")
+		}
+	}
+	if nostr.IsEphemeralKind(event.Kind) {
+		vlog("Kind %d is ephemeral: relays forward it without storing it, so its proof of work only counts when it is published", event.Kind)
+	}
+	return warnings
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateWindows are the time constants of the smoothed hash rates, as in the
+// load averages of Unix: short enough to show throttling within seconds, long
+// enough to show the sustained rate
+var rateWindows = [3]time.Duration{10 * time.Second, time.Minute, 15 * time.Minute}
+
+// rateMeter keeps exponentially weighted moving averages of a counter's rate,
+// one per rateWindows entry. It is fed the running total and may be read from
+// other goroutines.
+type rateMeter struct {
+	mu     sync.Mutex
+	last   int64
+	lastAt time.Time
+	ewma   [3]float64
+	// weight is how much of each average has been filled by samples; dividing
+	// by it keeps the averages from starting at 0 and creeping up for the
+	// first window
+	weight [3]float64
+}
+
+// update records the counter's total at time now
+func (m *rateMeter) update(total int64, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lastAt.IsZero() {
+		m.last, m.lastAt = total, now
+		return
+	}
+	dt := now.Sub(m.lastAt).Seconds()
+	if dt <= 0 {
+		return
+	}
+	rate := float64(total-m.last) / dt
+	for i, window := range rateWindows {
+		alpha := 1 - math.Exp(-dt/window.Seconds())
+		m.ewma[i] += alpha * (rate - m.ewma[i])
+		m.weight[i] += alpha * (1 - m.weight[i])
+	}
+	m.last, m.lastAt = total, now
+}
+
+// skip leaves out d of the time since the last update, such as time the
+// machine slept, so the next update doesn't average it in
+func (m *rateMeter) skip(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.lastAt.IsZero() {
+		m.lastAt = m.lastAt.Add(d)
+	}
+}
+
+// rates returns the averages in units per second, shortest window first; 0
+// until two updates have been recorded
+func (m *rateMeter) rates() [3]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var rates [3]float64
+	for i := range rates {
+		if m.weight[i] > 0 {
+			rates[i] = m.ewma[i] / m.weight[i]
+		}
+	}
+	return rates
+}
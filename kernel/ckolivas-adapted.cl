@@ -36,6 +36,9 @@
  * SUCH DAMAGE.
  */
 
+// NIP13-KERNEL-ABI: 1
+// NIP13-KERNEL-CAPS: max_serialized_length=2039 max_nonce_digits=22
+
 // SHA256 constants from ckolivas
 __constant uint K[] = {
   0x428a2f98U, 0x71374491U, 0xb5c0fbcfU, 0xe9b5dba5U,
@@ -158,7 +161,8 @@ void sha256_generic(uchar* input, int input_length, uchar output[32]) {
     };
     
     // Process input in 512-bit (64-byte) blocks
-    int num_blocks = (input_length + 9) / 64 + 1; // +9 for padding, +1 for length block
+    // Message + 0x80 + 64-bit length, rounded up to whole blocks
+    int num_blocks = (input_length + 72) / 64;
     int total_length = num_blocks * 64;
     
     uchar padded[2048]; // Max 2KB
@@ -205,7 +209,14 @@ void sha256_generic(uchar* input, int input_length, uchar output[32]) {
     }
 }
 
-__kernel void mine_nonce(
+// -tune's vector width: a hint to compilers that vectorize across work items
+#ifdef NIP13_VEC_TYPE
+#define NIP13_VEC_HINT __attribute__((vec_type_hint(NIP13_VEC_TYPE)))
+#else
+#define NIP13_VEC_HINT
+#endif
+
+__kernel NIP13_VEC_HINT void mine_nonce(
     __global uchar* base_serialized,
     int serialized_length,
     int nonce_offset,
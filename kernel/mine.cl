@@ -4,6 +4,9 @@
 //
 // NIP-13 Mining Kernel
 // Mines nonces in parallel to find event IDs with required leading zero bits
+//
+// NIP13-KERNEL-ABI: 1
+// NIP13-KERNEL-CAPS: max_serialized_length=2048 max_nonce_digits=22
 
 #define ROTRIGHT(a,b) (((a) >> (b)) | ((a) << (32-(b))))
 
@@ -187,7 +190,14 @@ int count_leading_zero_bits(uchar hash[32]) {
     return count;
 }
 
-__kernel void mine_nonce(
+// -tune's vector width: a hint to compilers that vectorize across work items
+#ifdef NIP13_VEC_TYPE
+#define NIP13_VEC_HINT __attribute__((vec_type_hint(NIP13_VEC_TYPE)))
+#else
+#define NIP13_VEC_HINT
+#endif
+
+__kernel NIP13_VEC_HINT void mine_nonce(
     __global uchar* base_serialized,  // Base serialized event with placeholder nonce
     int serialized_length,             // Length of serialized event
     int nonce_offset,                  // Byte position where nonce starts in string
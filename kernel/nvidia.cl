@@ -0,0 +1,244 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+//
+// NIP-13 Mining Kernel for NVIDIA GPUs
+// Mines nonces in parallel to find event IDs with required leading zero bits
+//
+// Differences from mine.cl:
+// - Rotations are funnel shifts (SHF.R.WRAP) and Ch/Maj/three-way XOR are
+//   single ternary logic ops (LOP3.LUT). With NVIDIA's compiler these are
+//   emitted as inline PTX; elsewhere the same expressions are written so
+//   that the optimizer can fuse them
+// - Reads message words straight from global memory and patches the nonce
+//   digits in on the fly instead of copying the event to private memory
+// - Uses a rolling 16-word message schedule to keep register pressure low
+//
+// Define NV_NO_INLINE_PTX to disable the inline PTX path. It is also disabled
+// for OpenCL 1.1 builds (NIP13_CL11), as those GPUs predate LOP3 and SHF.
+//
+// NIP13-KERNEL-ABI: 1
+// NIP13-KERNEL-CAPS: max_nonce_digits=22
+
+#if defined(cl_nv_pragma_unroll) && !defined(NV_NO_INLINE_PTX) && !defined(NIP13_CL11)
+inline uint rotr32(uint x, uint n) {
+    uint r;
+    asm("shf.r.wrap.b32 %0, %1, %1, %2;" : "=r"(r) : "r"(x), "r"(n));
+    return r;
+}
+inline uint lop3_ch(uint x, uint y, uint z) {
+    uint r;
+    asm("lop3.b32 %0, %1, %2, %3, 0xCA;" : "=r"(r) : "r"(x), "r"(y), "r"(z));
+    return r;
+}
+inline uint lop3_maj(uint x, uint y, uint z) {
+    uint r;
+    asm("lop3.b32 %0, %1, %2, %3, 0xE8;" : "=r"(r) : "r"(x), "r"(y), "r"(z));
+    return r;
+}
+inline uint lop3_xor3(uint x, uint y, uint z) {
+    uint r;
+    asm("lop3.b32 %0, %1, %2, %3, 0x96;" : "=r"(r) : "r"(x), "r"(y), "r"(z));
+    return r;
+}
+#define ROTR(x, n) rotr32((x), (uint)(n))
+#define CH(x, y, z) lop3_ch((x), (y), (z))
+#define MAJ(x, y, z) lop3_maj((x), (y), (z))
+#define XOR3(x, y, z) lop3_xor3((x), (y), (z))
+#else
+#define ROTR(x, n) rotate((x), (uint)(32 - (n)))
+#define CH(x, y, z) bitselect((z), (y), (x))
+#define MAJ(x, y, z) bitselect((x), (y), ((x) ^ (z)))
+#define XOR3(x, y, z) ((x) ^ (y) ^ (z))
+#endif
+
+#define EP0(x) XOR3(ROTR(x, 2), ROTR(x, 13), ROTR(x, 22))
+#define EP1(x) XOR3(ROTR(x, 6), ROTR(x, 11), ROTR(x, 25))
+#define SIG0(x) XOR3(ROTR(x, 7), ROTR(x, 18), ((x) >> 3))
+#define SIG1(x) XOR3(ROTR(x, 17), ROTR(x, 19), ((x) >> 10))
+
+// SHA256 constants
+__constant uint K[64] = {
+    0x428a2f98U, 0x71374491U, 0xb5c0fbcfU, 0xe9b5dba5U,
+    0x3956c25bU, 0x59f111f1U, 0x923f82a4U, 0xab1c5ed5U,
+    0xd807aa98U, 0x12835b01U, 0x243185beU, 0x550c7dc3U,
+    0x72be5d74U, 0x80deb1feU, 0x9bdc06a7U, 0xc19bf174U,
+    0xe49b69c1U, 0xefbe4786U, 0x0fc19dc6U, 0x240ca1ccU,
+    0x2de92c6fU, 0x4a7484aaU, 0x5cb0a9dcU, 0x76f988daU,
+    0x983e5152U, 0xa831c66dU, 0xb00327c8U, 0xbf597fc7U,
+    0xc6e00bf3U, 0xd5a79147U, 0x06ca6351U, 0x14292967U,
+    0x27b70a85U, 0x2e1b2138U, 0x4d2c6dfcU, 0x53380d13U,
+    0x650a7354U, 0x766a0abbU, 0x81c2c92eU, 0x92722c85U,
+    0xa2bfe8a1U, 0xa81a664bU, 0xc24b8b70U, 0xc76c51a3U,
+    0xd192e819U, 0xd6990624U, 0xf40e3585U, 0x106aa070U,
+    0x19a4c116U, 0x1e376c08U, 0x2748774cU, 0x34b0bcb5U,
+    0x391c0cb3U, 0x4ed8aa4aU, 0x5b9cca4fU, 0x682e6ff3U,
+    0x748f82eeU, 0x78a5636fU, 0x84c87814U, 0x8cc70208U,
+    0x90befffaU, 0xa4506cebU, 0xbef9a3f7U, 0xc67178f2U
+};
+
+// Convert integer to N-digit decimal ASCII string (zero-padded)
+void int_to_ascii(ulong n, uchar str[], int num_digits) {
+    for (int i = num_digits - 1; i >= 0; i--) {
+        str[i] = '0' + (n % 10);
+        n /= 10;
+    }
+}
+
+// Return big-endian word widx of the padded message, with the nonce digits
+// substituted and the 0x80 padding byte applied. The length words of the
+// final block are filled in by the caller.
+uint message_word(__global const uchar* msg, int len, int widx,
+                  int nonce_offset, int num_digits, const uchar* digits) {
+    int p = widx * 4;
+
+    // Fast path: the whole word is message data outside the nonce
+    if (p + 3 < len && (p + 3 < nonce_offset || p >= nonce_offset + num_digits)) {
+        return ((uint)msg[p] << 24) | ((uint)msg[p + 1] << 16) |
+               ((uint)msg[p + 2] << 8) | ((uint)msg[p + 3]);
+    }
+
+    uint w = 0;
+    for (int j = 0; j < 4; j++, p++) {
+        uint c = 0;
+        if (p < len) {
+            if (p >= nonce_offset && p < nonce_offset + num_digits) {
+                c = digits[p - nonce_offset];
+            } else {
+                c = msg[p];
+            }
+        } else if (p == len) {
+            c = 0x80;
+        }
+        w = (w << 8) | c;
+    }
+    return w;
+}
+
+// Process a single 512-bit block with a rolling 16-word schedule
+void sha256_compress(uint state[8], uint w[16]) {
+    uint a = state[0];
+    uint b = state[1];
+    uint c = state[2];
+    uint d = state[3];
+    uint e = state[4];
+    uint f = state[5];
+    uint g = state[6];
+    uint h = state[7];
+
+#ifndef NIP13_CL11
+    #pragma unroll
+#endif
+    for (int i = 0; i < 64; i++) {
+        uint wi;
+        if (i < 16) {
+            wi = w[i];
+        } else {
+            wi = w[i & 15] + SIG1(w[(i - 2) & 15]) + w[(i - 7) & 15] + SIG0(w[(i - 15) & 15]);
+            w[i & 15] = wi;
+        }
+
+        uint temp1 = h + EP1(e) + CH(e, f, g) + K[i] + wi;
+        uint temp2 = EP0(a) + MAJ(a, b, c);
+
+        h = g;
+        g = f;
+        f = e;
+        e = d + temp1;
+        d = c;
+        c = b;
+        b = a;
+        a = temp1 + temp2;
+    }
+
+    state[0] += a;
+    state[1] += b;
+    state[2] += c;
+    state[3] += d;
+    state[4] += e;
+    state[5] += f;
+    state[6] += g;
+    state[7] += h;
+}
+
+// -tune's vector width: a hint to compilers that vectorize across work items
+#ifdef NIP13_VEC_TYPE
+#define NIP13_VEC_HINT __attribute__((vec_type_hint(NIP13_VEC_TYPE)))
+#else
+#define NIP13_VEC_HINT
+#endif
+
+__kernel NIP13_VEC_HINT void mine_nonce(
+    __global uchar* base_serialized,  // Base serialized event with placeholder nonce
+    int serialized_length,             // Length of serialized event
+    int nonce_offset,                  // Byte position where nonce starts in string
+    int difficulty,                    // Required leading zero bits
+    int base_nonce_low,                // Starting nonce value (low 32 bits)
+    int base_nonce_high,               // Starting nonce value (high 32 bits)
+    __global int* results,             // Output: index of valid nonce (-1 if not found)
+    int num_digits                     // Number of digits for nonce
+) {
+    int global_id = get_global_id(0);
+
+    // Reconstruct 64-bit base_nonce
+    ulong base_nonce = ((ulong)(uint)base_nonce_high << 32) | ((ulong)(uint)base_nonce_low);
+    ulong nonce = base_nonce + (ulong)global_id;
+
+    // Calculate maximum nonce value
+    ulong max_nonce = 0;
+    if (num_digits <= 19) {
+        max_nonce = 1;
+        for (int i = 0; i < num_digits; i++) {
+            max_nonce *= 10;
+        }
+        max_nonce -= 1;
+    } else {
+        max_nonce = 0xFFFFFFFFFFFFFFFFUL;
+    }
+
+    if (nonce > max_nonce || num_digits > 22) {
+        results[global_id] = -1;
+        return;
+    }
+
+    uchar digits[22];
+    int_to_ascii(nonce, digits, num_digits);
+
+    uint state[8] = {
+        0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+        0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19
+    };
+
+    // Message + 0x80 + 64-bit length, rounded up to whole blocks
+    int num_blocks = (serialized_length + 72) / 64;
+    ulong bit_length = (ulong)serialized_length * 8;
+
+    for (int block = 0; block < num_blocks; block++) {
+        uint w[16];
+        for (int i = 0; i < 16; i++) {
+            w[i] = message_word(base_serialized, serialized_length, block * 16 + i,
+                                nonce_offset, num_digits, digits);
+        }
+        if (block == num_blocks - 1) {
+            w[14] = (uint)(bit_length >> 32);
+            w[15] = (uint)bit_length;
+        }
+        sha256_compress(state, w);
+    }
+
+    // Count leading zero bits across the full 256-bit hash
+    int leading_zeros = 0;
+    for (int i = 0; i < 8; i++) {
+        if (state[i] != 0) {
+            leading_zeros += clz(state[i]);
+            break;
+        }
+        leading_zeros += 32;
+    }
+
+    if (leading_zeros >= difficulty) {
+        results[global_id] = global_id;
+    } else {
+        results[global_id] = -1;
+    }
+}
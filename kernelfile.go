@@ -0,0 +1,120 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// kernelFileType is the kernel type of a kernel loaded with -kernel-file. Its
+// source is read from kernelFilePath whenever it is built, so rebuilding picks
+// up edits.
+const kernelFileType = "file"
+
+// kernelFilePath is the -kernel-file being mined with, if any
+var kernelFilePath string
+
+// kernelFilePinned, while kernelFilePinnedSet, is the source readKernelFile
+// returns instead of reading the file, so one reload hashes, builds and
+// self-tests the same bytes however often the file is written meanwhile
+var (
+	kernelFilePinned    string
+	kernelFilePinnedSet bool
+)
+
+// kernelWatchInterval is how often -watch looks at the kernel file
+const kernelWatchInterval = 500 * time.Millisecond
+
+// readKernelFile returns the source of the -kernel-file kernel
+func readKernelFile() (string, error) {
+	if kernelFilePath == "" {
+		return "", fmt.Errorf("kernel %s needs -kernel-file", kernelFileType)
+	}
+	if kernelFilePinnedSet {
+		return kernelFilePinned, nil
+	}
+	data, err := os.ReadFile(kernelFilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read kernel file: %v", err)
+	}
+	return string(data), nil
+}
+
+// kernelWatcher notices when the kernel file is written, by its size and
+// modification time
+type kernelWatcher struct {
+	path      string
+	size      int64
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newKernelWatcher(path string) (*kernelWatcher, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &kernelWatcher{path: path, size: info.Size(), modTime: info.ModTime(), lastCheck: time.Now()}, nil
+}
+
+// changed reports whether the file was written since the last change it
+// reported. It is cheap to call every batch: the file is looked at once per
+// kernelWatchInterval. A file that is missing, as while an editor replaces
+// it, is not a change.
+func (w *kernelWatcher) changed() bool {
+	if time.Since(w.lastCheck) < kernelWatchInterval {
+		return false
+	}
+	w.lastCheck = time.Now()
+	info, err := os.Stat(w.path)
+	if err != nil || (info.Size() == w.size && info.ModTime().Equal(w.modTime)) {
+		return false
+	}
+	w.size, w.modTime = info.Size(), info.ModTime()
+	return true
+}
+
+// reloadKernelFile reads the kernel file once, builds it as a mining session
+// would be, with any tuned settings, self-tests that build and sets it up like
+// the session it replaces. The self-test result is recorded in the tuning
+// cache, as gateKernel does.
+func reloadKernelFile(device *cl.Device, queues, batchSize int) (*clSession, error) {
+	source, err := readKernelFile()
+	if err != nil {
+		return nil, err
+	}
+	kernelFilePinned, kernelFilePinnedSet = source, true
+	defer func() { kernelFilePinned, kernelFilePinnedSet = "", false }()
+
+	session, err := newMiningSession(device, kernelFileType)
+	if err != nil {
+		return nil, err
+	}
+	vlog("Running quick self-test for kernel %s on %s...", kernelFilePath, device.Name())
+	testErr := selfTestSession(session)
+	cache := loadTuningCache()
+	cache.recordSelfTest(device, kernelFileType, testErr)
+	if err := cache.save(); err != nil {
+		vlog("Warning: Failed to save tuning cache: %v", err)
+	}
+	if testErr != nil {
+		session.Release()
+		return nil, fmt.Errorf("failed self-test: %v", testErr)
+	}
+
+	if err := session.setQueues(queues); err != nil {
+		session.Release()
+		return nil, fmt.Errorf("failed to set up %d command queues: %v", queues, err)
+	}
+	if err := session.allocResults(batchSize); err != nil {
+		session.Release()
+		return nil, err
+	}
+	return session, nil
+}
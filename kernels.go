@@ -11,3 +11,15 @@ var mineKernelSource string
 
 //go:embed kernel/ckolivas-adapted.cl
 var ckolivasKernelSource string
+
+//go:embed kernel/amd.cl
+var amdKernelSource string
+
+//go:embed kernel/nvidia.cl
+var nvidiaKernelSource string
+
+//go:embed kernel/offset.cl
+var offsetKernelSource string
+
+//go:embed kernel/midstate.cl
+var midstateKernelSource string
@@ -0,0 +1,97 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ladderFloor is the lowest milestone reported. Lower milestones would be
+// reached within the first batch and only cost CPU validation time.
+const ladderFloor = 16
+
+// difficultyLadder writes intermediate results to a side file while mining
+// toward a higher target, so the best version found so far is always at hand.
+// The kernel is run at the next milestone's difficulty instead of the target,
+// and every hit is checked on the CPU.
+type difficultyLadder struct {
+	file   *os.File
+	step   int
+	target int
+	next   int       // lowest difficulty not yet written
+	pow    powTarget // scores candidates, as the kernel does
+}
+
+// openDifficultyLadder opens (appending to) the side file for milestones every
+// step bits below target, scoring candidates with pow
+func openDifficultyLadder(path string, step, target int, pow powTarget) (*difficultyLadder, error) {
+	if step < 1 {
+		return nil, fmt.Errorf("ladder step must be at least 1 bit, got %d", step)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	next := step
+	for next < ladderFloor {
+		next += step
+	}
+	return &difficultyLadder{file: file, step: step, target: target, next: next, pow: pow}, nil
+}
+
+// setTarget changes the target difficulty. Milestones already written stay in
+// the file.
+func (l *difficultyLadder) setTarget(target int) {
+	l.target = target
+}
+
+// kernelDifficulty is the difficulty the kernel should report hits at
+func (l *difficultyLadder) kernelDifficulty() int {
+	if l.next < l.target {
+		return l.next
+	}
+	return l.target
+}
+
+// record checks a candidate nonce on the CPU and, if it reaches the next
+// milestone but not the target, appends the event to the side file as one JSON
+// line and moves to the following milestone. It returns the candidate's
+// difficulty; candidates reaching the target are left to the caller.
+func (l *difficultyLadder) record(event *nostr.Event, nonceStr string) (int, error) {
+	milestone := *event
+	milestone.Tags = setNonceValue(event.Tags, nonceStr)
+	milestone.ID = milestone.GetID()
+	bits := eventScore(l.pow, milestone)
+	if bits < l.next || bits >= l.target {
+		return bits, nil
+	}
+
+	line, err := json.Marshal(milestone)
+	if err != nil {
+		return bits, err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return bits, err
+	}
+	if err := l.file.Sync(); err != nil {
+		return bits, err
+	}
+	vlog("Milestone: %d leading zero bits (nonce %s)", bits, nonceStr)
+
+	// Skip milestones this result already passed
+	for l.next <= bits {
+		l.next += l.step
+	}
+	return bits, nil
+}
+
+// Close closes the side file
+func (l *difficultyLadder) Close() error {
+	return l.file.Close()
+}
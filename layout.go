@@ -0,0 +1,56 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// nonceLayout describes where the nonce falls in an event's SHA-256 input
+type nonceLayout struct {
+	totalBlocks    int // blocks hashed for the whole event
+	perNonceBlocks int // blocks a midstate kernel hashes for each nonce
+}
+
+// layoutWithNonceTag returns the layout of an event with nonceTag inserted at
+// position (see withNonceTag)
+func layoutWithNonceTag(event nostr.Event, nonceTag nostr.Tag, position int) (nonceLayout, error) {
+	event.Tags = withNonceTag(event.Tags, nonceTag, position)
+	serialized := event.Serialize()
+	offset := findNonceOffset(serialized, nonceTag[1])
+	if offset == -1 {
+		return nonceLayout{}, fmt.Errorf("nonce tag not found in the serialized event")
+	}
+	total := sha256Blocks(len(serialized))
+	return nonceLayout{
+		totalBlocks:    total,
+		perNonceBlocks: total - midstatePrefixLength(offset)/sha256BlockSize,
+	}, nil
+}
+
+// reportLayout prints how moving the nonce tag from position to after all
+// other tags changes the number of blocks hashed per nonce
+func reportLayout(w io.Writer, event nostr.Event, nonceTag nostr.Tag, position int) error {
+	before, err := layoutWithNonceTag(event, nonceTag, position)
+	if err != nil {
+		return err
+	}
+	after, err := layoutWithNonceTag(event, nonceTag, nonceTagLast)
+	if err != nil {
+		return err
+	}
+	if after.perNonceBlocks == before.perNonceBlocks {
+		fmt.Fprintf(w, "Layout: nonce tag already as late as it can be; each nonce hashes %d of %d SHA-256 blocks\n",
+			after.perNonceBlocks, after.totalBlocks)
+		return nil
+	}
+	fmt.Fprintf(w, "Layout: moved the nonce tag after all other tags; each nonce hashes %d of %d SHA-256 blocks instead of %d (expected speedup %.1fx)\n",
+		after.perNonceBlocks, after.totalBlocks, before.perNonceBlocks,
+		float64(before.perNonceBlocks)/float64(after.perNonceBlocks))
+	return nil
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	cl "github.com/jgillich/go-opencl/cl"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// libOptions are the options the shared library's gnp_mine accepts as JSON.
+// Zero values pick what the command line would by default.
+type libOptions struct {
+	Device      int    `json:"device"`       // index in -list-devices order; -1 or absent auto-selects
+	Prefer      string `json:"prefer"`       // criteria to auto-select by, as -device-prefer; "" is its default
+	GPUOnly     bool   `json:"gpu_only"`     // fail rather than mine on anything but a GPU
+	Kernel      string `json:"kernel"`       // "" is auto
+	BatchSize   int    `json:"batch_size"`   // nonces per launch; 0 is 10^6 (10^4 on CPUs)
+	CPU         bool   `json:"cpu"`          // mine on the CPU without OpenCL
+	CPUThreads  int    `json:"cpu_threads"`  // 0 is one per CPU
+	NoncePrefix string `json:"nonce_prefix"` // goes before the nonce digits
+	Timeout     int    `json:"timeout_ms"`   // 0 is no limit
+}
+
+// libInputBytes bounds the serialized size of events when sizing the results
+// buffer for a stream of them; NIP-11 relays commonly cap events well below it
+const libInputBytes = 1 << 16
+
+// mineEvent mines an event to a difficulty without the command line: the
+// shared library's entry point. It does what a plain run does (lenient nonce
+// tag policy, nonce tag kept in place, committing to difficulty) and returns
+// the event with its nonce tag and ID set. Command-line features that need a
+// process of their own (APIs, caches, checkpoints, progress) are left out.
+func mineEvent(event nostr.Event, difficulty int, opts libOptions) (nostr.Event, error) {
+	if opts.CPU && opts.GPUOnly {
+		return event, fmt.Errorf("cpu and gpu_only exclude each other")
+	}
+	event, template, position, err := prepareLibEvent(event, difficulty, opts.NoncePrefix)
+	if err != nil {
+		return event, err
+	}
+	var deadline time.Time
+	if opts.Timeout > 0 {
+		deadline = time.Now().Add(time.Duration(opts.Timeout) * time.Millisecond)
+	}
+	if opts.CPU {
+		mined, _, err := mineOnCPU(event, template, opts.NoncePrefix, decimalAlphabet, position, difficulty, opts.CPUThreads, deadline, nil)
+		return mined, err
+	}
+
+	widest := event
+	widest.Tags = withNonceTag(event.Tags, nonceTagWithValue(template, opts.NoncePrefix+strings.Repeat("0", cpuMaxDigits)), position)
+	session, batchSize, err := openLibSession(opts, len(widest.Serialize()), 0)
+	if err != nil {
+		return event, err
+	}
+	defer session.Release()
+	return mineOnSession(session, batchSize, event, template, position, difficulty, opts.NoncePrefix, deadline, nil, nil)
+}
+
+// prepareLibEvent checks the difficulty and nonce prefix and settles the
+// event's nonce tag the way a plain command-line run does. It returns the
+// event without its nonce tag, the nonce tag template and where it goes.
+func prepareLibEvent(event nostr.Event, difficulty int, noncePrefix string) (nostr.Event, nostr.Tag, int, error) {
+	if difficulty < 1 || difficulty > 256 {
+		return event, nil, 0, fmt.Errorf("difficulty must be between 1 and 256, got %d", difficulty)
+	}
+	if err := checkNoncePrefix(noncePrefix); err != nil {
+		return event, nil, 0, err
+	}
+	tags, _, err := sanitizeNonceTags(event.Tags, "lenient")
+	if err != nil {
+		return event, nil, 0, err
+	}
+	position, err := resolveNonceTagPosition("keep", tags)
+	if err != nil {
+		return event, nil, 0, err
+	}
+	template, err := nonceTagTemplate("replace", tags, difficulty)
+	if err != nil {
+		return event, nil, 0, err
+	}
+	event.Tags = withoutNonceTags(tags)
+	return event, template, position, nil
+}
+
+// openLibSession picks the device and kernel for opts and sets up a session
+// whose results buffer fits events of up to inputBytes in memBudget. It
+// returns the session and its batch size.
+func openLibSession(opts libOptions, inputBytes int, memBudget int64) (*clSession, int, error) {
+	preference := autoSelect
+	if opts.Prefer != "" {
+		if err := preference.Set(opts.Prefer); err != nil {
+			return nil, 0, err
+		}
+	}
+	device, kernelType, err := pickLibKernel(opts, preference)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000000
+		if device.Type()&cl.DeviceTypeCPU != 0 {
+			batchSize = 10000
+		}
+	}
+	maxBatch, err := maxBatchForMemory(device, memBudget, inputBytes)
+	if err != nil {
+		return nil, 0, err
+	}
+	batchSize = min(batchSize, maxBatch)
+
+	session, err := newCLSession(device, kernelType)
+	if err != nil {
+		return nil, 0, fmt.Errorf("kernel %s: %v", kernelType, err)
+	}
+	if err := session.allocResults(batchSize); err != nil {
+		session.Release()
+		return nil, 0, err
+	}
+	return session, batchSize, nil
+}
+
+// libTuningMu serializes the library's use of the tuning cache. gnp_mine
+// calls on different threads may run at once, and each loads the cache,
+// records platform probes and self-tests in it and saves it; without the lock
+// one call's save could drop what another recorded in between.
+var libTuningMu sync.Mutex
+
+// pickLibKernel finds the device for opts and the kernel to run on it, gated
+// by its self-test
+func pickLibKernel(opts libOptions, preference devicePreference) (*cl.Device, string, error) {
+	libTuningMu.Lock()
+	defer libTuningMu.Unlock()
+	device, err := findDeviceBy(opts.Device, preference)
+	if err != nil {
+		return nil, "", err
+	}
+	// A job too big for the CPU backend would take days there
+	if opts.GPUOnly && device.Type()&cl.DeviceTypeGPU == 0 {
+		return nil, "", fmt.Errorf("gpu_only: device %s is a %s", strings.TrimSpace(device.Name()), deviceClass(device))
+	}
+	kernelType := opts.Kernel
+	if kernelType == "" || kernelType == "auto" {
+		kernelType = selectKernelForDevice(device)
+	}
+	return device, gateKernel(device, kernelType), nil
+}
+
+// libDigits returns the nonce widths the library mines: from the narrowest
+// holding a whole batch, as in main, to two orders of magnitude past the
+// expected attempts, within what fits in a uint64
+func libDigits(difficulty, batchSize int) (minDigits, maxDigits int) {
+	minDigits = max(int(math.Ceil(math.Log10(float64(batchSize))))+1, 5)
+	maxDigits = min(max(int(math.Ceil(float64(difficulty)*math.Log10(2)))+2, 10), cpuMaxDigits)
+	return minDigits, maxDigits
+}
+
+// prepareWidth serializes an event with a placeholder nonce of the given
+// width and does the host-side work of loading it into a kernel
+func prepareWidth(p *inputPreparer, event nostr.Event, template nostr.Tag, position int, noncePrefix string, digits int) (preparedInput, error) {
+	placeholder := noncePrefix + fmt.Sprintf("%0*d", digits, uint64(math.Pow10(digits-1)))
+	event.Tags = withNonceTag(event.Tags, nonceTagWithValue(template, placeholder), position)
+	serialized := event.Serialize()
+	nonceOffset := findNonceOffset(serialized, placeholder)
+	if nonceOffset == -1 {
+		return preparedInput{}, fmt.Errorf("could not find nonce placeholder in serialized event (digits: %d)", digits)
+	}
+	return p.prepare(serialized, nonceOffset+len(noncePrefix), digits)
+}
+
+// mineOnSession is the mining loop of main without its extras, widening the
+// nonce one digit at a time. first, if not nil, is the event already prepared
+// at the narrowest width. A zero deadline means no limit; closing stop, if not
+// nil, ends the search after the current batch.
+func mineOnSession(session *clSession, batchSize int, event nostr.Event, template nostr.Tag, position, difficulty int, noncePrefix string, deadline time.Time, stop <-chan struct{}, first *preparedInput) (nostr.Event, error) {
+	minDigits, maxDigits := libDigits(difficulty, batchSize)
+	preparer := &inputPreparer{abi: session.abi}
+	for digits := minDigits; digits <= maxDigits; digits++ {
+		base := uint64(math.Pow10(digits - 1))
+		last := uint64(math.Pow10(digits)) - 1
+		event.Tags = withNonceTag(event.Tags, nonceTagWithValue(template, noncePrefix+fmt.Sprintf("%0*d", digits, base)), position)
+
+		var in preparedInput
+		var err error
+		if first != nil && digits == minDigits {
+			in = *first
+		} else if in, err = prepareWidth(preparer, event, template, position, noncePrefix, digits); err != nil {
+			return event, err
+		}
+		if err := session.setPreparedInput(in, difficulty); err != nil {
+			return event, err
+		}
+
+		for nonce := base; nonce <= last; {
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				return event, fmt.Errorf("no nonce found before the deadline")
+			}
+			select {
+			case <-stop:
+				return event, fmt.Errorf("stopped")
+			default:
+			}
+			results, err := session.runBatch(nonce, int(min(uint64(batchSize), last-nonce+1)))
+			if err != nil {
+				return event, fmt.Errorf("failed to execute kernel: %v", err)
+			}
+			for i, index := range results {
+				if index < 0 {
+					continue
+				}
+				candidate := nonce + uint64(i)
+				if !validateNonce(session.target, candidate, &event, difficulty, digits, noncePrefix) {
+					continue
+				}
+				event.Tags = setNonceValue(event.Tags, noncePrefix+fmt.Sprintf("%0*d", digits, candidate))
+				event.ID = event.GetID()
+				return event, nil
+			}
+			nonce += uint64(len(results))
+		}
+	}
+	return event, fmt.Errorf("could not find valid nonce up to %d digits", maxDigits)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"math"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// maxWorkGroupsPerLaunch is the most work-groups some drivers accept in one
+// NDRange dimension (older NVIDIA GPUs limit grids to 65535 blocks). OpenCL
+// does not report this limit, so launches never exceed it.
+const maxWorkGroupsPerLaunch = 65535
+
+// deviceLimits holds the work size limits of a device
+type deviceLimits struct {
+	maxWorkGroupSize int   // CL_DEVICE_MAX_WORK_GROUP_SIZE
+	maxWorkItemSizes []int // CL_DEVICE_MAX_WORK_ITEM_SIZES, per dimension
+	addressBits      int   // CL_DEVICE_ADDRESS_BITS, the width of size_t
+}
+
+// queryDeviceLimits reads a device's work size limits
+func queryDeviceLimits(device *cl.Device) deviceLimits {
+	return deviceLimits{
+		maxWorkGroupSize: device.MaxWorkGroupSize(),
+		maxWorkItemSizes: device.MaxWorkItemSizes(),
+		addressBits:      device.AddressBits(),
+	}
+}
+
+// maxLocalSize returns the largest work-group a 1D launch may use
+func (l deviceLimits) maxLocalSize() int {
+	size := l.maxWorkGroupSize
+	if len(l.maxWorkItemSizes) > 0 && l.maxWorkItemSizes[0] > 0 && (size <= 0 || l.maxWorkItemSizes[0] < size) {
+		size = l.maxWorkItemSizes[0]
+	}
+	return size
+}
+
+// assumedLocalSize is the work-group size maxGlobalSize assumes when the
+// launch's is not known: the largest the miner requests (see localWorkSize)
+const assumedLocalSize = 256
+
+// maxGlobalSize returns the most work items one 1D launch may contain when
+// its work-groups have localSize items (0 if not known). Larger batches are
+// split into several launches.
+func (l deviceLimits) maxGlobalSize(localSize int) int {
+	// Kernels index work items with int global IDs
+	limit := math.MaxInt32
+	if l.addressBits > 0 && l.addressBits < 32 {
+		limit = 1<<l.addressBits - 1
+	}
+	if localSize <= 0 {
+		localSize = assumedLocalSize
+		if largest := l.maxLocalSize(); largest > 0 && largest < localSize {
+			localSize = largest
+		}
+	}
+	if localSize > 0 && localSize*maxWorkGroupsPerLaunch < limit {
+		limit = localSize * maxWorkGroupsPerLaunch
+	}
+	return limit
+}
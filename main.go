@@ -6,7 +6,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
@@ -15,9 +14,13 @@ import (
 	"log"
 	"math"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
-	"unsafe"
 
 	cl "github.com/jgillich/go-opencl/cl"
 	"github.com/nbd-wtf/go-nostr"
@@ -26,39 +29,42 @@ import (
 
 var verbose bool
 
+// verboseLog is vlog's output. The standard logger is left for fatal errors,
+// which -notify reports by hooking its output.
+var verboseLog = log.New(os.Stderr, "", log.LstdFlags)
+
 func vlog(format string, args ...interface{}) {
 	if verbose {
-		log.Printf(format, args...)
+		verboseLog.Printf(format, args...)
 	}
 }
 
 // selectKernelForDevice automatically selects the best kernel for a given device
-// Returns "default" for CPUs and Intel GPUs, "ckolivas" for other GPUs
+// Returns "default" for CPUs and Intel GPUs, "amd" for AMD GPUs, "nvidia" for NVIDIA GPUs,
+// and "ckolivas" for other GPUs
 func selectKernelForDevice(device *cl.Device) string {
 	deviceType := device.Type()
-	deviceVendor := device.Vendor()
+	deviceVendor := strings.ToLower(device.Vendor())
 
 	// CPUs always use default kernel
 	if (deviceType & cl.DeviceTypeCPU) != 0 {
 		return "default"
 	}
 
-	// Intel GPUs use default kernel
 	if (deviceType & cl.DeviceTypeGPU) != 0 {
-		// Check if vendor contains "Intel" (case-insensitive check)
-		vendorLower := ""
-		for _, r := range deviceVendor {
-			vendorLower += string(r | 0x20) // Convert to lowercase
-		}
-		// Check if "intel" is contained in the vendor string
-		if len(vendorLower) >= 5 {
-			for i := 0; i <= len(vendorLower)-5; i++ {
-				if vendorLower[i:i+5] == "intel" {
-					return "default"
-				}
-			}
+		// Intel GPUs use default kernel
+		if strings.Contains(deviceVendor, "intel") {
+			return "default"
+		}
+		// AMD GPUs use the wavefront-aware amd kernel
+		if isAMDVendor(deviceVendor) {
+			return "amd"
 		}
-		// Other GPUs (NVIDIA, AMD, etc.) use ckolivas
+		// NVIDIA GPUs use the funnel shift / LOP3 nvidia kernel
+		if strings.Contains(deviceVendor, "nvidia") {
+			return "nvidia"
+		}
+		// Other GPUs use ckolivas
 		return "ckolivas"
 	}
 
@@ -66,6 +72,66 @@ func selectKernelForDevice(device *cl.Device) string {
 	return "default"
 }
 
+// isAMDVendor reports whether a lowercased vendor string belongs to AMD/ATI
+func isAMDVendor(vendorLower string) bool {
+	return strings.Contains(vendorLower, "advanced micro devices") ||
+		strings.Contains(vendorLower, "amd") ||
+		strings.Contains(vendorLower, "ati technologies")
+}
+
+// pciVendorID maps an OpenCL vendor string to its PCI vendor ID as shown in
+// sysfs, or "" if the vendor is not recognized
+func pciVendorID(vendor string) string {
+	vendorLower := strings.ToLower(vendor)
+	switch {
+	case strings.Contains(vendorLower, "nvidia"):
+		return "0x10de"
+	case isAMDVendor(vendorLower):
+		return "0x1002"
+	case strings.Contains(vendorLower, "intel"):
+		return "0x8086"
+	}
+	return ""
+}
+
+// localWorkSizeLimits returns the wavefront and largest work-group for
+// launches of a kernel, or zeros to let OpenCL choose the local work size.
+// The amd kernel is launched with work-groups aligned to the device's
+// wavefront (wave32 on RDNA, wave64 on GCN), which OpenCL reports as the
+// preferred work-group size multiple.
+func localWorkSizeLimits(kernelType string, kernel *cl.Kernel, device *cl.Device) (wavefront, maxSize int) {
+	if kernelType != "amd" {
+		return 0, 0
+	}
+
+	wavefront, err := kernel.PreferredWorkGroupSizeMultiple(device)
+	if err != nil || wavefront <= 0 {
+		return 0, 0
+	}
+	maxSize, err = kernel.WorkGroupSize(device)
+	if err != nil || maxSize <= 0 {
+		maxSize = device.MaxWorkGroupSize()
+	}
+	if limit := queryDeviceLimits(device).maxLocalSize(); limit > 0 && limit < maxSize {
+		maxSize = limit
+	}
+	return wavefront, maxSize
+}
+
+// localWorkSize returns the largest wavefront multiple (up to 256 and
+// maxSize) that evenly divides the global size, or 0 to let OpenCL choose
+func localWorkSize(wavefront, maxSize, globalSize int) int {
+	if wavefront <= 0 {
+		return 0
+	}
+	for size := (256 / wavefront) * wavefront; size >= wavefront; size -= wavefront {
+		if size <= maxSize && globalSize%size == 0 {
+			return size
+		}
+	}
+	return 0
+}
+
 // getKernelSource returns the kernel source code based on the kernel type
 // If kernelType is "auto", it will be determined based on the device
 func getKernelSource(kernelType string, device *cl.Device) (string, string, error) {
@@ -83,38 +149,50 @@ func getKernelSource(kernelType string, device *cl.Device) (string, string, erro
 	case "ckolivas":
 		// ckolivas kernel adapted from sgminer's Scrypt implementation for NIP-13
 		return ckolivasKernelSource, "mine_nonce", nil
+	case "amd":
+		// AMD GCN/RDNA kernel using cl_amd_media_ops and wavefront-aligned work-groups
+		return amdKernelSource, "mine_nonce", nil
+	case "nvidia":
+		// NVIDIA kernel using funnel shifts and LOP3 ternary logic ops
+		return nvidiaKernelSource, "mine_nonce", nil
+	case "offset":
+		// Opt-in variant that passes the batch's starting nonce as the NDRange global offset
+		return offsetKernelSource, "mine_nonce", nil
+	case "midstate":
+		// Opt-in variant that only hashes the blocks from the nonce's block on
+		return midstateKernelSource, "mine_nonce", nil
+	case kernelFileType:
+		// A kernel under development, read from -kernel-file
+		source, err := readKernelFile()
+		return source, "mine_nonce", err
 	default:
-		return "", "", fmt.Errorf("unknown kernel type: %s (use 'default', 'ckolivas', or 'auto')", kernelType)
+		return "", "", fmt.Errorf("unknown kernel type: %s (use 'default', 'ckolivas', 'amd', 'nvidia', 'offset', 'midstate', or 'auto')", kernelType)
 	}
 }
 
 // validateNonce validates a candidate nonce by recalculating the hash on CPU.
+// The nonce value is noncePrefix followed by the candidate's digits, and the
+// hash is scored with the target the kernel searched for.
 // Returns true if valid, false otherwise.
 // Logs errors to stderr.
-func validateNonce(candidateNonce uint64, event *nostr.Event, difficulty int, numDigits int) bool {
-	// Create a deep copy of the event for validation
+func validateNonce(target powTarget, candidateNonce uint64, event *nostr.Event, difficulty int, numDigits int, noncePrefix string) bool {
+	// Create a copy of the event for validation
 	testEvent := *event
 	// Clear the ID so it gets recalculated
 	testEvent.ID = ""
-	// Deep copy tags to avoid modifying the original
-	testEvent.Tags = make(nostr.Tags, len(event.Tags))
-	for i, tag := range event.Tags {
-		testEvent.Tags[i] = make(nostr.Tag, len(tag))
-		copy(testEvent.Tags[i], tag)
-	}
 
 	// Format nonce with correct number of digits
-	nonceStr := fmt.Sprintf("%0*d", numDigits, candidateNonce)
+	nonceStr := noncePrefix + fmt.Sprintf("%0*d", numDigits, candidateNonce)
 
-	// Find and update nonce tag (remove old one first, then add new)
-	filteredTags := make(nostr.Tags, 0, len(testEvent.Tags))
-	for _, tag := range testEvent.Tags {
-		if len(tag) == 0 || tag[0] != "nonce" {
-			filteredTags = append(filteredTags, tag)
-		}
+	// The event being mined carries exactly one nonce tag (see sanitizeNonceTags)
+	if n := len(event.Tags) - len(withoutNonceTags(event.Tags)); n != 1 {
+		fmt.Fprintf(os.Stderr, "Validation error: Event has %d nonce tags, expected 1 (nonce: %d). Continuing...\n", n, candidateNonce)
+		return false
 	}
-	// Add new nonce tag
-	testEvent.Tags = append(filteredTags, nostr.Tag{"nonce", nonceStr, strconv.Itoa(difficulty)})
+	nonceIndex := nonceTagIndex(event.Tags)
+
+	// Put the candidate nonce where the placeholder was mined, leaving the original tags untouched
+	testEvent.Tags = setNonceValue(event.Tags, nonceStr)
 
 	// Recalculate event ID by serializing and hashing (CPU-side validation)
 	eventIDHex := testEvent.GetID()
@@ -122,18 +200,11 @@ func validateNonce(candidateNonce uint64, event *nostr.Event, difficulty int, nu
 	// Set the event ID (required for CommittedDifficulty to work correctly)
 	testEvent.ID = eventIDHex
 
-	// Validate difficulty using NIP-13 Check function
-	if err := nip13.Check(eventIDHex, difficulty); err != nil {
-		fmt.Fprintf(os.Stderr, "Validation error: NIP-13 validation failed: %v (nonce: %d). Continuing...\n",
-			err, candidateNonce)
-		return false
-	}
-
 	// Additional validation: check committed difficulty matches
 	// Note: CommittedDifficulty reads from the nonce tag's third element
 	// It compares the tag difficulty with the actual hash difficulty
 	// If tag difficulty > actual difficulty, it returns 0
-	actualHashDifficulty := nip13.Difficulty(eventIDHex)
+	actualHashDifficulty := eventScore(target, testEvent)
 	committedDiff := nip13.CommittedDifficulty(&testEvent)
 
 	// CommittedDifficulty should return the minimum of tag difficulty and actual difficulty
@@ -154,24 +225,22 @@ func validateNonce(candidateNonce uint64, event *nostr.Event, difficulty int, nu
 		return true
 	}
 
-	if committedDiff != difficulty && committedDiff != 0 {
-		// Debug: check what tags we have
-		var nonceTagFound bool
-		for _, tag := range testEvent.Tags {
-			if len(tag) > 0 && tag[0] == "nonce" {
-				nonceTagFound = true
-				if len(tag) < 3 {
-					fmt.Fprintf(os.Stderr, "Validation error: Nonce tag has wrong format (len=%d, expected 3): %v (nonce: %d). Continuing...\n",
-						len(tag), tag, candidateNonce)
-				} else {
-					fmt.Fprintf(os.Stderr, "Validation error: Committed difficulty mismatch! Expected: %d, Got: %d, Actual hash difficulty: %d, Tag: %v (nonce: %d). Continuing...\n",
-						difficulty, committedDiff, actualHashDifficulty, tag, candidateNonce)
-				}
-				break
-			}
+	// With -nonce-tag-mode update the tag may commit to the input's own target
+	nonceTag := testEvent.Tags[nonceIndex]
+	expectedCommitted := difficulty
+	if len(nonceTag) >= 3 {
+		if target, err := strconv.Atoi(nonceTag[2]); err == nil {
+			expectedCommitted = target
 		}
-		if !nonceTagFound {
-			fmt.Fprintf(os.Stderr, "Validation error: Nonce tag not found in event! (nonce: %d). Continuing...\n", candidateNonce)
+	}
+
+	if committedDiff != expectedCommitted && committedDiff != 0 {
+		if len(nonceTag) < 3 {
+			fmt.Fprintf(os.Stderr, "Validation error: Nonce tag has wrong format (len=%d, expected 3): %v (nonce: %d). Continuing...\n",
+				len(nonceTag), nonceTag, candidateNonce)
+		} else {
+			fmt.Fprintf(os.Stderr, "Validation error: Committed difficulty mismatch! Expected: %d, Got: %d, Actual hash difficulty: %d, Tag: %v (nonce: %d). Continuing...\n",
+				expectedCommitted, committedDiff, actualHashDifficulty, nonceTag, candidateNonce)
 		}
 		return false
 	}
@@ -180,107 +249,55 @@ func validateNonce(candidateNonce uint64, event *nostr.Event, difficulty int, nu
 	return true
 }
 
-func updateProgressBar(nonce int64, digits int, totalTested int64, startTime time.Time, difficulty int) {
-	elapsed := time.Since(startTime)
-	var rate float64
-	if elapsed.Seconds() > 0 {
-		rate = float64(totalTested) / elapsed.Seconds()
-	}
-
-	// Calculate expected iterations: 2^difficulty
-	expectedIterations := math.Pow(2, float64(difficulty))
-
-	// Calculate percentage relative to expected iterations
-	// Allow percentage to exceed 100% to show how much beyond expected we are
-	var percent float64
-	if expectedIterations > 0 {
-		percent = float64(totalTested) / expectedIterations * 100
-	}
-
-	// Format rate
-	var rateStr string
-	if rate >= 1000000 {
-		rateStr = fmt.Sprintf("%.2fM", rate/1000000)
-	} else if rate >= 1000 {
-		rateStr = fmt.Sprintf("%.2fK", rate/1000)
-	} else {
-		rateStr = fmt.Sprintf("%.0f", rate)
-	}
-
-	// Format elapsed time
-	elapsedSec := int(elapsed.Seconds())
-	hours := elapsedSec / 3600
-	minutes := (elapsedSec % 3600) / 60
-	seconds := elapsedSec % 60
-	var elapsedStr string
-	if hours > 0 {
-		elapsedStr = fmt.Sprintf("%dh%dm%ds", hours, minutes, seconds)
-	} else if minutes > 0 {
-		elapsedStr = fmt.Sprintf("%dm%ds", minutes, seconds)
-	} else {
-		elapsedStr = fmt.Sprintf("%ds", seconds)
-	}
-
-	// Print progress bar to stderr
-	fmt.Fprintf(os.Stderr, "\r[%d digits] Nonce: %d (%.1f%% of expected) | Rate: %s nonces/s | Elapsed: %s",
-		digits, nonce, percent, rateStr, elapsedStr)
-	os.Stderr.Sync() // Flush stderr to ensure it's visible
-}
-
 func listAllDevices() {
-	platforms, err := cl.GetPlatforms()
+	platforms, _, err := enumeratePlatforms(nil)
 	if err != nil {
-		log.Fatalf("Failed to get platforms: %v", err)
-	}
-
-	if len(platforms) == 0 {
-		log.Fatal("No OpenCL platforms found")
+		log.Fatalf("Failed to list devices: %v", err)
 	}
 
 	var allDevices []*cl.Device
-	var devicePlatforms []int // Track which platform each device belongs to
 
 	fmt.Println("Available OpenCL devices:")
 	fmt.Println()
 
 	deviceNum := 0
-	for platformIdx, platform := range platforms {
-		platformName := platform.Name()
-		platformVendor := platform.Vendor()
-		fmt.Printf("Platform %d: %s (%s)\n", platformIdx, platformName, platformVendor)
+	for _, pd := range platforms {
+		platformName := pd.platform.Name()
+		platformVendor := pd.platform.Vendor()
+		fmt.Printf("Platform %d: %s (%s)\n", pd.index, platformName, platformVendor)
 
-		devices, err := platform.GetDevices(cl.DeviceTypeAll)
-		if err != nil {
-			fmt.Printf("  Error getting devices: %v\n", err)
+		if pd.skipped != "" {
+			fmt.Printf("  Skipped: %s\n\n", pd.skipped)
 			continue
 		}
+		if pd.duplicates > 0 {
+			fmt.Printf("  (%d device(s) hidden: also exposed by an earlier platform)\n", pd.duplicates)
+		}
 
-		for _, device := range devices {
+		for _, device := range pd.devices {
 			deviceName := device.Name()
 			deviceVendor := device.Vendor()
-			deviceType := device.Type()
 			deviceVersion := device.Version()
 			maxComputeUnits := device.MaxComputeUnits()
 			maxWorkGroupSize := device.MaxWorkGroupSize()
 			globalMemSize := device.GlobalMemSize()
-
-			var typeStr string
-			if (deviceType & cl.DeviceTypeGPU) != 0 {
-				typeStr = "GPU"
-			} else if (deviceType & cl.DeviceTypeCPU) != 0 {
-				typeStr = "CPU"
-			} else {
-				typeStr = "Other"
-			}
+			typeStr := deviceTypeName(device)
 
 			fmt.Printf("  [%d] %s (%s) - %s\n", deviceNum, deviceName, deviceVendor, typeStr)
 			fmt.Printf("       Version: %s\n", deviceVersion)
+			compat := ""
+			if isLegacyCLDevice(device) {
+				compat = " (kernels built in OpenCL 1.1 mode)"
+			}
+			fmt.Printf("       OpenCL C: %s%s\n", device.OpenCLCVersion(), compat)
 			fmt.Printf("       Compute Units: %d, Work Group Size: %d, Memory: %d MB\n",
 				maxComputeUnits, maxWorkGroupSize, globalMemSize/(1024*1024))
+			limits := queryDeviceLimits(device)
+			fmt.Printf("       Work Item Sizes: %v, Address Bits: %d, Max Launch: %d work items\n",
+				limits.maxWorkItemSizes, limits.addressBits, limits.maxGlobalSize(0))
 			fmt.Println()
 
 			allDevices = append(allDevices, device)
-			devicePlatforms = append(devicePlatforms, platformIdx)
 			deviceNum++
 		}
 	}
@@ -292,115 +309,137 @@ func listAllDevices() {
 	os.Exit(0)
 }
 
-// createRealisticBenchmarkEvent creates a realistic Nostr event with random values
-// This makes the benchmark more representative of real mining scenarios
-func createRealisticBenchmarkEvent() nostr.Event {
-	// Generate random pubkey (32 bytes)
-	pubkeyBytes := make([]byte, 32)
-	rand.Read(pubkeyBytes)
-	pubkey := hex.EncodeToString(pubkeyBytes)
-
-	// Generate random content (varying length like real events)
-	contentLengths := []int{50, 100, 200, 500, 1000}
-	contentBytes := make([]byte, contentLengths[len(pubkeyBytes)%len(contentLengths)])
-	rand.Read(contentBytes)
-	content := hex.EncodeToString(contentBytes)
-
-	// Create realistic tags (like #p, #e, #t tags that are common in Nostr)
-	tags := nostr.Tags{
-		nostr.Tag{"p", pubkey, "wss://relay.example.com"},
+// deviceTypeName names a device's type as -list-devices shows it
+func deviceTypeName(device *cl.Device) string {
+	deviceType := device.Type()
+	if (deviceType & cl.DeviceTypeGPU) != 0 {
+		return "GPU"
+	} else if (deviceType & cl.DeviceTypeCPU) != 0 {
+		return "CPU"
+	} else if (deviceType & cl.DeviceTypeAccelerator) != 0 {
+		return "Accelerator"
 	}
+	return "Other"
+}
 
-	// Randomly add more tags (30% chance)
-	if len(pubkeyBytes)%10 < 3 {
-		// Add another pubkey tag
-		anotherPubkey := make([]byte, 32)
-		rand.Read(anotherPubkey)
-		tags = append(tags, nostr.Tag{"p", hex.EncodeToString(anotherPubkey), ""})
+// openCLDevices returns the devices of all platforms in -list-devices order
+func openCLDevices() ([]*cl.Device, error) {
+	platforms, _, err := enumeratePlatforms(nil)
+	if err != nil {
+		return nil, err
 	}
-
-	// Randomly add event reference tag (20% chance)
-	if len(pubkeyBytes)%10 < 2 {
-		eventRef := make([]byte, 32)
-		rand.Read(eventRef)
-		tags = append(tags, nostr.Tag{"e", hex.EncodeToString(eventRef), "wss://relay.example.com"})
+	var allDevices []*cl.Device
+	for _, pd := range platforms {
+		allDevices = append(allDevices, pd.devices...)
 	}
-
-	// Randomly add topic tags (40% chance)
-	if len(pubkeyBytes)%10 < 4 {
-		topics := []string{"bitcoin", "nostr", "opencl", "gpu", "mining", "crypto", "tech"}
-		topic := topics[len(pubkeyBytes)%len(topics)]
-		tags = append(tags, nostr.Tag{"t", topic})
+	if len(allDevices) == 0 {
+		return nil, fmt.Errorf("no OpenCL devices found")
 	}
+	return allDevices, nil
+}
+
+// findDevice returns the device at deviceIndex in -list-devices order, or
+// for a negative index the one -device-prefer picks
+func findDevice(deviceIndex int) (*cl.Device, error) {
+	return findDeviceBy(deviceIndex, autoSelect)
+}
 
-	// Create event with random values
-	event := nostr.Event{
-		Kind:      1, // Text note
-		Content:   content,
-		CreatedAt: nostr.Timestamp(time.Now().Unix()),
-		Tags:      tags,
+// findDeviceBy is findDevice with the preference to auto-select by
+func findDeviceBy(deviceIndex int, preference devicePreference) (*cl.Device, error) {
+	allDevices, err := openCLDevices()
+	if err != nil {
+		return nil, err
 	}
 
-	// Set a random pubkey (we'll use a deterministic one for consistency in benchmark)
-	// But make it look realistic
-	event.PubKey = pubkey
+	if deviceIndex >= 0 {
+		if deviceIndex >= len(allDevices) {
+			return nil, fmt.Errorf("device index %d is out of range (0-%d)", deviceIndex, len(allDevices)-1)
+		}
+		return allDevices[deviceIndex], nil
+	}
+	index := preference.pick(allDevices)
+	vlog("Auto-selected device [%d]: %s (%s; preference %s)", index, allDevices[index].Name(), describeDevice(allDevices[index]), preference.String())
+	return allDevices[index], nil
+}
 
-	return event
+// kernelBenchmark is the best configuration -benchmark found for one kernel
+type kernelBenchmark struct {
+	kernelName     string
+	bestBatchPower int
+	bestBatchSize  int
+	bestQueues     int
+	bestRate       float64
 }
 
 // runBenchmark tests all kernels and different batch sizes to find the optimal combination
-func runBenchmark(difficulty int, deviceIndex int, kernelType string) {
+func runBenchmark(difficulty int, deviceIndex int, kernelType string, memBudget int64, events *benchmarkEvents) {
+	defer reportCLObjects()
 	fmt.Fprintf(os.Stderr, "Running benchmark to find optimal kernel and batch size...\n")
 	fmt.Fprintf(os.Stderr, "Each kernel and batch size will be tested 3 times (5 seconds each) with different events.\n\n")
 
-	// Get platforms
-	platforms, err := cl.GetPlatforms()
+	selectedDevice, err := findDevice(deviceIndex)
 	if err != nil {
-		log.Fatalf("Failed to get platforms: %v", err)
+		log.Fatalf("Failed to select device: %v", err)
 	}
-
-	if len(platforms) == 0 {
-		log.Fatal("No OpenCL platforms found")
+	if _, ok := benchmarkDevice(selectedDevice, difficulty, memBudget, events); !ok {
+		log.Fatal("No valid kernel results found")
 	}
+}
 
-	// Collect all devices
-	var allDevices []*cl.Device
-	for _, platform := range platforms {
-		devices, err := platform.GetDevices(cl.DeviceTypeAll)
-		if err != nil {
-			continue
-		}
-		for _, device := range devices {
-			allDevices = append(allDevices, device)
-		}
+// runBenchmarkAll benchmarks every device in turn and compares their best
+// configurations
+func runBenchmarkAll(difficulty int, memBudget int64, events *benchmarkEvents) {
+	defer reportCLObjects()
+	devices, err := openCLDevices()
+	if err != nil {
+		log.Fatalf("Failed to list devices: %v", err)
 	}
+	fmt.Fprintf(os.Stderr, "Benchmarking %d devices: every kernel and batch size, 3 runs of 5 seconds each.\n\n", len(devices))
 
-	if len(allDevices) == 0 {
-		log.Fatal("No OpenCL devices found")
+	type deviceBenchmark struct {
+		index int
+		name  string
+		best  kernelBenchmark
+		ok    bool
+	}
+	var results []deviceBenchmark
+	for i, device := range devices {
+		fmt.Fprintf(os.Stderr, "##### Device [%d]: %s #####\n", i, strings.TrimSpace(device.Name()))
+		best, ok := benchmarkDevice(device, difficulty, memBudget, events)
+		results = append(results, deviceBenchmark{index: i, name: strings.TrimSpace(device.Name()), best: best, ok: ok})
+		fmt.Fprintf(os.Stderr, "\n")
 	}
 
-	// Select device
-	var selectedDevice *cl.Device
-	if deviceIndex >= 0 {
-		if deviceIndex >= len(allDevices) {
-			log.Fatalf("Device index %d is out of range (0-%d)", deviceIndex, len(allDevices)-1)
+	fmt.Fprintf(os.Stderr, "=== All Devices ===\n")
+	fmt.Fprintf(os.Stderr, "%-6s %-32s %-10s %6s %7s %20s\n", "Device", "Name", "Kernel", "Batch", "Queues", "Performance")
+	fmt.Fprintf(os.Stderr, "%-6s %-32s %-10s %6s %7s %20s\n", "------", "----", "------", "-----", "------", "-----------")
+	var total float64
+	for _, r := range results {
+		if !r.ok {
+			fmt.Fprintf(os.Stderr, "%-6d %-32.32s %s\n", r.index, r.name, "no kernel ran")
+			continue
 		}
-		selectedDevice = allDevices[deviceIndex]
-	} else {
-		// Auto-select GPU or first device
-		selectedDevice = nil
-		for _, device := range allDevices {
-			deviceType := device.Type()
-			if (deviceType & cl.DeviceTypeGPU) != 0 {
-				selectedDevice = device
-				break
+		total += r.best.bestRate
+		fmt.Fprintf(os.Stderr, "%-6d %-32.32s %-10s 10^%-3d %7d %-8.2fM nonces/s\n",
+			r.index, r.name, r.best.kernelName, r.best.bestBatchPower, r.best.bestQueues, r.best.bestRate/1000000)
+	}
+	fmt.Fprintf(os.Stderr, "\nCombined: %.2fM nonces/s with one miner per device\n", total/1000000)
+	for _, r := range results {
+		if r.ok {
+			use := fmt.Sprintf("-device %d -kernel %s -batch-size %d", r.index, r.best.kernelName, r.best.bestBatchPower)
+			if r.best.bestQueues > 1 {
+				use += fmt.Sprintf(" -queues %d", r.best.bestQueues)
 			}
-		}
-		if selectedDevice == nil {
-			selectedDevice = allDevices[0]
+			fmt.Fprintf(os.Stderr, "Use: %s\n", use)
 		}
 	}
+}
 
+// benchmarkDevice tests all kernels and batch sizes on one device, prints a
+// summary and recommendation, and records each kernel's best configuration
+// in the tuning cache. It returns the best configuration, or false if no
+// kernel ran.
+func benchmarkDevice(selectedDevice *cl.Device, difficulty int, memBudget int64, events *benchmarkEvents) (kernelBenchmark, bool) {
 	deviceName := selectedDevice.Name()
 	deviceType := selectedDevice.Type()
 	isCPU := (deviceType & cl.DeviceTypeCPU) != 0
@@ -412,16 +451,9 @@ func runBenchmark(difficulty int, deviceIndex int, kernelType string) {
 	fmt.Fprintf(os.Stderr, "\n")
 
 	// Test all kernels
-	kernels := []string{"default", "ckolivas"}
+	kernels := []string{"default", "ckolivas", "amd", "nvidia", "offset", "midstate"}
 
-	type kernelBenchmarkResult struct {
-		kernelName     string
-		bestBatchPower int
-		bestBatchSize  int
-		bestRate       float64
-	}
-
-	var kernelResults []kernelBenchmarkResult
+	var kernelResults []kernelBenchmark
 
 	// Determine max batch size power based on device type
 	maxPower := 10
@@ -450,14 +482,14 @@ func runBenchmark(difficulty int, deviceIndex int, kernelType string) {
 			var rates []float64
 			failed := false
 			for run := 0; run < 3; run++ {
-				// Create a new realistic event for each run
-				testEvent := createRealisticBenchmarkEvent()
+				// Mine a new event from the mix for each run
+				testEvent := events.next()
 
 				// Run benchmark for this batch size (5 seconds per run)
-				rate, err := benchmarkBatchSizeSafe(selectedDevice, &testEvent, difficulty, batchSize, kernel)
+				rate, err := benchmarkBatchSizeSafe(selectedDevice, &testEvent, difficulty, batchSize, 1, kernel, memBudget, 5*time.Second)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "\n  Error testing batch size 10^%d (%d): %v\n", power, batchSize, err)
-					fmt.Fprintf(os.Stderr, "  Batch size too large for this device/kernel. Stopping.\n")
+					fmt.Fprintf(os.Stderr, "  Stopping.\n")
 					failed = true
 					break
 				}
@@ -502,30 +534,72 @@ func runBenchmark(difficulty int, deviceIndex int, kernelType string) {
 			}
 		}
 
-		kernelResults = append(kernelResults, kernelBenchmarkResult{
+		// Big GPUs may not fill up on one queue's launches; try splitting the
+		// best batch size across more queues
+		bestQueues, bestRate := 1, best.rate
+		for q := 2; q <= benchmarkMaxQueues && !isCPU; q *= 2 {
+			fmt.Fprintf(os.Stderr, "  Testing %d queues at batch size 10^%d... ", q, best.batchSizePower)
+			testEvent := events.next()
+			rate, err := benchmarkBatchSizeSafe(selectedDevice, &testEvent, difficulty, best.batchSize, q, kernel, memBudget, 5*time.Second)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed: %v\n", err)
+				break
+			}
+			fmt.Fprintf(os.Stderr, "%.2fM nonces/s (%+.1f%%)\n", rate/1000000, (rate/best.rate-1)*100)
+			if rate > bestRate {
+				bestQueues, bestRate = q, rate
+			}
+		}
+
+		kernelResults = append(kernelResults, kernelBenchmark{
 			kernelName:     kernel,
 			bestBatchPower: best.batchSizePower,
 			bestBatchSize:  best.batchSize,
-			bestRate:       best.rate,
+			bestQueues:     bestQueues,
+			bestRate:       bestRate,
 		})
 
-		fmt.Fprintf(os.Stderr, "  Best for %s: batch size 10^%d (%d) = %.2fM nonces/s\n\n", kernel, best.batchSizePower, best.batchSize, best.rate/1000000)
+		fmt.Fprintf(os.Stderr, "  Best for %s: batch size 10^%d (%d), %d queue(s) = %.2fM nonces/s\n\n", kernel, best.batchSizePower, best.batchSize, bestQueues, bestRate/1000000)
 	}
 
-	// Print summary table
 	if len(kernelResults) == 0 {
-		log.Fatal("No valid kernel results found")
+		return kernelBenchmark{}, false
+	}
+
+	// Later runs start from the tuned settings
+	cache := loadTuningCache()
+	for _, kr := range kernelResults {
+		cache.recordBenchmark(selectedDevice, kr.kernelName, kr.bestRate, kr.bestBatchPower, kr.bestQueues)
+	}
+	if err := cache.save(); err != nil {
+		vlog("Warning: Failed to save tuning cache: %v", err)
 	}
 
+	// Print summary table
+
 	fmt.Fprintf(os.Stderr, "=== Benchmark Summary ===\n")
-	fmt.Fprintf(os.Stderr, "%-12s %12s %20s\n", "Kernel", "Best Batch Size", "Performance")
-	fmt.Fprintf(os.Stderr, "%-12s %12s %20s\n", "------", "-------------", "-----------")
+	fmt.Fprintf(os.Stderr, "%-12s %12s %7s %20s\n", "Kernel", "Best Batch Size", "Queues", "Performance")
+	fmt.Fprintf(os.Stderr, "%-12s %12s %7s %20s\n", "------", "-------------", "------", "-----------")
 	for _, kr := range kernelResults {
-		fmt.Fprintf(os.Stderr, "%-12s 10^%-8d %-8.2fM nonces/s\n",
-			kr.kernelName, kr.bestBatchPower, kr.bestRate/1000000)
+		fmt.Fprintf(os.Stderr, "%-12s 10^%-8d %7d %-8.2fM nonces/s\n",
+			kr.kernelName, kr.bestBatchPower, kr.bestQueues, kr.bestRate/1000000)
 	}
 	fmt.Fprintf(os.Stderr, "\n")
 
+	// Compare the AMD kernel against ckolivas, which it is meant to replace on AMD GPUs
+	var amdRate, ckolivasRate float64
+	for _, kr := range kernelResults {
+		switch kr.kernelName {
+		case "amd":
+			amdRate = kr.bestRate
+		case "ckolivas":
+			ckolivasRate = kr.bestRate
+		}
+	}
+	if amdRate > 0 && ckolivasRate > 0 {
+		fmt.Fprintf(os.Stderr, "amd vs ckolivas: %+.1f%%\n\n", (amdRate/ckolivasRate-1)*100)
+	}
+
 	// Find overall best kernel
 	bestKernel := kernelResults[0]
 	for _, kr := range kernelResults {
@@ -537,9 +611,17 @@ func runBenchmark(difficulty int, deviceIndex int, kernelType string) {
 	fmt.Fprintf(os.Stderr, "=== Recommendation ===\n")
 	fmt.Fprintf(os.Stderr, "Best kernel: %s\n", bestKernel.kernelName)
 	fmt.Fprintf(os.Stderr, "Best batch size: 10^%d (%d)\n", bestKernel.bestBatchPower, bestKernel.bestBatchSize)
+	if bestKernel.bestQueues > 1 {
+		fmt.Fprintf(os.Stderr, "Best queues: %d\n", bestKernel.bestQueues)
+	}
 	fmt.Fprintf(os.Stderr, "Performance: %.2fM nonces/s\n", bestKernel.bestRate/1000000)
 	fmt.Fprintf(os.Stderr, "\n")
-	fmt.Fprintf(os.Stderr, "Use: -kernel %s -batch-size %d\n", bestKernel.kernelName, bestKernel.bestBatchPower)
+	use := fmt.Sprintf("-kernel %s -batch-size %d", bestKernel.kernelName, bestKernel.bestBatchPower)
+	if bestKernel.bestQueues > 1 {
+		use += fmt.Sprintf(" -queues %d", bestKernel.bestQueues)
+	}
+	fmt.Fprintf(os.Stderr, "Use: %s\n", use)
+	return bestKernel, true
 }
 
 // testSingleKernel tests a single kernel by mining a random event and validating the result
@@ -548,45 +630,11 @@ func testSingleKernel(device *cl.Device, event *nostr.Event, difficulty int, ker
 	// Use a reasonable batch size for testing (10^4 = 10000)
 	batchSize := 10000
 
-	// Create context
-	context, err := cl.CreateContext([]*cl.Device{device})
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to create context: %v", err)
-	}
-	defer context.Release()
-
-	// Create command queue
-	queue, err := context.CreateCommandQueue(device, 0)
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to create command queue: %v", err)
-	}
-	defer queue.Release()
-
-	// Get kernel source
-	kernelSource, kernelName, err := getKernelSource(kernelType, device)
+	session, err := newCLSession(device, kernelType)
 	if err != nil {
 		return false, 0, err
 	}
-
-	// Create program
-	program, err := context.CreateProgramWithSource([]string{kernelSource})
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to create program: %v", err)
-	}
-	defer program.Release()
-
-	// Build program
-	err = program.BuildProgram(nil, "")
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to build program: %v", err)
-	}
-
-	// Create kernel
-	kernel, err := program.CreateKernel(kernelName)
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to create kernel: %v", err)
-	}
-	defer kernel.Release()
+	defer session.Release()
 
 	// Calculate number of digits needed
 	expectedAttempts := math.Pow(2, float64(difficulty))
@@ -609,117 +657,35 @@ func testSingleKernel(device *cl.Device, event *nostr.Event, difficulty int, ker
 
 	// Serialize event
 	serialized := testEvent.Serialize()
-	serializedLength := len(serialized)
 
 	// Find nonce position
-	noncePlaceholderBytes := []byte(noncePlaceholder)
-	nonceOffset := bytes.Index(serialized, noncePlaceholderBytes)
+	nonceOffset := findNonceOffset(serialized, noncePlaceholder)
 	if nonceOffset == -1 {
 		return false, 0, fmt.Errorf("could not find nonce placeholder in serialized event")
 	}
 
-	// Create buffers
-	inputBuffer, err := context.CreateEmptyBuffer(cl.MemReadOnly, serializedLength)
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to create input buffer: %v", err)
-	}
-	defer inputBuffer.Release()
-
-	resultSize := 4 // int32
-	resultsBufferSize := batchSize * resultSize
-	resultsBuffer, err := context.CreateEmptyBuffer(cl.MemWriteOnly, resultsBufferSize)
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to create results buffer: %v", err)
-	}
-	defer resultsBuffer.Release()
-
-	// Write input buffer
-	_, err = queue.EnqueueWriteBuffer(inputBuffer, true, 0, serializedLength, unsafe.Pointer(&serialized[0]), nil)
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to write input buffer: %v", err)
-	}
-
-	// Set kernel arguments
-	err = kernel.SetArgBuffer(0, inputBuffer)
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to set kernel arg 0: %v", err)
-	}
-
-	err = kernel.SetArgInt32(1, int32(serializedLength))
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to set kernel arg 1: %v", err)
-	}
-
-	err = kernel.SetArgInt32(2, int32(nonceOffset))
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to set kernel arg 2: %v", err)
-	}
-
-	err = kernel.SetArgInt32(3, int32(difficulty))
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to set kernel arg 3: %v", err)
-	}
-
-	baseNonceLow := uint32(0)
-	baseNonceHigh := uint32(0)
-	err = kernel.SetArgInt32(4, int32(baseNonceLow))
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to set kernel arg 4: %v", err)
-	}
-
-	err = kernel.SetArgInt32(5, int32(baseNonceHigh))
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to set kernel arg 5: %v", err)
-	}
-
-	err = kernel.SetArgBuffer(6, resultsBuffer)
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to set kernel arg 6: %v", err)
+	if err := session.allocResults(batchSize); err != nil {
+		return false, 0, err
 	}
-
-	err = kernel.SetArgInt32(7, int32(numDigits))
-	if err != nil {
-		return false, 0, fmt.Errorf("failed to set kernel arg 7: %v", err)
+	if err := session.setInput(serialized, nonceOffset, numDigits, difficulty); err != nil {
+		return false, 0, err
 	}
 
 	// Execute kernel multiple times until we find a valid nonce or exhaust attempts
 	for batch := 0; batch < maxBatches; batch++ {
-		baseNonce := int64(batch) * int64(batchSize)
-		baseNonceLow = uint32(baseNonce & 0xFFFFFFFF)
-		baseNonceHigh = uint32((baseNonce >> 32) & 0xFFFFFFFF)
-
-		err = kernel.SetArgInt32(4, int32(baseNonceLow))
-		if err != nil {
-			return false, 0, fmt.Errorf("failed to set kernel arg 4: %v", err)
-		}
-
-		err = kernel.SetArgInt32(5, int32(baseNonceHigh))
-		if err != nil {
-			return false, 0, fmt.Errorf("failed to set kernel arg 5: %v", err)
-		}
-
-		// Execute kernel
-		globalSize := []int{batchSize}
-		_, err = queue.EnqueueNDRangeKernel(kernel, nil, globalSize, nil, nil)
-		if err != nil {
-			return false, 0, fmt.Errorf("failed to enqueue kernel: %v", err)
-		}
-
-		// Read results
-		results := make([]byte, resultsBufferSize)
-		_, err = queue.EnqueueReadBuffer(resultsBuffer, true, 0, resultsBufferSize, unsafe.Pointer(&results[0]), nil)
+		baseNonce := uint64(batch) * uint64(batchSize)
+		resultIndices, err := session.runBatch(baseNonce, batchSize)
 		if err != nil {
-			return false, 0, fmt.Errorf("failed to read results buffer: %v", err)
+			return false, 0, err
 		}
 
 		// Check results
-		resultIndices := (*[1 << 28]int32)(unsafe.Pointer(&results[0]))[:batchSize:batchSize]
-		for i := 0; i < batchSize; i++ {
+		for i := 0; i < len(resultIndices); i++ {
 			index := resultIndices[i]
 			if index >= 0 {
-				candidateNonce := uint64(baseNonce) + uint64(index)
+				candidateNonce := baseNonce + uint64(index)
 				// Validate the nonce
-				if validateNonce(candidateNonce, event, difficulty, numDigits) {
+				if validateNonce(session.target, candidateNonce, &testEvent, difficulty, numDigits, "") {
 					return true, candidateNonce, nil
 				}
 			}
@@ -730,70 +696,29 @@ func testSingleKernel(device *cl.Device, event *nostr.Event, difficulty int, ker
 }
 
 // testAllKernels tests all available kernels with random events
-func testAllKernels(difficulty int, deviceIndex int) {
+func testAllKernels(difficulty int, deviceIndex int, events *benchmarkEvents) {
+	defer reportCLObjects()
 	fmt.Fprintf(os.Stderr, "Testing all kernels with difficulty %d...\n", difficulty)
 	fmt.Fprintf(os.Stderr, "Each kernel will be tested 10 times with random events.\n\n")
 
-	// Get platforms
-	platforms, err := cl.GetPlatforms()
+	selectedDevice, err := findDevice(deviceIndex)
 	if err != nil {
-		log.Fatalf("Failed to get platforms: %v", err)
-	}
-
-	if len(platforms) == 0 {
-		log.Fatal("No OpenCL platforms found")
-	}
-
-	// Collect all devices
-	var allDevices []*cl.Device
-	for _, platform := range platforms {
-		devices, err := platform.GetDevices(cl.DeviceTypeAll)
-		if err != nil {
-			continue
-		}
-		for _, device := range devices {
-			allDevices = append(allDevices, device)
-		}
-	}
-
-	if len(allDevices) == 0 {
-		log.Fatal("No OpenCL devices found")
-	}
-
-	// Select device
-	var selectedDevice *cl.Device
-	if deviceIndex >= 0 {
-		if deviceIndex >= len(allDevices) {
-			log.Fatalf("Device index %d is out of range (0-%d)", deviceIndex, len(allDevices)-1)
-		}
-		selectedDevice = allDevices[deviceIndex]
-	} else {
-		// Auto-select GPU or first device
-		selectedDevice = nil
-		for _, device := range allDevices {
-			deviceType := device.Type()
-			if (deviceType & cl.DeviceTypeGPU) != 0 {
-				selectedDevice = device
-				break
-			}
-		}
-		if selectedDevice == nil {
-			selectedDevice = allDevices[0]
-		}
+		log.Fatalf("Failed to select device: %v", err)
 	}
 
 	deviceName := selectedDevice.Name()
 	fmt.Fprintf(os.Stderr, "Testing on device: %s\n\n", deviceName)
 
 	// List of all kernels to test
-	kernels := []string{"default", "ckolivas", "phatk", "diakgcn", "diablo", "poclbm"}
+	kernels := []string{"default", "ckolivas", "amd", "nvidia", "offset", "midstate", "phatk", "diakgcn", "diablo", "poclbm"}
 
 	// Store results for summary
 	type kernelResult struct {
-		name    string
-		correct int
-		wrong   int
-		errors  int
+		name     string
+		selfTest string
+		correct  int
+		wrong    int
+		errors   int
 	}
 	var results []kernelResult
 
@@ -801,13 +726,40 @@ func testAllKernels(difficulty int, deviceIndex int) {
 	for _, kernelType := range kernels {
 		fmt.Fprintf(os.Stderr, "Testing kernel: %s\n", kernelType)
 
+		// Exhaustive comparison against the CPU, including the 33-48 bit difficulty vectors
+		selfTest := "PASS"
+		if err := quickSelfTest(selectedDevice, kernelType); err != nil {
+			fmt.Fprintf(os.Stderr, "  Self-test: FAIL - %v\n", err)
+			selfTest = "FAIL"
+		} else {
+			fmt.Fprintf(os.Stderr, "  Self-test: PASS\n")
+		}
+
+		// Random events mixing escaped and multi-byte text
+		fuzzSeed := time.Now().UnixNano()
+		if err := fuzzSelfTest(selectedDevice, kernelType, 50, fuzzSeed); err != nil {
+			fmt.Fprintf(os.Stderr, "  Escaping fuzz: FAIL - %v\n", err)
+			selfTest = "FAIL"
+		} else {
+			fmt.Fprintf(os.Stderr, "  Escaping fuzz: PASS (seed %d)\n", fuzzSeed)
+		}
+
+		// How much of the device the built kernel can keep busy
+		if session, err := newCLSession(selectedDevice, kernelType); err == nil {
+			fmt.Fprintf(os.Stderr, "  Occupancy: %s\n", session.occupancy)
+			if advice := session.occupancy.advice(); advice != "" {
+				fmt.Fprintf(os.Stderr, "  Advice: %s\n", advice)
+			}
+			session.Release()
+		}
+
 		correct := 0
 		wrong := 0
 		errors := 0
 
 		for testNum := 0; testNum < 10; testNum++ {
 			// Create a random event for each test
-			testEvent := createRealisticBenchmarkEvent()
+			testEvent := events.next()
 
 			// Test the kernel
 			valid, nonce, err := testSingleKernel(selectedDevice, &testEvent, difficulty, kernelType)
@@ -834,71 +786,38 @@ func testAllKernels(difficulty int, deviceIndex int) {
 
 		// Store results for summary
 		results = append(results, kernelResult{
-			name:    kernelType,
-			correct: correct,
-			wrong:   wrong,
-			errors:  errors,
+			name:     kernelType,
+			selfTest: selfTest,
+			correct:  correct,
+			wrong:    wrong,
+			errors:   errors,
 		})
 	}
 
 	// Print summary
 	fmt.Fprintf(os.Stderr, "=== Summary ===\n")
-	fmt.Fprintf(os.Stderr, "%-12s %8s %8s %8s\n", "Kernel", "Correct", "Wrong", "Errors")
-	fmt.Fprintf(os.Stderr, "%-12s %8s %8s %8s\n", "------", "-------", "-----", "------")
+	fmt.Fprintf(os.Stderr, "%-12s %9s %8s %8s %8s\n", "Kernel", "Self-test", "Correct", "Wrong", "Errors")
+	fmt.Fprintf(os.Stderr, "%-12s %9s %8s %8s %8s\n", "------", "---------", "-------", "-----", "------")
 	for _, r := range results {
-		fmt.Fprintf(os.Stderr, "%-12s %8d %8d %8d\n", r.name, r.correct, r.wrong, r.errors)
+		fmt.Fprintf(os.Stderr, "%-12s %9s %8d %8d %8d\n", r.name, r.selfTest, r.correct, r.wrong, r.errors)
 	}
 	fmt.Fprintf(os.Stderr, "\n")
 }
 
-// benchmarkBatchSizeSafe runs a benchmark for a specific batch size
+// benchmarkBatchSizeSafe runs a benchmark for a specific batch size, split
+// across queues command queues, for at least duration
 // Returns the nonce rate in nonces per second and any error encountered
-func benchmarkBatchSizeSafe(device *cl.Device, event *nostr.Event, difficulty int, batchSize int, kernelType string) (float64, error) {
-	// Create context
-	context, err := cl.CreateContext([]*cl.Device{device})
-	if err != nil {
-		return 0, fmt.Errorf("failed to create context: %v", err)
-	}
-	defer context.Release()
-
-	// Create command queue
-	queue, err := context.CreateCommandQueue(device, 0)
+func benchmarkBatchSizeSafe(device *cl.Device, event *nostr.Event, difficulty int, batchSize int, queues int, kernelType string, memBudget int64, duration time.Duration) (float64, error) {
+	session, err := newCLSession(device, kernelType)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create command queue: %v", err)
+		return 0, err
 	}
-	defer queue.Release()
-
-	// Get kernel source
-	kernelSource, kernelName, err := getKernelSource(kernelType, device)
-	if err != nil {
+	defer session.Release()
+	if err := session.setQueues(queues); err != nil {
 		return 0, err
 	}
 	// Show actual kernel selected (in case auto was used)
-	actualKernel := kernelType
-	if kernelType == "auto" {
-		actualKernel = selectKernelForDevice(device)
-	}
-	vlog("Loading kernel: %s (function: %s)", actualKernel, kernelName)
-
-	// Create program
-	program, err := context.CreateProgramWithSource([]string{kernelSource})
-	if err != nil {
-		return 0, fmt.Errorf("failed to create program: %v", err)
-	}
-	defer program.Release()
-
-	// Build program
-	err = program.BuildProgram(nil, "")
-	if err != nil {
-		return 0, fmt.Errorf("failed to build program: %v", err)
-	}
-
-	// Create kernel
-	kernel, err := program.CreateKernel(kernelName)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create kernel: %v", err)
-	}
-	defer kernel.Release()
+	vlog("Loading kernel: %s (function: %s, %s)", session.kernelType, session.kernelName, session.abi)
 
 	// Prepare event with placeholder nonce
 	testEvent := *event
@@ -907,140 +826,256 @@ func benchmarkBatchSizeSafe(device *cl.Device, event *nostr.Event, difficulty in
 
 	// Serialize event
 	serialized := testEvent.Serialize()
-	serializedLength := len(serialized)
 
 	// Find nonce position
-	noncePlaceholderBytes := []byte(noncePlaceholder)
-	nonceOffset := bytes.Index(serialized, noncePlaceholderBytes)
+	nonceOffset := findNonceOffset(serialized, noncePlaceholder)
 	if nonceOffset == -1 {
 		return 0, fmt.Errorf("could not find nonce placeholder in serialized event")
 	}
 
-	// Create input buffer
-	inputBuffer, err := context.CreateEmptyBuffer(cl.MemReadOnly, serializedLength)
+	// Create results buffer, limited by the device memory budget
+	maxBatch, err := maxBatchForMemory(device, memBudget, len(serialized))
 	if err != nil {
-		return 0, fmt.Errorf("failed to create input buffer: %v", err)
+		return 0, err
 	}
-	defer inputBuffer.Release()
-
-	// Write serialized event to buffer
-	_, err = queue.EnqueueWriteBuffer(inputBuffer, true, 0, serializedLength, unsafe.Pointer(&serialized[0]), nil)
-	if err != nil {
-		return 0, fmt.Errorf("failed to write input buffer: %v", err)
+	if batchSize > maxBatch {
+		vlog("Batch size %d exceeds the device memory budget, testing %d instead", batchSize, maxBatch)
+		batchSize = maxBatch
 	}
-
-	// Create results buffer
-	resultSize := 4 // int32
-	resultsBufferSize := batchSize * resultSize
-	maxResultsBufferSize := 100 * 1024 * 1024
-	if resultsBufferSize > maxResultsBufferSize {
-		resultsBufferSize = maxResultsBufferSize
-		batchSize = resultsBufferSize / resultSize
+	if err := session.allocResults(batchSize); err != nil {
+		return 0, err
 	}
-
-	resultsBuffer, err := context.CreateEmptyBuffer(cl.MemWriteOnly, resultsBufferSize)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create results buffer: %v", err)
+	if err := session.setInput(serialized, nonceOffset, len(noncePlaceholder), difficulty); err != nil {
+		return 0, err
 	}
-	defer resultsBuffer.Release()
 
-	// Set kernel arguments (will be reused)
-	err = kernel.SetArgBuffer(0, inputBuffer)
-	if err != nil {
-		return 0, fmt.Errorf("failed to set kernel arg 0: %v", err)
-	}
+	startTime := time.Now()
+	totalTested := int64(0)
+	currentNonce := int64(1000000000) // Start at 10 digits
 
-	err = kernel.SetArgInt32(1, int32(serializedLength))
-	if err != nil {
-		return 0, fmt.Errorf("failed to set kernel arg 1: %v", err)
-	}
+	for time.Since(startTime) < duration {
+		results, err := session.runBatch(uint64(currentNonce), batchSize)
+		if err != nil {
+			return 0, err
+		}
 
-	err = kernel.SetArgInt32(2, int32(nonceOffset))
-	if err != nil {
-		return 0, fmt.Errorf("failed to set kernel arg 2: %v", err)
+		totalTested += int64(len(results))
+		currentNonce += int64(len(results))
 	}
 
-	err = kernel.SetArgInt32(3, int32(difficulty))
-	if err != nil {
-		return 0, fmt.Errorf("failed to set kernel arg 3: %v", err)
-	}
+	elapsed := time.Since(startTime)
+	rate := float64(totalTested) / elapsed.Seconds()
 
-	err = kernel.SetArgBuffer(6, resultsBuffer)
-	if err != nil {
-		return 0, fmt.Errorf("failed to set kernel arg 6: %v", err)
+	// The batch loop should barely allocate, so long runs don't keep the
+	// garbage collector busy
+	if err := checkBatchAllocs(session, uint64(currentNonce), batchSize); err != nil {
+		return rate, err
 	}
+	return rate, nil
+}
 
-	err = kernel.SetArgInt32(7, int32(10)) // 10 digits
-	if err != nil {
-		return 0, fmt.Errorf("failed to set kernel arg 7: %v", err)
-	}
-
-	// Benchmark for at least 5 seconds
-	benchmarkDuration := 5 * time.Second
-	startTime := time.Now()
-	totalTested := int64(0)
-	currentNonce := int64(1000000000) // Start at 10 digits
-
-	results := make([]byte, resultsBufferSize)
-
-	for time.Since(startTime) < benchmarkDuration {
-		// Set nonce arguments
-		baseNonceLow := uint32(currentNonce & 0xFFFFFFFF)
-		baseNonceHigh := uint32((currentNonce >> 32) & 0xFFFFFFFF)
-		err = kernel.SetArgInt32(4, int32(baseNonceLow))
+// maxLaunchAllocs bounds the heap allocations per kernel launch in the batch
+// loop. The OpenCL binding makes them: work size and event lists, and an
+// Event for the launch and for its readback. Anything more is the miner's.
+const maxLaunchAllocs = 8
+
+// allocCheckRuns is the number of batches checkBatchAllocs averages over
+const allocCheckRuns = 20
+
+// checkBatchAllocs runs batches as the mining loop does, each followed by a
+// scan of its results and the hex encoding of an event ID as for a hit, and
+// fails if they make more than maxLaunchAllocs heap allocations per launch
+// plus the ID string
+func checkBatchAllocs(session *clSession, nonce uint64, batchSize int) error {
+	var id [32]byte
+	var eventIDHex string
+	launches := session.launches
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for run := 0; run < allocCheckRuns; run++ {
+		results, err := session.runBatch(nonce, batchSize)
 		if err != nil {
-			return 0, fmt.Errorf("failed to set kernel arg 4: %v", err)
+			return err
 		}
-
-		err = kernel.SetArgInt32(5, int32(baseNonceHigh))
-		if err != nil {
-			return 0, fmt.Errorf("failed to set kernel arg 5: %v", err)
+		nonce += uint64(len(results))
+		for i, index := range results {
+			if index >= 0 {
+				id[0] = byte(i)
+			}
 		}
+		eventIDHex = hex.EncodeToString(id[:])
+	}
+	runtime.ReadMemStats(&after)
+	allocs := float64(after.Mallocs-before.Mallocs) / allocCheckRuns
+	perBatch := float64(session.launches-launches) / allocCheckRuns
+	limit := perBatch*maxLaunchAllocs + 1
+	vlog("Heap allocations: %.1f per batch of %.1f launches (limit %.0f, last ID %.8s…)", allocs, perBatch, limit, eventIDHex)
+	if allocs > limit {
+		return fmt.Errorf("batch loop made %.1f heap allocations per batch, more than %.0f (%d per launch and the ID)", allocs, limit, maxLaunchAllocs)
+	}
+	return nil
+}
 
-		// Execute kernel
-		remaining := batchSize
-		globalSize := []int{remaining}
-		_, err = queue.EnqueueNDRangeKernel(kernel, nil, globalSize, nil, nil)
-		if err != nil {
-			return 0, fmt.Errorf("failed to enqueue kernel: %v", err)
-		}
+// writeOutput prints the mined event to stdout, or writes it to path. The file
+// is written with writeFileAtomic, so a crash or power loss leaves either the
+// complete event or no file at all.
+func writeOutput(path string, eventJSON []byte) error {
+	data := append(append([]byte(nil), eventJSON...), '\n')
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
 
-		// Read results
-		readSize := remaining * resultSize
-		if readSize > resultsBufferSize {
-			readSize = resultsBufferSize
-			remaining = resultsBufferSize / resultSize
-		}
-		_, err = queue.EnqueueReadBuffer(resultsBuffer, true, 0, readSize, unsafe.Pointer(&results[0]), nil)
-		if err != nil {
-			return 0, fmt.Errorf("failed to read results buffer: %v", err)
-		}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	vlog("Wrote event to %s", path)
+	return nil
+}
 
-		totalTested += int64(remaining)
-		currentNonce += int64(remaining)
+// writeFileAtomic writes data to a temporary file in path's directory, syncs
+// it and renames it over path, so readers see the old or the new contents,
+// never a mix
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
 
-		// Check if we should continue
-		if time.Since(startTime) >= benchmarkDuration {
-			break
-		}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
 	}
 
-	elapsed := time.Since(startTime)
-	rate := float64(totalTested) / elapsed.Seconds()
-	return rate, nil
+	// Persist the rename itself; directories cannot be synced on every platform
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// eventWireSize returns the size of an event's JSON as published to relays,
+// counting a full-length id and signature even if they are not set yet
+func eventWireSize(event nostr.Event) int {
+	event.ID = strings.Repeat("0", 64)
+	if event.Sig == "" {
+		event.Sig = strings.Repeat("0", 128)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// parseResumePoint parses a -resume checkpoint of the form "<digits>:<nonce>".
+// An empty string yields zeros.
+func parseResumePoint(input string) (int, int64, error) {
+	if input == "" {
+		return 0, 0, nil
+	}
+	digitsStr, nonceStr, ok := strings.Cut(input, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid resume point %q (expected <digits>:<nonce>)", input)
+	}
+	digits, err := strconv.Atoi(digitsStr)
+	if err != nil || digits < 1 || digits > 18 {
+		return 0, 0, fmt.Errorf("invalid nonce digits %q", digitsStr)
+	}
+	nonce, err := strconv.ParseInt(nonceStr, 10, 64)
+	if err != nil || nonce < 1 {
+		return 0, 0, fmt.Errorf("invalid nonce %q", nonceStr)
+	}
+	return digits, nonce, nil
 }
 
 func main() {
 	// Parse CLI arguments
-	difficulty := flag.Int("difficulty", 16, "Number of leading zero bits required (NIP-13)")
+	difficultySpec := &difficultyFlag{bits: 16}
+	flag.Var(difficultySpec, "difficulty", "Number of leading zero bits required (NIP-13), or time:<duration> (e.g. time:30s) for the highest difficulty expected to take at most that long at the device's rate in the tuning cache")
+	difficulty := &difficultySpec.bits
 	batchSizePower := flag.Int("batch-size", -1, "Batch size as power of 10 (4=10000, 5=100000, etc.). -1 for auto-detect")
+	queues := flag.Int("queues", 1, "Command queues that split each batch on the device (advanced; -benchmark reports whether more than 1 helps)")
 	listDevices := flag.Bool("list-devices", false, "List available OpenCL devices and exit")
 	listDevicesShort := flag.Bool("l", false, "List available OpenCL devices and exit (short)")
 	deviceIndex := flag.Int("device", -1, "Select device by index from list (use -list-devices to see available devices)")
+	flag.Var(&autoSelect, "device-prefer", "Without -device, pick the device by these criteria, most important first: discrete, integrated, gpu, cpu, accelerator, units, memory, clock")
 	deviceIndexShort := flag.Int("d", -1, "Select device by index from list (short)")
+	flag.StringVar(&platformFilter, "platform", "", "Only use devices of this OpenCL platform: its index in -list-devices, or part of its name or vendor (e.g. nvidia)")
 	benchmark := flag.Bool("benchmark", false, "Benchmark different batch sizes to find optimal value")
+	tune := flag.Bool("tune", false, "Search batch sizes, work-group sizes and build options of the kernel for the fastest combination and record it in the tuning cache")
+	benchmarkAll := flag.Bool("benchmark-all", false, "Benchmark every device like -benchmark, compare them and record each device's best settings in the tuning cache")
 	testKernels := flag.Bool("test-kernels", false, "Test all kernels with random events to verify correctness")
-	kernelType := flag.String("kernel", "auto", "Kernel implementation to use: 'auto' (select based on device), 'default' (our implementation), or 'ckolivas' (sgminer)")
+	probe := flag.Bool("probe", false, "Build and self-test every kernel and run a 2-second benchmark on every device, then write a JSON diagnostic bundle to stdout (or -output) for bug reports")
+	benchEventSize := flag.String("bench-event-size", "typical", "Content size of the events -benchmark and -test-kernels mine: 'typical' (lengths seen on relays for each kind) or a fixed size such as 2K")
+	verifyInput := flag.Bool("verify", false, "Read a mined event from stdin, replay its hash on the CPU and the device, and report its ID, achieved and committed difficulty, nonce tag and signature")
+	calibrate := flag.Bool("calibrate", false, "Mine a few hundred low-difficulty events and check that the attempts each took follow the theoretical distribution")
+	calibrateEvents := flag.Int("calibrate-events", 300, "Events mined by -calibrate")
+	calibrateSeed := flag.Int64("calibrate-seed", 0, "Seed for the events mined by -calibrate (0 = random)")
+	conformance := flag.Bool("conformance", false, "Check the miner's NIP-13 handling (leading zero bits across byte boundaries, nonce tag formats, difficulty commitments) against curated edge cases on the CPU and, if available, the device, and print a compliance report")
+	selftestNetwork := flag.Bool("selftest-network", false, "Check the relay features (publishing, proof-of-work rejections, -check-relay, -notify) against an in-process mock relay, without OpenCL or a network connection")
+	batchMode := flag.Bool("batch", false, "Read one JSON event per line from stdin and write each mined event as a line, mining them all on one device session")
+	raceVariants := flag.Bool("race-variants", false, "Read variants of one event, one JSON event per line, from stdin, mine each on its own device at once and write the first one mined")
+	batchIdle := flag.Duration("batch-idle", time.Minute, "With -batch, release the device after waiting this long for the next event, so the GPU can idle at low power, and set it up again when one arrives (0 = keep it)")
+	stress := flag.Duration("stress", 0, "Mine random events on the device for this long, e.g. 30m, checking every hit and the rate, then print a pass/fail stability report")
+	kernelType := flag.String("kernel", "auto", "Kernel implementation to use: 'auto' (select based on device), 'default' (our implementation), 'ckolivas' (sgminer), 'amd' (AMD GCN/RDNA), 'nvidia' (NVIDIA), 'offset' (global offset variant), or 'midstate' (midstate variant)")
+	kernelFile := flag.String("kernel-file", "", "Mine with the OpenCL kernel in this file instead of a built-in one; it must follow the kernel ABI of the built-in kernels")
+	watchKernel := flag.Bool("watch", false, "With -kernel-file, rebuild and self-test the kernel whenever the file changes and switch to it between batches")
+	gpuMemBudget := flag.String("gpu-mem-budget", "0", "Maximum device memory the miner may allocate, e.g. 512M or 2G (0 = all device memory)")
+	deviceOpts := flag.String("device-opts", "", "Per-device overrides by device index, e.g. \"0:kernel=default,batch=1e6;1:kernel=nvidia,batch=1e7,mem=2G\"")
+	timeout := flag.Duration("timeout", 0, "Stop mining after this long, e.g. 10m or 2h (0 = no limit)")
+	resume := flag.String("resume", "", "Resume an interrupted run from the checkpoint it printed (<digits>:<nonce>)")
+	progressive := flag.Int("progressive", 0, "Write a version of the event to stdout as soon as it reaches this difficulty, then keep mining and write a better one every -progressive-step bits until -difficulty (0 = off)")
+	progressiveStep := flag.Int("progressive-step", 4, "Bits between the versions -progressive writes")
+	useResultCache := flag.Bool("result-cache", false, "Reuse nonces found by earlier runs for identical events and difficulty")
+	nonceTagMode := flag.String("nonce-tag-mode", "replace", "How to build the nonce tag: 'replace' (new [\"nonce\", value, difficulty] tag) or 'update' (mine only the value of the input's nonce tag, keeping its other elements)")
+	noncePrefix := flag.String("nonce-prefix", "", "Fixed string placed before the mined nonce digits, e.g. a worker ID, so workers mining the same event never test the same nonces")
+	nonceAlphabetSpec := flag.String("nonce-alphabet", "decimal", "Characters the mined nonce is written in: decimal, hex, base36, base36-novowels, or the characters themselves in digit order (not decimal: mined on the CPU, as the kernels write decimal digits)")
+	nonceTagPolicy := flag.String("nonce-tag-policy", "lenient", "What to do with malformed or duplicate nonce tags in the input: 'lenient' (drop them with a warning, keeping the first well-formed one) or 'strict' (refuse the event)")
+	nonceTagPosition := flag.String("nonce-tag-position", "keep", "Where to put the nonce tag: 'keep' (where the input had it, else last), 'first', 'last', or 'index:N'")
+	checkRelay := flag.String("check-relay", "", "For replaceable/addressable events, warn if this relay already has a newer version (e.g. wss://relay.example.com)")
+	bumpCreatedAt := flag.Bool("bump-created-at", false, "For replaceable/addressable events, move created_at to now (or past the newer version found with -check-relay)")
+	delegation := flag.String("delegation", "", "Add a NIP-26 delegation tag before mining: <delegator pubkey>:<conditions>:<token>")
+	ladderFile := flag.String("ladder-file", "", "Append events reaching intermediate difficulties to this file (one JSON event per line)")
+	ladderStep := flag.Int("ladder-step", 4, "Bits between intermediate difficulties written to -ladder-file")
+	retryAfter := flag.Float64("retry-after", 0, "After this many times the expected attempts (2^difficulty), bump created_at and restart from the shortest nonces (0 = never)")
+	maxEventSize := flag.String("max-event-size", "0", "Largest event (as sent to relays) the nonce may grow to, e.g. 64K (0 = no limit)")
+	transcriptPath := flag.String("transcript", "", "Write a transcript of the run (input event hash, nonce ranges searched with timestamps, found nonce) to this file")
+	transcriptKey := flag.String("transcript-key", "", "File holding a secret key (hex or nsec) to sign the -transcript with, as a kind 30078 Nostr event")
+	notifyTarget := flag.String("notify", "", "When mining ends or fails, send a notification with the outcome and the mined event: a NIP-04 DM to -notify-key's own pubkey via a relay (ws:// or wss:// URL), or a JSON POST to a webhook (http:// or https:// URL)")
+	notifyKey := flag.String("notify-key", "", "File holding the secret key (hex or nsec) -notify signs DMs to its own pubkey with")
+	outputPath := flag.String("output", "", "Write the mined event to this file (atomically) instead of stdout")
+	doubleCheck := flag.Bool("double-check", false, "Before writing the mined event, re-derive its ID and difficulty with an independent NIP-01 serializer and refuse to write it if they don't match")
+	stateDirFlag := flag.String("state-dir", "", "Directory for the tuning and result caches (default: the user cache directory)")
+	pidFile := flag.String("pid-file", "", "Write the process ID to this file while mining, for process supervisors")
+	apiListen := flag.String("api-listen", "", "Serve a cgminer-compatible monitoring API on this address, e.g. 127.0.0.1:4028")
+	statusListen := flag.String("status-listen", "", "Serve aggregate, non-sensitive mining stats at /status.json on this address, without authentication, e.g. :8080")
+	apiControl := flag.Bool("api-control", false, "Accept the setdifficulty command on -api-listen to change the target while mining")
+	cpuBelow := flag.String("cpu-below", "auto", "Mine on the CPU without OpenCL when the difficulty is at most this (-1 = always use the device), or 'auto' to pick whichever of the CPU and the fastest device in the tuning cache should finish sooner")
+	cpuThreads := flag.Int("cpu-threads", 0, "Threads used when mining on the CPU (0 = one per CPU)")
+	optimizeLayout := flag.Bool("optimize-layout", false, "Move the nonce tag after all other tags (this changes the event's tag order) and mine with the midstate kernel, so each nonce hashes as few SHA-256 blocks as possible")
+	startDigits := flag.Int("start-digits", 0, "Nonce width, in digits, to start mining at (0 = the narrowest that holds a batch); -analyze-digits recommends one")
+	analyzeDigits := flag.Bool("analyze-digits", false, "Measure the hash rate at each nonce width for the event on stdin and report which starting width minimizes the expected time, then exit without mining")
+	dryRun := flag.Bool("dry-run", false, "Show the serialized event, device, kernel, batch size, nonce digits, memory use and time estimate, then exit without mining")
+	pinThreads := flag.Bool("pin-threads", false, "Pin the host thread driving the device to CPUs on the GPU's NUMA node (Linux)")
+	flag.BoolVar(&traceHost, "trace-host", false, "Time the host side of the mining loop (serialization, kernel args, enqueue, results read, scan, validation) and print a breakdown on exit")
+	progressMode := flag.String("progress", "bar", "How to show mining progress on stderr: 'bar' (one redrawn line), 'json' (a JSON object per second, for log collectors) or 'none'")
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging")
 	flag.Parse()
 
@@ -1052,6 +1087,23 @@ func main() {
 		*deviceIndex = *deviceIndexShort
 	}
 
+	stateDir = *stateDirFlag
+
+	// time:<duration> difficulties need the device's rate
+	if difficultySpec.targetTime > 0 {
+		device, err := findDevice(*deviceIndex)
+		if err != nil {
+			log.Fatalf("Failed to select device for -difficulty %s: %v", difficultySpec, err)
+		}
+		kernel := *kernelType
+		if kernel == "auto" {
+			kernel = selectKernelForDevice(device)
+		}
+		if err := difficultySpec.resolve(device, kernel); err != nil {
+			log.Fatalf("Cannot use -difficulty %s: %v", difficultySpec, err)
+		}
+	}
+
 	if *difficulty < 0 || *difficulty > 256 {
 		log.Fatalf("Difficulty must be between 0 and 256, got %d", *difficulty)
 	}
@@ -1059,15 +1111,116 @@ func main() {
 	if *batchSizePower < -1 || *batchSizePower > 10 {
 		log.Fatalf("Batch size power must be between -1 (auto) and 10 (10000000000), got %d", *batchSizePower)
 	}
+	if *kernelFile != "" {
+		if *kernelType != "auto" && *kernelType != kernelFileType {
+			log.Fatalf("-kernel-file cannot be used with -kernel %s", *kernelType)
+		}
+		kernelFilePath = *kernelFile
+		*kernelType = kernelFileType
+	}
+	if *watchKernel && *kernelFile == "" {
+		log.Fatal("-watch needs -kernel-file")
+	}
+	if *queues < 1 || *queues > maxQueues {
+		log.Fatalf("Queues must be between 1 and %d, got %d", maxQueues, *queues)
+	}
+	if *progressive != 0 {
+		if *progressive < 1 || *progressive >= *difficulty {
+			log.Fatalf("-progressive must be between 1 and the -difficulty of %d, got %d", *difficulty, *progressive)
+		}
+		if *progressiveStep < 1 {
+			log.Fatalf("-progressive-step must be at least 1 bit, got %d", *progressiveStep)
+		}
+		if *useResultCache {
+			log.Fatal("-progressive cannot be used with -result-cache")
+		}
+	}
+
+	progressSink, err := newProgressSink(*progressMode)
+	if err != nil {
+		log.Fatalf("Invalid -progress: %v", err)
+	}
+
+	var transcriptSecret string
+	if *transcriptKey != "" {
+		if *transcriptPath == "" {
+			log.Fatal("-transcript-key needs -transcript")
+		}
+		if transcriptSecret, err = loadTranscriptKey(*transcriptKey); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if *transcriptPath != "" && *useResultCache {
+		log.Fatal("-transcript cannot be used with -result-cache")
+	}
+
+	memBudget, err := parseByteSize(*gpuMemBudget)
+	if err != nil {
+		log.Fatalf("Invalid -gpu-mem-budget: %v", err)
+	}
+
+	maxEventBytes, err := parseByteSize(*maxEventSize)
+	if err != nil {
+		log.Fatalf("Invalid -max-event-size: %v", err)
+	}
+
+	resumeDigits, resumeNonce, err := parseResumePoint(*resume)
+	if err != nil {
+		log.Fatalf("Invalid -resume: %v", err)
+	}
+
+	if err := checkNoncePrefix(*noncePrefix); err != nil {
+		log.Fatalf("Invalid -nonce-prefix: %v", err)
+	}
 
-	// Get platforms
-	platforms, err := cl.GetPlatforms()
+	cpuAuto, cpuBelowDifficulty, err := parseCPUBelow(*cpuBelow)
 	if err != nil {
-		log.Fatalf("Failed to get platforms: %v", err)
+		log.Fatalf("Invalid -cpu-below: %v", err)
+	}
+
+	// The kernels increment decimal digits, so other alphabets are mined on
+	// the CPU, by the plain mining path only
+	alphabet, err := parseNonceAlphabet(*nonceAlphabetSpec)
+	if err != nil {
+		log.Fatalf("Invalid -nonce-alphabet: %v", err)
+	}
+	if alphabet != decimalAlphabet {
+		switch {
+		case *batchMode:
+			log.Fatal("-batch mines decimal nonces only")
+		case *raceVariants:
+			log.Fatal("-race-variants mines decimal nonces only")
+		case *useResultCache:
+			log.Fatal("-result-cache stores decimal nonces only")
+		case !cpuAuto && cpuBelowDifficulty == -1:
+			log.Fatalf("-nonce-alphabet %s is mined on the CPU and cannot be used with -cpu-below -1", alphabet)
+		case *dryRun || *analyzeDigits || *resume != "" || *apiListen != "" || *statusListen != "" || *ladderFile != "" || *progressive != 0 || *transcriptPath != "":
+			log.Fatalf("-nonce-alphabet %s is mined on the CPU; -dry-run, -analyze-digits, -resume, -api-listen, -status-listen, -ladder-file, -progressive and -transcript need the device", alphabet)
+		}
 	}
 
-	if len(platforms) == 0 {
-		log.Fatal("No OpenCL platforms found")
+	if *nonceTagPolicy != "lenient" && *nonceTagPolicy != "strict" {
+		log.Fatalf("Invalid -nonce-tag-policy %q (use lenient or strict)", *nonceTagPolicy)
+	}
+
+	// -optimize-layout puts the nonce tag last, where the midstate kernel skips the most blocks
+	if *optimizeLayout {
+		if *nonceTagPosition != "keep" && *nonceTagPosition != "last" {
+			log.Fatalf("-optimize-layout puts the nonce tag last and cannot be used with -nonce-tag-position %s", *nonceTagPosition)
+		}
+		if *kernelType == "auto" {
+			*kernelType = "midstate"
+		}
+	}
+
+	benchEvents, err := newBenchmarkEvents(*benchEventSize, time.Now().UnixNano())
+	if err != nil {
+		log.Fatalf("Invalid -bench-event-size: %v", err)
+	}
+
+	perDeviceOpts, err := parseDeviceOptions(*deviceOpts)
+	if err != nil {
+		log.Fatalf("Invalid -device-opts: %v", err)
 	}
 
 	// List devices and exit if requested
@@ -1076,31 +1229,452 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Check NIP-13 edge cases, e.g. after updating go-nostr
+	if *conformance {
+		if !runConformance(os.Stdout, *deviceIndex, *kernelType) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Check the relay features without a live relay
+	if *selftestNetwork {
+		if !runNetworkSelfTest(*cpuThreads) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Collect a diagnostic bundle for a bug report
+	if *probe {
+		if err := runProbe(*difficulty, memBudget, benchEvents, *outputPath); err != nil {
+			log.Fatalf("Probe failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	// Run benchmark if requested
+	if *benchmarkAll {
+		runBenchmarkAll(*difficulty, memBudget, benchEvents)
+		os.Exit(0)
+	}
 	if *benchmark {
-		runBenchmark(*difficulty, *deviceIndex, *kernelType)
+		runBenchmark(*difficulty, *deviceIndex, *kernelType, memBudget, benchEvents)
+		os.Exit(0)
+	}
+
+	if *tune {
+		runTune(*deviceIndex, *kernelType, *difficulty, *queues, memBudget, benchEvents)
 		os.Exit(0)
 	}
 
 	// Test all kernels if requested
 	if *testKernels {
-		testAllKernels(*difficulty, *deviceIndex)
+		testAllKernels(*difficulty, *deviceIndex, benchEvents)
 		os.Exit(0)
 	}
 
-	// Collect all devices from all platforms
-	var allDevices []*cl.Device
-	var devicePlatforms []int
-	for platformIdx, platform := range platforms {
-		devices, err := platform.GetDevices(cl.DeviceTypeAll)
+	// Check an event someone says the miner got wrong
+	if *verifyInput {
+		jsonBytes, err := io.ReadAll(os.Stdin)
 		if err != nil {
-			vlog("Warning: Failed to get devices from platform %d: %v", platformIdx, err)
-			continue
+			log.Fatalf("Failed to read from stdin: %v", err)
 		}
-		for _, device := range devices {
-			allDevices = append(allDevices, device)
-			devicePlatforms = append(devicePlatforms, platformIdx)
+		var event nostr.Event
+		if err := json.Unmarshal(jsonBytes, &event); err != nil {
+			log.Fatalf("Failed to parse JSON event: %v", err)
+		}
+		// The device replay is optional, so verification works without OpenCL
+		var session *clSession
+		skipReason := ""
+		device, err := findDevice(*deviceIndex)
+		if err == nil {
+			session, err = newCLSession(device, *kernelType)
+		}
+		if err != nil {
+			skipReason = err.Error()
+		}
+		ok := verifyEvent(os.Stderr, event, session, skipReason)
+		if session != nil {
+			session.Release()
+			reportCLObjects()
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Compare the kernel's attempts-to-success distribution against theory
+	if *calibrate {
+		if *calibrateEvents < 1 {
+			log.Fatalf("-calibrate-events must be positive, got %d", *calibrateEvents)
+		}
+		seed := *calibrateSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		if !runCalibration(*deviceIndex, *kernelType, *calibrateEvents, seed) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Burn in a new rig or overclock before trusting it with real work
+	if *stress != 0 {
+		if *stress < 0 {
+			log.Fatalf("-stress must be positive, got %s", *stress)
+		}
+		if !runStress(*deviceIndex, *kernelType, *stress, *batchSizePower, memBudget) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Mine a stream of events on one session
+	if *batchMode {
+		if *raceVariants {
+			log.Fatal("-batch and -race-variants exclude each other")
+		}
+		if *difficulty < 1 {
+			log.Fatal("-batch needs a -difficulty of at least 1")
+		}
+		opts := libOptions{Device: *deviceIndex, Kernel: *kernelType, NoncePrefix: *noncePrefix}
+		if *batchSizePower >= 0 {
+			opts.BatchSize = int(math.Pow(10, float64(*batchSizePower)))
+		}
+		var out io.Writer = os.Stdout
+		var buffered bytes.Buffer
+		if *outputPath != "" {
+			out = &buffered
+		}
+		mined, failed, err := runBatchMining(os.Stdin, out, *difficulty, opts, memBudget, *batchIdle)
+		if err != nil {
+			log.Fatalf("Batch mining failed: %v", err)
+		}
+		if *outputPath != "" {
+			if err := writeOutput(*outputPath, bytes.TrimSuffix(buffered.Bytes(), []byte("\n"))); err != nil {
+				log.Fatalf("Failed to write output: %v", err)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Mined %d events, %d failed\n", mined, failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Race variants of one event across the devices
+	if *raceVariants {
+		if *difficulty < 1 {
+			log.Fatal("-race-variants needs a -difficulty of at least 1")
+		}
+		opts := libOptions{Kernel: *kernelType, NoncePrefix: *noncePrefix}
+		if *batchSizePower >= 0 {
+			opts.BatchSize = int(math.Pow(10, float64(*batchSizePower)))
+		}
+		mined, variant, err := runRaceVariants(os.Stdin, *difficulty, opts, memBudget)
+		if err != nil {
+			log.Fatalf("Racing variants failed: %v", err)
+		}
+		eventJSON, err := json.Marshal(mined)
+		if err != nil {
+			log.Fatalf("Failed to encode event: %v", err)
+		}
+		if err := writeOutput(*outputPath, eventJSON); err != nil {
+			log.Fatalf("Failed to write output: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Variant %d won: %s\n", variant, mined.ID)
+		os.Exit(0)
+	}
+
+	// -progressive mines toward the good-enough difficulty first and raises
+	// the target after each version it writes
+	finalDifficulty := *difficulty
+	if *progressive != 0 {
+		*difficulty = *progressive
+	}
+
+	// The PID file covers the mining run; a file left by a run that died
+	// without removing it is replaced by the next one
+	if *pidFile != "" {
+		if err := writePIDFile(*pidFile); err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer removePIDFile(*pidFile)
+	}
+
+	// Tiny targets are mined on the CPU without touching OpenCL. Features that
+	// only make sense for a GPU run keep the GPU path.
+	useCPU := !*dryRun && !*analyzeDigits && *resume == "" && *apiListen == "" && *statusListen == "" && *ladderFile == "" && *progressive == 0 && *transcriptPath == ""
+	if alphabet != decimalAlphabet {
+		threads := *cpuThreads
+		if threads <= 0 {
+			threads = runtime.GOMAXPROCS(0)
+		}
+		if rate := cpuRate(loadTuningCache(), threads); rate > 0 {
+			if expected := time.Duration(math.Pow(2, float64(*difficulty)) / rate * float64(time.Second)); expected > time.Minute {
+				fmt.Fprintf(os.Stderr, "Warning: -nonce-alphabet %s is mined on the CPU, which expects to take about %s at difficulty %d\n", alphabet, expected.Round(time.Second), *difficulty)
+			}
+		}
+	} else if useCPU {
+		if cpuAuto {
+			// Choosing a device, kernel or batch size asks for the device:
+			// auto leaves those runs on it
+			var pinned []string
+			flag.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "device", "kernel", "kernel-file", "batch-size":
+					pinned = append(pinned, "-"+f.Name)
+				}
+			})
+			if len(pinned) > 0 {
+				useCPU = false
+				vlog("Mining on the device, not the CPU: %s set explicitly (-cpu-below auto only picks the CPU without them)", strings.Join(pinned, ", "))
+			} else {
+				useCPU = preferCPU(*difficulty, *cpuThreads)
+			}
+		} else {
+			useCPU = *difficulty <= cpuBelowDifficulty
+		}
+	}
+
+	// The event is read and prepared (which may involve a relay query) while
+	// OpenCL is set up and the kernel compiled, so short jobs start sooner.
+	// Nothing in the device setup below depends on the event.
+	var event nostr.Event
+	var noncePosition int
+	var nonceTemplate nostr.Tag
+	var resultCacheFile *resultCache
+	var cacheKey string
+	readInput := func() {
+		// Read JSON event from stdin
+		jsonBytes, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("Failed to read from stdin: %v", err)
+		}
+
+		if len(jsonBytes) == 0 {
+			log.Fatal("No input provided")
+		}
+
+		// Parse the JSON event using go-nostr library
+		var warnings []string
+		event, warnings, err = parseInputEvent(jsonBytes)
+		if err != nil {
+			log.Fatalf("Failed to parse JSON event: %v", err)
+		}
+		for _, warning := range append(warnings, eventShapeWarnings(event)...) {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		}
+
+		// Replaceable events: don't mine a version relays would discard as stale
+		prepareReplaceableEvent(&event, *checkRelay, *bumpCreatedAt)
+
+		// NIP-26: add the delegation tag (after any created_at bump, so its conditions are checked against the final event)
+		if *delegation != "" {
+			tag, err := parseDelegationTag(*delegation)
+			if err != nil {
+				log.Fatalf("Invalid -delegation: %v", err)
+			}
+			if err := addDelegationTag(&event, tag); err != nil {
+				log.Fatalf("Delegation check failed: %v", err)
+			}
+			vlog("Added delegation tag from %s (%s)", tag[1], tag[2])
+		}
+
+		// Settle on at most one well-formed input nonce tag, so position and template agree
+		tags, warnings, err := sanitizeNonceTags(event.Tags, *nonceTagPolicy)
+		if err != nil {
+			log.Fatalf("Input rejected by -nonce-tag-policy strict: %v", err)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		}
+		event.Tags = tags
+
+		// Decide where the nonce tag goes, then remove any existing nonce tag to avoid duplicates
+		noncePosition, err = resolveNonceTagPosition(*nonceTagPosition, event.Tags)
+		if err != nil {
+			log.Fatalf("Invalid -nonce-tag-position: %v", err)
+		}
+		nonceTemplate, err = nonceTagTemplate(*nonceTagMode, event.Tags, *difficulty)
+		if err != nil {
+			log.Fatalf("Invalid -nonce-tag-mode: %v", err)
+		}
+		if target := nonceTemplate[2]; target != strconv.Itoa(*difficulty) {
+			fmt.Fprintf(os.Stderr, "Warning: Input nonce tag commits to target %q, not the -difficulty of %d; keeping it\n", target, *difficulty)
+		}
+		event.Tags = withoutNonceTags(event.Tags)
+		if *optimizeLayout {
+			// A 10-digit sample nonce; a few digits more or less rarely change the block count
+			sample := nonceTagWithValue(nonceTemplate, *noncePrefix+strings.Repeat("0", 10))
+			if err := reportLayout(os.Stderr, event, sample, noncePosition); err != nil {
+				log.Fatalf("Failed to optimize layout: %v", err)
+			}
+			noncePosition = nonceTagLast
+		}
+
+		// Return the nonce found by an earlier run for the same event and difficulty
+		if *useResultCache {
+			resultCacheFile = loadResultCache()
+			// The template's value holds the prefix, so workers with different prefixes don't share results
+			cacheKey = resultCacheKey(event, nonceTagWithValue(nonceTemplate, *noncePrefix), *difficulty, noncePosition)
+			if nonceStr, ok := resultCacheFile.lookup(cacheKey); ok && *dryRun {
+				fmt.Fprintf(os.Stderr, "Result cache has nonce %s for this event; a real run would return it without mining\n", nonceStr)
+			} else if ok {
+				eventJSON, err := cachedResult(event, nonceTemplate, nonceStr, *difficulty, noncePosition)
+				if err == nil && *doubleCheck {
+					err = doubleCheckOutput(eventJSON, *difficulty)
+				}
+				if err == nil {
+					vlog("Using cached nonce %s", nonceStr)
+					if err := writeOutput(*outputPath, eventJSON); err != nil {
+						log.Fatalf("Failed to write output: %v", err)
+					}
+					os.Exit(0)
+				}
+				vlog("Warning: Ignoring cached result: %v", err)
+			}
+		}
+	}
+
+	// From here on the run's outcome is worth a notification; fatal errors
+	// send theirs through the log
+	var notify *notifier
+	if *notifyTarget != "" {
+		if notify, err = newNotifier(*notifyTarget, *notifyKey); err != nil {
+			log.Fatalf("Invalid -notify: %v", err)
+		}
+		log.SetOutput(io.MultiWriter(os.Stderr, notify))
+	} else if *notifyKey != "" {
+		log.Fatal("-notify-key needs -notify")
+	}
+
+	// Tiny targets: the CPU finds a nonce before OpenCL would be ready
+	if useCPU {
+		readInput()
+		if alphabet != decimalAlphabet {
+			vlog("Mining difficulty %d on the CPU (-nonce-alphabet %s)", *difficulty, alphabet)
+		} else {
+			vlog("Mining difficulty %d on the CPU (-cpu-below %s)", *difficulty, *cpuBelow)
+		}
+		// Ctrl-C, SIGTERM and -timeout stop the workers within a chunk
+		interrupted := make(chan os.Signal, 1)
+		signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+		stop := make(chan struct{})
+		go func() {
+			<-interrupted
+			close(stop)
+		}()
+		var deadline time.Time
+		if *timeout > 0 {
+			deadline = time.Now().Add(*timeout)
+		}
+		start := time.Now()
+		mined, hashes, err := mineOnCPU(event, nonceTemplate, *noncePrefix, alphabet, noncePosition, *difficulty, *cpuThreads, deadline, stop)
+		signal.Stop(interrupted)
+		if err != nil {
+			timedOut := !deadline.IsZero() && !time.Now().Before(deadline)
+			select {
+			case <-stop:
+				timedOut = false
+			default:
+				if !timedOut {
+					log.Fatalf("CPU mining failed: %v", err)
+				}
+			}
+			if *pidFile != "" {
+				removePIDFile(*pidFile)
+			}
+			// The CPU path keeps no position to resume from
+			resumeLine := "Cannot resume a CPU run; run again to start over"
+			if timedOut {
+				fmt.Fprintf(os.Stderr, "Mining stopped at the %s deadline after %d nonces on the CPU\n", *timeout, hashes)
+				fmt.Fprintln(os.Stderr, resumeLine)
+				notify.send("timed out", resumeLine, 0, nil)
+				os.Exit(124)
+			}
+			fmt.Fprintf(os.Stderr, "Mining cancelled after %d nonces on the CPU (%s)\n", hashes, time.Since(start).Round(time.Millisecond))
+			fmt.Fprintln(os.Stderr, resumeLine)
+			notify.send("cancelled", resumeLine, 0, nil)
+			os.Exit(130)
+		}
+		// Runs long enough to be measured refresh the rate -cpu-below auto uses
+		if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+			threads := *cpuThreads
+			if threads <= 0 {
+				threads = runtime.GOMAXPROCS(0)
+			}
+			cache := loadTuningCache()
+			cache.recordCPURate(float64(hashes)/elapsed.Seconds(), threads)
+			if err := cache.save(); err != nil {
+				vlog("Warning: Failed to save tuning cache: %v", err)
+			}
 		}
+		if maxEventBytes > 0 && eventWireSize(mined) > int(maxEventBytes) {
+			log.Fatalf("Event is %d bytes, over the -max-event-size limit of %d bytes", eventWireSize(mined), maxEventBytes)
+		}
+		vlog("Found nonce on the CPU in %s (%d leading zero bits)", time.Since(start).Round(time.Microsecond), nip13.Difficulty(mined.ID))
+
+		if resultCacheFile != nil {
+			for _, tag := range mined.Tags {
+				if isNonceTag(tag) {
+					resultCacheFile.store(cacheKey, tag[1])
+					break
+				}
+			}
+			if err := resultCacheFile.save(); err != nil {
+				vlog("Warning: Failed to save result cache: %v", err)
+			}
+		}
+
+		eventJSON, err := json.Marshal(mined)
+		if err != nil {
+			log.Fatalf("Failed to marshal final event: %v", err)
+		}
+		if *doubleCheck {
+			if err := doubleCheckOutput(eventJSON, *difficulty); err != nil {
+				log.Fatalf("Double-check failed: %v", err)
+			}
+			vlog("Double-check passed: ID and difficulty match an independent serialization")
+		}
+		if err := writeOutput(*outputPath, eventJSON); err != nil {
+			log.Fatalf("Failed to write output: %v", err)
+		}
+		notify.send("mined", "", nip13.Difficulty(mined.ID), &mined)
+		if *pidFile != "" {
+			removePIDFile(*pidFile)
+		}
+		os.Exit(0)
+	}
+
+	// Setup time until mining starts is recorded for -cpu-below auto
+	setupStart := time.Now()
+	inputDone := make(chan struct{})
+	go func() {
+		readInput()
+		close(inputDone)
+	}()
+
+	// Collect devices platform by platform, stopping once the requested index
+	// is found: initializing every platform's driver can take hundreds of
+	// milliseconds. Auto-selection compares every device, so it needs them all.
+	platforms, enumeratedAll, err := enumeratePlatforms(func(found []*cl.Device) bool {
+		return *deviceIndex >= 0 && len(found) > *deviceIndex
+	})
+	if err != nil {
+		log.Fatalf("Failed to list devices: %v", err)
+	}
+	var allDevices []*cl.Device
+	for _, pd := range platforms {
+		if pd.skipped != "" {
+			vlog("Warning: Skipping platform %d (%s): %s", pd.index, pd.platform.Name(), pd.skipped)
+		}
+		allDevices = append(allDevices, pd.devices...)
+	}
+	if !enumeratedAll {
+		vlog("Found the device, not enumerating the remaining platform(s)")
 	}
 
 	if len(allDevices) == 0 {
@@ -1109,6 +1683,7 @@ func main() {
 
 	// Select device
 	var selectedDevice *cl.Device
+	selectedIndex := *deviceIndex
 	if *deviceIndex >= 0 {
 		if *deviceIndex >= len(allDevices) {
 			log.Fatalf("Device index %d is out of range. Use -list-devices to see available devices (0-%d)",
@@ -1118,29 +1693,51 @@ func main() {
 		deviceName := selectedDevice.Name()
 		vlog("Selected device [%d]: %s", *deviceIndex, deviceName)
 	} else {
-		// Default: prefer GPU devices, then use first available
-		selectedDevice = nil
+		// Pick by -device-prefer, logging how each device compares
 		for i, device := range allDevices {
-			deviceType := device.Type()
-			if (deviceType & cl.DeviceTypeGPU) != 0 {
-				selectedDevice = device
-				deviceName := device.Name()
-				vlog("Auto-selected GPU device [%d]: %s", i, deviceName)
-				break
-			}
+			vlog("Candidate device [%d]: %s (%s)", i, device.Name(), describeDevice(device))
+		}
+		selectedIndex = autoSelect.pick(allDevices)
+		selectedDevice = allDevices[selectedIndex]
+		vlog("Auto-selected device [%d]: %s by preference %s", selectedIndex, selectedDevice.Name(), autoSelect.String())
+	}
+
+	// Apply per-device overrides for the selected device
+	for index := range perDeviceOpts {
+		if enumeratedAll && index >= len(allDevices) {
+			fmt.Fprintf(os.Stderr, "Warning: -device-opts lists device %d, but only devices 0-%d exist\n", index, len(allDevices)-1)
+		}
+	}
+	if o, ok := perDeviceOpts[selectedIndex]; ok {
+		if o.Kernel != "" {
+			*kernelType = o.Kernel
+		}
+		if o.BatchSizePower >= 0 {
+			*batchSizePower = o.BatchSizePower
 		}
-		if selectedDevice == nil {
-			// No GPU found, use first device
-			selectedDevice = allDevices[0]
-			deviceName := selectedDevice.Name()
-			vlog("Auto-selected device [0]: %s", deviceName)
+		if o.MemBudget > 0 {
+			memBudget = o.MemBudget
+		}
+		vlog("Applied device options for device [%d]: kernel=%s batch-size=%d gpu-mem-budget=%d", selectedIndex, *kernelType, *batchSizePower, memBudget)
+	}
+
+	// Pin before creating the context so driver threads inherit the affinity
+	if *pinThreads {
+		cpuList, err := pinThreadsToDevice(selectedDevice)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Not pinning threads: %v\n", err)
+		} else {
+			vlog("Pinned host thread to CPUs %s (local to %s)", cpuList, selectedDevice.Name())
 		}
 	}
 
 	devices := []*cl.Device{selectedDevice}
 
-	// Auto-detect batch size if not specified
+	// Auto-detect batch size if not specified. Auto-sized batches then adapt
+	// to the observed batch latency while mining (see batchController).
 	var batchSize int
+	autoBatch := *batchSizePower == -1
+	lowTargetBatch := maxAdaptiveBatch
 	if *batchSizePower == -1 {
 		// Auto-detect based on device capabilities
 		device := devices[0]
@@ -1200,88 +1797,79 @@ func main() {
 		vlog("  Global memory: %d MB", globalMemSize/(1024*1024))
 		vlog("  Estimated capacity: %d work items", estimatedCapacity)
 		vlog("  Selected batch size: 10^%d = %d", *batchSizePower, int(math.Pow(10, float64(*batchSizePower))))
-	}
-
-	batchSize = int(math.Pow(10, float64(*batchSizePower)))
 
-	// Additional safety: limit batch size based on max work group size
-	// Some OpenCL implementations have issues with very large global sizes
-	maxWorkGroupSize := devices[0].MaxWorkGroupSize()
-	if batchSize > maxWorkGroupSize*100 {
-		// Limit to 100x the work group size as a safety measure
-		originalBatchSize := batchSize
-		batchSize = maxWorkGroupSize * 100
-		// Round down to nearest power of 10
-		batchSizePowerAdjusted := int(math.Floor(math.Log10(float64(batchSize))))
-		batchSize = int(math.Pow(10, float64(batchSizePowerAdjusted)))
-		if batchSize != originalBatchSize {
-			vlog("Warning: Adjusted batch size from %d to %d based on work group size limit", originalBatchSize, batchSize)
+		// Low targets are usually met within the first few thousand nonces, and
+		// a big batch would mostly hash past the answer. Size the batch for ~98%
+		// odds of a hit (4x the expected attempts) instead.
+		lowPower := int(math.Ceil(math.Log10(4 * math.Pow(2, float64(*difficulty)))))
+		if lowPower < 3 {
+			lowPower = 3
+		}
+		if lowPower < 8 {
+			lowTargetBatch = int(math.Pow(10, float64(lowPower)))
+		}
+		if lowPower < *batchSizePower {
+			*batchSizePower = lowPower
+			vlog("  Reduced batch size to 10^%d for difficulty %d", lowPower, *difficulty)
 		}
 	}
 
-	// Create context
-	context, err := cl.CreateContext([]*cl.Device{devices[0]})
-	if err != nil {
-		log.Fatalf("Failed to create context: %v", err)
-	}
-	defer context.Release()
+	batchSize = int(math.Pow(10, float64(*batchSizePower)))
 
-	// Create command queue
-	queue, err := context.CreateCommandQueue(devices[0], 0)
-	if err != nil {
-		log.Fatalf("Failed to create command queue: %v", err)
+	// Batches larger than the device accepts in one launch are split into
+	// several launches (see clSession.runBatch)
+	limits := queryDeviceLimits(selectedDevice)
+	if batchSize > limits.maxGlobalSize(0) {
+		vlog("Batch of %d nonces exceeds the device's %d work items per launch; it will be run in %d launches",
+			batchSize, limits.maxGlobalSize(0), (batchSize+limits.maxGlobalSize(0)-1)/limits.maxGlobalSize(0))
+	}
+
+	// Adapted batches grow no further than the low-target cap
+	maxLaunch := batchSize
+	if autoBatch {
+		maxLaunch = min(maxAdaptiveBatch, lowTargetBatch)
+		if (selectedDevice.Type() & cl.DeviceTypeCPU) != 0 {
+			// CPU runtimes may segfault on batches beyond 10^4
+			maxLaunch = min(maxLaunch, 10000)
+		}
+		maxLaunch = max(maxLaunch, batchSize)
 	}
-	defer queue.Release()
 
-	// Get kernel source
-	kernelSource, kernelName, err := getKernelSource(*kernelType, selectedDevice)
-	if err != nil {
-		log.Fatalf("Failed to get kernel source: %v", err)
-	}
-	// Show actual kernel selected (in case auto was used)
+	// Resolve the kernel (in case auto was used) and make sure it produces
+	// correct results on this device before mining with it
 	actualKernel := *kernelType
 	if *kernelType == "auto" {
 		actualKernel = selectKernelForDevice(selectedDevice)
-		vlog("Auto-selected kernel: %s (function: %s) for device: %s", actualKernel, kernelName, selectedDevice.Name())
-	} else {
-		vlog("Using kernel: %s (function: %s)", actualKernel, kernelName)
 	}
+	actualKernel = gateKernel(selectedDevice, actualKernel)
 
-	// Create program
-	program, err := context.CreateProgramWithSource([]string{kernelSource})
+	// Create context, queue and kernel
+	session, err := newMiningSession(selectedDevice, actualKernel)
 	if err != nil {
-		log.Fatalf("Failed to create program: %v", err)
+		log.Fatalf("Kernel %s: %v", actualKernel, err)
 	}
-	defer program.Release()
-
-	// Build program
-	err = program.BuildProgram(nil, "")
-	if err != nil {
-		log.Fatalf("Failed to build program: %v", err)
+	defer reportCLObjects()
+	// The session is replaced if its kernel is quarantined while mining
+	defer func() { session.Release() }()
+	if *kernelType == "auto" {
+		vlog("Auto-selected kernel: %s (function: %s) for device: %s", actualKernel, session.kernelName, selectedDevice.Name())
+	} else {
+		vlog("Using kernel: %s (function: %s)", actualKernel, session.kernelName)
 	}
-
-	// Create kernel
-	kernel, err := program.CreateKernel(kernelName)
-	if err != nil {
-		log.Fatalf("Failed to create kernel: %v", err)
+	vlog("Kernel %s", session.abi)
+	vlog("Occupancy: %s", session.occupancy)
+	if advice := session.occupancy.advice(); advice != "" {
+		vlog("Occupancy advice: %s", advice)
 	}
-	defer kernel.Release()
-
-	// Read JSON event from stdin
-	jsonBytes, err := io.ReadAll(os.Stdin)
-	if err != nil {
-		log.Fatalf("Failed to read from stdin: %v", err)
+	if err := session.setQueues(*queues); err != nil {
+		log.Fatalf("Failed to set up %d command queues: %v", *queues, err)
 	}
-
-	if len(jsonBytes) == 0 {
-		log.Fatal("No input provided")
+	if *queues > 1 {
+		vlog("Splitting each batch across %d command queues", *queues)
 	}
 
-	// Parse the JSON event using go-nostr library
-	var event nostr.Event
-	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		log.Fatalf("Failed to parse JSON event: %v", err)
-	}
+	// The kernel is ready; wait for the event
+	<-inputDone
 
 	// Calculate maximum number of digits needed for nonce based on difficulty
 	// Expected attempts = 2^difficulty, we want 2 orders of magnitude more
@@ -1298,61 +1886,271 @@ func main() {
 		minRequiredDigits = 5 // Minimum 5 digits
 	}
 
-	vlog("Difficulty: %d, Nonce digits: %d-%d (dynamic sizing)", *difficulty, minRequiredDigits, maxRequiredDigits)
+	// Keep the event under the relay size limit: each extra nonce digit adds a byte
+	if maxEventBytes > 0 {
+		probe := event
+		probe.Tags = withNonceTag(event.Tags, nonceTagWithValue(nonceTemplate, *noncePrefix+strings.Repeat("0", minRequiredDigits)), noncePosition)
+		minSize := eventWireSize(probe)
+		if minSize > int(maxEventBytes) {
+			log.Fatalf("Event is %d bytes with a %d-digit nonce, over the -max-event-size limit of %d bytes", minSize, minRequiredDigits, maxEventBytes)
+		}
+		if allowed := minRequiredDigits + int(maxEventBytes) - minSize; allowed < maxRequiredDigits {
+			fmt.Fprintf(os.Stderr, "Warning: -max-event-size limits the nonce to %d digits (wanted up to %d); mining may run out of nonces\n",
+				allowed, maxRequiredDigits)
+			maxRequiredDigits = allowed
+		}
+		if maxSize := minSize + maxRequiredDigits - minRequiredDigits; maxSize*10 > int(maxEventBytes)*9 {
+			fmt.Fprintf(os.Stderr, "Warning: Event will be up to %d bytes, close to the -max-event-size limit of %d bytes\n", maxSize, maxEventBytes)
+		}
+		vlog("Event size: %d-%d bytes (limit %d)", minSize, minSize+maxRequiredDigits-minRequiredDigits, maxEventBytes)
+	}
 
-	// Remove any existing nonce tag to avoid duplicates
-	filteredTags := make(nostr.Tags, 0, len(event.Tags))
-	for _, tag := range event.Tags {
-		if len(tag) > 0 && tag[0] != "nonce" {
-			filteredTags = append(filteredTags, tag)
+	// Nonces narrower than the starting width are never tried
+	firstDigits := minRequiredDigits
+	if *startDigits != 0 {
+		if *startDigits < minRequiredDigits || *startDigits > maxRequiredDigits {
+			log.Fatalf("-start-digits must be between %d and %d for this difficulty and batch size, got %d",
+				minRequiredDigits, maxRequiredDigits, *startDigits)
 		}
+		firstDigits = *startDigits
 	}
-	event.Tags = filteredTags
+
+	vlog("Difficulty: %d, Nonce digits: %d-%d (dynamic sizing)", *difficulty, firstDigits, maxRequiredDigits)
 
 	// We'll dynamically add the nonce tag and find its position
-	// Start with minimum digits for the first batch
-	currentDigits := minRequiredDigits
+	// Start with the first width for the first batch
+	currentDigits := firstDigits
+	if resumeDigits > 0 {
+		if resumeDigits < minRequiredDigits || resumeDigits > maxRequiredDigits {
+			log.Fatalf("Resume point uses %d-digit nonces, but this run uses %d-%d digits (use the same -difficulty and -batch-size)",
+				resumeDigits, minRequiredDigits, maxRequiredDigits)
+		}
+		currentDigits = resumeDigits
+		vlog("Resuming at %d-digit nonce %d", resumeDigits, resumeNonce)
+	}
 
 	vlog("Mining with difficulty %d (leading zero bits)", *difficulty)
 	vlog("Batch size: %d nonces", batchSize)
 
 	// Results buffer: index (int32, 4 bytes) per work item
 	// -1 means not found, >= 0 means valid nonce found at that index
-	resultSize := 4 // int32
-	resultsBufferSize := batchSize * resultSize
+	// Reserve room for the input buffer at the widest nonce we may use
+	sizingEvent := event
+	sizingEvent.Tags = append(append(nostr.Tags{}, event.Tags...),
+		nonceTagWithValue(nonceTemplate, *noncePrefix+strings.Repeat("0", maxRequiredDigits)))
+	maxBatch, err := maxBatchForMemory(selectedDevice, memBudget, len(sizingEvent.Serialize()))
+	if err != nil {
+		log.Fatalf("Cannot fit mining buffers in device memory: %v", err)
+	}
+	if batchSize > maxBatch {
+		fmt.Fprintf(os.Stderr, "Warning: Batch size %d needs a %s results buffer, reducing to %d to fit the device memory budget\n",
+			batchSize, formatByteSize(int64(batchSize)*resultSize), maxBatch)
+		batchSize = maxBatch
+	}
+	if maxLaunch > maxBatch {
+		maxLaunch = maxBatch
+	}
+	maxLaunch = max(maxLaunch, batchSize)
+	vlog("Results buffer: %s (memory budget: %s, max allocation: %s)", formatByteSize(int64(maxLaunch)*resultSize),
+		formatByteSize(memBudgetOrDevice(selectedDevice, memBudget)), formatByteSize(selectedDevice.MaxMemAllocSize()))
+
+	// Report the plan and stop before allocating buffers
+	if *dryRun {
+		placeholder := *noncePrefix + fmt.Sprintf("%0*d", currentDigits, int64(math.Pow(10, float64(currentDigits-1))))
+		planEvent := event
+		planEvent.Tags = withNonceTag(event.Tags, nonceTagWithValue(nonceTemplate, placeholder), noncePosition)
+		printMiningPlan(os.Stderr, miningPlan{
+			event:       planEvent,
+			placeholder: placeholder,
+			deviceIndex: selectedIndex,
+			device:      selectedDevice,
+			kernel:      actualKernel,
+			kernelName:  session.kernelName,
+			abi:         session.abi,
+			batchSize:   batchSize,
+			maxBatch:    maxLaunch,
+			minDigits:   firstDigits,
+			maxDigits:   maxRequiredDigits,
+			difficulty:  *difficulty,
+			memBudget:   memBudget,
+			inputSize:   len(sizingEvent.Serialize()),
+			hashRate:    loadTuningCache().kernel(selectedDevice, actualKernel).HashRate,
+		})
+		session.Release()
+		reportCLObjects()
+		if *pidFile != "" {
+			removePIDFile(*pidFile)
+		}
+		os.Exit(0)
+	}
 
-	// Safety check: limit results buffer to reasonable size (100MB)
-	maxResultsBufferSize := 100 * 1024 * 1024
-	if resultsBufferSize > maxResultsBufferSize {
-		vlog("Warning: Batch size %d would require %d MB results buffer, limiting to %d MB",
-			batchSize, resultsBufferSize/(1024*1024), maxResultsBufferSize/(1024*1024))
-		batchSize = maxResultsBufferSize / resultSize
-		resultsBufferSize = batchSize * resultSize
-		vlog("Adjusted batch size to %d", batchSize)
+	if err := session.allocResults(maxLaunch); err != nil {
+		log.Fatalf("Failed to allocate device buffers: %v", err)
+	}
+
+	// Windows resets a GPU whose launch runs past its watchdog delay. With a
+	// known rate, launches are capped to stay well short of it; forced
+	// batches beyond it are then split, and warned about.
+	var launchCap int
+	if underGPUWatchdog(selectedDevice) {
+		rate := loadTuningCache().kernel(selectedDevice, actualKernel).HashRate
+		launchCap = watchdogLaunchCap(rate)
+		switch {
+		case launchCap > 0:
+			session.setLaunchCap(launchCap)
+			vlog("Capping launches at %d nonces to stay under the %s GPU watchdog", launchCap, tdrDelay)
+			if !autoBatch && float64(batchSize)/rate > tdrDelay.Seconds() {
+				fmt.Fprintf(os.Stderr, "Warning: A batch of %d nonces takes about %.1fs on this device, past Windows' %s GPU watchdog; it will be run in launches of %d\n",
+					batchSize, float64(batchSize)/rate, tdrDelay, launchCap)
+			}
+		case !autoBatch && batchSize > tdrUnknownBatch:
+			fmt.Fprintf(os.Stderr, "Warning: A batch of %d nonces may run past Windows' %s GPU watchdog, which resets the driver; run -benchmark once to cap launches, or use a smaller -batch-size\n",
+				batchSize, tdrDelay)
+		}
 	}
 
-	resultsBuffer, err := context.CreateEmptyBuffer(cl.MemWriteOnly, resultsBufferSize)
-	if err != nil {
-		log.Fatalf("Failed to create results buffer: %v", err)
+	// rebuildSession replaces a session whose device context was lost
+	rebuildSession := func() {
+		session.Release()
+		var err error
+		if session, err = newMiningSession(selectedDevice, actualKernel); err != nil {
+			log.Fatalf("Kernel %s: %v", actualKernel, err)
+		}
+		if err := session.setQueues(*queues); err != nil {
+			log.Fatalf("Failed to set up %d command queues: %v", *queues, err)
+		}
+		if err := session.allocResults(maxLaunch); err != nil {
+			log.Fatalf("Failed to allocate device buffers: %v", err)
+		}
+		session.setLaunchCap(launchCap)
+	}
+
+	// Compare starting widths and stop before mining
+	if *analyzeDigits {
+		analysis := digitAnalysis{
+			event:         event,
+			nonceTemplate: nonceTemplate,
+			prefix:        *noncePrefix,
+			position:      noncePosition,
+			minDigits:     minRequiredDigits,
+			maxDigits:     maxRequiredDigits,
+			difficulty:    *difficulty,
+			batchSize:     batchSize,
+		}
+		analysis.run(os.Stderr, session)
+		session.Release()
+		reportCLObjects()
+		if *pidFile != "" {
+			removePIDFile(*pidFile)
+		}
+		os.Exit(0)
+	}
+	batches := newBatchController(batchSize, min(batchSize, batchGranule), maxLaunch)
+	if maxLaunch > batchSize {
+		vlog("Adapting batch size between %d and %d nonces to keep batches at %s-%s", batches.min, maxLaunch, batchTargetMin, batchTargetMax)
 	}
-	defer resultsBuffer.Release()
 
 	// Mining loop with dynamic nonce sizing
 	found := false
+	deviceLosses := 0 // consecutive failed launches
 	var foundNonce uint64
 	var foundEventID []byte
 	var currentNonce int64
 	var nonceOffset int
-	var serializedLength int
 	var serialized []byte
-	var inputBuffer *cl.MemObject
 
 	// Progress tracking
 	startTime := time.Now()
+	resetHostTrace()
 	totalTested := int64(0)
 	lastProgressUpdate := time.Now()
 
-	for currentDigits <= maxRequiredDigits && !found {
+	// What this run searches, for -transcript
+	var runTranscript *transcript
+	if *transcriptPath != "" {
+		runTranscript = newTranscript(event, selectedIndex, selectedDevice.Name(), actualKernel, *noncePrefix)
+	}
+
+	// Counters for the cgminer-compatible monitoring API and the status page
+	stats := &minerStats{
+		start:       startTime,
+		deviceIndex: selectedIndex,
+		deviceName:  selectedDevice.Name(),
+		kernel:      actualKernel,
+		control:     *apiControl,
+	}
+	stats.difficulty.Store(int64(*difficulty))
+	if *apiListen != "" {
+		if err := startCgminerAPI(*apiListen, stats); err != nil {
+			log.Fatalf("Failed to start API: %v", err)
+		}
+		vlog("Serving cgminer-compatible API on %s", *apiListen)
+	}
+	if *statusListen != "" {
+		if err := startStatusPage(*statusListen, stats); err != nil {
+			log.Fatalf("Failed to start status page: %v", err)
+		}
+		vlog("Serving /status.json on %s", *statusListen)
+	}
+
+	// Optional difficulty ladder: the kernel reports hits at the next milestone
+	// and the CPU sorts out milestones from the target
+	kernelDifficulty := *difficulty
+	var ladder *difficultyLadder
+	if *ladderFile != "" {
+		ladder, err = openDifficultyLadder(*ladderFile, *ladderStep, *difficulty, session.target)
+		if err != nil {
+			log.Fatalf("Failed to open ladder file: %v", err)
+		}
+		defer ladder.Close()
+		kernelDifficulty = ladder.kernelDifficulty()
+		vlog("Writing milestones every %d bits from %d to %s", *ladderStep, kernelDifficulty, *ladderFile)
+	}
+
+	// Stop cleanly on Ctrl-C or SIGTERM: the batch in flight finishes, no more
+	// batches are enqueued
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+	cancelled := false
+
+	// Optional deadline, handled like a cancellation (a nil channel never fires)
+	var deadline <-chan time.Time
+	timedOut := false
+	if *timeout > 0 {
+		timer := time.NewTimer(*timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	// Restart with a fresh created_at when the search runs far past the expected attempts
+	retryThreshold := int64(0)
+	if *retryAfter > 0 {
+		retryThreshold = int64(*retryAfter * math.Pow(2, float64(*difficulty)))
+		if retryThreshold < int64(batchSize) {
+			retryThreshold = int64(batchSize)
+		}
+	}
+	attemptsSinceRestart := int64(0)
+	restarts := 0
+	retargeted := false
+
+	// Hits the CPU rejects; too many and the kernel is swapped for the default
+	var falseHits falsePositives
+
+	// Sleep is noticed between batches
+	var sleepWatch suspendWatch
+
+	// -watch swaps in the kernel file when it is edited
+	var watcher *kernelWatcher
+	if *watchKernel {
+		if watcher, err = newKernelWatcher(kernelFilePath); err != nil {
+			log.Fatalf("Failed to watch kernel file: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Watching %s for changes\n", kernelFilePath)
+	}
+
+	for currentDigits <= maxRequiredDigits && !found && !cancelled {
 		// Calculate nonce range for current digit size
 		baseNonceValue := int64(math.Pow(10, float64(currentDigits-1)))
 		maxNonceValue := int64(math.Pow(10, float64(currentDigits))) - 1
@@ -1360,150 +2158,209 @@ func main() {
 		// Generate placeholder nonce with current digits (zero-padded)
 		noncePlaceholder := fmt.Sprintf("%0*d", currentDigits, baseNonceValue)
 
-		// Add/update nonce tag with current placeholder
-		// Remove existing nonce tag first
-		filteredTags := make(nostr.Tags, 0, len(event.Tags))
-		for _, tag := range event.Tags {
-			if len(tag) > 0 && tag[0] != "nonce" {
-				filteredTags = append(filteredTags, tag)
-			}
-		}
-		event.Tags = filteredTags
-		event.Tags = append(event.Tags, nostr.Tag{"nonce", noncePlaceholder, strconv.Itoa(*difficulty)})
+		// Add/update nonce tag with current placeholder at the requested position
+		event.Tags = withNonceTag(event.Tags, nonceTagWithValue(nonceTemplate, *noncePrefix+noncePlaceholder), noncePosition)
 
 		// Serialize event with current placeholder
+		serializeStart := phaseStart()
 		serialized = event.Serialize()
-		serializedLength = len(serialized)
 
-		// Find nonce position in serialized string
-		noncePlaceholderBytes := []byte(noncePlaceholder)
-		nonceOffset = bytes.Index(serialized, noncePlaceholderBytes)
+		// Find nonce position in serialized string; the kernel only writes the digits after the prefix
+		nonceOffset = findNonceOffset(serialized, *noncePrefix+noncePlaceholder)
 		if nonceOffset == -1 {
 			log.Fatalf("Could not find nonce placeholder in serialized event (digits: %d)", currentDigits)
 		}
-
-		// Create/update input buffer for base serialized event
-		if inputBuffer != nil {
-			inputBuffer.Release()
-		}
-		inputBuffer, err = context.CreateEmptyBuffer(cl.MemReadOnly, serializedLength)
-		if err != nil {
-			log.Fatalf("Failed to create input buffer: %v", err)
-		}
-
-		// Write base serialized event to buffer
-		_, err = queue.EnqueueWriteBuffer(inputBuffer, true, 0, serializedLength, unsafe.Pointer(&serialized[0]), nil)
-		if err != nil {
-			log.Fatalf("Failed to write input buffer: %v", err)
+		nonceOffset += len(*noncePrefix)
+		phaseEnd(phaseSerialize, serializeStart)
+
+		// Upload the serialized event and set the kernel arguments that stay
+		// constant for this digit size
+		setArgsStart := phaseStart()
+		if err := session.setInput(serialized, nonceOffset, currentDigits, kernelDifficulty); err != nil {
+			log.Fatalf("Failed to load the event into kernel %s: %v", actualKernel, err)
 		}
+		phaseEnd(phaseSetArgs, setArgsStart)
 
 		vlog("Trying %d-digit nonces: %d to %d", currentDigits, baseNonceValue, maxNonceValue)
 
-		// Start from base nonce for this digit size
+		// Start from base nonce for this digit size, or from the resume point
 		currentNonce = baseNonceValue
+		if resumeNonce > 0 && currentDigits == resumeDigits {
+			if resumeNonce < baseNonceValue || resumeNonce > maxNonceValue {
+				log.Fatalf("Resume nonce %d is not a %d-digit nonce", resumeNonce, resumeDigits)
+			}
+			currentNonce = resumeNonce
+			resumeNonce = 0
+		}
 
 		// Process batches for this digit size
 		for currentNonce <= maxNonceValue && !found {
-			// Calculate how many nonces to test in this batch
-			remaining := int(maxNonceValue - currentNonce + 1)
-			if remaining > batchSize {
-				remaining = batchSize
+			select {
+			case sig := <-interrupted:
+				vlog("Received %v, stopping", sig)
+				cancelled = true
+			case <-deadline:
+				cancelled = true
+				timedOut = true
+			default:
 			}
-
-			// Set kernel arguments
-			err = kernel.SetArgBuffer(0, inputBuffer)
-			if err != nil {
-				log.Fatalf("Failed to set kernel arg 0: %v", err)
-			}
-
-			err = kernel.SetArgInt32(1, int32(serializedLength))
-			if err != nil {
-				log.Fatalf("Failed to set kernel arg 1: %v", err)
+			if cancelled {
+				break
 			}
-
-			err = kernel.SetArgInt32(2, int32(nonceOffset))
-			if err != nil {
-				log.Fatalf("Failed to set kernel arg 2: %v", err)
+			if retryThreshold > 0 && attemptsSinceRestart >= retryThreshold {
+				break
 			}
 
-			err = kernel.SetArgInt32(3, int32(*difficulty))
-			if err != nil {
-				log.Fatalf("Failed to set kernel arg 3: %v", err)
-			}
+			// Target changed over the API: re-serialize the event with the new
+			// committed difficulty and carry on from the current nonce
+			if requested := int(stats.requestedDifficulty.Swap(0)); requested != 0 && requested != *difficulty {
+				previous := *difficulty
+				*difficulty = requested
+				if nonceTemplate[2] == strconv.Itoa(previous) {
+					nonceTemplate[2] = strconv.Itoa(requested)
+				}
+				if want := int(math.Ceil(float64(requested)*math.Log10(2))) + 2; want > maxRequiredDigits && maxEventBytes == 0 {
+					maxRequiredDigits = want
+				}
+				kernelDifficulty = requested
+				if ladder != nil {
+					ladder.setTarget(requested)
+					kernelDifficulty = ladder.kernelDifficulty()
+				}
+				if *retryAfter > 0 {
+					retryThreshold = int64(*retryAfter * math.Pow(2, float64(requested)))
+					if retryThreshold < int64(batchSize) {
+						retryThreshold = int64(batchSize)
+					}
+				}
+				stats.difficulty.Store(int64(requested))
+				retargeted = true
+				progressSink.Clear()
+				fmt.Fprintf(os.Stderr, "Difficulty changed from %d to %d\n", previous, requested)
 
-			// Pass nonce as two 32-bit values to avoid overflow
-			baseNonceLow := uint32(currentNonce & 0xFFFFFFFF)
-			baseNonceHigh := uint32((currentNonce >> 32) & 0xFFFFFFFF)
-			err = kernel.SetArgInt32(4, int32(baseNonceLow))
-			if err != nil {
-				log.Fatalf("Failed to set kernel arg 4: %v", err)
+				resumeDigits, resumeNonce = currentDigits, currentNonce
+				break
 			}
 
-			err = kernel.SetArgInt32(5, int32(baseNonceHigh))
-			if err != nil {
-				log.Fatalf("Failed to set kernel arg 5: %v", err)
+			// The kernel file was edited: if the new kernel builds and passes
+			// the self-test, carry on from the current nonce with it
+			if watcher != nil && watcher.changed() {
+				progressSink.Clear()
+				next, err := reloadKernelFile(selectedDevice, *queues, maxLaunch)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: Kernel file %s: %v; still mining with the previous kernel\n", kernelFilePath, err)
+				} else {
+					session.Release()
+					session = next
+					actualKernel = kernelFileType
+					falseHits = falsePositives{}
+					session.setLaunchCap(launchCap)
+					fmt.Fprintf(os.Stderr, "Reloaded kernel from %s (%s)\n", kernelFilePath, session.abi)
+					resumeDigits, resumeNonce = currentDigits, currentNonce
+					break
+				}
 			}
 
-			err = kernel.SetArgBuffer(6, resultsBuffer)
-			if err != nil {
-				log.Fatalf("Failed to set kernel arg 6 (results buffer): %v", err)
+			// Calculate how many nonces to test in this batch
+			remaining := int(maxNonceValue - currentNonce + 1)
+			if remaining > batches.size {
+				remaining = batches.size
 			}
 
-			err = kernel.SetArgInt32(7, int32(currentDigits))
-			if err != nil {
-				log.Fatalf("Failed to set kernel arg 7: %v", err)
+			// Execute kernel; only the base nonce changes between batches
+			batchStart := time.Now()
+			resultIndices, err := session.runBatch(uint64(currentNonce), remaining)
+
+			// The machine slept during the batch: leave the sleep out of the
+			// rates, rebuild the context if it didn't survive and mine the
+			// batch again, as its results can't be trusted
+			if slept, counted := sleepWatch.check(batchStart); slept > 0 {
+				progressSink.Clear()
+				fmt.Fprintf(os.Stderr, "The machine slept for about %s; checking the device\n", slept.Round(time.Second))
+				stats.suspended.Add(int64(counted))
+				stats.meter.skip(counted)
+				if err == nil {
+					// A lost context fails its next launch
+					_, err = session.runBatch(uint64(currentNonce), 1)
+				}
+				if err != nil {
+					vlog("Device context lost: %v", err)
+					rebuildSession()
+					fmt.Fprintf(os.Stderr, "Rebuilt the device context after it was lost in sleep\n")
+				}
+				resumeDigits, resumeNonce = currentDigits, currentNonce
+				break
 			}
-
-			// Execute kernel
-			globalSize := []int{remaining}
-			// Let OpenCL choose optimal local work group size
-			_, err = queue.EnqueueNDRangeKernel(kernel, nil, globalSize, nil, nil)
+			// A failed launch usually means the driver reset the device, as
+			// Windows does after a launch outlasts its GPU watchdog: rebuild
+			// the context and mine the batch again, with smaller batches
 			if err != nil {
-				log.Fatalf("Failed to enqueue kernel: %v", err)
-			}
-
-			// Read results (limit to actual buffer size)
-			readSize := remaining * resultSize
-			if readSize > resultsBufferSize {
-				readSize = resultsBufferSize
-				remaining = resultsBufferSize / resultSize
+				deviceLosses++
+				if deviceLosses > maxDeviceLosses {
+					log.Fatalf("Failed to execute kernel: %v", err)
+				}
+				progressSink.Clear()
+				fmt.Fprintf(os.Stderr, "Warning: Failed to execute kernel: %v; rebuilding the device context\n", err)
+				rebuildSession()
+				if autoBatch {
+					batches.size = batches.clamp(batches.size / 4)
+				}
+				resumeDigits, resumeNonce = currentDigits, currentNonce
+				break
 			}
-			results := make([]byte, readSize)
-			_, err = queue.EnqueueReadBuffer(resultsBuffer, true, 0, readSize, unsafe.Pointer(&results[0]), nil)
-			if err != nil {
-				log.Fatalf("Failed to read results buffer: %v", err)
+			deviceLosses = 0
+			// Batches read back in several launches stop at their first hit
+			remaining = len(resultIndices)
+			if autoBatch {
+				batches.observe(remaining, time.Since(batchStart))
 			}
 
-			// Check results - read as int32 array
-			resultIndices := (*[1 << 28]int32)(unsafe.Pointer(&results[0]))[:remaining:remaining]
+			// Check results; time spent on hits is counted as validation
+			scanStart := phaseStart()
+			validatedBefore := hostPhaseStats[phaseValidate].total
+			quarantined := false
 			for i := 0; i < remaining; i++ {
 				index := resultIndices[i]
 				if index >= 0 {
 					// Found candidate nonce! Calculate nonce from index
 					candidateNonce := uint64(currentNonce) + uint64(index)
 
-					// Validate this candidate by recalculating hash on CPU
-					if validateNonce(candidateNonce, &event, *difficulty, currentDigits) {
-						// Valid nonce found! Recalculate event ID for final output
-						// Create a deep copy of the event
-						testEvent := event
-						nonceStr := fmt.Sprintf("%0*d", currentDigits, candidateNonce)
-
-						// Deep copy tags to avoid modifying the original
-						testEvent.Tags = make(nostr.Tags, len(event.Tags))
-						for j, tag := range event.Tags {
-							testEvent.Tags[j] = make(nostr.Tag, len(tag))
-							copy(testEvent.Tags[j], tag)
+					// Below-target hits are milestones for the ladder
+					if kernelDifficulty < *difficulty {
+						nonceStr := *noncePrefix + fmt.Sprintf("%0*d", currentDigits, candidateNonce)
+						validateStart := phaseStart()
+						bits, err := ladder.record(&event, nonceStr)
+						phaseEnd(phaseValidate, validateStart)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Warning: Failed to write milestone: %v\n", err)
 						}
-
-						// Remove old nonce tags and add new one
-						filteredTags := make(nostr.Tags, 0, len(testEvent.Tags))
-						for _, tag := range testEvent.Tags {
-							if len(tag) == 0 || tag[0] != "nonce" {
-								filteredTags = append(filteredTags, tag)
+						if bits < kernelDifficulty {
+							fmt.Fprintf(os.Stderr, "Validation error: Hash difficulty %d is less than kernel difficulty %d (nonce: %d). Continuing...\n",
+								bits, kernelDifficulty, candidateNonce)
+							stats.hwErrors.Add(1)
+						}
+						if bits < *difficulty {
+							if falseHits.record(bits >= kernelDifficulty) && quarantineKernel(selectedDevice, actualKernel, falseHits) {
+								quarantined = true
+								break
 							}
+							continue
 						}
-						testEvent.Tags = append(filteredTags, nostr.Tag{"nonce", nonceStr, strconv.Itoa(*difficulty)})
+					}
+
+					// Validate this candidate by recalculating hash on CPU
+					validateStart := phaseStart()
+					valid := validateNonce(session.target, candidateNonce, &event, *difficulty, currentDigits, *noncePrefix)
+					phaseEnd(phaseValidate, validateStart)
+					if falseHits.record(valid) && quarantineKernel(selectedDevice, actualKernel, falseHits) {
+						quarantined = true
+						break
+					}
+					if valid {
+						// Valid nonce found! Recalculate event ID for final output
+						testEvent := event
+						nonceStr := *noncePrefix + fmt.Sprintf("%0*d", currentDigits, candidateNonce)
+						testEvent.Tags = setNonceValue(event.Tags, nonceStr)
 
 						// Recalculate event ID
 						eventIDHex := testEvent.GetID()
@@ -1513,25 +2370,88 @@ func main() {
 							continue
 						}
 
+						stats.found.Add(1)
+
+						// -progressive: write this version and raise the target. The
+						// nonce tag commits to the new target, so the event is
+						// re-serialized and the rest of this batch no longer applies.
+						if *difficulty < finalDifficulty {
+							testEvent.ID = eventIDHex
+							line, err := json.Marshal(testEvent)
+							if err != nil {
+								log.Fatalf("Failed to marshal event: %v", err)
+							}
+							if _, err := os.Stdout.Write(append(line, '\n')); err != nil {
+								log.Fatalf("Failed to write output: %v", err)
+							}
+							progressSink.Clear()
+							fmt.Fprintf(os.Stderr, "Wrote a version at difficulty %d, mining on toward %d\n", *difficulty, finalDifficulty)
+							stats.requestedDifficulty.Store(int64(min(*difficulty+*progressiveStep, finalDifficulty)))
+							break
+						}
+
 						foundNonce = candidateNonce
 						found = true
 						break
 					} else {
 						// Invalid result, continue mining
 						// Error already logged to stderr by validateNonce
+						stats.hwErrors.Add(1)
 						continue
 					}
 				}
 			}
+			phaseEndExcept(phaseScan, scanStart, phaseValidate, validatedBefore)
+
+			// The quarantined kernel may have missed hits in this batch too:
+			// mine it again with the default kernel
+			if quarantined {
+				session.Release()
+				session, err = newMiningSession(selectedDevice, "default")
+				if err != nil {
+					log.Fatalf("Kernel default: %v", err)
+				}
+				if err := session.setQueues(*queues); err != nil {
+					log.Fatalf("Failed to set up %d command queues: %v", *queues, err)
+				}
+				if err := session.allocResults(maxLaunch); err != nil {
+					log.Fatalf("Failed to allocate device buffers: %v", err)
+				}
+				session.setLaunchCap(launchCap)
+				actualKernel = "default"
+				falseHits = falsePositives{}
+				vlog("Switched to kernel default (function: %s), resuming at %d-digit nonce %d", session.kernelName, currentDigits, currentNonce)
+				resumeDigits, resumeNonce = currentDigits, currentNonce
+				break
+			}
+
+			if runTranscript != nil {
+				last := uint64(currentNonce) + uint64(remaining) - 1
+				if found {
+					last = foundNonce
+				}
+				runTranscript.searched(currentDigits, event.CreatedAt, *difficulty, uint64(currentNonce), last)
+			}
 
 			if !found {
 				currentNonce += int64(remaining)
 				totalTested += int64(remaining)
+				attemptsSinceRestart += int64(remaining)
+				stats.hashes.Store(totalTested)
+				stats.meter.update(totalTested, time.Now())
+
+				// Raise the kernel difficulty once a milestone is reached
+				if ladder != nil && ladder.kernelDifficulty() != kernelDifficulty {
+					kernelDifficulty = ladder.kernelDifficulty()
+					if err := session.setDifficulty(kernelDifficulty); err != nil {
+						log.Fatalf("Failed to set kernel difficulty: %v", err)
+					}
+				}
 
 				// Update progress bar every 100ms
 				now := time.Now()
 				if now.Sub(lastProgressUpdate) >= 100*time.Millisecond {
-					updateProgressBar(currentNonce-1, currentDigits, totalTested, startTime, *difficulty)
+					progressSink.Update(Progress{Nonce: currentNonce - 1, Digits: currentDigits, Tested: totalTested, Elapsed: stats.elapsed(), Difficulty: *difficulty, Rates: stats.meter.rates()})
 					lastProgressUpdate = now
 				}
 
@@ -1540,25 +2460,106 @@ func main() {
 				}
 			} else {
 				// Clear progress bar when found
-				fmt.Fprintf(os.Stderr, "\r%s\r", "                                                                                ")
+				progressSink.Clear()
+			}
+		}
+
+		// Re-serialize after a difficulty change
+		if resumeNonce > 0 && resumeDigits == currentDigits && !cancelled && !found {
+			continue
+		}
+
+		// Unlucky search: restart the nonce space with a new created_at rather than
+		// growing the nonce further
+		if !found && !cancelled && retryThreshold > 0 && attemptsSinceRestart >= retryThreshold {
+			previous := event.CreatedAt
+			event.CreatedAt = nostr.Now()
+			if event.CreatedAt <= previous {
+				event.CreatedAt = previous + 1
+			}
+			if err := checkDelegation(&event); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Not retrying with a new created_at, delegation would become invalid: %v\n", err)
+				event.CreatedAt = previous
+				retryThreshold = 0
+			} else {
+				restarts++
+				progressSink.Clear()
+				fmt.Fprintf(os.Stderr, "No nonce after %d attempts (%.1fx expected), retrying with created_at %d\n",
+					attemptsSinceRestart, float64(attemptsSinceRestart)/math.Pow(2, float64(*difficulty)), event.CreatedAt)
+				attemptsSinceRestart = 0
+				currentDigits = firstDigits
+				continue
 			}
 		}
 
 		// If we've exhausted this digit size, move to next
-		if !found && currentNonce > maxNonceValue {
+		if !found && !cancelled && currentNonce > maxNonceValue {
 			vlog("Exhausted %d-digit nonces, moving to %d digits", currentDigits, currentDigits+1)
 			currentDigits++
 		}
 	}
 
 	// Clear progress bar line
-	fmt.Fprintf(os.Stderr, "\r%s\r", "                                                                                ")
+	progressSink.Clear()
 
-	if inputBuffer != nil {
-		inputBuffer.Release()
+	if traceHost {
+		printHostTrace(os.Stderr, stats.elapsed())
+	}
+
+	// Remember the rate for -dry-run estimates; very short runs are mostly setup
+	if elapsed := stats.elapsed(); elapsed >= 2*time.Second && totalTested > 0 {
+		cache := loadTuningCache()
+		cache.recordHashRate(selectedDevice, actualKernel, float64(totalTested)/elapsed.Seconds(), startTime.Sub(setupStart))
+		if err := cache.save(); err != nil {
+			vlog("Warning: Failed to save tuning cache: %v", err)
+		}
+	}
+
+	if cancelled {
+		// os.Exit skips deferred calls
+		session.Release()
+		reportCLObjects()
+		if *pidFile != "" {
+			removePIDFile(*pidFile)
+		}
+
+		if runTranscript != nil {
+			outcome := "cancelled"
+			if timedOut {
+				outcome = "timeout"
+			}
+			if err := runTranscript.finish(*transcriptPath, transcriptSecret, outcome, "", ""); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to write transcript: %v\n", err)
+			}
+		}
+
+		elapsed := stats.elapsed().Round(time.Millisecond)
+		if timedOut {
+			fmt.Fprintf(os.Stderr, "Mining stopped at the %s deadline after %d nonces\n", *timeout, totalTested)
+		} else {
+			fmt.Fprintf(os.Stderr, "Mining cancelled after %d nonces (%s)\n", totalTested, elapsed)
+		}
+		resumeLine := "Cannot resume: created_at was changed by -retry-after"
+		if restarts == 0 && retargeted {
+			resumeLine = fmt.Sprintf("Resume with: -difficulty %d -resume %d:%d", *difficulty, currentDigits, currentNonce)
+		} else if restarts == 0 {
+			resumeLine = fmt.Sprintf("Resume with: -resume %d:%d", currentDigits, currentNonce)
+		}
+		fmt.Fprintln(os.Stderr, resumeLine)
+		if timedOut {
+			notify.send("timed out", resumeLine, 0, nil)
+			os.Exit(124)
+		}
+		notify.send("cancelled", resumeLine, 0, nil)
+		os.Exit(130)
 	}
 
 	if !found {
+		if runTranscript != nil {
+			if err := runTranscript.finish(*transcriptPath, transcriptSecret, "exhausted", "", ""); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to write transcript: %v\n", err)
+			}
+		}
 		log.Fatalf("Could not find valid nonce up to %d digits (max for difficulty %d)", maxRequiredDigits, *difficulty)
 	}
 
@@ -1568,20 +2569,12 @@ func main() {
 	if foundNonceDigits < minRequiredDigits {
 		foundNonceDigits = minRequiredDigits
 	}
-	nonceStr := fmt.Sprintf("%0*d", foundNonceDigits, foundNonce)
-	// Find and update nonce tag
-	for i, tag := range event.Tags {
-		if len(tag) > 0 && tag[0] == "nonce" {
-			event.Tags[i] = nostr.Tag{"nonce", nonceStr, strconv.Itoa(*difficulty)}
-			break
-		}
-	}
+	nonceStr := *noncePrefix + fmt.Sprintf("%0*d", foundNonceDigits, foundNonce)
+	// Update the nonce tag's value, keeping its other elements
+	event.Tags = setNonceValue(event.Tags, nonceStr)
 
 	// Set the event ID
-	eventIDHex := ""
-	for _, b := range foundEventID {
-		eventIDHex += fmt.Sprintf("%02x", b)
-	}
+	eventIDHex := hex.EncodeToString(foundEventID)
 	event.ID = eventIDHex
 
 	// Final validation (should always pass since we validated in the loop)
@@ -1592,8 +2585,17 @@ func main() {
 	}
 
 	// Log validation success
-	actualDifficulty := nip13.Difficulty(eventIDHex)
-	vlog("Validation successful: Event ID has %d leading zero bits (required: %d)", actualDifficulty, *difficulty)
+	actualDifficulty := eventScore(session.target, event)
+	vlog("Validation successful: Event reaches difficulty %d (required: %d)", actualDifficulty, *difficulty)
+
+	// The cache key covers the input's created_at and difficulty, so retried
+	// or retargeted results can't be cached
+	if resultCacheFile != nil && restarts == 0 && !retargeted {
+		resultCacheFile.store(cacheKey, nonceStr)
+		if err := resultCacheFile.save(); err != nil {
+			vlog("Warning: Failed to save result cache: %v", err)
+		}
+	}
 
 	// Output final event as JSON
 	eventJSON, err := json.Marshal(event)
@@ -1601,5 +2603,25 @@ func main() {
 		log.Fatalf("Failed to marshal final event: %v", err)
 	}
 
-	fmt.Println(string(eventJSON))
+	// NIP-13 leading zeros are all the independent check knows how to score
+	if *doubleCheck {
+		checkDifficulty := 0
+		if session.abi.Target == defaultPowTarget {
+			checkDifficulty = *difficulty
+		}
+		if err := doubleCheckOutput(eventJSON, checkDifficulty); err != nil {
+			log.Fatalf("Double-check failed: %v", err)
+		}
+		vlog("Double-check passed: ID and difficulty match an independent serialization")
+	}
+
+	if err := writeOutput(*outputPath, eventJSON); err != nil {
+		log.Fatalf("Failed to write output: %v", err)
+	}
+	if runTranscript != nil {
+		if err := runTranscript.finish(*transcriptPath, transcriptSecret, "found", nonceStr, eventIDHex); err != nil {
+			log.Fatalf("Failed to write transcript: %v", err)
+		}
+	}
+	notify.send("mined", "", actualDifficulty, &event)
 }
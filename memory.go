@@ -0,0 +1,82 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// resultSize is the size of one results buffer entry (int32 index per work item)
+const resultSize = 4
+
+// maxResultEntries bounds the batch size so results can be viewed as a
+// [1 << 28]int32 array and indexed by the kernels' int global IDs
+const maxResultEntries = 1 << 28
+
+// parseByteSize parses a size such as "512M", "2G", "64K" or a plain number of
+// bytes. Suffixes are binary (1K = 1024 bytes).
+func parseByteSize(input string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(input))
+	s = strings.TrimSuffix(s, "B")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (use e.g. 512M or 2G)", input)
+	}
+	return n * multiplier, nil
+}
+
+// formatByteSize formats a size in MB for log messages
+func formatByteSize(n int64) string {
+	return fmt.Sprintf("%d MB", n/(1024*1024))
+}
+
+// maxBatchForMemory returns the largest batch size whose results buffer fits
+// on the device. budget is the total device memory the miner may allocate
+// (0 means the device's global memory) and inputSize is the space reserved for
+// the serialized event. Each buffer is also limited by CL_DEVICE_MAX_MEM_ALLOC_SIZE.
+func maxBatchForMemory(device *cl.Device, budget int64, inputSize int) (int, error) {
+	budget = memBudgetOrDevice(device, budget)
+	if int64(inputSize) > device.MaxMemAllocSize() {
+		return 0, fmt.Errorf("serialized event (%d bytes) exceeds the device's max allocation size (%d bytes)",
+			inputSize, device.MaxMemAllocSize())
+	}
+
+	available := budget - int64(inputSize)
+	if limit := device.MaxMemAllocSize(); available > limit {
+		available = limit
+	}
+	if available < resultSize {
+		return 0, fmt.Errorf("memory budget of %d bytes leaves no room for results after the %d byte input buffer",
+			budget, inputSize)
+	}
+	if available/resultSize > maxResultEntries {
+		return maxResultEntries, nil
+	}
+	return int(available / resultSize), nil
+}
+
+// memBudgetOrDevice returns the effective memory budget for a device
+func memBudgetOrDevice(device *cl.Device, budget int64) int64 {
+	if budget <= 0 {
+		return device.GlobalMemSize()
+	}
+	return budget
+}
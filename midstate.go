@@ -0,0 +1,49 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+)
+
+// sha256BlockSize is the size of one SHA-256 message block
+const sha256BlockSize = 64
+
+// sha256Blocks returns how many blocks SHA-256 compresses for a message of
+// the given length: the message, the 0x80 byte and the 64-bit length, rounded up
+func sha256Blocks(length int) int {
+	return (length + 72) / sha256BlockSize
+}
+
+// midstatePrefixLength returns how many leading bytes of a serialized event
+// can be hashed once for all nonces: the whole blocks before the nonce's block
+func midstatePrefixLength(nonceOffset int) int {
+	return nonceOffset / sha256BlockSize * sha256BlockSize
+}
+
+// sha256Midstate returns the SHA-256 state after hashing prefix, whose length
+// must be a multiple of the block size, as eight little-endian uint32 words
+// ready to upload to the device
+func sha256Midstate(prefix []byte) ([]byte, error) {
+	if len(prefix)%sha256BlockSize != 0 {
+		return nil, fmt.Errorf("midstate prefix of %d bytes is not a whole number of blocks", len(prefix))
+	}
+	h := sha256.New()
+	h.Write(prefix)
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SHA-256 state: %v", err)
+	}
+	// The marshaled state is a 4-byte magic followed by the big-endian words
+	words := state[4 : 4+32]
+	midstate := make([]byte, 32)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(midstate[i*4:], binary.BigEndian.Uint32(words[i*4:]))
+	}
+	return midstate, nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// netTestDifficulty is the proof of work the mock relay of -selftest-network
+// requires; the CPU mines it in milliseconds
+const netTestDifficulty = 12
+
+// runNetworkSelfTest checks the miner's relay features against an in-process
+// mock relay: that a relay requiring proof of work rejects an unmined event
+// with a "pow:" reason and accepts it once mined, that the newest stored
+// version of a replaceable event is found as -check-relay looks for it, and
+// that -notify's direct message is published. It needs neither OpenCL nor a
+// network connection. It prints a line per check and returns whether all
+// passed.
+func runNetworkSelfTest(threads int) bool {
+	relay, err := newMockRelay(netTestDifficulty)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL: could not start the mock relay: %v\n", err)
+		return false
+	}
+	defer relay.Close()
+	fmt.Fprintf(os.Stderr, "Mock relay at %s requiring difficulty %d\n", relay.URL(), netTestDifficulty)
+
+	secretKey := nostr.GeneratePrivateKey()
+	pubkey, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL: could not derive a test key: %v\n", err)
+		return false
+	}
+	event := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindTextNote,
+		Tags:      nostr.Tags{},
+		Content:   "gpu-nostr-pow network self-test",
+	}
+
+	var problems []string
+	check := func(name string, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "  %-40s failed: %v\n", name, err)
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			return
+		}
+		fmt.Fprintf(os.Stderr, "  %-40s ok\n", name)
+	}
+
+	check("unmined event rejected with pow:", func() error {
+		unmined := event
+		if err := unmined.Sign(secretKey); err != nil {
+			return err
+		}
+		err := publishTo(relay.URL(), unmined)
+		if err == nil {
+			return fmt.Errorf("relay accepted it")
+		}
+		if !strings.Contains(err.Error(), "pow:") {
+			return fmt.Errorf("rejected for another reason: %v", err)
+		}
+		return nil
+	}())
+
+	check("mined event accepted", func() error {
+		_, err := mineAndPublish(relay.URL(), event, secretKey, threads)
+		return err
+	}())
+
+	check("newest replaceable version found", func() error {
+		profile := event
+		profile.Kind = nostr.KindProfileMetadata
+		profile.Content = `{"name":"gpu-nostr-pow self-test"}`
+		stored, err := mineAndPublish(relay.URL(), profile, secretKey, threads)
+		if err != nil {
+			return err
+		}
+		older := profile
+		older.CreatedAt = stored.CreatedAt - 60
+		latest, err := latestStoredVersion(relay.URL(), &older)
+		if err != nil {
+			return err
+		}
+		if latest != stored.CreatedAt {
+			return fmt.Errorf("found created_at %d, published %d", latest, stored.CreatedAt)
+		}
+		return nil
+	}())
+
+	// Direct messages carry no proof of work
+	check("notification DM published", func() error {
+		relay.setMinDifficulty(0)
+		n := &notifier{target: relay.URL(), secretKey: secretKey, start: time.Now()}
+		if err := n.sendDirectMessage("network self-test"); err != nil {
+			return err
+		}
+		for _, e := range relay.stored() {
+			if e.Kind == nostr.KindEncryptedDirectMessage && e.PubKey == pubkey {
+				return nil
+			}
+		}
+		return fmt.Errorf("relay did not store it")
+	}())
+
+	if len(problems) == 0 {
+		fmt.Fprintf(os.Stderr, "PASS: the relay features work against the mock relay\n")
+		return true
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "FAIL: %s\n", problem)
+	}
+	return false
+}
+
+// mineAndPublish mines an event to netTestDifficulty on the CPU, signs it and
+// publishes it
+func mineAndPublish(relayURL string, event nostr.Event, secretKey string, threads int) (nostr.Event, error) {
+	template := nostr.Tag{"nonce", "", strconv.Itoa(netTestDifficulty)}
+	mined, _, err := mineOnCPU(event, template, "", decimalAlphabet, nonceTagLast, netTestDifficulty, threads, time.Time{}, nil)
+	if err != nil {
+		return mined, fmt.Errorf("failed to mine: %v", err)
+	}
+	if err := mined.Sign(secretKey); err != nil {
+		return mined, fmt.Errorf("failed to sign: %v", err)
+	}
+	return mined, publishTo(relayURL, mined)
+}
+
+// publishTo publishes an event to a relay, returning the relay's rejection
+// reason as the error
+func publishTo(relayURL string, event nostr.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), relayQueryTimeout)
+	defer cancel()
+	relay, err := nostr.RelayConnect(ctx, relayURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	defer relay.Close()
+	return relay.Publish(ctx, event)
+}
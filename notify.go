@@ -0,0 +1,182 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// notifyTimeout bounds sending a notification, so an unreachable relay or
+// webhook holds up the miner's exit only briefly
+const notifyTimeout = 15 * time.Second
+
+// notifier tells the user that a mining run ended (-notify): by a NIP-04
+// direct message from the -notify-key to its own pubkey, published to a
+// relay, or by a JSON POST to a webhook. It is also the log's output, so the
+// log.Fatal of any failure sends a notification before the miner exits.
+type notifier struct {
+	target    string // relay (ws:// or wss://) or webhook (http:// or https://) URL
+	secretKey string // for relays
+	start     time.Time
+
+	once sync.Once
+}
+
+// notification is the body POSTed to webhooks. text holds the whole message,
+// for chat services that show a field of that name.
+type notification struct {
+	Status     string       `json:"status"` // "mined", "failed", "timed out" or "cancelled"
+	Text       string       `json:"text"`
+	Host       string       `json:"host,omitempty"`
+	Elapsed    float64      `json:"elapsed_seconds"`
+	Difficulty int          `json:"difficulty,omitempty"` // achieved by the mined event
+	Event      *nostr.Event `json:"event,omitempty"`
+}
+
+// newNotifier checks a -notify target and loads the key relay targets need
+func newNotifier(target, keyPath string) (*notifier, error) {
+	n := &notifier{target: target, start: time.Now()}
+	switch {
+	case strings.HasPrefix(target, "ws://"), strings.HasPrefix(target, "wss://"):
+		if keyPath == "" {
+			return nil, fmt.Errorf("a relay target needs -notify-key")
+		}
+		key, err := loadSecretKey(keyPath, "notify key")
+		if err != nil {
+			return nil, err
+		}
+		n.secretKey = key
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		if keyPath != "" {
+			return nil, fmt.Errorf("-notify-key is only used with a relay target")
+		}
+	default:
+		return nil, fmt.Errorf("target must be a relay (ws:// or wss://) or webhook (http:// or https://) URL, got %q", target)
+	}
+	return n, nil
+}
+
+// Write sends a failure notification with the fatal error being logged,
+// without the date and time the standard logger puts before it
+func (n *notifier) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(string(p))
+	if fields := strings.SplitN(message, " ", 3); len(fields) == 3 {
+		message = fields[2]
+	}
+	n.send("failed", message, 0, nil)
+	return len(p), nil
+}
+
+// send notifies that the run ended. Only the first call sends anything, so a
+// failure while reporting success is not reported twice. Errors are warnings:
+// the run's outcome stands whether or not the notification arrives. A nil
+// notifier sends nothing.
+func (n *notifier) send(status, detail string, difficulty int, event *nostr.Event) {
+	if n == nil {
+		return
+	}
+	n.once.Do(func() {
+		host, _ := os.Hostname()
+		elapsed := time.Since(n.start)
+		text := fmt.Sprintf("gpu-nostr-pow on %s: %s after %s", host, status, elapsed.Round(time.Second))
+		if event != nil {
+			text += fmt.Sprintf(", event %s at difficulty %d", event.ID, difficulty)
+		}
+		if detail != "" {
+			text += ": " + detail
+		}
+
+		var err error
+		if n.secretKey != "" {
+			// The event is part of the message, so it can be copied out of the DM
+			message := text
+			if event != nil {
+				data, _ := json.Marshal(event)
+				message += "\n\n" + string(data)
+			}
+			err = n.sendDirectMessage(message)
+		} else {
+			err = n.postWebhook(notification{Status: status, Text: text, Host: host, Elapsed: elapsed.Seconds(), Difficulty: difficulty, Event: event})
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to send notification to %s: %v\n", n.target, err)
+		} else {
+			vlog("Sent notification to %s", n.target)
+		}
+	})
+}
+
+// sendDirectMessage publishes a NIP-04 direct message from the key to itself
+func (n *notifier) sendDirectMessage(message string) error {
+	pubkey, err := nostr.GetPublicKey(n.secretKey)
+	if err != nil {
+		return fmt.Errorf("failed to derive public key: %v", err)
+	}
+	shared, err := nip04.ComputeSharedSecret(pubkey, n.secretKey)
+	if err != nil {
+		return fmt.Errorf("failed to compute shared secret: %v", err)
+	}
+	content, err := nip04.Encrypt(message, shared)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt message: %v", err)
+	}
+	dm := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindEncryptedDirectMessage,
+		Tags:      nostr.Tags{nostr.Tag{"p", pubkey}},
+		Content:   content,
+	}
+	if err := dm.Sign(n.secretKey); err != nil {
+		return fmt.Errorf("failed to sign message: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	relay, err := nostr.RelayConnect(ctx, n.target)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	defer relay.Close()
+	if err := relay.Publish(ctx, dm); err != nil {
+		return fmt.Errorf("relay rejected message: %v", err)
+	}
+	return nil
+}
+
+// postWebhook POSTs a notification as JSON
+func (n *notifier) postWebhook(body notification) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// occupancyLow is the estimate below which the report gives advice
+const occupancyLow = 0.75
+
+// reqdWorkGroupSize matches a kernel's compile-time work-group size attribute
+var reqdWorkGroupSize = regexp.MustCompile(`reqd_work_group_size\(\s*(\d+)\s*,\s*(\d+)\s*,\s*(\d+)\s*\)`)
+
+// occupancyReport estimates how much of a device a built kernel can keep busy.
+//
+// The OpenCL binding exposes neither CL_KERNEL_PRIVATE_MEM_SIZE nor
+// CL_KERNEL_COMPILE_WORK_GROUP_SIZE, so register pressure is read from the
+// kernel's work-group size instead: drivers lower it below the device maximum
+// when each work item needs so many registers or so much private memory that
+// a full group no longer fits on a compute unit. The compile-time work-group
+// size comes from the kernel source.
+type occupancyReport struct {
+	kernelWorkGroup   int // most work items per group the built kernel allows
+	deviceWorkGroup   int // most work items per group the device allows
+	preferredMultiple int // wavefront or warp size, 0 if unknown
+	compileWorkGroup  int // reqd_work_group_size, 0 if the kernel sets none
+	cpu               bool
+
+	// occupancy is the estimated fraction of the device's work items kept
+	// resident, and limiter what limits it
+	occupancy float64
+	limiter   string
+}
+
+// measureOccupancy queries a built kernel's work-group info on a device
+func measureOccupancy(kernel *cl.Kernel, device *cl.Device, source string) occupancyReport {
+	r := occupancyReport{
+		deviceWorkGroup: device.MaxWorkGroupSize(),
+		cpu:             device.Type()&cl.DeviceTypeCPU != 0,
+		occupancy:       1,
+	}
+	if size, err := kernel.WorkGroupSize(device); err == nil {
+		r.kernelWorkGroup = size
+	}
+	if multiple, err := kernel.PreferredWorkGroupSizeMultiple(device); err == nil {
+		r.preferredMultiple = multiple
+	}
+	if m := reqdWorkGroupSize.FindStringSubmatch(source); m != nil {
+		x, _ := strconv.Atoi(m[1])
+		y, _ := strconv.Atoi(m[2])
+		z, _ := strconv.Atoi(m[3])
+		r.compileWorkGroup = x * y * z
+	}
+
+	if r.kernelWorkGroup > 0 && r.deviceWorkGroup > 0 && r.kernelWorkGroup < r.deviceWorkGroup {
+		r.occupancy = float64(r.kernelWorkGroup) / float64(r.deviceWorkGroup)
+		r.limiter = "private memory"
+	}
+	// A fixed group size that is not a wavefront multiple leaves lanes idle
+	if r.compileWorkGroup > 0 && r.preferredMultiple > 0 && r.compileWorkGroup%r.preferredMultiple != 0 {
+		padded := (r.compileWorkGroup + r.preferredMultiple - 1) / r.preferredMultiple * r.preferredMultiple
+		lanes := float64(r.compileWorkGroup) / float64(padded)
+		if lanes < r.occupancy {
+			r.limiter = "work-group size"
+		}
+		r.occupancy *= lanes
+	}
+	return r
+}
+
+// String summarizes the work-group info and the estimate
+func (r occupancyReport) String() string {
+	s := fmt.Sprintf("work group %d of %d", r.kernelWorkGroup, r.deviceWorkGroup)
+	if r.preferredMultiple > 0 {
+		s += fmt.Sprintf(", preferred multiple %d", r.preferredMultiple)
+	}
+	if r.compileWorkGroup > 0 {
+		s += fmt.Sprintf(", compiled for %d", r.compileWorkGroup)
+	}
+	if r.cpu {
+		return s + " (CPU device, occupancy not estimated)"
+	}
+	return s + fmt.Sprintf(", estimated occupancy %.0f%%", r.occupancy*100)
+}
+
+// advice says how to raise a low occupancy estimate, or "" if there is
+// nothing to do
+func (r occupancyReport) advice() string {
+	if r.cpu || r.occupancy >= occupancyLow {
+		return ""
+	}
+	switch r.limiter {
+	case "private memory":
+		return fmt.Sprintf("reduce UNROLL or the state kept per work item; private memory limits you to %.0f%% occupancy", r.occupancy*100)
+	case "work-group size":
+		return fmt.Sprintf("make reqd_work_group_size a multiple of %d; the current size limits you to %.0f%% occupancy", r.preferredMultiple, r.occupancy*100)
+	}
+	return ""
+}
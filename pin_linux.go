@@ -0,0 +1,134 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// maxPinnedCPUs is the size of the affinity mask, matching glibc's cpu_set_t
+const maxPinnedCPUs = 1024
+
+// pinThreadsToDevice locks the calling goroutine to its OS thread and restricts
+// that thread to the CPUs local to the device's PCIe root (its NUMA node).
+// Threads the OpenCL driver creates afterwards inherit the affinity, so this
+// must be called before the context is created.
+//
+// go-opencl does not expose the device's PCI address, so the device is located
+// in sysfs by vendor. When several GPUs of the same vendor sit on different
+// NUMA nodes the device is ambiguous and nothing is pinned.
+func pinThreadsToDevice(device *cl.Device) (string, error) {
+	cpuList, err := deviceLocalCPUs(device)
+	if err != nil {
+		return "", err
+	}
+	cpus, err := parseCPUList(cpuList)
+	if err != nil {
+		return "", err
+	}
+
+	var mask [maxPinnedCPUs / 64]uint64
+	for _, cpu := range cpus {
+		if cpu >= maxPinnedCPUs {
+			return "", fmt.Errorf("CPU %d is beyond the supported %d CPUs", cpu, maxPinnedCPUs)
+		}
+		mask[cpu/64] |= 1 << (uint(cpu) % 64)
+	}
+
+	runtime.LockOSThread()
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		runtime.UnlockOSThread()
+		return "", fmt.Errorf("failed to set CPU affinity: %v", errno)
+	}
+	return cpuList, nil
+}
+
+// deviceLocalCPUs returns the sysfs local_cpulist of the PCI display device
+// matching the OpenCL device's vendor
+func deviceLocalCPUs(device *cl.Device) (string, error) {
+	vendorID := pciVendorID(device.Vendor())
+	if vendorID == "" {
+		return "", fmt.Errorf("unknown PCI vendor for %q", device.Vendor())
+	}
+
+	paths, err := filepath.Glob("/sys/bus/pci/devices/*")
+	if err != nil {
+		return "", err
+	}
+	var cpuLists []string
+	for _, path := range paths {
+		// Display controllers are PCI class 0x03xxxx
+		if class := readSysfs(path, "class"); !strings.HasPrefix(class, "0x03") {
+			continue
+		}
+		if readSysfs(path, "vendor") != vendorID {
+			continue
+		}
+		if cpuList := readSysfs(path, "local_cpulist"); cpuList != "" {
+			cpuLists = append(cpuLists, cpuList)
+		}
+	}
+
+	if len(cpuLists) == 0 {
+		return "", fmt.Errorf("no PCI display device with vendor %s found in sysfs", vendorID)
+	}
+	for _, cpuList := range cpuLists[1:] {
+		if cpuList != cpuLists[0] {
+			return "", fmt.Errorf("found %d GPUs with vendor %s on different NUMA nodes, cannot tell which one is %s",
+				len(cpuLists), vendorID, device.Name())
+		}
+	}
+	return cpuLists[0], nil
+}
+
+// readSysfs reads a sysfs attribute, returning "" if it cannot be read
+func readSysfs(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// parseCPUList parses a Linux CPU list such as "0-7,16-23"
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU list %q", list)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU list %q", list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("empty CPU list")
+	}
+	return cpus, nil
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// pinThreadsToDevice is only supported on Linux, where topology is read from sysfs
+func pinThreadsToDevice(device *cl.Device) (string, error) {
+	return "", fmt.Errorf("thread pinning is only supported on Linux")
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// platformFilter restricts enumeration to one platform (-platform): its index
+// in the ICD loader's order, or a case-insensitive part of its name or vendor.
+// Empty enumerates all platforms.
+var platformFilter string
+
+// probeKernelSource is built once per platform before its devices are used.
+// Broken ICDs (Mesa Clover in particular) fail or crash on any build, and are
+// then skipped instead of failing every later run.
+const probeKernelSource = `__kernel void probe(__global int *out) { out[get_global_id(0)] = 1; }`
+
+// platformDevices is one platform with the devices it contributes
+type platformDevices struct {
+	index      int // in the ICD loader's order
+	platform   *cl.Platform
+	devices    []*cl.Device
+	duplicates int    // devices dropped as already exposed by an earlier platform
+	skipped    string // why the platform contributes no devices, if it doesn't
+}
+
+// platformKey identifies a platform in the tuning cache
+func platformKey(p *cl.Platform) string {
+	return strings.TrimSpace(p.Name()) + " " + strings.TrimSpace(p.Version())
+}
+
+// isMesaPlatform reports whether a platform is one of Mesa's (Clover or
+// rusticl), which often expose the same GPUs as the vendor's own ICD
+func isMesaPlatform(p *cl.Platform) bool {
+	name := strings.ToLower(p.Name() + " " + p.Vendor())
+	return strings.Contains(name, "clover") || strings.Contains(name, "rusticl") || strings.Contains(name, "mesa")
+}
+
+// deviceIdentity is what two platforms exposing the same physical device
+// report alike. OpenCL 1.2 has no portable PCI address to compare.
+func deviceIdentity(d *cl.Device) string {
+	return fmt.Sprintf("%s|%d|%d|%d|%d", strings.TrimSpace(d.Name()), d.Type(), d.MaxComputeUnits(), d.GlobalMemSize(), d.MaxClockFrequency())
+}
+
+// orderPlatforms returns the platforms to enumerate, in order: those matching
+// platformFilter, vendor platforms before Mesa's so that duplicates keep the
+// vendor's driver
+func orderPlatforms(platforms []*cl.Platform) ([]int, error) {
+	var order []int
+	for i, p := range platforms {
+		if platformFilter == "" {
+			order = append(order, i)
+			continue
+		}
+		if n, err := strconv.Atoi(platformFilter); err == nil {
+			if n == i {
+				order = append(order, i)
+			}
+			continue
+		}
+		name := strings.ToLower(p.Name() + " " + p.Vendor())
+		if strings.Contains(name, strings.ToLower(platformFilter)) {
+			order = append(order, i)
+		}
+	}
+	if len(order) == 0 {
+		return nil, fmt.Errorf("no OpenCL platform matches -platform %q", platformFilter)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return !isMesaPlatform(platforms[order[a]]) && isMesaPlatform(platforms[order[b]])
+	})
+	return order, nil
+}
+
+// enumeratePlatforms collects devices platform by platform. Devices another
+// platform already exposed are dropped, and platforms whose probe build
+// failed are skipped unless -platform selects them. After each platform, stop
+// is called with the devices so far; if it returns true enumeration ends
+// early and complete is false. stop may be nil.
+func enumeratePlatforms(stop func([]*cl.Device) bool) (result []platformDevices, complete bool, err error) {
+	platforms, err := cl.GetPlatforms()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get platforms: %v", err)
+	}
+	if len(platforms) == 0 {
+		return nil, false, fmt.Errorf("no OpenCL platforms found")
+	}
+	order, err := orderPlatforms(platforms)
+	if err != nil {
+		return nil, false, err
+	}
+
+	seen := make(map[string]int) // identity -> devices of earlier platforms
+	var all []*cl.Device
+	var cache *tuningCache
+	for n, i := range order {
+		pd := platformDevices{index: i, platform: platforms[i]}
+		devices, err := platforms[i].GetDevices(cl.DeviceTypeAll)
+		if err != nil {
+			pd.skipped = fmt.Sprintf("failed to get devices: %v", err)
+			result = append(result, pd)
+			continue
+		}
+
+		if len(devices) > 0 && platformFilter == "" {
+			if cache == nil {
+				cache = loadTuningCache()
+			}
+			if err := probePlatform(cache, platforms[i], devices[0]); err != nil {
+				pd.skipped = fmt.Sprintf("probe build failed (%v); select it with -platform to use it anyway", err)
+				result = append(result, pd)
+				continue
+			}
+		}
+
+		// Dropped as duplicates only against earlier platforms, so identical
+		// cards on one platform are all kept
+		counts := make(map[string]int)
+		for _, d := range devices {
+			id := deviceIdentity(d)
+			counts[id]++
+			if counts[id] <= seen[id] {
+				pd.duplicates++
+				continue
+			}
+			pd.devices = append(pd.devices, d)
+		}
+		for id, c := range counts {
+			seen[id] = max(seen[id], c)
+		}
+		result = append(result, pd)
+		all = append(all, pd.devices...)
+
+		if stop != nil && n < len(order)-1 && stop(all) {
+			return result, false, nil
+		}
+	}
+	return result, true, nil
+}
+
+// probePlatform builds probeKernelSource on a platform's first device, once
+// per platform and version. The attempt is recorded before building, so a
+// build that crashes the miner marks the platform as broken for the next run.
+func probePlatform(cache *tuningCache, platform *cl.Platform, device *cl.Device) error {
+	key := platformKey(platform)
+	pt := cache.platform(key)
+	switch pt.Probe {
+	case "passed":
+		return nil
+	case "failed":
+		return fmt.Errorf("%s", pt.Error)
+	case "probing":
+		pt.Probe, pt.Error = "failed", "the miner exited while building on this platform"
+		if err := cache.save(); err != nil {
+			vlog("Warning: Failed to save tuning cache: %v", err)
+		}
+		return fmt.Errorf("%s", pt.Error)
+	}
+
+	vlog("Probing platform %s", key)
+	pt.Probe = "probing"
+	if err := cache.save(); err != nil {
+		vlog("Warning: Failed to save tuning cache: %v", err)
+	}
+	probeErr := buildProbe(device)
+	pt.Probe, pt.Error, pt.ProbedAt = "passed", "", time.Now()
+	if probeErr != nil {
+		pt.Probe, pt.Error = "failed", probeErr.Error()
+	}
+	if err := cache.save(); err != nil {
+		vlog("Warning: Failed to save tuning cache: %v", err)
+	}
+	return probeErr
+}
+
+// buildProbe builds probeKernelSource for a device
+func buildProbe(device *cl.Device) error {
+	context, err := cl.CreateContext([]*cl.Device{device})
+	if err != nil {
+		return fmt.Errorf("failed to create context: %v", err)
+	}
+	trackCL("context", 1)
+	defer func() {
+		context.Release()
+		trackCL("context", -1)
+	}()
+	program, err := context.CreateProgramWithSource([]string{probeKernelSource})
+	if err != nil {
+		return fmt.Errorf("failed to create program: %v", err)
+	}
+	trackCL("program", 1)
+	defer func() {
+		program.Release()
+		trackCL("program", -1)
+	}()
+	if err := program.BuildProgram(nil, ""); err != nil {
+		return fmt.Errorf("failed to build program: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+// Package powsigner adds NIP-13 proof of work to the events a go-nostr
+// Signer signs. Wrapping a bot's signer is all it takes:
+//
+//	signer = powsigner.New(signer, 20)
+//
+// Every event passed to SignEvent is mined to the difficulty by the
+// gpu-nostr-pow binary before the wrapped signer signs it. The miner's core
+// lives in its main package, which Go cannot import, so the binary is run as
+// a child process; it reads the event on stdin and writes the mined event on
+// stdout, as on the command line.
+package powsigner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// Signer is a nostr.Signer that mines each event before the wrapped signer
+// signs it
+type Signer struct {
+	nostr.Signer
+
+	// Difficulty is the number of leading zero bits each event's ID must have
+	Difficulty int
+	// Binary is the miner to run; "gpu-nostr-pow" is looked up in PATH if empty
+	Binary string
+	// Args are extra command-line options for the miner, e.g. -device 1
+	Args []string
+}
+
+// New wraps signer so that the events it signs carry proof of work of the
+// given difficulty
+func New(signer nostr.Signer, difficulty int) *Signer {
+	return &Signer{Signer: signer, Difficulty: difficulty}
+}
+
+// SignEvent sets the event's pubkey and, if unset, created_at, mines a nonce
+// tag into it and has the wrapped signer sign it. Both fields are set before
+// mining because the ID, and so the proof of work, covers them. Cancelling
+// ctx stops the miner.
+func (s *Signer) SignEvent(ctx context.Context, evt *nostr.Event) error {
+	pubkey, err := s.Signer.GetPublicKey(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get public key: %v", err)
+	}
+	evt.PubKey = pubkey
+	if evt.CreatedAt == 0 {
+		evt.CreatedAt = nostr.Now()
+	}
+
+	mined, err := s.mine(ctx, *evt)
+	if err != nil {
+		return err
+	}
+	*evt = mined
+	return s.Signer.SignEvent(ctx, evt)
+}
+
+// mine runs the miner on an event and checks that what comes back is the same
+// event with a nonce tag that reaches the difficulty
+func (s *Signer) mine(ctx context.Context, event nostr.Event) (nostr.Event, error) {
+	input, err := json.Marshal(event)
+	if err != nil {
+		return event, fmt.Errorf("failed to encode event: %v", err)
+	}
+	binary := s.Binary
+	if binary == "" {
+		binary = "gpu-nostr-pow"
+	}
+
+	// Progress would only fill stderr, which holds the error message on failure
+	args := append([]string{"-difficulty", strconv.Itoa(s.Difficulty), "-progress", "none"}, s.Args...)
+	cmd := exec.CommandContext(ctx, binary, args...)
+	// The miner stops cleanly on an interrupt; it is killed if it doesn't
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return event, ctx.Err()
+		}
+		return event, fmt.Errorf("failed to mine event: %v: %s", err, lastLine(stderr.String()))
+	}
+
+	var mined nostr.Event
+	if err := json.Unmarshal(stdout.Bytes(), &mined); err != nil {
+		return event, fmt.Errorf("failed to decode mined event: %v", err)
+	}
+	if mined.PubKey != event.PubKey || mined.Kind != event.Kind || mined.Content != event.Content || mined.CreatedAt != event.CreatedAt ||
+		!sameTags(withoutNonce(mined.Tags), withoutNonce(event.Tags)) {
+		return event, fmt.Errorf("miner returned a different event")
+	}
+	if mined.GetID() != mined.ID {
+		return event, fmt.Errorf("mined event ID %s does not match its content", mined.ID)
+	}
+	if bits := nip13.Difficulty(mined.ID); bits < s.Difficulty {
+		return event, fmt.Errorf("mined event reaches difficulty %d, not %d", bits, s.Difficulty)
+	}
+	return mined, nil
+}
+
+// withoutNonce returns the tags other than nonce tags, in order
+func withoutNonce(tags nostr.Tags) nostr.Tags {
+	var rest nostr.Tags
+	for _, tag := range tags {
+		if len(tag) > 0 && tag[0] == "nonce" {
+			continue
+		}
+		rest = append(rest, tag)
+	}
+	return rest
+}
+
+// sameTags reports whether two tag lists hold the same tags in the same order
+func sameTags(a, b nostr.Tags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if a[i][j] != b[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lastLine returns the last non-empty line of the miner's stderr, which
+// holds its error message
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
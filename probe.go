@@ -0,0 +1,179 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// probeBenchmarkDuration is how long -probe benchmarks each device
+const probeBenchmarkDuration = 2 * time.Second
+
+// probeKernels are the kernels -probe builds and self-tests on every device
+var probeKernels = []string{"default", "ckolivas", "amd", "nvidia", "offset", "midstate"}
+
+// probeBundle is the diagnostic bundle -probe writes: everything needed to
+// reproduce a user's setup in a bug report
+type probeBundle struct {
+	MinerVersion string           `json:"miner_version"`
+	GoVersion    string           `json:"go_version"`
+	OS           string           `json:"os"`
+	Arch         string           `json:"arch"`
+	CreatedAt    time.Time        `json:"created_at"`
+	Error        string           `json:"error,omitempty"`
+	Platforms    []bundlePlatform `json:"platforms"`
+}
+
+type bundlePlatform struct {
+	Index            int            `json:"index"`
+	Name             string         `json:"name"`
+	Vendor           string         `json:"vendor"`
+	Version          string         `json:"version"`
+	Skipped          string         `json:"skipped,omitempty"`
+	HiddenDuplicates int            `json:"hidden_duplicates,omitempty"`
+	Devices          []bundleDevice `json:"devices"`
+}
+
+type bundleDevice struct {
+	Index          int            `json:"index"` // in -list-devices order
+	Name           string         `json:"name"`
+	Vendor         string         `json:"vendor"`
+	Type           string         `json:"type"`
+	Version        string         `json:"version"`
+	DriverVersion  string         `json:"driver_version"`
+	OpenCLC        string         `json:"opencl_c"`
+	ComputeUnits   int            `json:"compute_units"`
+	ClockMHz       int            `json:"clock_mhz"`
+	GlobalMemory   int64          `json:"global_memory"`
+	MaxWorkGroup   int            `json:"max_work_group"`
+	MaxLaunch      int64          `json:"max_launch"`
+	AutoKernel     string         `json:"auto_kernel"`
+	Kernels        []bundleKernel `json:"kernels"`
+	BenchKernel    string         `json:"benchmark_kernel,omitempty"`
+	BenchBatchSize int            `json:"benchmark_batch_size,omitempty"`
+	HashRate       float64        `json:"hash_rate,omitempty"`
+	BenchError     string         `json:"benchmark_error,omitempty"`
+}
+
+type bundleKernel struct {
+	Name          string `json:"name"`
+	Build         string `json:"build"` // "ok" or the build error
+	ABI           string `json:"abi,omitempty"`
+	Occupancy     string `json:"occupancy,omitempty"`
+	SelfTest      string `json:"self_test,omitempty"` // "pass", "fail" or empty if not built
+	SelfTestError string `json:"self_test_error,omitempty"`
+}
+
+// runProbe enumerates platforms and devices, builds and self-tests every
+// kernel on each device, benchmarks the device's automatic kernel for
+// probeBenchmarkDuration and writes the results as one JSON bundle to
+// outputPath, or stdout if it is empty. Progress goes to stderr.
+func runProbe(difficulty int, memBudget int64, events *benchmarkEvents, outputPath string) error {
+	defer reportCLObjects()
+	bundle := probeBundle{
+		MinerVersion: minerVersion(),
+		GoVersion:    runtime.Version(),
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		CreatedAt:    time.Now().UTC(),
+		Platforms:    []bundlePlatform{},
+	}
+
+	// A machine without working OpenCL still gets a bundle saying so
+	platforms, _, err := enumeratePlatforms(nil)
+	if err != nil {
+		bundle.Error = err.Error()
+	}
+
+	deviceNum := 0
+	for _, pd := range platforms {
+		pp := bundlePlatform{
+			Index:            pd.index,
+			Name:             pd.platform.Name(),
+			Vendor:           pd.platform.Vendor(),
+			Version:          pd.platform.Version(),
+			Skipped:          pd.skipped,
+			HiddenDuplicates: pd.duplicates,
+			Devices:          []bundleDevice{},
+		}
+		for _, device := range pd.devices {
+			fmt.Fprintf(os.Stderr, "Probing device %d: %s\n", deviceNum, strings.TrimSpace(device.Name()))
+			pp.Devices = append(pp.Devices, probeOneDevice(deviceNum, device, difficulty, memBudget, events))
+			deviceNum++
+		}
+		bundle.Platforms = append(bundle.Platforms, pp)
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the probe bundle: %v", err)
+	}
+	return writeOutput(outputPath, data)
+}
+
+// probeOneDevice collects a device's properties, kernel results and
+// micro-benchmark for the bundle
+func probeOneDevice(index int, device *cl.Device, difficulty int, memBudget int64, events *benchmarkEvents) bundleDevice {
+	pd := bundleDevice{
+		Index:         index,
+		Name:          strings.TrimSpace(device.Name()),
+		Vendor:        strings.TrimSpace(device.Vendor()),
+		Type:          deviceTypeName(device),
+		Version:       device.Version(),
+		DriverVersion: device.DriverVersion(),
+		OpenCLC:       device.OpenCLCVersion(),
+		ComputeUnits:  device.MaxComputeUnits(),
+		ClockMHz:      device.MaxClockFrequency(),
+		GlobalMemory:  device.GlobalMemSize(),
+		MaxWorkGroup:  device.MaxWorkGroupSize(),
+		MaxLaunch:     int64(queryDeviceLimits(device).maxGlobalSize(0)),
+		AutoKernel:    selectKernelForDevice(device),
+	}
+
+	for _, kernelType := range probeKernels {
+		pk := bundleKernel{Name: kernelType}
+		session, err := newCLSession(device, kernelType)
+		if err != nil {
+			pk.Build = err.Error()
+			fmt.Fprintf(os.Stderr, "  %-10s build failed: %v\n", kernelType, err)
+			pd.Kernels = append(pd.Kernels, pk)
+			continue
+		}
+		pk.Build, pk.ABI, pk.Occupancy = "ok", session.abi.String(), session.occupancy.String()
+		session.Release()
+
+		pk.SelfTest = "pass"
+		if err := quickSelfTest(device, kernelType); err != nil {
+			pk.SelfTest, pk.SelfTestError = "fail", err.Error()
+		}
+		fmt.Fprintf(os.Stderr, "  %-10s self-test %s\n", kernelType, pk.SelfTest)
+		pd.Kernels = append(pd.Kernels, pk)
+	}
+
+	// Benchmark the kernel mining would pick, at a batch size safe for the
+	// device type
+	pd.BenchKernel = gateKernel(device, pd.AutoKernel)
+	pd.BenchBatchSize = 1000000
+	if device.Type()&cl.DeviceTypeCPU != 0 {
+		pd.BenchBatchSize = 10000
+	}
+	testEvent := events.next()
+	rate, err := benchmarkBatchSizeSafe(device, &testEvent, difficulty, pd.BenchBatchSize, 1, pd.BenchKernel, memBudget, probeBenchmarkDuration)
+	if err != nil {
+		pd.BenchError = err.Error()
+		fmt.Fprintf(os.Stderr, "  benchmark failed: %v\n", err)
+	} else {
+		pd.HashRate = rate
+		fmt.Fprintf(os.Stderr, "  benchmark (%s): %.2fM nonces/s\n", pd.BenchKernel, rate/1000000)
+	}
+	return pd
+}
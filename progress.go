@@ -0,0 +1,149 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Progress is one report from the mining loop
+type Progress struct {
+	Nonce      int64         `json:"nonce"`  // last nonce tested
+	Digits     int           `json:"digits"` // nonce width being mined
+	Tested     int64         `json:"nonces_tested"`
+	Elapsed    time.Duration `json:"-"`
+	Difficulty int           `json:"difficulty"`
+	// Rates are the smoothed rates over rateWindows (10s, 1m, 15m) in nonces
+	// per second, 0 until known
+	Rates [3]float64 `json:"-"`
+}
+
+// rate returns the average nonces per second so far
+func (p Progress) rate() float64 {
+	if p.Elapsed.Seconds() <= 0 {
+		return 0
+	}
+	return float64(p.Tested) / p.Elapsed.Seconds()
+}
+
+// expectedPercent returns the nonces tested as a percentage of the 2^difficulty
+// expected; it exceeds 100 on unlucky searches
+func (p Progress) expectedPercent() float64 {
+	return float64(p.Tested) / math.Pow(2, float64(p.Difficulty)) * 100
+}
+
+// ProgressSink renders the mining loop's progress. The loop calls Update
+// about every 100ms while mining, and Clear before it writes other output to
+// stderr and when mining ends. Applications embedding the miner supply their
+// own sink to show progress their way; the CLI picks one with -progress.
+type ProgressSink interface {
+	Update(p Progress)
+	Clear()
+}
+
+// newProgressSink returns the sink for a -progress setting
+func newProgressSink(mode string) (ProgressSink, error) {
+	switch mode {
+	case "bar":
+		return &terminalProgress{w: os.Stderr}, nil
+	case "json":
+		return &jsonProgress{w: os.Stderr, interval: time.Second}, nil
+	case "none":
+		return noProgress{}, nil
+	}
+	return nil, fmt.Errorf("unknown progress mode %q (use bar, json or none)", mode)
+}
+
+// terminalProgress redraws a one-line progress bar
+type terminalProgress struct {
+	w io.Writer
+}
+
+// formatRate formats nonces per second with a K or M suffix
+func formatRate(rate float64) string {
+	if rate >= 1000000 {
+		return fmt.Sprintf("%.2fM", rate/1000000)
+	} else if rate >= 1000 {
+		return fmt.Sprintf("%.2fK", rate/1000)
+	}
+	return fmt.Sprintf("%.0f", rate)
+}
+
+func (t *terminalProgress) Update(p Progress) {
+	// The smoothed rates show throttling that the whole-run average hides;
+	// the average stands in until the first ones are known
+	rateStr := formatRate(p.rate())
+	if p.Rates[0] > 0 {
+		rateStr = formatRate(p.Rates[0]) + "/" + formatRate(p.Rates[1]) + "/" + formatRate(p.Rates[2])
+	}
+
+	// Format elapsed time
+	elapsedSec := int(p.Elapsed.Seconds())
+	hours := elapsedSec / 3600
+	minutes := (elapsedSec % 3600) / 60
+	seconds := elapsedSec % 60
+	var elapsedStr string
+	if hours > 0 {
+		elapsedStr = fmt.Sprintf("%dh%dm%ds", hours, minutes, seconds)
+	} else if minutes > 0 {
+		elapsedStr = fmt.Sprintf("%dm%ds", minutes, seconds)
+	} else {
+		elapsedStr = fmt.Sprintf("%ds", seconds)
+	}
+
+	fmt.Fprintf(t.w, "\r[%d digits] Nonce: %d (%.1f%% of expected) | Rate 10s/1m/15m: %s nonces/s | Elapsed: %s",
+		p.Digits, p.Nonce, p.expectedPercent(), rateStr, elapsedStr)
+	if f, ok := t.w.(*os.File); ok {
+		f.Sync() // Flush stderr to ensure it's visible
+	}
+}
+
+func (t *terminalProgress) Clear() {
+	fmt.Fprintf(t.w, "\r%s\r", strings.Repeat(" ", 120))
+}
+
+// jsonProgress writes one JSON object per line, at most once per interval,
+// for log collectors and wrapper scripts
+type jsonProgress struct {
+	w        io.Writer
+	interval time.Duration
+	last     time.Time
+}
+
+func (j *jsonProgress) Update(p Progress) {
+	now := time.Now()
+	if now.Sub(j.last) < j.interval {
+		return
+	}
+	j.last = now
+	line, err := json.Marshal(struct {
+		Progress
+		AverageHashRate float64 `json:"average_hash_rate"`
+		HashRate10s     float64 `json:"hash_rate_10s"`
+		HashRate1m      float64 `json:"hash_rate_1m"`
+		HashRate15m     float64 `json:"hash_rate_15m"`
+		ElapsedSeconds  float64 `json:"elapsed_seconds"`
+		ExpectedPercent float64 `json:"expected_percent"`
+	}{p, p.rate(), p.Rates[0], p.Rates[1], p.Rates[2], p.Elapsed.Seconds(), p.expectedPercent()})
+	if err != nil {
+		return
+	}
+	j.w.Write(append(line, '\n'))
+}
+
+// Clear does nothing: each line is complete
+func (j *jsonProgress) Clear() {}
+
+// noProgress discards progress
+type noProgress struct{}
+
+func (noProgress) Update(Progress) {}
+func (noProgress) Clear()          {}
@@ -0,0 +1,73 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// quarantineMinRejected is how many of a kernel's candidates must fail CPU
+// validation before it is quarantined; one bad hit can be a cosmic ray
+const quarantineMinRejected = 3
+
+// quarantineMaxRejectedShare is the share of a kernel's candidates that may
+// fail CPU validation before it is quarantined
+const quarantineMaxRejectedShare = 0.1
+
+// falsePositives counts the candidates a kernel reports in a mining run and
+// how many of them fail CPU validation
+type falsePositives struct {
+	candidates int64
+	rejected   int64
+	tripped    bool
+}
+
+// record counts one candidate and reports whether the kernel just crossed the
+// quarantine threshold; it reports so at most once per run
+func (f *falsePositives) record(valid bool) bool {
+	f.candidates++
+	if !valid {
+		f.rejected++
+	}
+	if f.tripped || f.rejected < quarantineMinRejected || float64(f.rejected) < quarantineMaxRejectedShare*float64(f.candidates) {
+		return false
+	}
+	f.tripped = true
+	return true
+}
+
+// quarantineKernel warns that a kernel reports too many false positives and
+// reports whether the miner should switch to the default kernel. A kernel that
+// reports wrong hits may also miss right ones, so it is marked failed in the
+// tuning cache and later runs fall back to the default kernel too, as after a
+// failed self-test. When the default kernel is the one misbehaving there is
+// nothing to switch to and the device itself is suspect.
+func quarantineKernel(device *cl.Device, kernelType string, f falsePositives) bool {
+	banner := strings.Repeat("!", 72)
+	reason := fmt.Sprintf("%d of %d candidates failed CPU validation while mining", f.rejected, f.candidates)
+	fmt.Fprintf(os.Stderr, "\n%s\n", banner)
+	defer fmt.Fprintf(os.Stderr, "%s\n", banner)
+
+	if kernelType == "default" {
+		fmt.Fprintf(os.Stderr, "Warning: The default kernel is reporting wrong hits on %s: %s\n", device.Name(), reason)
+		fmt.Fprintf(os.Stderr, "Warning: The device may be unstable (overclocked, overheating or faulty); results may be missed\n")
+		return false
+	}
+
+	fmt.Fprintf(os.Stderr, "Warning: Kernel %s is reporting wrong hits on %s: %s\n", kernelType, device.Name(), reason)
+	fmt.Fprintf(os.Stderr, "Warning: It may be missing valid nonces too; switching to the default kernel\n")
+	cache := loadTuningCache()
+	cache.recordSelfTest(device, kernelType, fmt.Errorf("quarantined: %s", reason))
+	if err := cache.save(); err != nil {
+		vlog("Warning: Failed to save tuning cache: %v", err)
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "Warning: Later runs will use the default kernel too (delete %s to retest)\n", cache.path)
+	return true
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// raceVariant is one -race-variants event, ready to mine
+type raceVariant struct {
+	event    nostr.Event // without its nonce tag
+	template nostr.Tag
+	position int
+}
+
+// raceResult is what one device's goroutine of runRaceVariants ends with
+type raceResult struct {
+	variant int
+	event   nostr.Event
+	err     error
+	lost    bool // stopped by another device's win
+}
+
+// runRaceVariants mines variants of one event, one JSON event per line in in,
+// on a device each at once: variant i on device i in -list-devices order,
+// every device with its own session. The first variant mined wins; the other
+// devices stop after their current batch. Racing helps only with several
+// devices, since on one device every hash succeeds with the same probability
+// whichever variant it is for. It returns the mined event and its line's
+// index among the variants.
+func runRaceVariants(in io.Reader, difficulty int, opts libOptions, memBudget int64) (nostr.Event, int, error) {
+	var variants []raceVariant
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), batchMaxLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		event, _, err := parseInputEvent(scanner.Bytes())
+		if err != nil {
+			return nostr.Event{}, 0, fmt.Errorf("line %d: failed to parse JSON event: %v", line, err)
+		}
+		var v raceVariant
+		if v.event, v.template, v.position, err = prepareLibEvent(event, difficulty, opts.NoncePrefix); err != nil {
+			return nostr.Event{}, 0, fmt.Errorf("line %d: %v", line, err)
+		}
+		variants = append(variants, v)
+	}
+	if err := scanner.Err(); err != nil {
+		return nostr.Event{}, 0, fmt.Errorf("failed to read events: %v", err)
+	}
+	if len(variants) == 0 {
+		return nostr.Event{}, 0, fmt.Errorf("no events on stdin")
+	}
+
+	devices, err := openCLDevices()
+	if err != nil {
+		return nostr.Event{}, 0, err
+	}
+	if len(variants) > len(devices) {
+		fmt.Fprintf(os.Stderr, "Warning: %d variants for %d devices; racing the first %d\n", len(variants), len(devices), len(devices))
+		variants = variants[:len(devices)]
+	}
+	if len(variants) == 1 {
+		fmt.Fprintf(os.Stderr, "Warning: Racing one variant is plain mining; give one variant per device\n")
+	}
+
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	results := make(chan raceResult, len(variants))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, v := range variants {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deviceOpts := opts
+			deviceOpts.Device = i
+			mined, err := raceOnDevice(v, difficulty, deviceOpts, memBudget, stop)
+			r := raceResult{variant: i, event: mined, err: err}
+			if err == nil {
+				stopOnce.Do(func() { close(stop) })
+			} else {
+				select {
+				case <-stop:
+					r.lost = true
+				default:
+				}
+			}
+			results <- r
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var winner *raceResult
+	var failures []string
+	for r := range results {
+		switch {
+		case r.err == nil && winner == nil:
+			winner = &r
+		case r.err == nil:
+			// Found in the same batch as the winner; equally valid
+			vlog("Variant %d on device %d was mined too", r.variant, r.variant)
+		case !r.lost:
+			failures = append(failures, fmt.Sprintf("device %d: %v", r.variant, r.err))
+		}
+	}
+	for _, failure := range failures {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", failure)
+	}
+	if winner == nil {
+		return nostr.Event{}, 0, fmt.Errorf("no variant was mined: %s", strings.Join(failures, "; "))
+	}
+	vlog("Variant %d won on device %d in %s", winner.variant, winner.variant, time.Since(start).Round(time.Millisecond))
+	return winner.event, winner.variant, nil
+}
+
+// raceOnDevice sets up a session on the device of opts and mines a variant on
+// it until it is mined or stop is closed
+func raceOnDevice(v raceVariant, difficulty int, opts libOptions, memBudget int64, stop <-chan struct{}) (nostr.Event, error) {
+	session, batchSize, err := openLibSession(opts, libInputBytes, memBudget)
+	if err != nil {
+		return v.event, err
+	}
+	defer session.Release()
+	vlog("Device %d: mining variant %d with kernel %s, batch size %d", opts.Device, opts.Device, session.kernelType, batchSize)
+	return mineOnSession(session, batchSize, v.event, v.template, v.position, difficulty, opts.NoncePrefix, time.Time{}, stop, nil)
+}
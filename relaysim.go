@@ -0,0 +1,162 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/coder/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// mockRelay is an in-process Nostr relay for developing and checking the
+// miner's network features without a live relay. It accepts EVENT, answering
+// OK, and REQ, answering with the stored events that match and EOSE. Like
+// relays that require proof of work, it rejects events below its minimum
+// difficulty with a "pow:" reason. It keeps every accepted event in memory.
+type mockRelay struct {
+	server   *http.Server
+	listener net.Listener
+
+	mu            sync.Mutex
+	minDifficulty int
+	events        []*nostr.Event
+}
+
+// newMockRelay starts a mock relay on a free localhost port
+func newMockRelay(minDifficulty int) (*mockRelay, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+	r := &mockRelay{listener: listener, minDifficulty: minDifficulty}
+	r.server = &http.Server{Handler: http.HandlerFunc(r.serve)}
+	go r.server.Serve(listener)
+	return r, nil
+}
+
+// URL returns the relay's ws:// URL
+func (r *mockRelay) URL() string {
+	return "ws://" + r.listener.Addr().String()
+}
+
+// Close stops the relay and drops its connections
+func (r *mockRelay) Close() error {
+	return r.server.Close()
+}
+
+// setMinDifficulty changes the difficulty events need to be accepted
+func (r *mockRelay) setMinDifficulty(bits int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.minDifficulty = bits
+}
+
+// stored returns the events the relay accepted, oldest first
+func (r *mockRelay) stored() []*nostr.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*nostr.Event(nil), r.events...)
+}
+
+// serve runs one client connection
+func (r *mockRelay) serve(w http.ResponseWriter, req *http.Request) {
+	conn, err := websocket.Accept(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.CloseNow()
+	ctx := req.Context()
+	for {
+		_, message, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		var replies []nostr.Envelope
+		switch env := nostr.ParseMessage(string(message)).(type) {
+		case *nostr.EventEnvelope:
+			replies = append(replies, r.accept(&env.Event))
+		case *nostr.ReqEnvelope:
+			replies = r.query(env)
+		case *nostr.CloseEnvelope:
+			// Subscriptions end with their EOSE, so there is nothing to close
+		default:
+			notice := nostr.NoticeEnvelope(fmt.Sprintf("unsupported message: %.64s", message))
+			replies = append(replies, &notice)
+		}
+		for _, reply := range replies {
+			data, err := reply.MarshalJSON()
+			if err != nil {
+				return
+			}
+			if err := conn.Write(ctx, websocket.MessageText, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// accept checks an event as a relay requiring proof of work does and stores
+// it if it passes
+func (r *mockRelay) accept(event *nostr.Event) *nostr.OKEnvelope {
+	reject := func(reason string) *nostr.OKEnvelope {
+		return &nostr.OKEnvelope{EventID: event.ID, OK: false, Reason: reason}
+	}
+	if !event.CheckID() {
+		return reject("invalid: event id does not match its content")
+	}
+	if ok, err := event.CheckSignature(); !ok || err != nil {
+		return reject("invalid: bad signature")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.minDifficulty > 0 {
+		if work := nip13.Difficulty(event.ID); work < r.minDifficulty {
+			return reject(fmt.Sprintf("pow: difficulty %d is less than %d", work, r.minDifficulty))
+		}
+		// NIP-13: a lower committed target means the work was aimed lower
+		if tag := event.Tags.Find("nonce"); len(tag) >= 3 {
+			if target, err := strconv.Atoi(tag[2]); err != nil || target < r.minDifficulty {
+				return reject(fmt.Sprintf("pow: committed target %q is less than %d", tag[2], r.minDifficulty))
+			}
+		}
+	}
+	for _, e := range r.events {
+		if e.ID == event.ID {
+			return &nostr.OKEnvelope{EventID: event.ID, OK: true, Reason: "duplicate: already have this event"}
+		}
+	}
+	r.events = append(r.events, event)
+	return &nostr.OKEnvelope{EventID: event.ID, OK: true}
+}
+
+// query answers a REQ with the stored events its filters match, the most
+// recently stored first, then EOSE
+func (r *mockRelay) query(req *nostr.ReqEnvelope) []nostr.Envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var replies []nostr.Envelope
+	for _, filter := range req.Filters {
+		sent := 0
+		for i := len(r.events) - 1; i >= 0; i-- {
+			if filter.Limit > 0 && sent == filter.Limit {
+				break
+			}
+			if filter.Matches(r.events[i]) {
+				subscription := req.SubscriptionID
+				replies = append(replies, &nostr.EventEnvelope{SubscriptionID: &subscription, Event: *r.events[i]})
+				sent++
+			}
+		}
+	}
+	eose := nostr.EOSEEnvelope(req.SubscriptionID)
+	return append(replies, &eose)
+}
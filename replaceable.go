@@ -0,0 +1,100 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// relayQueryTimeout bounds connecting to and querying a relay
+const relayQueryTimeout = 10 * time.Second
+
+// isReplaceableEvent reports whether relays keep only the newest version of an
+// event of this kind (replaceable and addressable kinds)
+func isReplaceableEvent(event *nostr.Event) bool {
+	return nostr.IsReplaceableKind(event.Kind) || nostr.IsAddressableKind(event.Kind)
+}
+
+// latestStoredVersion asks a relay for the newest version it stores of a
+// replaceable or addressable event and returns its created_at, or 0 if the
+// relay has none
+func latestStoredVersion(relayURL string, event *nostr.Event) (nostr.Timestamp, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), relayQueryTimeout)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, relayURL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect: %v", err)
+	}
+	defer relay.Close()
+
+	filter := nostr.Filter{
+		Authors: []string{event.PubKey},
+		Kinds:   []int{event.Kind},
+		Limit:   1,
+	}
+	if nostr.IsAddressableKind(event.Kind) {
+		filter.Tags = nostr.TagMap{"d": []string{event.Tags.GetD()}}
+	}
+	events, err := relay.QuerySync(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("query failed: %v", err)
+	}
+
+	var latest nostr.Timestamp
+	for _, e := range events {
+		if e.CreatedAt > latest {
+			latest = e.CreatedAt
+		}
+	}
+	return latest, nil
+}
+
+// prepareReplaceableEvent makes sure mining a replaceable or addressable event
+// is not wasted on a version relays will discard as stale. If relayURL is set,
+// the relay is asked for the newest stored version. With bump, created_at is
+// moved to now, or past the relay's newest version if that is later.
+func prepareReplaceableEvent(event *nostr.Event, relayURL string, bump bool) {
+	if !isReplaceableEvent(event) {
+		if bump {
+			vlog("Not bumping created_at: kind %d is not replaceable", event.Kind)
+		}
+		return
+	}
+
+	var newest nostr.Timestamp
+	if relayURL != "" {
+		latest, err := latestStoredVersion(relayURL, event)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not check %s for newer versions of this event: %v\n", relayURL, err)
+		} else if latest > event.CreatedAt {
+			newest = latest
+		} else {
+			vlog("Relay %s has no newer version of this kind %d event", relayURL, event.Kind)
+		}
+	}
+
+	if bump {
+		target := nostr.Now()
+		if newest >= target {
+			target = newest + 1
+		}
+		if target > event.CreatedAt {
+			fmt.Fprintf(os.Stderr, "Bumped created_at from %d to %d\n", event.CreatedAt, target)
+			event.CreatedAt = target
+		}
+		return
+	}
+
+	if newest > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %s already has a newer version of this kind %d event (created_at %d > %d); relays will treat the mined event as stale. Use -bump-created-at to mine a newer version.\n",
+			relayURL, event.Kind, newest, event.CreatedAt)
+	}
+}
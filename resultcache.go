@@ -0,0 +1,130 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// maxResultCacheEntries bounds the result cache; the oldest entries are dropped
+const maxResultCacheEntries = 256
+
+// resultCache remembers the nonces found for recently mined events, so mining
+// the same event at the same difficulty again (e.g. when a caller retries)
+// returns immediately. It is persisted as JSON next to the tuning cache.
+type resultCache struct {
+	Entries []resultCacheEntry `json:"entries"` // oldest first
+
+	path string
+}
+
+// resultCacheEntry maps an event and difficulty to the nonce tag value found for it
+type resultCacheEntry struct {
+	Key     string    `json:"key"`
+	Nonce   string    `json:"nonce"`
+	MinedAt time.Time `json:"mined_at"`
+}
+
+// resultCachePath returns the location of the result cache file
+func resultCachePath() (string, error) {
+	return stateFile("results.json")
+}
+
+// loadResultCache reads the result cache from disk.
+// A missing or unreadable cache yields an empty one.
+func loadResultCache() *resultCache {
+	cache := &resultCache{}
+
+	path, err := resultCachePath()
+	if err != nil {
+		vlog("Result cache disabled: %v", err)
+		return cache
+	}
+	cache.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			vlog("Warning: Failed to read result cache %s: %v", path, err)
+		}
+		return cache
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		vlog("Warning: Ignoring corrupt result cache %s: %v", path, err)
+		cache.Entries = nil
+	}
+	return cache
+}
+
+// save writes the result cache to disk atomically, so an interrupted run
+// leaves the previous cache in place
+func (c *resultCache) save() error {
+	if c.path == "" {
+		return fmt.Errorf("no result cache path")
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, data)
+}
+
+// resultCacheKey identifies an event (with its nonce tag already removed),
+// nonce tag template, difficulty and nonce tag position. Together they cover
+// everything the event ID depends on.
+func resultCacheKey(event nostr.Event, nonceTemplate nostr.Tag, difficulty int, noncePosition int) string {
+	h := sha256.New()
+	h.Write(event.Serialize())
+	fmt.Fprintf(h, "\x00%q\x00%d\x00%d", []string(nonceTemplate), difficulty, noncePosition)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lookup returns the cached nonce for a key
+func (c *resultCache) lookup(key string) (string, bool) {
+	for _, entry := range c.Entries {
+		if entry.Key == key {
+			return entry.Nonce, true
+		}
+	}
+	return "", false
+}
+
+// store records the nonce found for a key, evicting the oldest entries
+func (c *resultCache) store(key, nonce string) {
+	entries := c.Entries[:0]
+	for _, entry := range c.Entries {
+		if entry.Key != key {
+			entries = append(entries, entry)
+		}
+	}
+	entries = append(entries, resultCacheEntry{Key: key, Nonce: nonce, MinedAt: time.Now()})
+	if len(entries) > maxResultCacheEntries {
+		entries = entries[len(entries)-maxResultCacheEntries:]
+	}
+	c.Entries = entries
+}
+
+// cachedResult rebuilds the mined event from a cached nonce and checks it on
+// the CPU, so a stale or corrupt cache can never produce an invalid event
+func cachedResult(event nostr.Event, nonceTemplate nostr.Tag, nonceStr string, difficulty int, noncePosition int) ([]byte, error) {
+	event.Tags = withNonceTag(event.Tags, nonceTagWithValue(nonceTemplate, nonceStr), noncePosition)
+	event.ID = event.GetID()
+	if got := nip13.Difficulty(event.ID); got < difficulty {
+		return nil, fmt.Errorf("cached nonce %s gives %d leading zero bits, need %d", nonceStr, got, difficulty)
+	}
+	return json.Marshal(event)
+}
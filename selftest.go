@@ -0,0 +1,432 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"math/bits"
+	mrand "math/rand"
+	"os"
+	"strings"
+
+	cl "github.com/jgillich/go-opencl/cl"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// leadingZeroBits counts the leading zero bits of a SHA-256 hash
+func leadingZeroBits(hash [32]byte) int {
+	count := 0
+	for _, b := range hash {
+		if b == 0 {
+			count += 8
+			continue
+		}
+		count += bits.LeadingZeros8(b)
+		break
+	}
+	return count
+}
+
+// difficultyVector is an event and nonce whose event ID is known, from CPU
+// hashing, to have a specific number of leading zero bits. The 32- and 33-bit
+// vectors check that kernels carry the count from the first 32-bit word of
+// the hash into the second.
+type difficultyVector struct {
+	event     nostr.Event // nonce tag holds the placeholder
+	nonce     uint64
+	numDigits int
+	bits      int
+}
+
+// difficultyVectors cover the boundary between the first two 32-bit words of
+// the hash: the 32-bit vector must not be reported at difficulty 33, and the
+// 33-bit vector must be. Their windows are also mined at difficulties 34-48,
+// which only checks that nothing is reported there; a vector that must be
+// reported above 33 bits would take about 2^bits hashes on the CPU to find.
+var difficultyVectors = []difficultyVector{
+	newDifficultyVector(3724288, 32),
+	newDifficultyVector(1236848220, 33),
+}
+
+// newDifficultyVector builds a vector for the fixed test event
+func newDifficultyVector(nonce uint64, bits int) difficultyVector {
+	const numDigits = 12
+	return difficultyVector{
+		event: nostr.Event{
+			PubKey:    "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+			CreatedAt: nostr.Timestamp(1700000000),
+			Kind:      1,
+			Tags:      nostr.Tags{nostr.Tag{"nonce", strings.Repeat("0", numDigits), "33"}},
+			Content:   "nip-13 test vector",
+		},
+		nonce:     nonce,
+		numDigits: numDigits,
+		bits:      bits,
+	}
+}
+
+// runWindow runs one batch of the session's batch size over a serialized event
+// starting at baseNonce and returns each work item's result
+func runWindow(session *clSession, serialized []byte, nonceOffset, numDigits, difficulty int, baseNonce uint64) ([]int32, error) {
+	if err := session.setInput(serialized, nonceOffset, numDigits, difficulty); err != nil {
+		return nil, fmt.Errorf("serialized length %d: %v", len(serialized), err)
+	}
+	results, err := session.runBatch(baseNonce, session.batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("kernel launch failed (serialized length %d): %v", len(serialized), err)
+	}
+	return results, nil
+}
+
+// quickSelfTest runs a kernel over a fixed nonce range for events whose
+// serialized lengths cover every residue modulo the SHA-256 block size and
+// compares every reported hit against a CPU reference (the kernel's powTarget). Unlike testSingleKernel,
+// this catches missed hits as well as false positives, including padding bugs
+// that only show up at particular event lengths. It then checks the
+// difficultyVectors across the first word boundary and the escapingVectors.
+func quickSelfTest(device *cl.Device, kernelType string) error {
+	session, err := newCLSession(device, kernelType)
+	if err != nil {
+		return err
+	}
+	defer session.Release()
+	return selfTestSession(session)
+}
+
+// selfTestSession runs quickSelfTest's checks on a kernel already built, so
+// a build with other options or from source read once is tested as built.
+// It leaves the session with a results buffer for the test's batch size.
+func selfTestSession(session *clSession) error {
+	const batchSize = 1024
+	const difficulty = 4
+	const numDigits = 10
+	const baseNonce = 1000000000
+
+	if err := session.allocResults(batchSize); err != nil {
+		return err
+	}
+
+	noncePlaceholder := fmt.Sprintf("%0*d", numDigits, baseNonce)
+
+	// One event per content length so the serialized length hits every
+	// position of the final SHA-256 block
+	for contentLen := 0; contentLen < 64; contentLen++ {
+		event := nostr.Event{
+			PubKey:    strings.Repeat("ab", 32),
+			CreatedAt: nostr.Timestamp(1700000000),
+			Kind:      1,
+			Tags:      nostr.Tags{nostr.Tag{"nonce", noncePlaceholder, fmt.Sprint(difficulty)}},
+			Content:   strings.Repeat("x", contentLen),
+		}
+		serialized := event.Serialize()
+		serializedLength := len(serialized)
+		nonceOffset := findNonceOffset(serialized, noncePlaceholder)
+		if nonceOffset == -1 {
+			return fmt.Errorf("could not find nonce placeholder in serialized event")
+		}
+
+		resultIndices, err := runWindow(session, serialized, nonceOffset, numDigits, difficulty, baseNonce)
+		if err != nil {
+			return err
+		}
+
+		// Compare every index against the CPU
+		message := append([]byte(nil), serialized...)
+		for i := 0; i < batchSize; i++ {
+			copy(message[nonceOffset:], fmt.Sprintf("%0*d", numDigits, baseNonce+i))
+			cpuHit := session.target.score(message) >= difficulty
+			gpuHit := resultIndices[i] >= 0
+
+			if gpuHit && resultIndices[i] != int32(i) {
+				return fmt.Errorf("serialized length %d: work item %d reported index %d", serializedLength, i, resultIndices[i])
+			}
+			if gpuHit != cpuHit {
+				return fmt.Errorf("serialized length %d, nonce %d: GPU hit=%v, CPU hit=%v",
+					serializedLength, baseNonce+i, gpuHit, cpuHit)
+			}
+		}
+	}
+
+	// High difficulty vectors: a window of nonces around each vector must
+	// contain exactly the vector's nonce for every difficulty it satisfies.
+	// Their difficulties are NIP-13 leading zero bits.
+	vectors := difficultyVectors
+	if session.abi.Target != defaultPowTarget {
+		vectors = nil
+	}
+	for _, vector := range vectors {
+		noncePlaceholder := strings.Repeat("0", vector.numDigits)
+		serialized := vector.event.Serialize()
+		nonceOffset := findNonceOffset(serialized, noncePlaceholder)
+		if nonceOffset == -1 {
+			return fmt.Errorf("could not find nonce placeholder in test vector")
+		}
+
+		// Verify the vector on the CPU first so serializer changes are not
+		// reported as kernel failures
+		message := append([]byte(nil), serialized...)
+		copy(message[nonceOffset:], fmt.Sprintf("%0*d", vector.numDigits, vector.nonce))
+		if got := leadingZeroBits(sha256.Sum256(message)); got != vector.bits {
+			return fmt.Errorf("test vector %d has %d leading zero bits on CPU, expected %d", vector.nonce, got, vector.bits)
+		}
+
+		// CPU reference for the whole window
+		windowStart := vector.nonce - batchSize/2
+		windowBits := make([]int, batchSize)
+		for i := range windowBits {
+			copy(message[nonceOffset:], fmt.Sprintf("%0*d", vector.numDigits, windowStart+uint64(i)))
+			windowBits[i] = leadingZeroBits(sha256.Sum256(message))
+		}
+
+		for difficulty := 33; difficulty <= 48; difficulty++ {
+			resultIndices, err := runWindow(session, serialized, nonceOffset, vector.numDigits, difficulty, windowStart)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < batchSize; i++ {
+				nonce := windowStart + uint64(i)
+				gpuHit := resultIndices[i] >= 0
+				cpuHit := windowBits[i] >= difficulty
+				if gpuHit != cpuHit {
+					return fmt.Errorf("difficulty %d, nonce %d (%d bits on CPU): GPU hit=%v, CPU hit=%v",
+						difficulty, nonce, windowBits[i], gpuHit, cpuHit)
+				}
+			}
+		}
+	}
+
+	// Content and tags that change JSON escaping, and so the nonce's byte offset
+	for _, event := range escapingVectors() {
+		if err := checkEscapedEvent(session, event); err != nil {
+			return err
+		}
+	}
+
+	// Input shapes behind past bug reports, at several nonce widths
+	for _, event := range eventShapeVectors() {
+		for _, digits := range shapeWidths {
+			if err := checkEventAtWidth(session, event, digits); err != nil {
+				return fmt.Errorf("kind %d event with %d tags, %d-digit nonce: %v", event.Kind, len(event.Tags), digits, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// escapingRunes are fragments that JSON serialization escapes or that are
+// multi-byte in UTF-8, plus text resembling the nonce tag itself
+var escapingRunes = []string{
+	"a", " ", "\"", "\\", "/", "\n", "\r", "\t", "\b", "\f", "\x00", "\x01", "\x1f", "\x7f",
+	"<", ">", "&", "é", "日本", "🤙🏽", "👨‍👩‍👧", "\u2028", "\u2029", "\ufeff", "\xff", `\u0000`,
+	"nonce", `["nonce","`, "0000000000", `"]`,
+}
+
+// escapingVectors returns fixed events whose content and tag values exercise
+// JSON escaping: quotes, backslashes, control characters, emoji and other
+// multi-byte text, and strings that look like the nonce tag
+func escapingVectors() []nostr.Event {
+	contents := []string{
+		"emoji 🤙🏽🔥 and ZWJ 👨‍👩‍👧",
+		"line one\nline two\r\n\ttabbed",
+		`say "hello" to C:\path\file`,
+		"controls \x00\x01\x02\x1f\x7f end",
+		"</script><b>&amp;</b>",
+		"separators \u2028 \u2029 bom \ufeff",
+		"invalid utf-8 \xff\xfe\xc3",
+		`fake ["nonce","0000000000","4"] tag`,
+		strings.Repeat("日本語🤙\n\"", 20),
+	}
+	tagValues := [][]string{
+		nil,
+		{"t", "quote\"d"},
+		{"e", "line\nbreak", "wss://relay.example.com/\u00e9"},
+		{"nonce-like", "0000000000"},
+	}
+
+	var events []nostr.Event
+	for i, content := range contents {
+		tags := nostr.Tags{}
+		if tv := tagValues[i%len(tagValues)]; tv != nil {
+			tags = append(tags, nostr.Tag(tv))
+		}
+		events = append(events, nostr.Event{
+			PubKey:    strings.Repeat("cd", 32),
+			CreatedAt: nostr.Timestamp(1700000000 + i),
+			Kind:      1,
+			Tags:      tags,
+			Content:   content,
+		})
+	}
+	return events
+}
+
+// randomEscapingEvent builds an event whose content and tags are random
+// sequences of escapingRunes
+func randomEscapingEvent(rng *mrand.Rand) nostr.Event {
+	randomText := func(maxParts int) string {
+		var b strings.Builder
+		for n := rng.Intn(maxParts + 1); n > 0; n-- {
+			b.WriteString(escapingRunes[rng.Intn(len(escapingRunes))])
+		}
+		return b.String()
+	}
+
+	tags := nostr.Tags{}
+	for n := rng.Intn(3); n > 0; n-- {
+		tags = append(tags, nostr.Tag{randomText(3), randomText(8)})
+	}
+	return nostr.Event{
+		PubKey:    strings.Repeat("ef", 32),
+		CreatedAt: nostr.Timestamp(1700000000 + rng.Intn(100000000)),
+		Kind:      rng.Intn(40000),
+		Tags:      tags,
+		Content:   randomText(60),
+	}
+}
+
+// shapeWidths are the nonce widths eventShapeVectors are checked at: the
+// narrowest the miner starts at, the usual 10 digits, and a width only hard
+// targets reach, so digit growth shifts the nonce tag's closing bytes and
+// everything after them
+var shapeWidths = []int{5, 10, 16}
+
+// eventShapeVectors returns events of the shapes behind past bug reports: no
+// tags at all, so the nonce tag is the only one; tags missing from the input
+// (nil); empty content; kind 0 metadata, whose content is escaped JSON; and
+// ephemeral and other five-digit kinds, which move every later offset
+func eventShapeVectors() []nostr.Event {
+	pubkey := strings.Repeat("a1", 32)
+	return []nostr.Event{
+		{PubKey: pubkey, CreatedAt: 1700000000, Kind: 1, Tags: nostr.Tags{}, Content: ""},
+		{PubKey: pubkey, CreatedAt: 1700000000, Kind: 1, Tags: nil, Content: "no tags"},
+		{PubKey: pubkey, CreatedAt: 1700000000, Kind: 0, Tags: nostr.Tags{},
+			Content: `{"name":"alice","about":"line\nbreak \"quoted\" 🤙","picture":"https://example.com/a.png","nip05":"alice@example.com"}`},
+		{PubKey: pubkey, CreatedAt: 1700000000, Kind: 0, Tags: nostr.Tags{}, Content: "{}"},
+		{PubKey: pubkey, CreatedAt: 1700000000, Kind: 20001, Tags: nostr.Tags{}, Content: ""},
+		{PubKey: pubkey, CreatedAt: 1700000000, Kind: 29999, Tags: nostr.Tags{{"p", strings.Repeat("b2", 32)}}, Content: "ephemeral"},
+		{PubKey: pubkey, CreatedAt: 1700000000, Kind: 30023, Tags: nostr.Tags{{"d", ""}}, Content: ""},
+	}
+}
+
+// checkEscapedEvent runs checkEventAtWidth with 10-digit nonces
+func checkEscapedEvent(session *clSession, event nostr.Event) error {
+	return checkEventAtWidth(session, event, 10)
+}
+
+// checkEventAtWidth adds a nonce tag of numDigits digits to the event and
+// checks, on the CPU, that writing nonce digits at the offset found in the
+// serialized placeholder gives exactly the serialization of the event with
+// that nonce. It then runs the kernel and compares every result against event
+// IDs computed by serializing the event afresh with each nonce, so an offset
+// error can't hide in both the kernel and its reference.
+func checkEventAtWidth(session *clSession, event nostr.Event, numDigits int) error {
+	const difficulty = 4
+	baseNonce := 2 * uint64(math.Pow(10, float64(numDigits-1)))
+
+	placeholder := fmt.Sprintf("%0*d", numDigits, baseNonce)
+	event.Tags = withNonceTag(event.Tags, nostr.Tag{"nonce", placeholder, fmt.Sprint(difficulty)}, nonceTagLast)
+	serialized := event.Serialize()
+	nonceOffset := findNonceOffset(serialized, placeholder)
+	if nonceOffset == -1 {
+		return fmt.Errorf("content %q: could not find nonce placeholder", event.Content)
+	}
+
+	// Reference IDs from a full re-serialization with each nonce
+	cpuBits := make([]int, session.batchSize)
+	message := append([]byte(nil), serialized...)
+	for i := range cpuBits {
+		nonceStr := fmt.Sprintf("%0*d", numDigits, baseNonce+uint64(i))
+		withNonce := event
+		withNonce.Tags = replaceNonceTag(event.Tags, nostr.Tag{"nonce", nonceStr, fmt.Sprint(difficulty)})
+		reserialized := withNonce.Serialize()
+
+		copy(message[nonceOffset:], nonceStr)
+		if !bytes.Equal(message, reserialized) {
+			return fmt.Errorf("content %q: writing nonce %s at offset %d does not match the serialized event",
+				event.Content, nonceStr, nonceOffset)
+		}
+		cpuBits[i] = session.target.score(reserialized)
+	}
+
+	resultIndices, err := runWindow(session, serialized, nonceOffset, numDigits, difficulty, baseNonce)
+	if err != nil {
+		return err
+	}
+	for i := range cpuBits {
+		gpuHit := resultIndices[i] >= 0
+		cpuHit := cpuBits[i] >= difficulty
+		if gpuHit != cpuHit {
+			return fmt.Errorf("content %q, nonce %d: GPU hit=%v, CPU hit=%v", event.Content, baseNonce+uint64(i), gpuHit, cpuHit)
+		}
+	}
+	return nil
+}
+
+// fuzzSelfTest runs checkEscapedEvent on random events built from
+// escapingRunes. The seed is reported on failure so the case can be replayed.
+func fuzzSelfTest(device *cl.Device, kernelType string, rounds int, seed int64) error {
+	session, err := newCLSession(device, kernelType)
+	if err != nil {
+		return err
+	}
+	defer session.Release()
+	if err := session.allocResults(1024); err != nil {
+		return err
+	}
+
+	rng := mrand.New(mrand.NewSource(seed))
+	for round := 0; round < rounds; round++ {
+		if err := checkEscapedEvent(session, randomEscapingEvent(rng)); err != nil {
+			return fmt.Errorf("seed %d, round %d: %v", seed, round, err)
+		}
+	}
+	return nil
+}
+
+// gateKernel checks that a non-default kernel produces correct results on the
+// device before it is used for mining. A kernel that fails the quick self-test
+// is replaced by "default", and the failure is recorded in the tuning cache so
+// later runs fall back without retesting.
+func gateKernel(device *cl.Device, kernelType string) string {
+	if kernelType == "default" {
+		return kernelType
+	}
+	// Leave unknown kernel names for the caller to report
+	if _, _, err := getKernelSource(kernelType, device); err != nil {
+		return kernelType
+	}
+
+	cache := loadTuningCache()
+	kt := cache.kernel(device, kernelType)
+	switch kt.SelfTest {
+	case "passed":
+		vlog("Kernel %s passed self-test on %s (cached)", kernelType, device.Name())
+		return kernelType
+	case "failed":
+		fmt.Fprintf(os.Stderr, "Warning: Kernel %s previously failed self-test on %s: %s\n", kernelType, device.Name(), kt.SelfTestError)
+		fmt.Fprintf(os.Stderr, "Warning: Falling back to default kernel (delete %s to retest)\n", cache.path)
+		return "default"
+	}
+
+	vlog("Running quick self-test for kernel %s on %s...", kernelType, device.Name())
+	testErr := quickSelfTest(device, kernelType)
+	cache.recordSelfTest(device, kernelType, testErr)
+	if err := cache.save(); err != nil {
+		vlog("Warning: Failed to save tuning cache: %v", err)
+	}
+
+	if testErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Kernel %s failed self-test on %s: %v\n", kernelType, device.Name(), testErr)
+		fmt.Fprintf(os.Stderr, "Warning: Falling back to default kernel\n")
+		return "default"
+	}
+
+	vlog("Kernel %s passed self-test", kernelType)
+	return kernelType
+}
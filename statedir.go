@@ -0,0 +1,57 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// stateDir is where the tuning and result caches live (-state-dir). Empty
+// means the user cache directory, which services running without a home
+// directory may not have.
+var stateDir string
+
+// stateFile returns the path of a file in the state directory
+func stateFile(name string) (string, error) {
+	if stateDir != "" {
+		return filepath.Join(stateDir, name), nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gpu-nostr-pow", name), nil
+}
+
+// writePIDFile writes the process ID to path, through a temporary file so a
+// supervisor never reads a partial one. A file left by a crashed run is
+// replaced.
+func writePIDFile(path string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write PID file: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write PID file: %v", err)
+	}
+	return nil
+}
+
+// removePIDFile removes the PID file if it still holds this process's ID,
+// so a run that outlived its file does not delete a newer run's
+func removePIDFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid == os.Getpid() {
+		os.Remove(path)
+	}
+}
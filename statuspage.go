@@ -0,0 +1,86 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"time"
+)
+
+// minerStatus is the body of /status.json. It holds aggregate numbers only:
+// nothing about the event being mined, the device or how to control the
+// miner, so it can be exposed to the public.
+type minerStatus struct {
+	Difficulty      int     `json:"difficulty"`
+	HashRate        float64 `json:"hash_rate"`         // nonces per second, last 5 seconds
+	AverageHashRate float64 `json:"average_hash_rate"` // nonces per second, whole run
+	// Exponentially weighted moving averages, in nonces per second, which
+	// show throttling and intensity changes the whole-run average hides
+	HashRate10s    float64 `json:"hash_rate_10s"`
+	HashRate1m     float64 `json:"hash_rate_1m"`
+	HashRate15m    float64 `json:"hash_rate_15m"`
+	NoncesTested   int64   `json:"nonces_tested"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// ExpectedSeconds is the average time to a nonce at this difficulty and
+	// the current rate, 0 until the rate is known
+	ExpectedSeconds float64 `json:"expected_seconds"`
+	Found           int64   `json:"found"`
+}
+
+// status snapshots the counters
+func (s *minerStats) status() minerStatus {
+	average, recent := s.rates()
+	smoothed := s.meter.rates()
+	difficulty := int(s.difficulty.Load())
+	status := minerStatus{
+		Difficulty:      difficulty,
+		HashRate:        recent * 1e6,
+		AverageHashRate: average * 1e6,
+		HashRate10s:     smoothed[0],
+		HashRate1m:      smoothed[1],
+		HashRate15m:     smoothed[2],
+		NoncesTested:    s.hashes.Load(),
+		ElapsedSeconds:  math.Round(s.elapsed().Seconds()*10) / 10,
+		Found:           s.found.Load(),
+	}
+	if recent > 0 {
+		status.ExpectedSeconds = math.Ldexp(1, difficulty) / status.HashRate
+	}
+	return status
+}
+
+// startStatusPage serves the miner's status as JSON at /status.json on addr,
+// without authentication. It returns once the listener is open.
+func startStatusPage(addr string, stats *minerStats) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+
+	stats.sampling.Do(func() { go stats.sampleHashRate() })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		// Dashboards on other origins fetch it from the browser
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(stats.status())
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			vlog("Warning: Status page stopped: %v", err)
+		}
+	}()
+	return nil
+}
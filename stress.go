@@ -0,0 +1,264 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	mrand "math/rand"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// stressDifficulty gives about 15 hits per million nonces: enough to check
+// the kernel's hits constantly, few enough that checking them costs nothing
+const stressDifficulty = 16
+
+// Stress test settings
+const (
+	stressInterval     = 10 * time.Second // how often the rate and temperature are sampled and reported
+	stressRepeatEvery  = 8                // every 8th batch is mined twice and the hits compared
+	stressMissCheck    = 4096             // nonces at the start of each batch re-checked on the CPU for missed hits
+	stressMinRateShare = 0.8              // intervals slower than this share of the median fail the test
+	stressHotCelsius   = 90               // temperatures at or above this are warned about
+	stressMaxErrors    = 10               // launch errors before the test gives up
+	stressInputBytes   = 1024             // upper bound on the serialized size of the synthetic events
+)
+
+// stressReport is what a stress run counts
+type stressReport struct {
+	batches    int
+	tested     int64
+	hits       int
+	falseHits  int // hits that fail CPU validation
+	missed     int // qualifying nonces the kernel did not report
+	repeats    int
+	mismatches int // repeated batches whose hits differ
+	errors     int // failed launches
+	rates      []float64
+	temps      []float64
+}
+
+// runStress mines random events on a device for duration, as a burn-in for
+// new rigs and overclocks. Unstable hardware shows up as hits that fail CPU
+// validation, qualifying nonces the kernel misses, batches that give
+// different hits when mined twice, failed launches, or a rate that sags as the
+// device heats up and throttles. Prints a report and returns whether the
+// device passed.
+func runStress(deviceIndex int, kernelType string, duration time.Duration, batchPower int, memBudget int64) bool {
+	defer reportCLObjects()
+
+	device, err := findDevice(deviceIndex)
+	if err != nil {
+		log.Fatalf("Failed to select device: %v", err)
+	}
+	// Stress the kernel mining would use
+	if kernelType == "auto" {
+		kernelType = selectKernelForDevice(device)
+	}
+	kernelType = gateKernel(device, kernelType)
+
+	batchSize := 1000000
+	if batchPower >= 0 {
+		batchSize = int(math.Pow(10, float64(batchPower)))
+	} else if device.Type()&cl.DeviceTypeCPU != 0 {
+		batchSize = 10000
+	}
+	maxBatch, err := maxBatchForMemory(device, memBudget, stressInputBytes)
+	if err != nil {
+		log.Fatalf("Failed to size batches: %v", err)
+	}
+	batchSize = min(batchSize, maxBatch)
+
+	openSession := func() (*clSession, error) {
+		session, err := newCLSession(device, kernelType)
+		if err != nil {
+			return nil, err
+		}
+		if err := session.allocResults(batchSize); err != nil {
+			session.Release()
+			return nil, err
+		}
+		return session, nil
+	}
+	session, err := openSession()
+	if err != nil {
+		log.Fatalf("Failed to set up kernel %s: %v", kernelType, err)
+	}
+	defer func() {
+		if session != nil {
+			session.Release()
+		}
+	}()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+	if _, err := deviceTemperature(device); err != nil {
+		vlog("No temperature readings: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Stress testing kernel %s on %s for %s (batch size %d, difficulty %d); Ctrl-C stops early\n",
+		session.kernelType, device.Name(), duration, batchSize, stressDifficulty)
+
+	var r stressReport
+	placeholder := fmt.Sprintf("%0*d", calibrationDigits, calibrationBaseNum)
+	rng := mrand.New(mrand.NewSource(time.Now().UnixNano()))
+	start := time.Now()
+	intervalStart, intervalTested := start, int64(0)
+	stopped := false
+	var hits, again []int
+	var tested int
+	for time.Since(start) < duration && r.errors < stressMaxErrors {
+		select {
+		case <-interrupted:
+			stopped = true
+		default:
+		}
+		if stopped {
+			break
+		}
+
+		// Random events, as -calibrate mines, put the nonce at many offsets
+		event := calibrationEvent(rng, placeholder)
+		serialized := event.Serialize()
+		nonceOffset := findNonceOffset(serialized, placeholder)
+		message := append([]byte(nil), serialized...)
+		cpuHit := func(nonce uint64) bool {
+			copy(message[nonceOffset:], fmt.Sprintf("%0*d", calibrationDigits, nonce))
+			return session.target.score(message) >= stressDifficulty
+		}
+		base := uint64(calibrationBaseNum) + uint64(rng.Int63n(8*calibrationBaseNum))
+
+		hits, tested, err = r.mine(session, serialized, nonceOffset, base, batchSize, hits[:0])
+		if err == nil && r.batches%stressRepeatEvery == 0 {
+			// Healthy hardware gives the same hits every time
+			if again, _, err = r.mine(session, serialized, nonceOffset, base, batchSize, again[:0]); err == nil {
+				r.repeats++
+				if !slices.Equal(hits, again) {
+					r.mismatches++
+					vlog("Batch at nonce %d gave %d hits, then %d when mined again", base, len(hits), len(again))
+				}
+			}
+		}
+		if err != nil {
+			r.errors++
+			fmt.Fprintf(os.Stderr, "Launch failed: %v\n", err)
+			session.Release()
+			if session, err = openSession(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to set up kernel %s again: %v\n", kernelType, err)
+				break
+			}
+			continue
+		}
+
+		r.batches++
+		r.hits += len(hits)
+		for _, index := range hits {
+			if !cpuHit(base + uint64(index)) {
+				r.falseHits++
+				vlog("Nonce %d was reported but fails CPU validation", base+uint64(index))
+			}
+		}
+		for i := 0; i < stressMissCheck && i < tested; i++ {
+			if _, hit := slices.BinarySearch(hits, i); !hit && cpuHit(base+uint64(i)) {
+				r.missed++
+				vlog("Nonce %d qualifies but was not reported", base+uint64(i))
+			}
+		}
+
+		if now := time.Now(); now.Sub(intervalStart) >= stressInterval {
+			rate := float64(r.tested-intervalTested) / now.Sub(intervalStart).Seconds()
+			r.rates = append(r.rates, rate)
+			line := fmt.Sprintf("[%s] %.2fM nonces/s, %d hits, %d false, %d missed, %d of %d repeats differ",
+				now.Sub(start).Round(time.Second), rate/1000000, r.hits, r.falseHits, r.missed, r.mismatches, r.repeats)
+			if celsius, err := deviceTemperature(device); err == nil {
+				r.temps = append(r.temps, celsius)
+				line += fmt.Sprintf(", %.0f°C", celsius)
+			}
+			fmt.Fprintln(os.Stderr, line)
+			intervalStart, intervalTested = now, r.tested
+		}
+	}
+
+	return r.report(time.Since(start), duration, stopped)
+}
+
+// mine runs one batch of the event, appends the indices of its hits to hits
+// and returns how many nonces were tested: a batch run as several launches
+// stops at the first launch with a hit.
+func (r *stressReport) mine(session *clSession, serialized []byte, nonceOffset int, base uint64, count int, hits []int) ([]int, int, error) {
+	if err := session.setInput(serialized, nonceOffset, calibrationDigits, stressDifficulty); err != nil {
+		return hits, 0, err
+	}
+	results, err := session.runBatch(base, count)
+	if err != nil {
+		return hits, 0, err
+	}
+	r.tested += int64(len(results))
+	for i, index := range results {
+		if index >= 0 {
+			hits = append(hits, i)
+		}
+	}
+	return hits, len(results), nil
+}
+
+// report prints the stress test summary and returns whether the device passed
+func (r *stressReport) report(elapsed, duration time.Duration, stopped bool) bool {
+	fmt.Fprintf(os.Stderr, "\nStress test: %s, %d batches, %d nonces\n", elapsed.Round(time.Second), r.batches, r.tested)
+	fmt.Fprintf(os.Stderr, "Hits: %d, false hits: %d, missed: %d, repeated batches differing: %d of %d, launch errors: %d\n",
+		r.hits, r.falseHits, r.missed, r.mismatches, r.repeats, r.errors)
+
+	var problems []string
+	if len(r.rates) > 0 {
+		sorted := slices.Clone(r.rates)
+		slices.Sort(sorted)
+		median := sorted[len(sorted)/2]
+		fmt.Fprintf(os.Stderr, "Rate over %s intervals: min %.2fM, median %.2fM, max %.2fM nonces/s\n",
+			stressInterval, sorted[0]/1000000, median/1000000, sorted[len(sorted)-1]/1000000)
+		// The first interval includes warm-up, so it only counts when it is all there is
+		if len(sorted) >= 3 && sorted[0] < stressMinRateShare*median {
+			problems = append(problems, fmt.Sprintf("rate fell to %.0f%% of the median (throttling?)", sorted[0]/median*100))
+		}
+	}
+	if len(r.temps) > 0 {
+		hottest := slices.Max(r.temps)
+		fmt.Fprintf(os.Stderr, "Temperature: %.0f°C to %.0f°C\n", slices.Min(r.temps), hottest)
+		if hottest >= stressHotCelsius {
+			fmt.Fprintf(os.Stderr, "Warning: The device reached %.0f°C; check its cooling\n", hottest)
+		}
+	}
+
+	if r.falseHits > 0 {
+		problems = append(problems, fmt.Sprintf("%d reported nonces failed CPU validation", r.falseHits))
+	}
+	if r.missed > 0 {
+		problems = append(problems, fmt.Sprintf("%d qualifying nonces were not reported", r.missed))
+	}
+	if r.mismatches > 0 {
+		problems = append(problems, fmt.Sprintf("%d of %d batches gave different hits when mined again", r.mismatches, r.repeats))
+	}
+	if r.errors > 0 {
+		problems = append(problems, fmt.Sprintf("%d launches failed", r.errors))
+	}
+	if stopped {
+		problems = append(problems, fmt.Sprintf("stopped after %s of %s", elapsed.Round(time.Second), duration))
+	}
+	if len(problems) == 0 {
+		fmt.Fprintf(os.Stderr, "PASS: the device mined without errors for %s\n", duration)
+		return true
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "FAIL: %s\n", problem)
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import "time"
+
+// Suspend detection settings
+const (
+	suspendMinGap     = 5 * time.Second // shorter unexplained gaps are scheduling noise, not sleep
+	suspendBatchRatio = 20              // batches this many times slower than usual are taken for sleep
+)
+
+// suspendWatch notices that the machine slept while a batch ran. Go measures
+// durations with the monotonic clock. On Linux and macOS that clock stops
+// while the machine sleeps and the wall clock doesn't, so the sleep is the
+// difference between them. On Windows it keeps counting, so a batch that took
+// far longer than usual is taken for sleep instead.
+type suspendWatch struct {
+	typical time.Duration // smoothed duration of batches without sleep
+}
+
+// check returns how long the machine slept during the batch that started at
+// start, and how much of that the monotonic clock counted and so has to be
+// left out of elapsed times and rates. slept is 0 if it didn't sleep.
+func (w *suspendWatch) check(start time.Time) (slept, counted time.Duration) {
+	now := time.Now()
+	took := now.Sub(start)
+	// Round(0) strips the monotonic reading, leaving the wall clock
+	if gap := now.Round(0).Sub(start.Round(0)) - took; gap >= suspendMinGap {
+		return gap, 0
+	}
+	if w.typical > 0 && took >= suspendMinGap && took > suspendBatchRatio*w.typical {
+		return took - w.typical, took - w.typical
+	}
+	if w.typical == 0 {
+		w.typical = took
+	} else {
+		w.typical += (took - w.typical) / 4
+	}
+	return 0, 0
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// nonceTagLast places the nonce tag after all other tags
+const nonceTagLast = -1
+
+// isNonceTag reports whether a tag is a NIP-13 nonce tag
+func isNonceTag(tag nostr.Tag) bool {
+	return len(tag) > 0 && tag[0] == "nonce"
+}
+
+// checkNonceTag returns an error if a nonce tag doesn't have the NIP-13 form
+// ["nonce", "<value>", "<target>"]: it has no value, or its target is not a
+// non-negative number. A missing target is allowed (one is filled in before
+// mining), and the value may be empty since it is mined anyway.
+func checkNonceTag(tag nostr.Tag) error {
+	if len(tag) < 2 {
+		return fmt.Errorf("nonce tag %v has no value", []string(tag))
+	}
+	if len(tag) >= 3 {
+		if target, err := strconv.Atoi(tag[2]); err != nil || target < 0 {
+			return fmt.Errorf("nonce tag %v has target %q, not a number of bits", []string(tag), tag[2])
+		}
+	}
+	return nil
+}
+
+// sanitizeNonceTags applies a -nonce-tag-policy to an input event's tags, so
+// that everything after it sees at most one well-formed nonce tag:
+//
+//	lenient  malformed nonce tags (see checkNonceTag) are dropped, and of
+//	         several well-formed ones the first is kept in place and the rest
+//	         dropped; each drop is described in the returned warnings
+//	strict   malformed or duplicate nonce tags are an error
+func sanitizeNonceTags(tags nostr.Tags, policy string) (nostr.Tags, []string, error) {
+	if policy != "lenient" && policy != "strict" {
+		return nil, nil, fmt.Errorf("invalid nonce tag policy %q (use lenient or strict)", policy)
+	}
+	result := make(nostr.Tags, 0, len(tags))
+	var warnings []string
+	kept := -1
+	for i, tag := range tags {
+		if !isNonceTag(tag) {
+			result = append(result, tag)
+			continue
+		}
+		if err := checkNonceTag(tag); err != nil {
+			if policy == "strict" {
+				return nil, nil, fmt.Errorf("tag %d: %v", i, err)
+			}
+			warnings = append(warnings, fmt.Sprintf("Dropping malformed tag %d: %v", i, err))
+			continue
+		}
+		if kept >= 0 {
+			if policy == "strict" {
+				return nil, nil, fmt.Errorf("tag %d is a second nonce tag (the first is tag %d)", i, kept)
+			}
+			warnings = append(warnings, fmt.Sprintf("Dropping duplicate nonce tag %d %v; keeping tag %d", i, []string(tag), kept))
+			continue
+		}
+		kept = i
+		result = append(result, tag)
+	}
+	return result, warnings, nil
+}
+
+// nonceTagIndex returns the index of the first nonce tag, or -1
+func nonceTagIndex(tags nostr.Tags) int {
+	for i, tag := range tags {
+		if isNonceTag(tag) {
+			return i
+		}
+	}
+	return -1
+}
+
+// withoutNonceTags returns the tags other than nonce tags, in their original order
+func withoutNonceTags(tags nostr.Tags) nostr.Tags {
+	filtered := make(nostr.Tags, 0, len(tags))
+	for _, tag := range tags {
+		if !isNonceTag(tag) {
+			filtered = append(filtered, tag)
+		}
+	}
+	return filtered
+}
+
+// withNonceTag returns a copy of tags with any nonce tags removed and nonceTag
+// inserted at position among the remaining tags. Positions past the end and
+// nonceTagLast append it.
+func withNonceTag(tags nostr.Tags, nonceTag nostr.Tag, position int) nostr.Tags {
+	filtered := withoutNonceTags(tags)
+	if position == nonceTagLast || position > len(filtered) {
+		position = len(filtered)
+	}
+	result := make(nostr.Tags, 0, len(filtered)+1)
+	result = append(result, filtered[:position]...)
+	result = append(result, nonceTag)
+	return append(result, filtered[position:]...)
+}
+
+// replaceNonceTag returns a copy of tags with the first nonce tag replaced by
+// nonceTag in place and any other nonce tags dropped. If there is no nonce
+// tag, nonceTag is appended.
+func replaceNonceTag(tags nostr.Tags, nonceTag nostr.Tag) nostr.Tags {
+	result := make(nostr.Tags, 0, len(tags)+1)
+	replaced := false
+	for _, tag := range tags {
+		if !isNonceTag(tag) {
+			result = append(result, tag)
+		} else if !replaced {
+			result = append(result, nonceTag)
+			replaced = true
+		}
+	}
+	if !replaced {
+		result = append(result, nonceTag)
+	}
+	return result
+}
+
+// nonceTagTemplate returns the nonce tag to mine with, with an empty value.
+// In "replace" mode this is a new ["nonce", "", "<difficulty>"] tag. In "update"
+// mode the input's first nonce tag is reused so any extra elements survive and
+// only its value is mined; a missing target is filled in with the difficulty.
+// Without an input nonce tag both modes build a new one.
+func nonceTagTemplate(mode string, tags nostr.Tags, difficulty int) (nostr.Tag, error) {
+	fresh := nostr.Tag{"nonce", "", strconv.Itoa(difficulty)}
+	switch mode {
+	case "replace":
+		return fresh, nil
+	case "update":
+		i := nonceTagIndex(tags)
+		if i < 0 {
+			return fresh, nil
+		}
+		template := append(nostr.Tag(nil), tags[i]...)
+		for len(template) < 3 {
+			template = append(template, fresh[len(template)])
+		}
+		template[1] = ""
+		return template, nil
+	default:
+		return nil, fmt.Errorf("invalid nonce tag mode %q (use replace or update)", mode)
+	}
+}
+
+// nonceTagWithValue returns a copy of a nonce tag template with its value set
+func nonceTagWithValue(template nostr.Tag, nonceStr string) nostr.Tag {
+	tag := append(nostr.Tag(nil), template...)
+	tag[1] = nonceStr
+	return tag
+}
+
+// setNonceValue returns a copy of tags with the value of the first nonce tag
+// set to nonceStr, keeping its other elements
+func setNonceValue(tags nostr.Tags, nonceStr string) nostr.Tags {
+	result := make(nostr.Tags, len(tags))
+	copy(result, tags)
+	if i := nonceTagIndex(result); i >= 0 && len(result[i]) >= 2 {
+		result[i] = nonceTagWithValue(result[i], nonceStr)
+	}
+	return result
+}
+
+// resolveNonceTagPosition turns a -nonce-tag-position value into an index among
+// the event's other tags, or nonceTagLast:
+//
+//	keep     where the input's nonce tag was, or last if it had none
+//	first    before all other tags
+//	last     after all other tags
+//	index:N  at tags[N] in the output (last if there are fewer tags)
+func resolveNonceTagPosition(spec string, tags nostr.Tags) (int, error) {
+	switch {
+	case spec == "keep":
+		if i := nonceTagIndex(tags); i >= 0 {
+			// Count only the non-nonce tags before it
+			return len(withoutNonceTags(tags[:i])), nil
+		}
+		return nonceTagLast, nil
+	case spec == "first":
+		return 0, nil
+	case spec == "last":
+		return nonceTagLast, nil
+	case strings.HasPrefix(spec, "index:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(spec, "index:"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid nonce tag index in %q", spec)
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("invalid nonce tag position %q (use keep, first, last, or index:N)", spec)
+	}
+}
+
+// maxNoncePrefixLength bounds -nonce-prefix so it can't crowd out the digits
+const maxNoncePrefixLength = 64
+
+// checkNoncePrefix returns an error unless prefix is made of characters that
+// JSON serialization leaves unescaped. Other characters would move the digits
+// away from where findNonceOffset expects them.
+func checkNoncePrefix(prefix string) error {
+	if len(prefix) > maxNoncePrefixLength {
+		return fmt.Errorf("nonce prefix is %d characters, at most %d allowed", len(prefix), maxNoncePrefixLength)
+	}
+	for _, c := range prefix {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("nonce prefix %q may only contain letters, digits, '-', '_' and '.'", prefix)
+		}
+	}
+	return nil
+}
+
+// findNonceOffset returns the offset of the nonce placeholder's digits in a
+// serialized event, or -1. It anchors on the start of the nonce tag, so digit
+// runs elsewhere in the event (pubkey, created_at, other tags, content) cannot
+// be mistaken for the nonce.
+func findNonceOffset(serialized []byte, placeholder string) int {
+	prefix := []byte(`["nonce","`)
+	offset := bytes.Index(serialized, append(append(prefix, placeholder...), '"'))
+	if offset == -1 {
+		return -1
+	}
+	return offset + len(prefix)
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestFindNonceOffset(t *testing.T) {
+	tests := []struct {
+		name        string
+		serialized  string
+		placeholder string
+		want        int
+	}{
+		{"nonce tag", `[0,"ab",1,1,[["nonce","0000","20"]],""]`, "0000", 23},
+		{"digits before the tag", `[0,"0000",1,1,[["t","0000"],["nonce","0000","20"]],"0000"]`, "0000", 38},
+		{"no nonce tag", `[0,"ab",1,1,[["t","0000"]],"0000"]`, "0000", -1},
+		{"longer value", `[0,"ab",1,1,[["nonce","00000","20"]],""]`, "0000", -1},
+		{"empty placeholder", `[0,"ab",1,1,[["nonce","","20"]],""]`, "", 23},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findNonceOffset([]byte(tt.serialized), tt.placeholder); got != tt.want {
+				t.Errorf("findNonceOffset() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindNonceOffsetSerialized(t *testing.T) {
+	event := nostr.Event{
+		PubKey:    "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		CreatedAt: 1700000000,
+		Kind:      1,
+		Tags:      nostr.Tags{{"e", "1234567890"}, {"nonce", "1234567890", "20"}},
+		Content:   "1234567890",
+	}
+	serialized := event.Serialize()
+	offset := findNonceOffset(serialized, "1234567890")
+	if offset == -1 {
+		t.Fatal("nonce not found")
+	}
+	if got := string(serialized[offset-len(`["nonce","`) : offset+10]); got != `["nonce","1234567890` {
+		t.Errorf("offset %d points into %q", offset, got)
+	}
+}
+
+func TestSanitizeNonceTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     nostr.Tags
+		policy   string
+		want     nostr.Tags
+		warnings int
+		wantErr  bool
+	}{
+		{
+			name:   "no nonce tag",
+			tags:   nostr.Tags{{"t", "x"}},
+			policy: "strict",
+			want:   nostr.Tags{{"t", "x"}},
+		},
+		{
+			name:   "one nonce tag",
+			tags:   nostr.Tags{{"t", "x"}, {"nonce", "1", "20"}},
+			policy: "strict",
+			want:   nostr.Tags{{"t", "x"}, {"nonce", "1", "20"}},
+		},
+		{
+			name:   "nonce tag without target",
+			tags:   nostr.Tags{{"nonce", ""}},
+			policy: "strict",
+			want:   nostr.Tags{{"nonce", ""}},
+		},
+		{
+			name:     "duplicate, lenient",
+			tags:     nostr.Tags{{"nonce", "1", "20"}, {"t", "x"}, {"nonce", "2", "21"}},
+			policy:   "lenient",
+			want:     nostr.Tags{{"nonce", "1", "20"}, {"t", "x"}},
+			warnings: 1,
+		},
+		{
+			name:    "duplicate, strict",
+			tags:    nostr.Tags{{"nonce", "1", "20"}, {"nonce", "2", "21"}},
+			policy:  "strict",
+			wantErr: true,
+		},
+		{
+			name:     "malformed, lenient",
+			tags:     nostr.Tags{{"nonce"}, {"nonce", "1", "x"}, {"nonce", "1", "-1"}, {"nonce", "2", "20"}},
+			policy:   "lenient",
+			want:     nostr.Tags{{"nonce", "2", "20"}},
+			warnings: 3,
+		},
+		{
+			name:    "malformed, strict",
+			tags:    nostr.Tags{{"nonce", "1", "x"}},
+			policy:  "strict",
+			wantErr: true,
+		},
+		{
+			name:    "unknown policy",
+			tags:    nostr.Tags{},
+			policy:  "loose",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, warnings, err := sanitizeNonceTags(tt.tags, tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sanitizeNonceTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sanitizeNonceTags() = %v, want %v", got, tt.want)
+			}
+			if len(warnings) != tt.warnings {
+				t.Errorf("sanitizeNonceTags() warnings = %q, want %d", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestWithNonceTag(t *testing.T) {
+	nonce := nostr.Tag{"nonce", "0", "20"}
+	tags := nostr.Tags{{"a"}, {"nonce", "9", "1"}, {"b"}}
+	tests := []struct {
+		name     string
+		position int
+		want     nostr.Tags
+	}{
+		{"first", 0, nostr.Tags{nonce, {"a"}, {"b"}}},
+		{"middle", 1, nostr.Tags{{"a"}, nonce, {"b"}}},
+		{"end", 2, nostr.Tags{{"a"}, {"b"}, nonce}},
+		{"past the end", 5, nostr.Tags{{"a"}, {"b"}, nonce}},
+		{"last", nonceTagLast, nostr.Tags{{"a"}, {"b"}, nonce}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withNonceTag(tags, nonce, tt.position); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withNonceTag() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if len(tags) != 3 || tags[1][0] != "nonce" {
+		t.Errorf("withNonceTag() modified its input: %v", tags)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// powTarget is the function a kernel searches for: the score of a serialized
+// event, which must reach -difficulty. NIP-13 scores the leading zero bits of
+// the SHA-256 event ID; other proof-of-work schemes or difficulty encodings
+// are added as a kernel declaring "target=<name>" in its capabilities plus a
+// powTarget registered under that name. The mining loop, self-tests and
+// validation only ever call score, so they work unchanged with any target.
+type powTarget interface {
+	// score returns the difficulty a serialized event achieves
+	score(serialized []byte) int
+}
+
+// defaultPowTarget is the target of kernels that don't declare one
+const defaultPowTarget = "nip13"
+
+// powTargets holds the targets kernels may declare, by name
+var powTargets = map[string]powTarget{
+	defaultPowTarget: nip13Target{},
+}
+
+// nip13Target scores an event by the leading zero bits of its ID
+type nip13Target struct{}
+
+func (nip13Target) score(serialized []byte) int {
+	return leadingZeroBits(sha256.Sum256(serialized))
+}
+
+// lookupPowTarget returns the target registered under name
+func lookupPowTarget(name string) (powTarget, error) {
+	if target, ok := powTargets[name]; ok {
+		return target, nil
+	}
+	names := make([]string, 0, len(powTargets))
+	for known := range powTargets {
+		names = append(names, known)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown proof-of-work target %q (known: %s)", name, strings.Join(names, ", "))
+}
+
+// eventScore returns the difficulty an event achieves under a target
+func eventScore(target powTarget, event nostr.Event) int {
+	return target.score(event.Serialize())
+}
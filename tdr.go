@@ -0,0 +1,38 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"runtime"
+	"time"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// GPU watchdog settings. Windows resets the display driver when a GPU kernel
+// runs longer than its Timeout Detection and Recovery (TDR) delay, losing
+// every OpenCL context on the GPU.
+const (
+	tdrDelay        = 2 * time.Second        // Windows' default TDR delay
+	tdrSafeLaunch   = 500 * time.Millisecond // longest launch planned for, with room for the desktop sharing the GPU
+	tdrUnknownBatch = 10000000               // forced batches above this are warned about when the device's rate is not known
+	maxDeviceLosses = 3                      // consecutive failed launches recovered from before mining gives up
+)
+
+// underGPUWatchdog reports whether launches on a device can trip Windows'
+// GPU watchdog
+func underGPUWatchdog(device *cl.Device) bool {
+	return runtime.GOOS == "windows" && device.Type()&cl.DeviceTypeGPU != 0
+}
+
+// watchdogLaunchCap returns the most nonces a launch at rate nonces/s may
+// test to take about tdrSafeLaunch, or 0 if the rate is not known
+func watchdogLaunchCap(rate float64) int {
+	if rate <= 0 {
+		return 0
+	}
+	size := int(rate * tdrSafeLaunch.Seconds())
+	return max(size-size%batchGranule, batchGranule)
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// deviceTemperature returns the device's temperature in degrees Celsius from
+// the hwmon sensor its driver registers in sysfs (amdgpu, radeon, nouveau,
+// i915 and xe do; NVIDIA's proprietary driver does not). As for thread
+// pinning, the device is located by PCI vendor, so with several GPUs of the
+// same vendor that have sensors the reading is ambiguous and an error is
+// returned.
+func deviceTemperature(device *cl.Device) (float64, error) {
+	vendorID := pciVendorID(device.Vendor())
+	if vendorID == "" {
+		return 0, fmt.Errorf("unknown PCI vendor for %q", device.Vendor())
+	}
+
+	paths, err := filepath.Glob("/sys/bus/pci/devices/*")
+	if err != nil {
+		return 0, err
+	}
+	var sensors []string
+	for _, path := range paths {
+		if class := readSysfs(path, "class"); !strings.HasPrefix(class, "0x03") {
+			continue
+		}
+		if readSysfs(path, "vendor") != vendorID {
+			continue
+		}
+		if hwmons, _ := filepath.Glob(filepath.Join(path, "hwmon", "hwmon*")); len(hwmons) > 0 && readSysfs(hwmons[0], "temp1_input") != "" {
+			sensors = append(sensors, hwmons[0])
+		}
+	}
+
+	switch len(sensors) {
+	case 0:
+		return 0, fmt.Errorf("no temperature sensor found for PCI vendor %s", vendorID)
+	case 1:
+	default:
+		return 0, fmt.Errorf("found %d GPUs with vendor %s and temperature sensors, cannot tell which one is %s",
+			len(sensors), vendorID, device.Name())
+	}
+	millidegrees, err := strconv.Atoi(readSysfs(sensors[0], "temp1_input"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid temperature in %s: %v", sensors[0], err)
+	}
+	return float64(millidegrees) / 1000, nil
+}
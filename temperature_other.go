@@ -0,0 +1,18 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// deviceTemperature is only supported on Linux, where sensors are read from sysfs
+func deviceTemperature(device *cl.Device) (float64, error) {
+	return 0, fmt.Errorf("temperature readings are only supported on Linux")
+}
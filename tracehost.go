@@ -0,0 +1,107 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// traceHost enables timing of the host mining loop's phases (-trace-host)
+var traceHost bool
+
+// hostPhase is a phase of the host mining loop
+type hostPhase int
+
+const (
+	phaseSerialize hostPhase = iota // serializing the event and locating the nonce
+	phaseSetArgs                    // uploading the event and setting kernel arguments
+	phaseEnqueue                    // launching the kernel (returns before it runs)
+	phaseRead                       // blocking results read, which waits for the kernel
+	phaseScan                       // scanning the results for hits
+	phaseValidate                   // checking hits on the CPU
+	numHostPhases
+)
+
+var hostPhaseNames = [numHostPhases]string{
+	"serialize",
+	"set args",
+	"enqueue",
+	"read (waits for device)",
+	"scan results",
+	"validate",
+}
+
+// phaseTotal is the time spent in a phase and how often it was entered
+type phaseTotal struct {
+	total time.Duration
+	count int64
+}
+
+// hostPhaseStats accumulates the time spent in each phase. Only the mining
+// loop's goroutine records phases.
+var hostPhaseStats [numHostPhases]phaseTotal
+
+// resetHostTrace clears the accumulated times, so setup work such as kernel
+// self-tests is not counted
+func resetHostTrace() {
+	hostPhaseStats = [numHostPhases]phaseTotal{}
+}
+
+// phaseStart returns the start time of a phase, or the zero time when not tracing
+func phaseStart() time.Time {
+	if !traceHost {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// phaseEnd adds the time since start to a phase
+func phaseEnd(phase hostPhase, start time.Time) {
+	if !traceHost {
+		return
+	}
+	hostPhaseStats[phase].total += time.Since(start)
+	hostPhaseStats[phase].count++
+}
+
+// phaseEndExcept adds the time since start to a phase, minus the time the
+// nested phase accumulated meanwhile (nestedBefore is its total at start)
+func phaseEndExcept(phase hostPhase, start time.Time, nested hostPhase, nestedBefore time.Duration) {
+	if !traceHost {
+		return
+	}
+	hostPhaseStats[phase].total += time.Since(start) - (hostPhaseStats[nested].total - nestedBefore)
+	hostPhaseStats[phase].count++
+}
+
+// printHostTrace writes the time spent in each phase as a share of wall, the
+// mining loop's total run time. Time outside the phases (progress output,
+// bookkeeping, API polling) is reported as other.
+func printHostTrace(w io.Writer, wall time.Duration) {
+	if wall <= 0 {
+		return
+	}
+	fmt.Fprintf(w, "Host loop timing over %s:\n", wall.Round(time.Millisecond))
+	var traced time.Duration
+	for phase, s := range hostPhaseStats {
+		traced += s.total
+		var avg time.Duration
+		if s.count > 0 {
+			avg = s.total / time.Duration(s.count)
+		}
+		fmt.Fprintf(w, "  %-24s %12s %5.1f%%  %8d calls, %s avg\n", hostPhaseNames[phase],
+			s.total.Round(time.Microsecond), 100*float64(s.total)/float64(wall), s.count, avg.Round(time.Microsecond))
+	}
+	other := wall - traced
+	if other < 0 {
+		other = 0
+	}
+	fmt.Fprintf(w, "  %-24s %12s %5.1f%%\n", "other", other.Round(time.Microsecond), 100*float64(other)/float64(wall))
+	read := hostPhaseStats[phaseRead].total
+	fmt.Fprintf(w, "The device only works during the read phase; for the other %.1f%% of the time it waits on the host.\n",
+		100*float64(wall-read)/float64(wall))
+}
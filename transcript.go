@@ -0,0 +1,155 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// transcriptKind is the kind of the event a signed transcript is wrapped in:
+// NIP-78 application data, which clients don't show as a note
+const transcriptKind = 30078
+
+// transcriptRange is a run of consecutive nonces mined with the same width,
+// created_at and target
+type transcriptRange struct {
+	Digits     int       `json:"digits"`
+	CreatedAt  int64     `json:"created_at"`
+	Difficulty int       `json:"difficulty"`
+	From       uint64    `json:"from"`
+	To         uint64    `json:"to"` // inclusive
+	Started    time.Time `json:"started"`
+	Ended      time.Time `json:"ended"`
+}
+
+// transcript records what a mining run searched and found, for -transcript.
+// Nonce values are the digits only; NoncePrefix goes before each of them.
+type transcript struct {
+	MinerVersion string `json:"miner_version"`
+	// InputHash is the SHA-256 of the input event's NIP-01 serialization
+	// without a nonce tag, as it was when mining started
+	InputHash   string            `json:"input_hash"`
+	DeviceIndex int               `json:"device_index"`
+	Device      string            `json:"device"`
+	Kernel      string            `json:"kernel"`
+	NoncePrefix string            `json:"nonce_prefix,omitempty"`
+	Started     time.Time         `json:"started"`
+	Ended       time.Time         `json:"ended"`
+	Ranges      []transcriptRange `json:"ranges"`
+	// Outcome is found, cancelled, timeout or exhausted
+	Outcome string `json:"outcome"`
+	Nonce   string `json:"nonce,omitempty"` // the found nonce value, with the prefix
+	EventID string `json:"event_id,omitempty"`
+}
+
+// newTranscript starts a transcript for an event without its nonce tag
+func newTranscript(event nostr.Event, deviceIndex int, device, kernel, noncePrefix string) *transcript {
+	hash := sha256.Sum256(event.Serialize())
+	return &transcript{
+		MinerVersion: minerVersion(),
+		InputHash:    hex.EncodeToString(hash[:]),
+		DeviceIndex:  deviceIndex,
+		Device:       strings.TrimSpace(device),
+		Kernel:       kernel,
+		NoncePrefix:  noncePrefix,
+		Started:      time.Now().UTC(),
+		Ranges:       []transcriptRange{},
+	}
+}
+
+// searched records nonces from through to as mined, extending the last range
+// when they continue it
+func (t *transcript) searched(digits int, createdAt nostr.Timestamp, difficulty int, from, to uint64) {
+	now := time.Now().UTC()
+	if n := len(t.Ranges); n > 0 {
+		last := &t.Ranges[n-1]
+		if last.Digits == digits && last.CreatedAt == int64(createdAt) && last.Difficulty == difficulty && last.To+1 == from {
+			last.To, last.Ended = to, now
+			return
+		}
+	}
+	t.Ranges = append(t.Ranges, transcriptRange{
+		Digits:     digits,
+		CreatedAt:  int64(createdAt),
+		Difficulty: difficulty,
+		From:       from,
+		To:         to,
+		Started:    now,
+		Ended:      now,
+	})
+}
+
+// finish records the outcome and writes the transcript to path. With a secret
+// key it is written as the content of a kind 30078 event signed with that
+// key, so anyone holding the matching pubkey can check it with any Nostr
+// library; without one the bare transcript is written.
+func (t *transcript) finish(path, secretKey, outcome, nonce, eventID string) error {
+	t.Ended = time.Now().UTC()
+	t.Outcome, t.Nonce, t.EventID = outcome, nonce, eventID
+	body, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("failed to encode transcript: %v", err)
+	}
+	if secretKey == "" {
+		return writeOutput(path, body)
+	}
+
+	pubkey, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return fmt.Errorf("failed to derive the transcript pubkey: %v", err)
+	}
+	signed := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      transcriptKind,
+		Tags:      nostr.Tags{{"d", "gpu-nostr-pow-transcript:" + t.InputHash + ":" + t.Started.Format(time.RFC3339Nano)}},
+		Content:   string(body),
+	}
+	if err := signed.Sign(secretKey); err != nil {
+		return fmt.Errorf("failed to sign transcript: %v", err)
+	}
+	data, err := json.Marshal(signed)
+	if err != nil {
+		return fmt.Errorf("failed to encode signed transcript: %v", err)
+	}
+	return writeOutput(path, data)
+}
+
+// loadTranscriptKey reads the secret key transcripts are signed with
+func loadTranscriptKey(path string) (string, error) {
+	return loadSecretKey(path, "transcript key")
+}
+
+// loadSecretKey reads a secret key from a file, as 64 hex characters or an
+// nsec. Keys are read from a file so they don't show up in process listings.
+// name says what the key is for in errors.
+func loadSecretKey(path, name string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	key := strings.TrimSpace(string(data))
+	if strings.HasPrefix(key, "nsec") {
+		prefix, value, err := nip19.Decode(key)
+		decoded, ok := value.(string)
+		if err != nil || prefix != "nsec" || !ok {
+			return "", fmt.Errorf("%s is not a valid nsec", name)
+		}
+		key = decoded
+	}
+	if b, err := hex.DecodeString(key); err != nil || len(b) != 32 {
+		return "", fmt.Errorf("%s must be 64 hex characters or an nsec", name)
+	}
+	return strings.ToLower(key), nil
+}
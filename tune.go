@@ -0,0 +1,265 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cl "github.com/jgillich/go-opencl/cl"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Tuning search settings
+const (
+	tuneFirstRound = 250 * time.Millisecond // each candidate's measuring time in the first round; it doubles every round
+	tuneLastRound  = 4 * time.Second        // the search ends after the round measuring this long
+	tunePruneShare = 0.5                    // candidates below this share of the round's best rate are dropped whatever their rank
+	tuneDigits     = 16                     // nonce width; no round runs out of nonces at any rate
+)
+
+// tuneLocalSizes are the work-group sizes -tune tries; 0 is the kernel's
+// default (see localWorkSizeLimits)
+var tuneLocalSizes = []int{0, 32, 64, 128, 256}
+
+// tuneVectorWidths are the vector widths -tune tries: the width of the
+// vec_type_hint the kernels are built with, for compilers that vectorize
+// across work items (1 is no hint)
+var tuneVectorWidths = []int{1, 2, 4, 8}
+
+// vectorWidthOption returns the build option that sets a vector width
+func vectorWidthOption(width int) string {
+	if width <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("-D NIP13_VEC_TYPE=uint%d", width)
+}
+
+// tuneBuildOptions returns the compiler options -tune tries for a kernel on a
+// device: none, and those that change the code the device's compiler
+// generates for integer work like SHA-256
+func tuneBuildOptions(device *cl.Device, kernelType string) []string {
+	options := []string{""}
+	if strings.Contains(strings.ToLower(device.Vendor()), "nvidia") {
+		// Capping registers per work item lets more work items share a compute unit
+		options = append(options, "-cl-nv-maxrregcount=32", "-cl-nv-maxrregcount=64")
+		if kernelType == "nvidia" {
+			options = append(options, "-D NV_NO_INLINE_PTX")
+		}
+	}
+	return options
+}
+
+// tuneCandidate is one point of the -tune grid
+type tuneCandidate struct {
+	options        string
+	vectorWidth    int
+	batchSizePower int
+	localSize      int
+	rate           float64
+}
+
+func (c tuneCandidate) String() string {
+	local := "default"
+	if c.localSize > 0 {
+		local = strconv.Itoa(c.localSize)
+	}
+	options := c.options
+	if options == "" {
+		options = "none"
+	}
+	return fmt.Sprintf("batch 10^%d, local size %s, vector width %d, options %s", c.batchSizePower, local, c.vectorWidth, options)
+}
+
+// buildOptions returns the options the candidate's kernel is built with
+func (c tuneCandidate) buildOptions() string {
+	return strings.TrimSpace(c.options + " " + vectorWidthOption(c.vectorWidth))
+}
+
+// runTune searches the batch sizes, work-group sizes, vector widths and build
+// options of a kernel on a device for the fastest combination and records it
+// in the tuning cache, where mining picks up its local size and build
+// options. Each build is self-tested before it is measured, and builds that
+// fail are left out, so the options mining uses have passed.
+// Every candidate is measured for tuneFirstRound; each round keeps the
+// faster half, dropping any far behind the best, and measures the survivors
+// twice as long, so losers cost little and the winner is measured longest.
+func runTune(deviceIndex int, kernelType string, difficulty, queues int, memBudget int64, events *benchmarkEvents) {
+	defer reportCLObjects()
+
+	device, err := findDevice(deviceIndex)
+	if err != nil {
+		log.Fatalf("Failed to select device: %v", err)
+	}
+	if kernelType == "auto" {
+		kernelType = selectKernelForDevice(device)
+	}
+	kernelType = gateKernel(device, kernelType)
+
+	// One event for every candidate, so they hash the same number of blocks
+	event := events.next()
+	placeholder := fmt.Sprintf("%0*d", tuneDigits, uint64(math.Pow10(tuneDigits-1)))
+	event.Tags = append(event.Tags, nostr.Tag{"nonce", placeholder, strconv.Itoa(difficulty)})
+	serialized := event.Serialize()
+	nonceOffset := findNonceOffset(serialized, placeholder)
+	maxBatch, err := maxBatchForMemory(device, memBudget, len(serialized))
+	if err != nil {
+		log.Fatalf("Failed to size batches: %v", err)
+	}
+	maxPower := 10
+	if device.Type()&cl.DeviceTypeCPU != 0 {
+		maxPower = 4 // as -benchmark, larger batches crash CPU runtimes
+	}
+
+	// One build per set of options and vector width; batch and local sizes
+	// are set per launch
+	sessions := make(map[string]*clSession)
+	defer func() {
+		for _, session := range sessions {
+			session.Release()
+		}
+	}()
+	var candidates []tuneCandidate
+	for _, options := range tuneBuildOptions(device, kernelType) {
+		for _, width := range tuneVectorWidths {
+			build := tuneCandidate{options: options, vectorWidth: width}
+			session, err := newTunedCLSession(device, kernelType, build.buildOptions())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Kernel %s does not build with options %q: %v\n", kernelType, build.buildOptions(), err)
+				continue
+			}
+			sessions[build.buildOptions()] = session
+			if err := selfTestSession(session); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Kernel %s fails its self-test with options %q: %v\n", kernelType, build.buildOptions(), err)
+				continue
+			}
+			if err := session.setQueues(queues); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Kernel %s cannot use %d queues with options %q: %v\n", kernelType, queues, build.buildOptions(), err)
+				continue
+			}
+			for power := 3; power <= maxPower && int(math.Pow10(power)) <= maxBatch; power++ {
+				for _, localSize := range tuneLocalSizes {
+					// Launches that don't divide into work-groups of the size get the default
+					if localSize > 0 && int(math.Pow10(power))%localSize != 0 {
+						continue
+					}
+					if session.setLocalSize(localSize) == nil {
+						c := build
+						c.batchSizePower, c.localSize = power, localSize
+						candidates = append(candidates, c)
+					}
+				}
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		log.Fatalf("No configuration of kernel %s runs on %s", kernelType, device.Name())
+	}
+	fmt.Fprintf(os.Stderr, "Tuning kernel %s on %s: %d configurations\n", kernelType, device.Name(), len(candidates))
+
+	for round := tuneFirstRound; ; round *= 2 {
+		fmt.Fprintf(os.Stderr, "Measuring %d configurations for %s each...\n", len(candidates), round)
+		measured := candidates[:0]
+		for _, c := range candidates {
+			c.rate, err = measureTuneCandidate(sessions[c.buildOptions()], c, serialized, nonceOffset, difficulty, round)
+			if err != nil {
+				vlog("%s: %v", c, err)
+				continue
+			}
+			vlog("%s: %.2fM nonces/s", c, c.rate/1000000)
+			measured = append(measured, c)
+		}
+		if len(measured) == 0 {
+			log.Fatalf("No configuration of kernel %s ran", kernelType)
+		}
+		sort.SliceStable(measured, func(i, j int) bool { return measured[i].rate > measured[j].rate })
+		candidates = measured
+		if round >= tuneLastRound || len(candidates) == 1 {
+			break
+		}
+		keep := max(len(candidates)/2, 1)
+		for keep > 1 && candidates[keep-1].rate < tunePruneShare*candidates[0].rate {
+			keep--
+		}
+		candidates = candidates[:keep]
+		fmt.Fprintf(os.Stderr, "  Best so far: %s at %.2fM nonces/s\n", candidates[0], candidates[0].rate/1000000)
+	}
+
+	fmt.Fprintf(os.Stderr, "\n=== Tuning Results ===\n")
+	for i, c := range candidates[:min(len(candidates), 5)] {
+		fmt.Fprintf(os.Stderr, "%d. %s: %.2fM nonces/s\n", i+1, c, c.rate/1000000)
+	}
+	best := candidates[0]
+	cache := loadTuningCache()
+	cache.recordTune(device, kernelType, best.rate, best.batchSizePower, queues, best.localSize, best.buildOptions())
+	if err := cache.save(); err != nil {
+		log.Fatalf("Failed to save tuning cache: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "\nRecorded in %s; mining with kernel %s on this device uses its local size and build options\n", cache.path, kernelType)
+	use := fmt.Sprintf("-kernel %s -batch-size %d", kernelType, best.batchSizePower)
+	if queues > 1 {
+		use += fmt.Sprintf(" -queues %d", queues)
+	}
+	fmt.Fprintf(os.Stderr, "Use: %s\n", use)
+}
+
+// newMiningSession builds a kernel for mining with the local size and build
+// options -tune recorded for it on the device, if any. Settings recorded for
+// another program than the one they would now build, or by a -tune that did
+// not self-test its builds, are ignored.
+func newMiningSession(device *cl.Device, kernelType string) (*clSession, error) {
+	tuned := *loadTuningCache().kernel(device, kernelType)
+	if !tuned.TunedAt.IsZero() && tuned.TunedHash != kernelProgramHash(device, kernelType, tuned.BuildOptions) {
+		vlog("Ignoring tuned settings for kernel %s: they were not self-tested with this build", kernelType)
+		tuned = kernelTuning{}
+	}
+	session, err := newTunedCLSession(device, kernelType, tuned.BuildOptions)
+	if err != nil {
+		return nil, err
+	}
+	if !tuned.TunedAt.IsZero() {
+		if err := session.setLocalSize(tuned.LocalSize); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Ignoring tuned local size: %v\n", err)
+		}
+		vlog("Tuned settings: local size %d, build options %q", tuned.LocalSize, tuned.BuildOptions)
+	}
+	return session, nil
+}
+
+// measureTuneCandidate mines the event with a candidate's settings for
+// duration, after one launch to warm up, and returns the rate
+func measureTuneCandidate(session *clSession, c tuneCandidate, serialized []byte, nonceOffset, difficulty int, duration time.Duration) (float64, error) {
+	batchSize := int(math.Pow10(c.batchSizePower))
+	if err := session.allocResults(batchSize); err != nil {
+		return 0, err
+	}
+	if err := session.setLocalSize(c.localSize); err != nil {
+		return 0, err
+	}
+	if err := session.setInput(serialized, nonceOffset, tuneDigits, difficulty); err != nil {
+		return 0, err
+	}
+	nonce := uint64(math.Pow10(tuneDigits - 1))
+	if _, err := session.runBatch(nonce, batchSize); err != nil {
+		return 0, err
+	}
+	tested := 0
+	start := time.Now()
+	for time.Since(start) < duration {
+		results, err := session.runBatch(nonce, batchSize)
+		if err != nil {
+			return 0, err
+		}
+		tested += len(results)
+		nonce += uint64(len(results))
+	}
+	return float64(tested) / time.Since(start).Seconds(), nil
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	cl "github.com/jgillich/go-opencl/cl"
+)
+
+// tuningCache stores per-device results that are expensive to recompute,
+// such as kernel self-test outcomes. It is persisted as JSON in the user
+// cache directory.
+type tuningCache struct {
+	Devices   map[string]*deviceTuning   `json:"devices"`
+	CPU       *cpuTuning                 `json:"cpu,omitempty"`
+	Platforms map[string]*platformTuning `json:"platforms,omitempty"`
+
+	path string
+}
+
+// deviceTuning holds cached results for a single OpenCL device. Results
+// measured with another driver version are discarded.
+type deviceTuning struct {
+	Name          string                   `json:"name"`
+	Vendor        string                   `json:"vendor"`
+	DriverVersion string                   `json:"driver_version,omitempty"`
+	Kernels       map[string]*kernelTuning `json:"kernels"`
+}
+
+// kernelTuning holds cached results for one kernel on one device. Results
+// for other kernel source or another miner build are discarded.
+type kernelTuning struct {
+	SourceHash   string `json:"source_hash,omitempty"` // kernel source and build options
+	MinerVersion string `json:"miner_version,omitempty"`
+
+	SelfTest      string    `json:"self_test,omitempty"` // "passed" or "failed"
+	SelfTestError string    `json:"self_test_error,omitempty"`
+	TestedAt      time.Time `json:"tested_at,omitempty"`
+
+	HashRate   float64   `json:"hash_rate,omitempty"`       // nonces/s in the last mining run
+	Startup    float64   `json:"startup_seconds,omitempty"` // OpenCL setup before that run started mining
+	MeasuredAt time.Time `json:"measured_at,omitempty"`
+
+	// Best settings found by -benchmark or -benchmark-all
+	BenchmarkRate  float64   `json:"benchmark_rate,omitempty"`
+	BatchSizePower int       `json:"batch_size,omitempty"`
+	Queues         int       `json:"queues,omitempty"`
+	BenchmarkedAt  time.Time `json:"benchmarked_at,omitempty"`
+
+	// Launch settings found by -tune; mining builds and launches the kernel
+	// with them
+	LocalSize    int       `json:"local_size,omitempty"` // 0 is the kernel's default
+	BuildOptions string    `json:"build_options,omitempty"`
+	TunedHash    string    `json:"tuned_hash,omitempty"` // the program built with BuildOptions, which passed its self-test
+	TunedAt      time.Time `json:"tuned_at,omitempty"`
+}
+
+// platformTuning holds the outcome of a platform's probe build (see
+// probePlatform): "passed", "failed", or "probing" while it runs
+type platformTuning struct {
+	Probe    string    `json:"probe"`
+	Error    string    `json:"error,omitempty"`
+	ProbedAt time.Time `json:"probed_at,omitempty"`
+}
+
+// cpuTuning holds the CPU miner's rate, measured by a mining run or a probe
+type cpuTuning struct {
+	HashRate   float64   `json:"hash_rate"`
+	Threads    int       `json:"threads"`
+	MeasuredAt time.Time `json:"measured_at"`
+}
+
+// tuningCachePath returns the location of the tuning cache file
+func tuningCachePath() (string, error) {
+	return stateFile("tuning.json")
+}
+
+// loadTuningCache reads the tuning cache from disk.
+// A missing or unreadable cache yields an empty one.
+func loadTuningCache() *tuningCache {
+	cache := &tuningCache{Devices: make(map[string]*deviceTuning)}
+
+	path, err := tuningCachePath()
+	if err != nil {
+		vlog("Tuning cache disabled: %v", err)
+		return cache
+	}
+	cache.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			vlog("Warning: Failed to read tuning cache %s: %v", path, err)
+		}
+		return cache
+	}
+
+	if err := json.Unmarshal(data, cache); err != nil {
+		vlog("Warning: Ignoring corrupt tuning cache %s: %v", path, err)
+		cache.Devices = make(map[string]*deviceTuning)
+	}
+	if cache.Devices == nil {
+		cache.Devices = make(map[string]*deviceTuning)
+	}
+	return cache
+}
+
+// save writes the tuning cache to disk, replacing the file atomically so a
+// concurrent loadTuningCache never reads it half written
+func (c *tuningCache) save() error {
+	if c.path == "" {
+		return fmt.Errorf("no tuning cache path")
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, data)
+}
+
+// deviceKey identifies a device in the tuning cache
+func deviceKey(device *cl.Device) string {
+	return device.Vendor() + "/" + device.Name()
+}
+
+// kernel returns the cached entry for a kernel on a device, creating it if
+// needed. Entries recorded under another driver version, kernel source or
+// miner build are replaced with empty ones, so self-tests and rates are
+// measured again instead of carrying over stale results.
+func (c *tuningCache) kernel(device *cl.Device, kernelType string) *kernelTuning {
+	key := deviceKey(device)
+	driver := device.DriverVersion()
+	dt, ok := c.Devices[key]
+	if ok && dt.DriverVersion != driver {
+		vlog("Driver of %s changed (%q to %q); discarding its tuning results", device.Name(), dt.DriverVersion, driver)
+		ok = false
+	}
+	if !ok {
+		dt = &deviceTuning{
+			Name:          device.Name(),
+			Vendor:        device.Vendor(),
+			DriverVersion: driver,
+			Kernels:       make(map[string]*kernelTuning),
+		}
+		c.Devices[key] = dt
+	}
+	if dt.Kernels == nil {
+		dt.Kernels = make(map[string]*kernelTuning)
+	}
+	sourceHash, version := kernelSourceHash(device, kernelType), minerVersion()
+	kt, ok := dt.Kernels[kernelType]
+	if ok && (kt.SourceHash != sourceHash || kt.MinerVersion != version) {
+		vlog("Kernel %s or the miner changed since it was tuned on %s; discarding its tuning results", kernelType, device.Name())
+		ok = false
+	}
+	if !ok {
+		kt = &kernelTuning{SourceHash: sourceHash, MinerVersion: version}
+		dt.Kernels[kernelType] = kt
+	}
+	return kt
+}
+
+// kernelSourceHash identifies the program a kernel builds on a device: its
+// source and build options
+func kernelSourceHash(device *cl.Device, kernelType string) string {
+	return kernelProgramHash(device, kernelType, "")
+}
+
+// kernelProgramHash is kernelSourceHash for a build with extra options after
+// the device's, as -tune records them
+func kernelProgramHash(device *cl.Device, kernelType, extraOptions string) string {
+	source, _, err := getKernelSource(kernelType, device)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(source))
+	h.Write([]byte{0})
+	h.Write([]byte(kernelBuildOptions(device)))
+	if extraOptions != "" {
+		h.Write([]byte{0})
+		h.Write([]byte(extraOptions))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// minerVersion identifies the miner build: its module version and, when
+// built from a checkout, the VCS revision
+func minerVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	version := info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			version += " " + setting.Value
+		case "vcs.modified":
+			if setting.Value == "true" {
+				version += " (modified)"
+			}
+		}
+	}
+	return version
+}
+
+// platform returns the cached entry for a platform, creating it if needed
+func (c *tuningCache) platform(key string) *platformTuning {
+	if c.Platforms == nil {
+		c.Platforms = make(map[string]*platformTuning)
+	}
+	pt, ok := c.Platforms[key]
+	if !ok {
+		pt = &platformTuning{}
+		c.Platforms[key] = pt
+	}
+	return pt
+}
+
+// recordSelfTest stores a self-test outcome for a kernel on a device
+func (c *tuningCache) recordSelfTest(device *cl.Device, kernelType string, testErr error) {
+	kt := c.kernel(device, kernelType)
+	kt.TestedAt = time.Now()
+	if testErr != nil {
+		kt.SelfTest = "failed"
+		kt.SelfTestError = testErr.Error()
+	} else {
+		kt.SelfTest = "passed"
+		kt.SelfTestError = ""
+	}
+}
+
+// recordHashRate stores the rate measured by a mining run and the setup time
+// before it, for estimates in later runs
+func (c *tuningCache) recordHashRate(device *cl.Device, kernelType string, rate float64, startup time.Duration) {
+	kt := c.kernel(device, kernelType)
+	kt.HashRate = rate
+	kt.Startup = startup.Seconds()
+	kt.MeasuredAt = time.Now()
+}
+
+// recordBenchmark stores the best settings a benchmark found for a kernel.
+// Until a mining run records its own rate, the benchmark rate stands in.
+func (c *tuningCache) recordBenchmark(device *cl.Device, kernelType string, rate float64, batchSizePower, queues int) {
+	kt := c.kernel(device, kernelType)
+	kt.BenchmarkRate = rate
+	kt.BatchSizePower = batchSizePower
+	kt.Queues = queues
+	kt.BenchmarkedAt = time.Now()
+	if kt.HashRate == 0 {
+		kt.HashRate = rate
+		kt.MeasuredAt = kt.BenchmarkedAt
+	}
+}
+
+// recordTune stores the configuration -tune found fastest for a kernel. Its
+// batch size and rate are recorded as a benchmark's are.
+func (c *tuningCache) recordTune(device *cl.Device, kernelType string, rate float64, batchSizePower, queues, localSize int, buildOptions string) {
+	c.recordBenchmark(device, kernelType, rate, batchSizePower, queues)
+	kt := c.kernel(device, kernelType)
+	kt.LocalSize = localSize
+	kt.BuildOptions = buildOptions
+	kt.TunedHash = kernelProgramHash(device, kernelType, buildOptions)
+	kt.TunedAt = kt.BenchmarkedAt
+}
+
+// recordCPURate stores the CPU miner's rate with a number of threads
+func (c *tuningCache) recordCPURate(rate float64, threads int) {
+	c.CPU = &cpuTuning{HashRate: rate, Threads: threads, MeasuredAt: time.Now()}
+}
+
+// fastestKernel returns the highest recorded mining rate of any kernel on any
+// device, with its setup time, or nil if no rate has been recorded
+func (c *tuningCache) fastestKernel() *kernelTuning {
+	var best *kernelTuning
+	for _, dt := range c.Devices {
+		for _, kt := range dt.Kernels {
+			if kt.HashRate > 0 && (best == nil || kt.HashRate > best.HashRate) {
+				best = kt
+			}
+		}
+	}
+	return best
+}
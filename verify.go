@@ -0,0 +1,173 @@
+// Copyright (c) 2025
+// Licensed under Girino's Anarchist License (GAL)
+// See LICENSE file or https://license.girino.org for details
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// maxReplayDigits is the widest numeric nonce the device replay formats; the
+// kernels count nonces in 64 bits
+const maxReplayDigits = 19
+
+// splitNonceValue splits a nonce value into its prefix and the run of decimal
+// digits at its end, which is the part the kernels write
+func splitNonceValue(value string) (prefix, digits string) {
+	i := len(value)
+	for i > 0 && value[i-1] >= '0' && value[i-1] <= '9' {
+		i--
+	}
+	return value[:i], value[i:]
+}
+
+// tagJSON formats a tag as it appears in the event
+func tagJSON(tag nostr.Tag) string {
+	b, _ := json.Marshal(tag)
+	return string(b)
+}
+
+// replayOnDevice hashes the event's own nonce with a kernel and returns the
+// difficulty the kernel sees under its target: the highest difficulty at which it reports the
+// nonce as a hit. The event's nonce tag must end in decimal digits.
+func replayOnDevice(session *clSession, event nostr.Event) (int, error) {
+	i := nonceTagIndex(event.Tags)
+	if i < 0 || len(event.Tags[i]) < 2 {
+		return 0, fmt.Errorf("no nonce value to replay")
+	}
+	value := event.Tags[i][1]
+	prefix, digits := splitNonceValue(value)
+	if digits == "" || len(digits) > maxReplayDigits {
+		return 0, fmt.Errorf("nonce value %q does not end in 1-%d digits the kernels can write", value, maxReplayDigits)
+	}
+	nonce, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("nonce digits %q: %v", digits, err)
+	}
+
+	serialized := event.Serialize()
+	nonceOffset := findNonceOffset(serialized, value)
+	if nonceOffset == -1 {
+		return 0, fmt.Errorf("could not find the nonce tag in the serialized event")
+	}
+	nonceOffset += len(prefix)
+
+	if err := session.allocResults(1); err != nil {
+		return 0, err
+	}
+	if err := session.setInput(serialized, nonceOffset, len(digits), 1); err != nil {
+		return 0, err
+	}
+	bits := 0
+	for difficulty := 1; difficulty <= 256; difficulty++ {
+		if err := session.setDifficulty(difficulty); err != nil {
+			return 0, err
+		}
+		results, err := session.runBatch(nonce, 1)
+		if err != nil {
+			return 0, err
+		}
+		if results[0] < 0 {
+			break
+		}
+		bits = difficulty
+	}
+	return bits, nil
+}
+
+// verifyEvent replays a mined event's hash on the CPU and reports, to w, its
+// ID, achieved and committed difficulty, nonce tag and signature. If session
+// is not nil the hash is also replayed on the device, and skipReason, if not
+// empty, says why it is nil. Returns whether the event checks out.
+func verifyEvent(w io.Writer, event nostr.Event, session *clSession, skipReason string) bool {
+	ok := true
+	fail := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format, args...)
+		ok = false
+	}
+
+	id := event.GetID()
+	switch {
+	case event.ID == "":
+		fmt.Fprintf(w, "Event ID:             none given, computed %s\n", id)
+	case event.ID == id:
+		fmt.Fprintf(w, "Event ID:             %s (matches the recomputed ID)\n", id)
+	default:
+		fail("Event ID:             %s DOES NOT MATCH the recomputed %s\n", event.ID, id)
+	}
+
+	achieved := nip13.Difficulty(id)
+	fmt.Fprintf(w, "Achieved difficulty:  %d bits\n", achieved)
+
+	// The nonce tag: exactly one, with a value and a numeric target
+	nonceTags := len(event.Tags) - len(withoutNonceTags(event.Tags))
+	index := nonceTagIndex(event.Tags)
+	switch {
+	case nonceTags == 0:
+		fail("Nonce tag:            MISSING\n")
+	case nonceTags > 1:
+		fail("Nonce tag:            %d nonce tags, expected 1\n", nonceTags)
+	default:
+		tag := event.Tags[index]
+		if err := checkNonceTag(tag); err != nil {
+			fail("Nonce tag:            MALFORMED: %v\n", err)
+		} else if len(tag) < 3 {
+			fail("Nonce tag:            %s has no target, so it commits to no difficulty\n", tagJSON(tag))
+		} else if tag[1] == "" {
+			fail("Nonce tag:            %s has an empty value\n", tagJSON(tag))
+		} else {
+			fmt.Fprintf(w, "Nonce tag:            %s (well-formed)\n", tagJSON(tag))
+		}
+	}
+
+	if nonceTags == 1 && len(event.Tags[index]) >= 3 {
+		target, err := strconv.Atoi(event.Tags[index][2])
+		switch {
+		case err != nil:
+			fail("Committed difficulty: %q is not a number\n", event.Tags[index][2])
+		case achieved >= target:
+			fmt.Fprintf(w, "Committed difficulty: %d (met)\n", target)
+		default:
+			fail("Committed difficulty: %d NOT MET, the hash has %d bits\n", target, achieved)
+		}
+	}
+
+	switch {
+	case event.Sig == "":
+		fmt.Fprintf(w, "Signature:            none (the miner outputs unsigned events)\n")
+	default:
+		// The signature covers the recomputed ID, whatever the id field says
+		if valid, err := event.CheckSignature(); err != nil {
+			fail("Signature:            INVALID: %v\n", err)
+		} else if !valid {
+			fail("Signature:            INVALID for pubkey %s\n", event.PubKey)
+		} else {
+			fmt.Fprintf(w, "Signature:            valid\n")
+		}
+	}
+
+	if session == nil {
+		fmt.Fprintf(w, "Device replay:        skipped: %s\n", skipReason)
+		return ok
+	}
+	bits, err := replayOnDevice(session, event)
+	cpuBits := eventScore(session.target, event)
+	device := fmt.Sprintf("kernel %s on %s", session.kernelType, strings.TrimSpace(session.device.Name()))
+	switch {
+	case err != nil:
+		fmt.Fprintf(w, "Device replay:        skipped (%s): %v\n", device, err)
+	case bits == cpuBits:
+		fmt.Fprintf(w, "Device replay:        %d bits with %s (agrees with the CPU)\n", bits, device)
+	default:
+		fail("Device replay:        %d bits with %s, DISAGREES with the CPU's %d\n", bits, device, cpuBits)
+	}
+	return ok
+}